@@ -45,6 +45,17 @@ func (c *Client) addAuthorizationHeader(verb, url string, headers map[string]str
 	return headers, nil
 }
 
+// addSASToken returns uri with the parameters of a SAS token added to its
+// query.
+func addSASToken(uri string, token url.Values) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = mergeParams(u.Query(), token).Encode()
+	return u.String(), nil
+}
+
 func (c *Client) getSharedKey(verb, url string, headers map[string]string, auth authentication) (string, error) {
 	canRes, err := c.buildCanonicalizedResource(url, auth)
 	if err != nil {
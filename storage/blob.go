@@ -2,11 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -22,11 +22,24 @@ type BlobStorageClient struct {
 	auth   authentication
 }
 
+// WithContext returns a copy of b whose requests are bound to ctx. Calls
+// made through the copy are abandoned as soon as ctx is cancelled or its
+// deadline expires. The provided ctx must be non-nil.
+func (b BlobStorageClient) WithContext(ctx context.Context) BlobStorageClient {
+	if ctx == nil {
+		panic("nil context")
+	}
+	b.client.ctx = ctx
+	return b
+}
+
 // A Container is an entry in ContainerListResponse.
 type Container struct {
 	Name       string              `xml:"Name"`
 	Properties ContainerProperties `xml:"Properties"`
-	// TODO (ahmetalpbalkan) Metadata
+
+	// Metadata is only set when the listing includes metadata.
+	Metadata BlobMetadata `xml:"Metadata"`
 }
 
 // ContainerProperties contains various properties of a container returned from
@@ -132,6 +145,10 @@ type BlobProperties struct {
 	CopyStatusDescription string   `xml:"CopyStatusDescription"`
 	LeaseStatus           string   `xml:"LeaseStatus"`
 	LeaseState            string   `xml:"LeaseState"`
+
+	// RequestID identifies the Get Blob Properties request that returned
+	// these properties. It is not set for listed blobs.
+	RequestID string `xml:"-"`
 }
 
 // BlobHeaders contains various properties of a blob and is an entry
@@ -714,8 +731,10 @@ func (b BlobStorageClient) getBlobRange(container, name, bytesRange string, extr
 	if err != nil {
 		return nil, err
 	}
-	name = parts.Name
-	params := parts.Query
+	return b.getBlobRangeQuery(container, parts.Name, parts.Query, bytesRange, extraHeaders)
+}
+
+func (b BlobStorageClient) getBlobRangeQuery(container, name string, params url.Values, bytesRange string, extraHeaders map[string]string) (*storageResponse, error) {
 	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), params)
 
 	extraHeaders = b.client.protectUserAgent(extraHeaders)
@@ -911,8 +930,10 @@ func (b BlobStorageClient) GetBlobProperties(container, name string) (*BlobPrope
 	if err != nil {
 		return nil, err
 	}
-	name = parts.Name
-	params := parts.Query
+	return b.getBlobPropertiesQuery(container, parts.Name, parts.Query)
+}
+
+func (b BlobStorageClient) getBlobPropertiesQuery(container, name string, params url.Values) (*BlobProperties, error) {
 	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), params)
 
 	headers := b.client.getStandardHeaders()
@@ -963,6 +984,7 @@ func (b BlobStorageClient) GetBlobProperties(container, name string) (*BlobPrope
 		BlobType:              BlobType(resp.headers.Get("x-ms-blob-type")),
 		LeaseStatus:           resp.headers.Get("x-ms-lease-status"),
 		LeaseState:            resp.headers.Get("x-ms-lease-state"),
+		RequestID:             resp.headers.Get("x-ms-request-id"),
 	}, nil
 }
 
@@ -1039,16 +1061,15 @@ func (b BlobStorageClient) SetBlobMetadata(container, name string, metadata map[
 //
 // See https://msdn.microsoft.com/en-us/library/azure/dd179414.aspx
 func (b BlobStorageClient) GetBlobMetadata(container, name string) (map[string]string, error) {
-	//params := url.Values{"comp": {"metadata"}, "snapshot": {"2015-12-22T20:33:43.9355961Z"}}
-	params := url.Values{"comp": {"metadata"}}
-
 	parts, err := ParseURLNameQuery(name)
 	if err != nil {
 		return nil, err
 	}
-	name = parts.Name
-	params = mergeParams(params, parts.Query)
+	return b.getBlobMetadataQuery(container, parts.Name, parts.Query)
+}
 
+func (b BlobStorageClient) getBlobMetadataQuery(container, name string, params url.Values) (map[string]string, error) {
+	params = mergeParams(url.Values{"comp": {"metadata"}}, params)
 	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), params)
 	headers := b.client.getStandardHeaders()
 
@@ -1163,12 +1184,21 @@ func (b BlobStorageClient) PutBlockWithLength(container, name, blockID string, s
 //
 // See https://msdn.microsoft.com/en-us/library/azure/dd179467.aspx
 func (b BlobStorageClient) PutBlockList(container, name string, blocks []Block) error {
+	return b.putBlockList(container, name, blocks, nil)
+}
+
+func (b BlobStorageClient) putBlockList(container, name string, blocks []Block, extraHeaders map[string]string) error {
 	blockListXML := prepareBlockListRequest(blocks)
 
 	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), url.Values{"comp": {"blocklist"}})
+	extraHeaders = b.client.protectUserAgent(extraHeaders)
 	headers := b.client.getStandardHeaders()
 	headers["Content-Length"] = fmt.Sprintf("%v", len(blockListXML))
 
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
+
 	resp, err := b.client.exec(http.MethodPut, uri, headers, strings.NewReader(blockListXML), b.auth)
 	if err != nil {
 		return err
@@ -1258,22 +1288,37 @@ func (b BlobStorageClient) PutPage(container, name string, startByte, endByte in
 	return checkRespCode(resp.statusCode, []int{http.StatusCreated})
 }
 
+// LogTrace logs msgs together with the location of its caller, as a debug
+// entry of a Logger writing to the standard logger of the log package.
+//
+// Deprecated: set the Logger of the Client, or add LoggingMiddleware or
+// another Middleware to it, to trace storage requests.
 func LogTrace(msgs ...string) {
-	msg := strings.Join(msgs, " ")
-	pc := make([]uintptr, 10) // at least 1 entry needed
-	runtime.Callers(2, pc)
-	f := runtime.FuncForPC(pc[0])
-	file, line := f.FileLine(pc[0])
-	log.Printf("TRACER: %s - %s:%d %s\n", msg, file, line, f.Name())
+	caller := "unknown"
+	if pc, file, line, ok := runtime.Caller(1); ok {
+		caller = fmt.Sprintf("%s:%d", file, line)
+		if f := runtime.FuncForPC(pc); f != nil {
+			caller += " " + f.Name()
+		}
+	}
+	traceLogger.Log(LogDebug, strings.Join(msgs, " "), map[string]interface{}{"caller": caller})
 }
 
 // GetPageRanges returns the list of valid page ranges for a page blob.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/ee691973.aspx
 func (b BlobStorageClient) GetPageRanges(container, name string) (GetPageRangesResponse, error) {
+	return b.getPageRanges(container, name, nil)
+}
+
+func (b BlobStorageClient) getPageRanges(container, name string, extraHeaders map[string]string) (GetPageRangesResponse, error) {
 	path := fmt.Sprintf("%s/%s", container, name)
 	uri := b.client.getEndpoint(blobServiceName, path, url.Values{"comp": {"pagelist"}})
+	extraHeaders = b.client.protectUserAgent(extraHeaders)
 	headers := b.client.getStandardHeaders()
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
 
 	var out GetPageRangesResponse
 	resp, err := b.client.exec(http.MethodGet, uri, headers, nil, b.auth)
@@ -1313,7 +1358,9 @@ func (b BlobStorageClient) PutAppendBlob(container, name string, extraHeaders ma
 	return checkRespCode(resp.statusCode, []int{http.StatusCreated})
 }
 
-// AppendBlock appends a block to an append blob.
+// AppendBlock appends a block to an append blob. Unless extraHeaders set
+// the x-ms-blob-condition-appendpos condition, the block is only sent again
+// by the RetryPolicy of the client when it could not be sent at all.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/mt427365.aspx
 func (b BlobStorageClient) AppendBlock(container, name string, chunk []byte, extraHeaders map[string]string) error {
@@ -1328,7 +1375,15 @@ func (b BlobStorageClient) AppendBlock(container, name string, chunk []byte, ext
 		headers[k] = v
 	}
 
-	resp, err := b.client.exec(http.MethodPut, uri, headers, bytes.NewReader(chunk), b.auth)
+	// Without an append position condition, a retried block that was
+	// appended already would be appended twice.
+	exec := b.client.execNonIdempotent
+	for k := range headers {
+		if strings.EqualFold(k, "x-ms-blob-condition-appendpos") {
+			exec = b.client.exec
+		}
+	}
+	resp, err := exec(http.MethodPut, uri, headers, bytes.NewReader(chunk), b.auth)
 	if err != nil {
 		return err
 	}
@@ -1452,55 +1507,12 @@ func (b BlobStorageClient) AbortBlobCopy(container, name, copyID, currentLeaseID
 	return nil
 }
 
-// WaitForBlobCopy loops until a BlobCopy operation is completed (or fails with error)
+// WaitForBlobCopy loops until a BlobCopy operation is completed (or fails
+// with error). It polls the blob with the default BlobCopyWaitOptions; use
+// TrackBlobCopy to follow its progress.
 func (b BlobStorageClient) WaitForBlobCopy(container, name, copyID string) error {
-	copyStartTime := time.Now()
-
-	for {
-		props, err := b.GetBlobProperties(container, name)
-		if err != nil {
-			return err
-		}
-
-		if props.CopyID != copyID {
-			return errBlobCopyIDMismatch
-		}
-
-		if time.Now().Sub(copyStartTime) > 15*time.Second {
-			log.Printf("CopyStartTime         = %v", copyStartTime)
-			log.Printf("CopySource            = %s", props.CopySource)
-			log.Printf("CopyID                = %s", props.CopyID)
-			log.Printf("CopyStatus            = %s", props.CopyStatus)
-			log.Printf("CopyStatusDescription = %s", props.CopyStatusDescription)
-			log.Printf("CopyProgress          = %s", props.CopyProgress)
-			log.Printf("CopyCompletionTime    = %s", props.CopyCompletionTime)
-
-			r, err := CalcBlobDataCopyRate(props.CopyProgress, copyStartTime)
-			if err != nil {
-				log.Printf("StartTime   = %v\n", r.StartTime)
-				log.Printf("NowTime     = %v\n", r.NowTime)
-				log.Printf("BytesSofar  = %.0f MB\n", r.BytesSoFar/(1024*1024))
-				log.Printf("BytesTotal  = %.0f MB\n", r.BytesTotal/(1024*1024))
-				log.Printf("CopyPercent = %.0f%%\n", r.Percent)
-				log.Printf("CopyRate    = %.0f MB/s\n", r.RateBps/(1000*1000))
-				log.Printf("ttcMins     = %.2f\n", r.TtcSecs/60)
-			}
-		}
-
-		switch props.CopyStatus {
-		case blobCopyStatusSuccess:
-			return nil
-		case blobCopyStatusPending:
-			time.Sleep(60 * time.Second)
-			continue
-		case blobCopyStatusAborted:
-			return errBlobCopyAborted
-		case blobCopyStatusFailed:
-			return fmt.Errorf("storage: blob copy failed. Id=%s Description=%s", props.CopyID, props.CopyStatusDescription)
-		default:
-			return fmt.Errorf("storage: unhandled blob copy status: '%s'", props.CopyStatus)
-		}
-	}
+	_, err := b.TrackBlobCopy(container, name, copyID, BlobCopyWaitOptions{})
+	return err
 }
 
 // DeleteBlob deletes the given blob from the specified container.
@@ -1535,9 +1547,10 @@ func (b BlobStorageClient) deleteBlob(container, name string, extraHeaders map[s
 	if err != nil {
 		return nil, err
 	}
-	name = parts.Name
-	params := parts.Query
+	return b.deleteBlobQuery(container, parts.Name, parts.Query, extraHeaders)
+}
 
+func (b BlobStorageClient) deleteBlobQuery(container, name string, params url.Values, extraHeaders map[string]string) (*storageResponse, error) {
 	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), params)
 	extraHeaders = b.client.protectUserAgent(extraHeaders)
 	headers := b.client.getStandardHeaders()
@@ -1562,10 +1575,15 @@ func pathForBlob(container, name string) string {
 // GetBlobSASURIWithSignedIPAndProtocol creates an URL to the specified blob which contains the Shared
 // Access Signature with specified permissions and expiration time. Also includes signedIPRange and allowed protocols.
 // If old API version is used but no signedIP is passed (ie empty string) then this should still work.
-// We only populate the signedIP when it non-empty.
+// We only populate the signedIP when it non-empty. A snapshot can be
+// addressed by appending its query to name; GetBlobRefSASURI addresses it
+// with a BlobRef instead.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/ee395415.aspx
 func (b BlobStorageClient) GetBlobSASURIWithSignedIPAndProtocol(container, name string, expiry time.Time, permissions string, signedIPRange string, HTTPSOnly bool) (string, error) {
+	if err := b.client.checkSigningKey(); err != nil {
+		return "", err
+	}
 
 	// Remove any query parameters (like ?snapshot=) from name
 	parts, err := ParseURLNameQuery(name)
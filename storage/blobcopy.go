@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBlobCopyMinPollInterval and DefaultBlobCopyMaxPollInterval
+	// bound the delay between two polls of a pending copy when
+	// BlobCopyWaitOptions does not set them.
+	DefaultBlobCopyMinPollInterval = time.Second
+	DefaultBlobCopyMaxPollInterval = 60 * time.Second
+
+	// DefaultBlobCopyConcurrency is the number of copies polled at once by
+	// TrackBlobCopies when BlobCopyWaitOptions.Concurrency is not set.
+	DefaultBlobCopyConcurrency = 16
+
+	// blobCopyLogDelay is how long a copy is waited for before its
+	// progress is logged.
+	blobCopyLogDelay = 15 * time.Second
+)
+
+// BlobCopy identifies a copy started by StartBlobCopy.
+type BlobCopy struct {
+	Container string
+	Name      string
+	CopyID    string
+}
+
+// BlobCopyProgress is the state of a blob copy at a poll.
+type BlobCopyProgress struct {
+	BlobCopy
+
+	// Status is one of the BlobCopyStatus constants.
+	Status            string
+	StatusDescription string
+
+	// BytesCopied and BytesTotal are parsed from the copy progress of the
+	// blob. They are zero until the service reports them.
+	BytesCopied int64
+	BytesTotal  int64
+
+	// Rate is the number of bytes copied per second since the first poll
+	// and Remaining the time left at that rate. Both are zero until two
+	// polls report a progress.
+	Rate      float64
+	Remaining time.Duration
+
+	// Elapsed is the time spent waiting for the copy so far.
+	Elapsed time.Duration
+
+	// CompletionTime is the time the copy ended at, once it is not
+	// pending anymore.
+	CompletionTime time.Time
+}
+
+// BlobCopyWaitOptions is the set of options that can be specified for
+// waiting for blob copies. The delay between two polls of a pending copy
+// starts at MinPollInterval and doubles on every poll, up to
+// MaxPollInterval. A zero struct uses DefaultBlobCopyMinPollInterval and
+// DefaultBlobCopyMaxPollInterval. Waiting stops when the context of the
+// client is done, so use WithContext to set a timeout.
+type BlobCopyWaitOptions struct {
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+
+	// Progress, if set, is called with the state of the copy after every
+	// poll, including the last one. It is never called concurrently.
+	Progress func(BlobCopyProgress)
+
+	// Concurrency is the largest number of copies TrackBlobCopies polls at
+	// once. It does not limit the number of copies waited for.
+	Concurrency int
+}
+
+func (o BlobCopyWaitOptions) withDefaults() BlobCopyWaitOptions {
+	if o.MinPollInterval <= 0 {
+		o.MinPollInterval = DefaultBlobCopyMinPollInterval
+	}
+	if o.MaxPollInterval <= 0 {
+		o.MaxPollInterval = DefaultBlobCopyMaxPollInterval
+	}
+	if o.MaxPollInterval < o.MinPollInterval {
+		o.MaxPollInterval = o.MinPollInterval
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultBlobCopyConcurrency
+	}
+	return o
+}
+
+// BlobCopyResult is the outcome of a copy tracked by TrackBlobCopies.
+// Progress is the last state polled, Err is nil if the copy succeeded.
+type BlobCopyResult struct {
+	Progress BlobCopyProgress
+	Err      error
+}
+
+// TrackBlobCopy waits for a copy started by StartBlobCopy to complete,
+// reporting its progress, and returns its final state. The error is nil
+// only if the copy succeeded.
+func (b BlobStorageClient) TrackBlobCopy(container, name, copyID string, options BlobCopyWaitOptions) (BlobCopyProgress, error) {
+	return b.trackBlobCopy(BlobCopy{Container: container, Name: name, CopyID: copyID}, options.withDefaults(), nil)
+}
+
+// TrackBlobCopies waits for many copies at once, polling at most
+// options.Concurrency of them at a time. The results are in the order of
+// copies.
+func (b BlobStorageClient) TrackBlobCopies(copies []BlobCopy, options BlobCopyWaitOptions) []BlobCopyResult {
+	options = options.withDefaults()
+	if progress := options.Progress; progress != nil {
+		var mu sync.Mutex
+		options.Progress = func(p BlobCopyProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress(p)
+		}
+	}
+
+	results := make([]BlobCopyResult, len(copies))
+	slots := make(chan struct{}, options.Concurrency)
+	var wg sync.WaitGroup
+	for i, cp := range copies {
+		wg.Add(1)
+		go func(i int, cp BlobCopy) {
+			defer wg.Done()
+			p, err := b.trackBlobCopy(cp, options, slots)
+			results[i] = BlobCopyResult{Progress: p, Err: err}
+		}(i, cp)
+	}
+	wg.Wait()
+	return results
+}
+
+// trackBlobCopy polls cp until it is not pending anymore. Each poll holds
+// one of slots, if any.
+func (b BlobStorageClient) trackBlobCopy(cp BlobCopy, options BlobCopyWaitOptions, slots chan struct{}) (BlobCopyProgress, error) {
+	ctx := b.client.requestContext()
+	p := BlobCopyProgress{BlobCopy: cp}
+	start := time.Now()
+	var first time.Time
+	var firstBytes int64
+	delay := options.MinPollInterval
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return p, ctx.Err()
+			}
+		}
+		props, err := b.GetBlobProperties(cp.Container, cp.Name)
+		if slots != nil {
+			<-slots
+		}
+		if err != nil {
+			return p, err
+		}
+		if props.CopyID != cp.CopyID {
+			return p, errBlobCopyIDMismatch
+		}
+
+		now := time.Now()
+		p.Status = props.CopyStatus
+		p.StatusDescription = props.CopyStatusDescription
+		p.Elapsed = now.Sub(start)
+		if copied, total, err := parseCopyProgress(props.CopyProgress); err == nil {
+			p.BytesCopied, p.BytesTotal = copied, total
+			if first.IsZero() {
+				first, firstBytes = now, copied
+			} else if d := now.Sub(first).Seconds(); d > 0 {
+				p.Rate = float64(copied-firstBytes) / d
+				p.Remaining = 0
+				if p.Rate > 0 {
+					p.Remaining = time.Duration(float64(total-copied) / p.Rate * float64(time.Second))
+				}
+			}
+		}
+		if props.CopyStatus != blobCopyStatusPending {
+			p.Remaining = 0
+			if t, err := time.Parse(http.TimeFormat, props.CopyCompletionTime); err == nil {
+				p.CompletionTime = t
+			}
+		}
+		if options.Progress != nil {
+			options.Progress(p)
+		}
+		if p.Elapsed > blobCopyLogDelay {
+			b.logBlobCopy(p, props)
+		}
+
+		switch props.CopyStatus {
+		case blobCopyStatusSuccess:
+			return p, nil
+		case blobCopyStatusPending:
+		case blobCopyStatusAborted:
+			return p, errBlobCopyAborted
+		case blobCopyStatusFailed:
+			return p, fmt.Errorf("storage: blob copy failed. Id=%s Description=%s", props.CopyID, props.CopyStatusDescription)
+		default:
+			return p, fmt.Errorf("storage: unhandled blob copy status: '%s'", props.CopyStatus)
+		}
+
+		if !sleepContext(ctx, delay) {
+			return p, ctx.Err()
+		}
+		if delay *= 2; delay > options.MaxPollInterval {
+			delay = options.MaxPollInterval
+		}
+	}
+}
+
+func (b BlobStorageClient) logBlobCopy(p BlobCopyProgress, props *BlobProperties) {
+	b.client.log(LogInfo, "blob copy in progress", map[string]interface{}{
+		"requestId":             props.RequestID,
+		"copySource":            props.CopySource,
+		"copyId":                p.CopyID,
+		"copyStatus":            p.Status,
+		"copyStatusDescription": p.StatusDescription,
+		"copyProgress":          props.CopyProgress,
+		"copyCompletionTime":    props.CopyCompletionTime,
+		"copyRateBps":           p.Rate,
+		"remainingSeconds":      p.Remaining.Seconds(),
+		"elapsedSeconds":        p.Elapsed.Seconds(),
+	})
+}
+
+// parseCopyProgress parses the x-ms-copy-progress of a blob, which is the
+// number of bytes copied and the total number of bytes separated by a
+// slash.
+func parseCopyProgress(progress string) (int64, int64, error) {
+	parts := strings.Split(progress, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("storage: invalid blob copy progress %q", progress)
+	}
+	copied, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("storage: invalid blob copy progress %q", progress)
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("storage: invalid blob copy progress %q", progress)
+	}
+	return copied, total, nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type BlobCopySuite struct{}
+
+var _ = chk.Suite(&BlobCopySuite{})
+
+// copyServer reports the copies of its blobs, which go through their
+// progress steps one poll at a time.
+type copyServer struct {
+	mu    sync.Mutex
+	steps map[string][]string
+	polls map[string]int
+}
+
+func (f *copyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/cnt/")
+	steps, ok := f.steps[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	i := f.polls[name]
+	if i >= len(steps) {
+		i = len(steps) - 1
+	}
+	f.polls[name]++
+
+	h := w.Header()
+	h.Set("x-ms-copy-id", "id-"+name)
+	h.Set("x-ms-copy-progress", steps[i])
+	if i < len(steps)-1 {
+		h.Set("x-ms-copy-status", blobCopyStatusPending)
+	} else {
+		h.Set("x-ms-copy-status", blobCopyStatusSuccess)
+		h.Set("x-ms-copy-completion-time", "Wed, 12 Apr 2017 08:09:10 GMT")
+	}
+}
+
+func newCopyServer(steps map[string][]string) *copyServer {
+	return &copyServer{steps: steps, polls: map[string]int{}}
+}
+
+func (s *BlobCopySuite) TestTrack(c *chk.C) {
+	f := newCopyServer(map[string][]string{"a": {"0/400", "100/400", "300/400", "400/400"}})
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	var updates []BlobCopyProgress
+	p, err := cli.GetBlobService().TrackBlobCopy("cnt", "a", "id-a", BlobCopyWaitOptions{
+		MinPollInterval: time.Millisecond,
+		MaxPollInterval: 2 * time.Millisecond,
+		Progress:        func(p BlobCopyProgress) { updates = append(updates, p) },
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(updates, chk.HasLen, 4)
+	c.Assert(updates[3], chk.DeepEquals, p)
+
+	c.Assert(updates[0].Status, chk.Equals, BlobCopyStatusPending)
+	c.Assert(updates[0].Rate, chk.Equals, float64(0))
+	c.Assert(updates[1].BytesCopied, chk.Equals, int64(100))
+	c.Assert(updates[1].BytesTotal, chk.Equals, int64(400))
+	c.Assert(updates[1].Rate > 0, chk.Equals, true)
+	c.Assert(updates[1].Remaining > 0, chk.Equals, true)
+	c.Assert(updates[1].CompletionTime.IsZero(), chk.Equals, true)
+
+	c.Assert(p.BlobCopy, chk.Equals, BlobCopy{Container: "cnt", Name: "a", CopyID: "id-a"})
+	c.Assert(p.Status, chk.Equals, BlobCopyStatusSuccess)
+	c.Assert(p.BytesCopied, chk.Equals, int64(400))
+	c.Assert(p.Remaining, chk.Equals, time.Duration(0))
+	c.Assert(p.CompletionTime.Equal(time.Date(2017, 4, 12, 8, 9, 10, 0, time.UTC)), chk.Equals, true)
+}
+
+func (s *BlobCopySuite) TestTrackCancel(c *chk.C) {
+	f := newCopyServer(map[string][]string{"a": {"0/1", "0/1", "1/1"}})
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	blobs := cli.GetBlobService().WithContext(ctx)
+	_, err := blobs.TrackBlobCopy("cnt", "a", "id-a", BlobCopyWaitOptions{
+		MinPollInterval: time.Hour,
+		Progress:        func(BlobCopyProgress) { cancel() },
+	})
+	c.Assert(err, chk.Equals, context.Canceled)
+}
+
+func (s *BlobCopySuite) TestTrackMany(c *chk.C) {
+	f := newCopyServer(map[string][]string{
+		"a": {"0/10", "10/10"},
+		"b": {"5/10", "10/10"},
+		"c": {"10/10"},
+	})
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	polls := 0
+	results := cli.GetBlobService().TrackBlobCopies([]BlobCopy{
+		{Container: "cnt", Name: "a", CopyID: "id-a"},
+		{Container: "cnt", Name: "b", CopyID: "other"},
+		{Container: "cnt", Name: "c", CopyID: "id-c"},
+		{Container: "cnt", Name: "missing", CopyID: "id"},
+	}, BlobCopyWaitOptions{
+		MinPollInterval: time.Millisecond,
+		Concurrency:     2,
+		Progress: func(BlobCopyProgress) {
+			mu.Lock()
+			polls++
+			mu.Unlock()
+		},
+	})
+	c.Assert(results, chk.HasLen, 4)
+	c.Assert(results[0].Err, chk.IsNil)
+	c.Assert(results[0].Progress.Status, chk.Equals, BlobCopyStatusSuccess)
+	c.Assert(results[1].Err, chk.Equals, errBlobCopyIDMismatch)
+	c.Assert(results[2].Err, chk.IsNil)
+	c.Assert(results[2].Progress.Name, chk.Equals, "c")
+	c.Assert(results[3].Err, chk.NotNil)
+	c.Assert(polls, chk.Equals, 3)
+}
+
+func (s *BlobCopySuite) TestParseCopyProgress(c *chk.C) {
+	copied, total, err := parseCopyProgress("1099511627776/2199023255552")
+	c.Assert(err, chk.IsNil)
+	c.Assert(copied, chk.Equals, int64(1)<<40)
+	c.Assert(total, chk.Equals, int64(1)<<41)
+	for _, bad := range []string{"", "1", "a/2", "1/b", "1/2/3"} {
+		_, _, err := parseCopyProgress(bad)
+		c.Assert(err, chk.ErrorMatches, "storage: invalid blob copy progress .*")
+	}
+}
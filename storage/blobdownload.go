@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDownloadRangeSize is the size of the ranges fetched by
+	// DownloadToWriterAt and DownloadToFile when DownloadOptions.RangeSize
+	// is not set.
+	DefaultDownloadRangeSize = 4 * 1024 * 1024
+
+	// DefaultDownloadParallelism is the number of ranges fetched
+	// concurrently when DownloadOptions.Parallelism is not set.
+	DefaultDownloadParallelism = 4
+
+	// DefaultDownloadMaxRetries is the number of times a single range is
+	// retried when DownloadOptions.MaxRetries is not set.
+	DefaultDownloadMaxRetries = 3
+
+	defaultDownloadRetryDelay = time.Second
+
+	// downloadCheckpointSuffix is appended to the local file name to build
+	// the default checkpoint path of DownloadToFile.
+	downloadCheckpointSuffix = ".download"
+)
+
+// DownloadOptions is the set of options that can be specified for
+// DownloadToWriterAt and DownloadToFile. A zero struct fetches
+// DefaultDownloadRangeSize ranges using DefaultDownloadParallelism workers.
+type DownloadOptions struct {
+	// RangeSize is the size of each range requested from the service.
+	RangeSize int64
+
+	// Parallelism is the number of ranges fetched concurrently.
+	Parallelism int
+
+	// MaxRetries is the number of times an individual range is retried
+	// before the whole download is abandoned. Use a negative value to
+	// disable retries.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry of a range. It is
+	// doubled on every subsequent retry of the same range.
+	RetryDelay time.Duration
+
+	// CheckpointPath is the file DownloadToFile uses to record completed
+	// ranges so an interrupted download can be resumed. It defaults to the
+	// local file name followed by ".download". It is ignored by
+	// DownloadToWriterAt.
+	CheckpointPath string
+}
+
+// byteRange is an inclusive range of bytes of a blob.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+// downloadCheckpoint is persisted by DownloadToFile after every completed
+// range. It is only honoured if the blob still has the same ETag, size and
+// range layout, and a completed range is only skipped if the local file
+// still holds the data whose MD5 hash was recorded for it in Checksums.
+type downloadCheckpoint struct {
+	Etag      string   `json:"etag"`
+	Size      int64    `json:"size"`
+	RangeSize int64    `json:"rangeSize"`
+	Completed []int    `json:"completed"`
+	Checksums []string `json:"checksums"`
+}
+
+func (o DownloadOptions) withDefaults() (DownloadOptions, error) {
+	if o.RangeSize == 0 {
+		o.RangeSize = DefaultDownloadRangeSize
+	}
+	if o.RangeSize < 0 {
+		return o, fmt.Errorf("storage: invalid download range size %d", o.RangeSize)
+	}
+	if o.Parallelism <= 0 {
+		o.Parallelism = DefaultDownloadParallelism
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultDownloadMaxRetries
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultDownloadRetryDelay
+	}
+	return o, nil
+}
+
+// splitRange splits the blob region r into consecutive ranges of at most
+// size bytes.
+func splitRange(r byteRange, size int64) []byteRange {
+	var out []byteRange
+	for start := r.start; start <= r.end; start += size {
+		end := start + size - 1
+		if end > r.end {
+			end = r.end
+		}
+		out = append(out, byteRange{start: start, end: end})
+	}
+	return out
+}
+
+// planDownload returns the ranges that need to be fetched to reproduce the
+// blob described by props. For page blobs only the valid page ranges are
+// returned; the remainder of the blob reads as zeros and is skipped.
+func (b BlobStorageClient) planDownload(container, name string, props *BlobProperties, options DownloadOptions) ([]byteRange, error) {
+	if props.ContentLength == 0 {
+		return nil, nil
+	}
+	if props.BlobType != BlobTypePage {
+		return splitRange(byteRange{start: 0, end: props.ContentLength - 1}, options.RangeSize), nil
+	}
+
+	pages, err := b.getPageRanges(container, name, map[string]string{
+		headerIfMatch: props.Etag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ranges []byteRange
+	for _, p := range pages.PageList {
+		ranges = append(ranges, splitRange(byteRange{start: p.Start, end: p.End}, options.RangeSize)...)
+	}
+	return ranges, nil
+}
+
+// DownloadToWriterAt downloads the specified blob into w, fetching ranges of
+// options.RangeSize bytes concurrently. Every range request is pinned to the
+// ETag returned by Get Blob Properties with an If-Match condition, so a blob
+// modified during the download fails the download instead of producing a
+// mixture of old and new content. Failed ranges are retried individually.
+//
+// Page blobs are transferred sparsely: only the ranges reported by Get Page
+// Ranges are fetched and the holes between them are never written to w, so
+// w must read as zeros where nothing is written, as a newly created file
+// does.
+//
+// The properties the download was pinned to are returned on success.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd179440.aspx
+func (b BlobStorageClient) DownloadToWriterAt(container, name string, w io.WriterAt, options DownloadOptions) (*BlobProperties, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := b.GetBlobProperties(container, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges, err := b.planDownload(container, name, props, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.downloadRanges(BlobRef{Container: container, Name: name}, props.Etag, ranges, nil, w, options, nil); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// DownloadToFile downloads the specified blob into the local file at path,
+// creating it if needed. See DownloadToWriterAt for details.
+//
+// Completed ranges are recorded in a checkpoint file next to the download.
+// If the download is interrupted, calling DownloadToFile again with the same
+// options only fetches the missing ranges, provided the blob has not changed
+// in the meantime. Completed ranges are fetched again if the local file no
+// longer holds their data, and the checkpoint is discarded if the file is
+// missing or does not have the size of the blob. The checkpoint is removed
+// once the download completes.
+func (b BlobStorageClient) DownloadToFile(container, name, path string, options DownloadOptions) (*BlobProperties, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if options.CheckpointPath == "" {
+		options.CheckpointPath = path + downloadCheckpointSuffix
+	}
+
+	props, err := b.GetBlobProperties(container, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges, err := b.planDownload(container, name, props, options)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := downloadCheckpoint{
+		Etag:      props.Etag,
+		Size:      props.ContentLength,
+		RangeSize: options.RangeSize,
+	}
+	previous, err := readDownloadCheckpoint(options.CheckpointPath)
+	resume := err == nil && previous.resumes(checkpoint)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() || info.Size() != props.ContentLength {
+		// The file the checkpoint describes is gone or was replaced.
+		resume = false
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if resume {
+		checkpoint.Completed, checkpoint.Checksums, err = previous.verify(f, ranges)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Truncate(props.ContentLength); err != nil {
+		return nil, err
+	}
+	if err := writeDownloadCheckpoint(options.CheckpointPath, checkpoint); err != nil {
+		return nil, err
+	}
+
+	skip := make(map[int]bool, len(checkpoint.Completed))
+	for _, i := range checkpoint.Completed {
+		skip[i] = true
+	}
+
+	var mu sync.Mutex
+	completed := func(i int, checksum string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		checkpoint.Completed = append(checkpoint.Completed, i)
+		checkpoint.Checksums = append(checkpoint.Checksums, checksum)
+		return writeDownloadCheckpoint(options.CheckpointPath, checkpoint)
+	}
+
+	if err := b.downloadRanges(BlobRef{Container: container, Name: name}, props.Etag, ranges, skip, f, options, completed); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(options.CheckpointPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return props, nil
+}
+
+// downloadRanges fetches ranges of the blob or snapshot addressed by ref
+// concurrently into w, skipping the indexes
+// present in skip. done, if not nil, is called after each range is written
+// with the base64 encoded MD5 hash of its data.
+func (b BlobStorageClient) downloadRanges(ref BlobRef, etag string, ranges []byteRange, skip map[int]bool, w io.WriterAt, options DownloadOptions, done func(int, string) error) error {
+	ctx, cancel := context.WithCancel(b.client.requestContext())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan int)
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				var checksum string
+				err := retryWithBackoff(ctx, options.MaxRetries, options.RetryDelay, isBlobChangedError, func() error {
+					var err error
+					checksum, err = b.downloadRange(ref, etag, ranges[i], w)
+					return err
+				})
+				if err == nil && done != nil {
+					err = done(i, checksum)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	for i := range ranges {
+		if skip[i] {
+			continue
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if isBlobChangedError(firstErr) {
+		return fmt.Errorf("storage: blob %s/%s changed during download: %v", ref.Container, ref.Name, firstErr)
+	}
+	return firstErr
+}
+
+// downloadRange fetches a single range of the blob or snapshot addressed by
+// ref and writes it at the same offset of w. It returns the base64 encoded
+// MD5 hash of the range.
+func (b BlobStorageClient) downloadRange(ref BlobRef, etag string, r byteRange, w io.WriterAt) (string, error) {
+	body, err := b.GetBlobRangeByRef(ref, r.String(), map[string]string{
+		headerIfMatch: etag,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) != r.length() {
+		return "", fmt.Errorf("storage: range %s returned %d bytes", r, len(data))
+	}
+	if _, err = w.WriteAt(data, r.start); err != nil {
+		return "", err
+	}
+	return rangeChecksum(data), nil
+}
+
+func rangeChecksum(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// isBlobChangedError reports whether err is the service rejecting an
+// If-Match condition, which retrying cannot fix.
+func isBlobChangedError(err error) bool {
+	serr, ok := err.(AzureStorageServiceError)
+	return ok && serr.StatusCode == http.StatusPreconditionFailed
+}
+
+func (c downloadCheckpoint) resumes(other downloadCheckpoint) bool {
+	return c.Etag == other.Etag && c.Size == other.Size && c.RangeSize == other.RangeSize
+}
+
+// verify returns the completed ranges of c, along with their checksums,
+// whose data f still holds. The others are downloaded again.
+func (c downloadCheckpoint) verify(f *os.File, ranges []byteRange) ([]int, []string, error) {
+	var completed []int
+	var checksums []string
+	for n, i := range c.Completed {
+		if n >= len(c.Checksums) || i < 0 || i >= len(ranges) {
+			continue
+		}
+		data := make([]byte, ranges[i].length())
+		if _, err := f.ReadAt(data, ranges[i].start); err != nil {
+			return nil, nil, err
+		}
+		if rangeChecksum(data) == c.Checksums[n] {
+			completed = append(completed, i)
+			checksums = append(checksums, c.Checksums[n])
+		}
+	}
+	return completed, checksums, nil
+}
+
+func readDownloadCheckpoint(path string) (downloadCheckpoint, error) {
+	var c downloadCheckpoint
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// writeDownloadCheckpoint replaces the checkpoint at path. The new content
+// is written to a temporary file first so a crash never leaves a truncated
+// checkpoint behind.
+func writeDownloadCheckpoint(path string, c downloadCheckpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type BlobDownloadSuite struct{}
+
+var _ = chk.Suite(&BlobDownloadSuite{})
+
+// fakeBlobReadServer serves Get Blob Properties and ranged Get Blob
+// requests for a single blob.
+type fakeBlobReadServer struct {
+	mu       sync.Mutex
+	data     []byte
+	etag     string
+	failures map[string]int
+	requests map[string]int
+
+	// changeOnHead makes the blob change right after its properties are
+	// read, as if another writer raced with the download.
+	changeOnHead bool
+}
+
+func newFakeBlobReadServer(data []byte) *fakeBlobReadServer {
+	return &fakeBlobReadServer{
+		data:     data,
+		etag:     `"0x8D0001"`,
+		failures: make(map[string]int),
+		requests: make(map[string]int),
+	}
+}
+
+func (f *fakeBlobReadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Etag", f.etag)
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+		w.Header().Set("x-ms-blob-type", string(BlobTypeBlock))
+		w.WriteHeader(http.StatusOK)
+		if f.changeOnHead {
+			f.etag = `"0x8D0002"`
+		}
+	case http.MethodGet:
+		rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+		f.requests[rng]++
+		if r.Header.Get("If-Match") != f.etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if f.failures[rng] > 0 {
+			f.failures[rng]--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var start, end int
+		fmt.Sscanf(rng, "%d-%d", &start, &end)
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(f.data[start : end+1])
+	}
+}
+
+func (s *BlobDownloadSuite) Test_splitRange(c *chk.C) {
+	c.Assert(splitRange(byteRange{0, 9}, 4), chk.DeepEquals, []byteRange{{0, 3}, {4, 7}, {8, 9}})
+	c.Assert(splitRange(byteRange{512, 1023}, 512), chk.DeepEquals, []byteRange{{512, 1023}})
+}
+
+func (s *BlobDownloadSuite) TestDownloadToWriterAt(c *chk.C) {
+	data := randBytes(5000)
+	fake := newFakeBlobReadServer(data)
+	fake.failures["1024-2047"] = 2
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "download")
+	c.Assert(err, chk.IsNil)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	props, err := cli.GetBlobService().DownloadToWriterAt("container", "blob", f, DownloadOptions{
+		RangeSize:  1024,
+		RetryDelay: time.Millisecond,
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.Etag, chk.Equals, fake.etag)
+	c.Assert(fake.requests["1024-2047"], chk.Equals, 3)
+
+	got, err := ioutil.ReadFile(f.Name())
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, data)
+}
+
+func (s *BlobDownloadSuite) TestDownloadBlobChanged(c *chk.C) {
+	fake := newFakeBlobReadServer(randBytes(100))
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	// The blob changes once its properties are read, so every range fails
+	// its If-Match condition, which must not be retried.
+	fake.changeOnHead = true
+	dir, err := ioutil.TempDir("", "download")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+
+	_, err = cli.GetBlobService().DownloadToFile("container", "blob", filepath.Join(dir, "blob"), DownloadOptions{RetryDelay: time.Millisecond})
+	c.Assert(err, chk.ErrorMatches, "storage: blob container/blob changed during download: .*")
+	c.Assert(fake.requests["0-99"], chk.Equals, 1)
+}
+
+func (s *BlobDownloadSuite) TestDownloadToFileResumes(c *chk.C) {
+	data := randBytes(4096)
+	fake := newFakeBlobReadServer(data)
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blob")
+	options := DownloadOptions{RangeSize: 1024, RetryDelay: time.Millisecond}
+
+	// Simulate a previous run that stored the first two ranges.
+	partial := make([]byte, len(data))
+	copy(partial, data[:2048])
+	c.Assert(ioutil.WriteFile(path, partial, 0644), chk.IsNil)
+	c.Assert(writeDownloadCheckpoint(path+downloadCheckpointSuffix, downloadCheckpoint{
+		Etag:      fake.etag,
+		Size:      int64(len(data)),
+		RangeSize: 1024,
+		Completed: []int{0, 1},
+		Checksums: []string{rangeChecksum(data[:1024]), rangeChecksum(data[1024:2048])},
+	}), chk.IsNil)
+
+	_, err = cli.GetBlobService().DownloadToFile("container", "blob", path, options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requests, chk.DeepEquals, map[string]int{"2048-3071": 1, "3072-4095": 1})
+
+	got, err := ioutil.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, data)
+	_, err = os.Stat(path + downloadCheckpointSuffix)
+	c.Assert(os.IsNotExist(err), chk.Equals, true)
+}
+
+func (s *BlobDownloadSuite) TestDownloadToFileIgnoresStaleCheckpoint(c *chk.C) {
+	data := randBytes(2048)
+	fake := newFakeBlobReadServer(data)
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blob")
+
+	c.Assert(writeDownloadCheckpoint(path+downloadCheckpointSuffix, downloadCheckpoint{
+		Etag:      `"stale"`,
+		Size:      int64(len(data)),
+		RangeSize: 1024,
+		Completed: []int{0, 1},
+	}), chk.IsNil)
+
+	_, err = cli.GetBlobService().DownloadToFile("container", "blob", path, DownloadOptions{RangeSize: 1024})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requests, chk.HasLen, 2)
+
+	got, err := ioutil.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, data)
+}
+
+func (s *BlobDownloadSuite) TestDownloadToFileChecksLocalFile(c *chk.C) {
+	data := randBytes(2048)
+	fake := newFakeBlobReadServer(data)
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blob")
+	checkpoint := downloadCheckpoint{
+		Etag:      fake.etag,
+		Size:      int64(len(data)),
+		RangeSize: 1024,
+		Completed: []int{0, 1},
+		Checksums: []string{rangeChecksum(data[:1024]), rangeChecksum(data[1024:])},
+	}
+
+	// The local file is missing.
+	c.Assert(writeDownloadCheckpoint(path+downloadCheckpointSuffix, checkpoint), chk.IsNil)
+	_, err = cli.GetBlobService().DownloadToFile("container", "blob", path, DownloadOptions{RangeSize: 1024})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requests, chk.HasLen, 2)
+	got, err := ioutil.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, data)
+
+	// The local file was replaced by one of the same size.
+	replaced := make([]byte, len(data))
+	copy(replaced, data[:1024])
+	c.Assert(ioutil.WriteFile(path, replaced, 0644), chk.IsNil)
+	c.Assert(writeDownloadCheckpoint(path+downloadCheckpointSuffix, checkpoint), chk.IsNil)
+	fake.requests = map[string]int{}
+	_, err = cli.GetBlobService().DownloadToFile("container", "blob", path, DownloadOptions{RangeSize: 1024})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requests, chk.DeepEquals, map[string]int{"1024-2047": 1})
+	got, err = ioutil.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, data)
+}
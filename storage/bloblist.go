@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+// BlobListInclude selects the additional datasets returned when listing
+// blobs.
+type BlobListInclude struct {
+	// Snapshots lists the snapshots of the blobs, before the blobs.
+	Snapshots bool
+
+	// Metadata returns the metadata of the blobs.
+	Metadata bool
+
+	// UncommittedBlobs lists the block blobs that only have uncommitted
+	// blocks.
+	UncommittedBlobs bool
+
+	// Copy returns the copy properties of the blobs.
+	Copy bool
+}
+
+// String returns the include parameter of List Blobs for i, which can be
+// used as ListBlobsParameters.Include.
+func (i BlobListInclude) String() string {
+	var values []string
+	if i.Snapshots {
+		values = append(values, "snapshots")
+	}
+	if i.Metadata {
+		values = append(values, "metadata")
+	}
+	if i.UncommittedBlobs {
+		values = append(values, "uncommittedblobs")
+	}
+	if i.Copy {
+		values = append(values, "copy")
+	}
+	return strings.Join(values, ",")
+}
+
+// BlobIteratorOptions is the set of options that can be specified for a
+// BlobIterator.
+type BlobIteratorOptions struct {
+	Prefix string
+
+	// Delimiter, if set, groups the blobs whose names contain it after the
+	// prefix into virtual directories, which the iterator returns instead
+	// of their blobs.
+	Delimiter string
+
+	Include BlobListInclude
+
+	// PageSize is the number of entries requested at once. The service
+	// returns up to 5000 entries per page by default.
+	PageSize uint
+}
+
+// BlobIterator walks the blobs of a container, fetching further pages as
+// needed. It stops at the first error, including the cancellation of the
+// context of the client that created it.
+//
+//	it := blobs.WithContext(ctx).NewBlobIterator("container", BlobIteratorOptions{Prefix: "logs/"})
+//	for it.Next() {
+//		blob := it.Blob()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type BlobIterator struct {
+	client    BlobStorageClient
+	container string
+	params    ListBlobsParameters
+
+	prefixes []string
+	blobs    []Blob
+	prefix   string
+	blob     Blob
+	done     bool
+	err      error
+}
+
+// NewBlobIterator returns an iterator over the blobs of container selected
+// by options.
+func (b BlobStorageClient) NewBlobIterator(container string, options BlobIteratorOptions) *BlobIterator {
+	return &BlobIterator{
+		client:    b,
+		container: container,
+		params: ListBlobsParameters{
+			Prefix:     options.Prefix,
+			Delimiter:  options.Delimiter,
+			Include:    options.Include.String(),
+			MaxResults: options.PageSize,
+		},
+	}
+}
+
+// Next advances the iterator to the next entry, which is then available
+// through Blob, or through Prefix for virtual directories. Within a page
+// the virtual directories come before the blobs. It returns false when
+// there are no more entries or an error occurred.
+func (it *BlobIterator) Next() bool {
+	for len(it.prefixes) == 0 && len(it.blobs) == 0 {
+		if it.done || it.err != nil {
+			it.prefix, it.blob = "", Blob{}
+			return false
+		}
+		if err := it.client.client.requestContext().Err(); err != nil {
+			it.err = err
+			continue
+		}
+		resp, err := it.client.ListBlobs(it.container, it.params)
+		if err != nil {
+			it.err = err
+			continue
+		}
+		it.prefixes, it.blobs = resp.BlobPrefixes, resp.Blobs
+		it.params.Marker = resp.NextMarker
+		it.done = resp.NextMarker == ""
+	}
+	if len(it.prefixes) > 0 {
+		it.prefix, it.blob = it.prefixes[0], Blob{}
+		it.prefixes = it.prefixes[1:]
+	} else {
+		it.prefix, it.blob = "", it.blobs[0]
+		it.blobs = it.blobs[1:]
+	}
+	return true
+}
+
+// Blob returns the current blob. It is the zero Blob when the current
+// entry is a virtual directory.
+func (it *BlobIterator) Blob() Blob {
+	return it.blob
+}
+
+// Prefix returns the name of the current virtual directory, ending with
+// the delimiter, or "" if the current entry is a blob.
+func (it *BlobIterator) Prefix() string {
+	return it.prefix
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *BlobIterator) Err() error {
+	return it.err
+}
+
+// SkipPrefix is used as a return value from BlobWalkFunc to indicate that
+// the virtual directory named in the call is not to be walked.
+var SkipPrefix = errors.New("storage: skip this prefix")
+
+// BlobWalkFunc is called by WalkBlobs for each virtual directory, with a
+// nil blob, and for each blob, with the prefix of the directory holding
+// it. Returning SkipPrefix for a directory skips its content; any other
+// error stops the walk and is returned by WalkBlobs.
+type BlobWalkFunc func(prefix string, blob *Blob) error
+
+// WalkBlobs walks the blobs of container as a tree of virtual directories
+// separated by options.Delimiter, "/" if empty, calling fn for each
+// directory before walking its content. Within a directory entries are
+// visited in listing order, page by page.
+func (b BlobStorageClient) WalkBlobs(container string, options BlobIteratorOptions, fn BlobWalkFunc) error {
+	if options.Delimiter == "" {
+		options.Delimiter = "/"
+	}
+	it := b.NewBlobIterator(container, options)
+	for it.Next() {
+		if it.Prefix() == "" {
+			blob := it.Blob()
+			if err := fn(options.Prefix, &blob); err != nil {
+				return err
+			}
+			continue
+		}
+		err := fn(it.Prefix(), nil)
+		if err == SkipPrefix {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sub := options
+		sub.Prefix = it.Prefix()
+		if err := b.WalkBlobs(container, sub, fn); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// ContainerIteratorOptions is the set of options that can be specified for
+// a ContainerIterator.
+type ContainerIteratorOptions struct {
+	Prefix string
+
+	// IncludeMetadata returns the metadata of the containers.
+	IncludeMetadata bool
+
+	// PageSize is the number of containers requested at once. The
+	// service returns up to 5000 containers per page by default.
+	PageSize uint
+}
+
+// ContainerIterator walks the containers of the account, fetching further
+// pages as needed. It stops at the first error, including the cancellation
+// of the context of the client that created it.
+type ContainerIterator struct {
+	client BlobStorageClient
+	params ListContainersParameters
+
+	page      []Container
+	container Container
+	done      bool
+	err       error
+}
+
+// NewContainerIterator returns an iterator over the containers of the
+// account selected by options.
+func (b BlobStorageClient) NewContainerIterator(options ContainerIteratorOptions) *ContainerIterator {
+	params := ListContainersParameters{Prefix: options.Prefix, MaxResults: options.PageSize}
+	if options.IncludeMetadata {
+		params.Include = "metadata"
+	}
+	return &ContainerIterator{client: b, params: params}
+}
+
+// Next advances the iterator to the next container, which is then
+// available through Container. It returns false when there are no more
+// containers or an error occurred.
+func (it *ContainerIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			it.container = Container{}
+			return false
+		}
+		if err := it.client.client.requestContext().Err(); err != nil {
+			it.err = err
+			continue
+		}
+		resp, err := it.client.ListContainers(it.params)
+		if err != nil {
+			it.err = err
+			continue
+		}
+		it.page = resp.Containers
+		it.params.Marker = resp.NextMarker
+		it.done = resp.NextMarker == ""
+	}
+	it.container, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Container returns the current container.
+func (it *ContainerIterator) Container() Container {
+	return it.container
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *ContainerIterator) Err() error {
+	return it.err
+}
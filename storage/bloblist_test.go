@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type BlobListSuite struct {
+	blobServerSuite
+}
+
+var _ = chk.Suite(&BlobListSuite{})
+
+func (s *BlobListSuite) TestBlobIterator(c *chk.C) {
+	for _, name := range []string{"a", "b/1", "b/2", "b/c/3", "d"} {
+		s.putBlob(c, name, s.data)
+	}
+	c.Assert(s.cli.SetBlobMetadata(s.cnt, "a", map[string]string{"k": "v"}, nil), chk.IsNil)
+	_, err := s.cli.SnapshotBlob(s.cnt, "a", 0, nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(s.cli.PutBlock(s.cnt, "e", base64.StdEncoding.EncodeToString([]byte("id")), s.data), chk.IsNil)
+
+	var names []string
+	it := s.cli.NewBlobIterator(s.cnt, storage.BlobIteratorOptions{
+		Include:  storage.BlobListInclude{Snapshots: true, Metadata: true, UncommittedBlobs: true},
+		PageSize: 2,
+	})
+	for it.Next() {
+		blob := it.Blob()
+		c.Assert(it.Prefix(), chk.Equals, "")
+		if blob.Name == "a" {
+			c.Assert(blob.Metadata, chk.DeepEquals, storage.BlobMetadata{"k": "v"})
+		}
+		if blob.Snapshot != "" {
+			names = append(names, blob.Name+"@snapshot")
+		} else {
+			names = append(names, blob.Name)
+		}
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	c.Assert(names, chk.DeepEquals, []string{"a@snapshot", "a", "b/1", "b/2", "b/c/3", "d", "e"})
+
+	names = nil
+	it = s.cli.NewBlobIterator(s.cnt, storage.BlobIteratorOptions{Prefix: "b/", Delimiter: "/", PageSize: 1})
+	for it.Next() {
+		names = append(names, it.Prefix()+it.Blob().Name)
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	c.Assert(names, chk.DeepEquals, []string{"b/1", "b/2", "b/c/"})
+	c.Assert(it.Next(), chk.Equals, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it = s.cli.WithContext(ctx).NewBlobIterator(s.cnt, storage.BlobIteratorOptions{PageSize: 1})
+	c.Assert(it.Next(), chk.Equals, true)
+	cancel()
+	c.Assert(it.Next(), chk.Equals, false)
+	c.Assert(it.Err(), chk.Equals, context.Canceled)
+
+	it = s.cli.NewBlobIterator("missing", storage.BlobIteratorOptions{})
+	c.Assert(it.Next(), chk.Equals, false)
+	serr, ok := it.Err().(storage.AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", it.Err(), it.Err()))
+	c.Assert(serr.StatusCode, chk.Equals, http.StatusNotFound)
+	c.Assert(serr.Code, chk.Equals, "ContainerNotFound")
+}
+
+func (s *BlobListSuite) TestWalkBlobs(c *chk.C) {
+	for _, name := range []string{"a", "b/1", "b/c/2", "b/d/3", "e/4"} {
+		s.putBlob(c, name, s.data)
+	}
+	var visited []string
+	err := s.cli.WalkBlobs(s.cnt, storage.BlobIteratorOptions{PageSize: 1}, func(prefix string, blob *storage.Blob) error {
+		if blob == nil {
+			visited = append(visited, "dir "+prefix)
+			if prefix == "b/d/" {
+				return storage.SkipPrefix
+			}
+			return nil
+		}
+		visited = append(visited, prefix+" "+blob.Name)
+		return nil
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(visited, chk.DeepEquals, []string{
+		" a",
+		"dir b/", "b/ b/1", "dir b/c/", "b/c/ b/c/2", "dir b/d/",
+		"dir e/", "e/ e/4",
+	})
+
+	stop := errors.New("stop")
+	err = s.cli.WalkBlobs(s.cnt, storage.BlobIteratorOptions{Prefix: "b/"}, func(prefix string, blob *storage.Blob) error {
+		return stop
+	})
+	c.Assert(err, chk.Equals, stop)
+}
+
+func (s *BlobListSuite) TestContainerIterator(c *chk.C) {
+	c.Assert(s.cli.CreateContainer("other", storage.ContainerAccessTypePrivate), chk.IsNil)
+	c.Assert(s.cli.CreateContainer("third", storage.ContainerAccessTypePrivate), chk.IsNil)
+
+	var names []string
+	it := s.cli.NewContainerIterator(storage.ContainerIteratorOptions{PageSize: 2, IncludeMetadata: true})
+	for it.Next() {
+		names = append(names, it.Container().Name)
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	c.Assert(names, chk.DeepEquals, []string{"container", "other", "third"})
+
+	it = s.cli.NewContainerIterator(storage.ContainerIteratorOptions{Prefix: "o"})
+	c.Assert(it.Next(), chk.Equals, true)
+	c.Assert(it.Container().Name, chk.Equals, "other")
+	c.Assert(it.Next(), chk.Equals, false)
+	c.Assert(it.Err(), chk.IsNil)
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// snapshotTimeFormat is the layout of the snapshot parameter, which must
+// match the x-ms-snapshot value returned by Snapshot Blob to the tick.
+const snapshotTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// BlobRef addresses a blob or one of its snapshots without encoding the
+// snapshot into the blob name.
+type BlobRef struct {
+	Container string
+	Name      string
+
+	// Snapshot is the timestamp returned by SnapshotBlob. The zero value
+	// addresses the base blob.
+	Snapshot time.Time
+}
+
+// IsSnapshot reports whether r addresses a snapshot rather than the base
+// blob.
+func (r BlobRef) IsSnapshot() bool {
+	return !r.Snapshot.IsZero()
+}
+
+// query returns the query parameters selecting the snapshot of r, if any.
+func (r BlobRef) query() url.Values {
+	params := url.Values{}
+	if r.IsSnapshot() {
+		params.Set("snapshot", r.Snapshot.UTC().Format(snapshotTimeFormat))
+	}
+	return params
+}
+
+// snapshotRef returns the BlobRef addressing the given snapshot of a blob,
+// a timestamp as returned by SnapshotBlob or listed in Blob.Snapshot. An
+// empty snapshot addresses the base blob.
+func snapshotRef(container, name, snapshot string) (BlobRef, error) {
+	ref := BlobRef{Container: container, Name: name}
+	if snapshot == "" {
+		return ref, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, snapshot)
+	if err != nil {
+		return ref, fmt.Errorf("storage: invalid snapshot %q: %v", snapshot, err)
+	}
+	ref.Snapshot = t
+	return ref, nil
+}
+
+// DeleteSnapshotsOption controls what happens to the snapshots of a blob
+// when the blob is deleted.
+type DeleteSnapshotsOption string
+
+// Possible values of the x-ms-delete-snapshots header.
+const (
+	// DeleteSnapshotsNone deletes the blob only, which fails if it has
+	// snapshots.
+	DeleteSnapshotsNone DeleteSnapshotsOption = ""
+
+	// DeleteSnapshotsInclude deletes the blob together with all of its
+	// snapshots.
+	DeleteSnapshotsInclude DeleteSnapshotsOption = "include"
+
+	// DeleteSnapshotsOnly deletes the snapshots of the blob and keeps the
+	// blob itself.
+	DeleteSnapshotsOnly DeleteSnapshotsOption = "only"
+)
+
+// GetBlobRefURL gets the canonical URL to the blob or snapshot addressed by
+// ref. See GetBlobURL.
+func (b BlobStorageClient) GetBlobRefURL(ref BlobRef) string {
+	container := ref.Container
+	if container == "" {
+		container = "$root"
+	}
+	return b.client.getEndpoint(blobServiceName, pathForBlob(container, ref.Name), ref.query())
+}
+
+// GetBlobByRef returns a stream to read the blob or snapshot addressed by
+// ref. See GetBlob.
+func (b BlobStorageClient) GetBlobByRef(ref BlobRef) (io.ReadCloser, error) {
+	resp, err := b.getBlobRangeQuery(ref.Container, ref.Name, ref.query(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
+		return nil, err
+	}
+	return resp.body, nil
+}
+
+// GetBlobRangeByRef reads the specified range of the blob or snapshot
+// addressed by ref. See GetBlobRange.
+func (b BlobStorageClient) GetBlobRangeByRef(ref BlobRef, bytesRange string, extraHeaders map[string]string) (io.ReadCloser, error) {
+	resp, err := b.getBlobRangeQuery(ref.Container, ref.Name, ref.query(), bytesRange, extraHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRespCode(resp.statusCode, []int{http.StatusPartialContent}); err != nil {
+		return nil, err
+	}
+	return resp.body, nil
+}
+
+// GetBlobPropertiesByRef provides various information about the blob or
+// snapshot addressed by ref. See GetBlobProperties.
+func (b BlobStorageClient) GetBlobPropertiesByRef(ref BlobRef) (*BlobProperties, error) {
+	return b.getBlobPropertiesQuery(ref.Container, ref.Name, ref.query())
+}
+
+// GetBlobMetadataByRef returns all user-defined metadata of the blob or
+// snapshot addressed by ref. See GetBlobMetadata.
+func (b BlobStorageClient) GetBlobMetadataByRef(ref BlobRef) (map[string]string, error) {
+	return b.getBlobMetadataQuery(ref.Container, ref.Name, ref.query())
+}
+
+// DeleteBlobByRef deletes the blob or snapshot addressed by ref.
+// deleteSnapshots chooses what happens to the snapshots of a base blob; it
+// must be DeleteSnapshotsNone when ref addresses a snapshot.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd179413.aspx
+func (b BlobStorageClient) DeleteBlobByRef(ref BlobRef, deleteSnapshots DeleteSnapshotsOption, extraHeaders map[string]string) error {
+	if deleteSnapshots != DeleteSnapshotsNone {
+		if ref.IsSnapshot() {
+			return fmt.Errorf("storage: x-ms-delete-snapshots cannot be used when deleting a snapshot")
+		}
+		headers := map[string]string{"x-ms-delete-snapshots": string(deleteSnapshots)}
+		for k, v := range extraHeaders {
+			headers[k] = v
+		}
+		extraHeaders = headers
+	}
+
+	resp, err := b.deleteBlobQuery(ref.Container, ref.Name, ref.query(), extraHeaders)
+	if err != nil {
+		return err
+	}
+	defer resp.body.Close()
+	return checkRespCode(resp.statusCode, []int{http.StatusAccepted})
+}
+
+// StartBlobCopyFromRef starts copying the blob or snapshot addressed by
+// source into the specified blob. See StartBlobCopy.
+func (b BlobStorageClient) StartBlobCopyFromRef(container, name string, source BlobRef) (string, error) {
+	return b.StartBlobCopy(container, name, b.GetBlobRefURL(source))
+}
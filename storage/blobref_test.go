@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type BlobRefSuite struct{}
+
+var _ = chk.Suite(&BlobRefSuite{})
+
+// recordingBlobServer answers every request with the given status and
+// remembers the requests it received.
+type recordingBlobServer struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+}
+
+func (f *recordingBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r)
+	w.Header().Set("x-ms-meta-owner", "backup")
+	w.Header().Set("x-ms-copy-id", "copy-id")
+	w.WriteHeader(f.status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte("content"))
+	}
+}
+
+var testSnapshotTime = time.Date(2017, 3, 1, 10, 0, 0, 935596100, time.UTC)
+
+func (s *BlobRefSuite) TestBlobRefQuery(c *chk.C) {
+	c.Assert(BlobRef{Container: "c", Name: "b"}.query().Encode(), chk.Equals, "")
+	ref := BlobRef{Container: "c", Name: "b", Snapshot: testSnapshotTime}
+	c.Assert(ref.query().Get("snapshot"), chk.Equals, "2017-03-01T10:00:00.9355961Z")
+}
+
+func (s *BlobRefSuite) TestGetBlobRefURL(c *chk.C) {
+	cli, err := NewBasicClient("foo", "YmFy")
+	c.Assert(err, chk.IsNil)
+	b := cli.GetBlobService()
+
+	c.Assert(b.GetBlobRefURL(BlobRef{Name: "disk.vhd"}), chk.Equals, "https://foo.blob.core.windows.net/$root/disk.vhd")
+	c.Assert(b.GetBlobRefURL(BlobRef{Container: "vhds", Name: "a:b?.vhd", Snapshot: testSnapshotTime}), chk.Equals,
+		"https://foo.blob.core.windows.net/vhds/a:b%3F.vhd?snapshot=2017-03-01T10%3A00%3A00.9355961Z")
+}
+
+func (s *BlobRefSuite) TestReadSnapshotByRef(c *chk.C) {
+	fake := &recordingBlobServer{status: http.StatusOK}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	b := cli.GetBlobService()
+	ref := BlobRef{Container: "vhds", Name: "disk.vhd", Snapshot: testSnapshotTime}
+
+	body, err := b.GetBlobByRef(ref)
+	c.Assert(err, chk.IsNil)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(data), chk.Equals, "content")
+
+	_, err = b.GetBlobPropertiesByRef(ref)
+	c.Assert(err, chk.IsNil)
+
+	metadata, err := b.GetBlobMetadataByRef(ref)
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata, chk.DeepEquals, map[string]string{"owner": "backup"})
+
+	c.Assert(fake.requests, chk.HasLen, 3)
+	for _, r := range fake.requests {
+		c.Assert(r.URL.Path, chk.Equals, "/vhds/disk.vhd")
+		c.Assert(r.URL.Query().Get("snapshot"), chk.Equals, "2017-03-01T10:00:00.9355961Z")
+	}
+	c.Assert(fake.requests[2].URL.Query().Get("comp"), chk.Equals, "metadata")
+}
+
+func (s *BlobRefSuite) TestDeleteBlobByRef(c *chk.C) {
+	fake := &recordingBlobServer{status: http.StatusAccepted}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	b := cli.GetBlobService()
+
+	c.Assert(b.DeleteBlobByRef(BlobRef{Container: "vhds", Name: "disk.vhd"}, DeleteSnapshotsInclude, nil), chk.IsNil)
+	c.Assert(b.DeleteBlobByRef(BlobRef{Container: "vhds", Name: "disk.vhd", Snapshot: testSnapshotTime}, DeleteSnapshotsNone, nil), chk.IsNil)
+
+	c.Assert(fake.requests, chk.HasLen, 2)
+	c.Assert(fake.requests[0].Header.Get("x-ms-delete-snapshots"), chk.Equals, "include")
+	c.Assert(fake.requests[0].URL.RawQuery, chk.Equals, "")
+	c.Assert(fake.requests[1].Header.Get("x-ms-delete-snapshots"), chk.Equals, "")
+	c.Assert(fake.requests[1].URL.Query().Get("snapshot"), chk.Equals, "2017-03-01T10:00:00.9355961Z")
+}
+
+func (s *BlobRefSuite) TestDeleteSnapshotRejectsDeleteSnapshotsOption(c *chk.C) {
+	err := BlobStorageClient{}.DeleteBlobByRef(BlobRef{Container: "vhds", Name: "disk.vhd", Snapshot: testSnapshotTime}, DeleteSnapshotsOnly, nil)
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *BlobRefSuite) TestStartBlobCopyFromRef(c *chk.C) {
+	fake := &recordingBlobServer{status: http.StatusAccepted}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	b := cli.GetBlobService()
+
+	id, err := b.StartBlobCopyFromRef("vhds", "restored.vhd", BlobRef{Container: "vhds", Name: "disk.vhd", Snapshot: testSnapshotTime})
+	c.Assert(err, chk.IsNil)
+	c.Assert(id, chk.Equals, "copy-id")
+	c.Assert(fake.requests[0].Header.Get("x-ms-copy-source"), chk.Equals, "https://foo.blob.core.windows.net/vhds/disk.vhd?snapshot=2017-03-01T10%3A00%3A00.9355961Z")
+}
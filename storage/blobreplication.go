@@ -0,0 +1,514 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplicationConcurrency is the number of copies a
+	// BlobReplicator runs at once when ReplicationOptions.Concurrency is
+	// not set.
+	DefaultReplicationConcurrency = 8
+
+	// DefaultReplicationSASExpiry is how long the read signatures handed
+	// to the destination are valid when ReplicationOptions.SASExpiry is not
+	// set.
+	DefaultReplicationSASExpiry = 24 * time.Hour
+)
+
+// States of the blobs recorded in a replication journal. A snapshot is
+// snapshotting once it is copied onto the destination blob, until the
+// destination blob is snapshotted.
+const (
+	replicationStarted      = "started"
+	replicationSnapshotting = "snapshotting"
+	replicationDone         = "done"
+)
+
+// replicationSnapshotMetadata is the metadata set on the destination
+// snapshots, naming the time of the source snapshot they replicate.
+const replicationSnapshotMetadata = "replicatedsnapshot"
+
+var errReplicationAborted = errors.New("storage: not replicated because an older snapshot of the blob failed to")
+
+// ReplicationOptions is the set of options that can be specified for a
+// BlobReplicator.
+type ReplicationOptions struct {
+	// Prefix restricts replication to the blobs whose names start with it.
+	Prefix string
+
+	// IncludeSnapshots replicates the snapshots of the blobs too, oldest
+	// first, as snapshots of the destination blob. The destination
+	// snapshots carry the time of their source snapshot in their
+	// replicatedsnapshot metadata, and a source snapshot is skipped if the
+	// destination blob has a snapshot of it.
+	IncludeSnapshots bool
+
+	// Concurrency is the largest number of copies in progress at once.
+	// The snapshots of a blob are always copied one after the other.
+	Concurrency int
+
+	// SASExpiry is how long the read signatures granting the destination
+	// access to the source blobs are valid. It must cover the longest
+	// copy.
+	SASExpiry time.Duration
+
+	// JournalPath is the file in which the progress of the replication is
+	// recorded. When set, a run interrupted by a crash is resumed by the
+	// next one using the same file: completed blobs are skipped and copies
+	// still in progress are waited for rather than started again.
+	JournalPath string
+
+	// Wait sets how copies are polled. Its Concurrency is ignored.
+	Wait BlobCopyWaitOptions
+}
+
+func (o ReplicationOptions) withDefaults() ReplicationOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultReplicationConcurrency
+	}
+	if o.SASExpiry <= 0 {
+		o.SASExpiry = DefaultReplicationSASExpiry
+	}
+	o.Wait = o.Wait.withDefaults()
+	return o
+}
+
+// ReplicationFailure is a source blob or snapshot a BlobReplicator could
+// not replicate.
+type ReplicationFailure struct {
+	Ref BlobRef
+	Err error
+}
+
+// ReplicationReport lists what BlobReplicator.Run did with every source
+// blob and snapshot it considered. BytesCopied is the size of the copied
+// ones.
+type ReplicationReport struct {
+	Copied      []BlobRef
+	Skipped     []BlobRef
+	Failed      []ReplicationFailure
+	BytesCopied int64
+}
+
+// BlobReplicator copies the blobs of a container to a container of
+// another account, possibly in another region, with server-side copies.
+// The destination reads the source blobs through read-only shared access
+// signatures, so the source client must be created with the account key.
+// Server-side copies keep the metadata and properties of the blobs.
+type BlobReplicator struct {
+	source               Client
+	sourceContainer      string
+	destination          Client
+	destinationContainer string
+	options              ReplicationOptions
+}
+
+// NewBlobReplicator returns a replicator copying the blobs of
+// sourceContainer in source to destinationContainer in destination, which
+// is created if it does not exist.
+func NewBlobReplicator(source Client, sourceContainer string, destination Client, destinationContainer string, options ReplicationOptions) *BlobReplicator {
+	return &BlobReplicator{
+		source:               source,
+		sourceContainer:      sourceContainer,
+		destination:          destination,
+		destinationContainer: destinationContainer,
+		options:              options,
+	}
+}
+
+// replicationItem is a source blob or snapshot along with its listed
+// properties.
+type replicationItem struct {
+	ref   BlobRef
+	props BlobProperties
+}
+
+// replicationGroup is a source blob and its snapshots, oldest first and
+// base blob last, which are replicated in that order.
+type replicationGroup []replicationItem
+
+// Run replicates the blobs whose names start with the prefix of the
+// options, skipping the ones the destination already holds: the blobs
+// whose source ETag is recorded as done in the journal and the blobs whose
+// destination has the same size and Content-MD5. Requests are bound to
+// ctx. The failures of individual blobs are listed in the report; the
+// error is only set if replication could not start, such as when listing
+// the source fails.
+func (r *BlobReplicator) Run(ctx context.Context) (ReplicationReport, error) {
+	var report ReplicationReport
+	options := r.options.withDefaults()
+	if r.source.accountName == r.destination.accountName && r.source.baseURL == r.destination.baseURL && r.sourceContainer == r.destinationContainer {
+		return report, fmt.Errorf("storage: cannot replicate container %s onto itself", r.sourceContainer)
+	}
+	src := r.source.GetBlobService().WithContext(ctx)
+	dst := r.destination.GetBlobService().WithContext(ctx)
+
+	journal, err := openReplicationJournal(options.JournalPath)
+	if err != nil {
+		return report, err
+	}
+	defer journal.close()
+
+	if _, err := dst.CreateContainerIfNotExists(r.destinationContainer, ContainerAccessTypePrivate); err != nil {
+		return report, err
+	}
+	groups, err := r.list(src, options)
+	if err != nil {
+		return report, err
+	}
+
+	reports := make([]ReplicationReport, len(groups))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range work {
+				reports[g] = r.replicateGroup(src, dst, journal, groups[g], options)
+			}
+		}()
+	}
+	for g := range groups {
+		work <- g
+	}
+	close(work)
+	wg.Wait()
+
+	for _, g := range reports {
+		report.Copied = append(report.Copied, g.Copied...)
+		report.Skipped = append(report.Skipped, g.Skipped...)
+		report.Failed = append(report.Failed, g.Failed...)
+		report.BytesCopied += g.BytesCopied
+	}
+	return report, nil
+}
+
+// list returns the source blobs to replicate, grouped with their
+// snapshots.
+func (r *BlobReplicator) list(src BlobStorageClient, options ReplicationOptions) ([]replicationGroup, error) {
+	params := ListBlobsParameters{Prefix: options.Prefix}
+	if options.IncludeSnapshots {
+		params.Include = "snapshots"
+	}
+	groups := make(map[string]replicationGroup)
+	var names []string
+	for {
+		resp, err := src.ListBlobs(r.sourceContainer, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range resp.Blobs {
+			item := replicationItem{
+				ref:   BlobRef{Container: r.sourceContainer, Name: blob.Name},
+				props: blob.Properties,
+			}
+			if blob.Snapshot != "" {
+				if item.ref.Snapshot, err = time.Parse(time.RFC3339, blob.Snapshot); err != nil {
+					return nil, err
+				}
+			}
+			if _, ok := groups[blob.Name]; !ok {
+				names = append(names, blob.Name)
+			}
+			groups[blob.Name] = append(groups[blob.Name], item)
+		}
+		if resp.NextMarker == "" {
+			break
+		}
+		params.Marker = resp.NextMarker
+	}
+
+	result := make([]replicationGroup, len(names))
+	for i, name := range names {
+		g := groups[name]
+		sort.Sort(sort.Reverse(g))
+		result[i] = g
+	}
+	return result, nil
+}
+
+// replicationGroup sorts from the newest snapshot to the oldest one, the
+// base blob counting as the newest.
+func (g replicationGroup) Len() int      { return len(g) }
+func (g replicationGroup) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g replicationGroup) Less(i, j int) bool {
+	a, b := g[i].ref, g[j].ref
+	if !a.IsSnapshot() || !b.IsSnapshot() {
+		return !a.IsSnapshot() && b.IsSnapshot()
+	}
+	return a.Snapshot.After(b.Snapshot)
+}
+
+// replicateGroup replicates the items of g in order, giving up on the
+// remaining ones once one fails. Snapshots are replicated by copying them
+// onto the destination blob before snapshotting it, so the base blob is
+// always copied again once a snapshot was.
+func (r *BlobReplicator) replicateGroup(src, dst BlobStorageClient, journal *replicationJournal, g replicationGroup, options ReplicationOptions) ReplicationReport {
+	var report ReplicationReport
+	var existing destinationSnapshots
+	if len(g) > 1 || g[0].ref.IsSnapshot() {
+		var err error
+		if existing, err = listDestinationSnapshots(dst, r.destinationContainer, g[0].ref.Name); err != nil {
+			for _, item := range g {
+				report.Failed = append(report.Failed, ReplicationFailure{Ref: item.ref, Err: err})
+			}
+			return report
+		}
+	}
+	snapshotCopied := false
+	for i, item := range g {
+		copied, err := r.replicate(src, dst, journal, item, options, existing, snapshotCopied)
+		if copied && item.ref.IsSnapshot() {
+			snapshotCopied = true
+		}
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, ReplicationFailure{Ref: item.ref, Err: err})
+			for _, rest := range g[i+1:] {
+				report.Failed = append(report.Failed, ReplicationFailure{Ref: rest.ref, Err: errReplicationAborted})
+			}
+			return report
+		case copied:
+			report.Copied = append(report.Copied, item.ref)
+			report.BytesCopied += item.props.ContentLength
+		default:
+			report.Skipped = append(report.Skipped, item.ref)
+		}
+	}
+	return report
+}
+
+// replicate copies item to the destination unless it is already there,
+// and reports whether it did. Snapshots are looked up in existing, the
+// snapshots of the destination blob. force copies a base blob even if the
+// destination seems to hold it already.
+func (r *BlobReplicator) replicate(src, dst BlobStorageClient, journal *replicationJournal, item replicationItem, options ReplicationOptions, existing destinationSnapshots, force bool) (bool, error) {
+	entry := journal.lookup(item.ref)
+	if !force && entry.State == replicationDone && entry.ETag == item.props.Etag {
+		return false, nil
+	}
+	if item.ref.IsSnapshot() && existing[journalSnapshot(item.ref)] {
+		return false, journal.record(item.ref, item.props.Etag, entry.CopyID, replicationDone)
+	}
+	name := item.ref.Name
+	current, err := destinationProperties(dst, r.destinationContainer, name)
+	if err != nil {
+		return false, err
+	}
+	copyID := entry.CopyID
+	sameCopy := entry.ETag == item.props.Etag && current != nil && current.CopyID == copyID
+	resumed := entry.State == replicationStarted && sameCopy &&
+		(current.CopyStatus == blobCopyStatusPending || current.CopyStatus == blobCopyStatusSuccess)
+	// A snapshot copied onto the destination blob by a run that stopped
+	// before snapshotting it only needs the snapshot.
+	copied := item.ref.IsSnapshot() && entry.State == replicationSnapshotting && sameCopy &&
+		current.CopyStatus == blobCopyStatusSuccess
+	// A pending copy sets the properties of the destination when it
+	// starts, so only a completed one can be compared.
+	if !resumed && !force && !item.ref.IsSnapshot() && current != nil && current.CopyStatus != blobCopyStatusPending &&
+		current.ContentMD5 != "" && current.ContentMD5 == item.props.ContentMD5 && current.ContentLength == item.props.ContentLength {
+		return false, journal.record(item.ref, item.props.Etag, entry.CopyID, replicationDone)
+	}
+	if !resumed && !copied {
+		source, err := r.sourceSASURI(src, item.ref, options.SASExpiry)
+		if err != nil {
+			return false, err
+		}
+		if copyID, err = dst.StartBlobCopy(r.destinationContainer, name, source); err != nil {
+			return false, err
+		}
+		if err := journal.record(item.ref, item.props.Etag, copyID, replicationStarted); err != nil {
+			return false, err
+		}
+	}
+	if !copied {
+		if _, err := dst.trackBlobCopy(BlobCopy{Container: r.destinationContainer, Name: name, CopyID: copyID}, options.Wait, nil); err != nil {
+			return false, err
+		}
+	}
+	if item.ref.IsSnapshot() {
+		if err := journal.record(item.ref, item.props.Etag, copyID, replicationSnapshotting); err != nil {
+			return false, err
+		}
+		if err := r.snapshotDestination(dst, item.ref); err != nil {
+			return false, err
+		}
+	}
+	return true, journal.record(item.ref, item.props.Etag, copyID, replicationDone)
+}
+
+// snapshotDestination snapshots the destination blob holding a copy of the
+// source snapshot ref. The snapshot keeps the metadata of the copy and
+// records the time of ref.
+func (r *BlobReplicator) snapshotDestination(dst BlobStorageClient, ref BlobRef) error {
+	metadata, err := dst.GetBlobMetadata(r.destinationContainer, ref.Name)
+	if err != nil {
+		return err
+	}
+	metadata[replicationSnapshotMetadata] = journalSnapshot(ref)
+	_, err = dst.SnapshotBlob(r.destinationContainer, ref.Name, 0, mergeMDIntoExtraHeaders(metadata, nil))
+	return err
+}
+
+// sourceSASURI returns the URL of ref carrying a read-only signature valid
+// for expiry.
+func (r *BlobReplicator) sourceSASURI(src BlobStorageClient, ref BlobRef, expiry time.Duration) (string, error) {
+	return src.GetBlobRefSASURI(ref, SASOptions{
+		Permissions: "r",
+		Expiry:      time.Now().Add(expiry),
+	})
+}
+
+// destinationSnapshots holds the times of the source snapshots the
+// snapshots of a destination blob replicate, as recorded in their
+// metadata.
+type destinationSnapshots map[string]bool
+
+// listDestinationSnapshots returns the snapshots of the destination blob
+// name.
+func listDestinationSnapshots(dst BlobStorageClient, container, name string) (destinationSnapshots, error) {
+	snapshots := make(destinationSnapshots)
+	it := dst.NewBlobIterator(container, BlobIteratorOptions{Prefix: name, Include: BlobListInclude{Snapshots: true, Metadata: true}})
+	for it.Next() {
+		blob := it.Blob()
+		if source := blob.Metadata[replicationSnapshotMetadata]; blob.Name == name && blob.Snapshot != "" && source != "" {
+			snapshots[source] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		if serr, ok := err.(AzureStorageServiceError); ok && serr.StatusCode == http.StatusNotFound {
+			return snapshots, nil
+		}
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// destinationProperties returns the properties of a destination blob, or
+// nil if it does not exist.
+func destinationProperties(dst BlobStorageClient, container, name string) (*BlobProperties, error) {
+	props, err := dst.getBlobPropertiesQuery(container, name, nil)
+	if err != nil {
+		if serr, ok := err.(AzureStorageServiceError); ok && serr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if serr, ok := err.(UnexpectedStatusCodeError); ok && serr.Got() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return props, nil
+}
+
+// replicationJournalEntry is a line of a replication journal, which records
+// the state of a source blob or snapshot each time it changes. The last
+// line of a blob wins.
+type replicationJournalEntry struct {
+	Name     string `json:"name"`
+	Snapshot string `json:"snapshot,omitempty"`
+	ETag     string `json:"etag"`
+	CopyID   string `json:"copyId,omitempty"`
+	State    string `json:"state"`
+}
+
+// replicationJournal is an append-only file of replicationJournalEntry
+// lines. A nil journal records nothing.
+type replicationJournal struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]replicationJournalEntry
+}
+
+func openReplicationJournal(path string) (*replicationJournal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j := &replicationJournal{f: f, entries: make(map[string]replicationJournalEntry)}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e replicationJournalEntry
+		// A crash may leave a truncated last line, which is ignored.
+		if json.Unmarshal(line, &e) == nil {
+			j.entries[e.Name+"\x00"+e.Snapshot] = e
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		// Start a new line after a truncated one.
+		if _, err := f.Write([]byte("\n")); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+func journalSnapshot(ref BlobRef) string {
+	if !ref.IsSnapshot() {
+		return ""
+	}
+	return ref.Snapshot.UTC().Format(snapshotTimeFormat)
+}
+
+func (j *replicationJournal) lookup(ref BlobRef) replicationJournalEntry {
+	if j == nil {
+		return replicationJournalEntry{}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.entries[ref.Name+"\x00"+journalSnapshot(ref)]
+}
+
+// record appends the state of ref to the journal and syncs it to disk.
+func (j *replicationJournal) record(ref BlobRef, etag, copyID, state string) error {
+	if j == nil {
+		return nil
+	}
+	e := replicationJournalEntry{
+		Name:     ref.Name,
+		Snapshot: journalSnapshot(ref),
+		ETag:     etag,
+		CopyID:   copyID,
+		State:    state,
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.entries[e.Name+"\x00"+e.Snapshot] = e
+	return nil
+}
+
+func (j *replicationJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,261 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/storage/storagetest"
+	chk "gopkg.in/check.v1"
+)
+
+// blobServerSuite runs each test against a fake server holding an empty
+// container.
+type blobServerSuite struct {
+	srv  *storagetest.Server
+	cli  storage.BlobStorageClient
+	cnt  string
+	data []byte
+}
+
+func (s *blobServerSuite) SetUpTest(c *chk.C) {
+	s.srv = storagetest.NewServer()
+	s.cli = s.srv.Client().GetBlobService()
+	s.cnt = "container"
+	s.data = []byte("hello, world")
+	c.Assert(s.cli.CreateContainer(s.cnt, storage.ContainerAccessTypePrivate), chk.IsNil)
+}
+
+func (s *blobServerSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *blobServerSuite) putBlob(c *chk.C, name string, data []byte) {
+	err := s.cli.CreateBlockBlobFromReader(s.cnt, name, uint64(len(data)), bytes.NewReader(data), nil)
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *blobServerSuite) getBlob(c *chk.C, name string) []byte {
+	r, err := s.cli.GetBlob(s.cnt, name)
+	c.Assert(err, chk.IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, chk.IsNil)
+	return data
+}
+
+type BlobReplicationSuite struct {
+	blobServerSuite
+}
+
+var _ = chk.Suite(&BlobReplicationSuite{})
+
+func (s *BlobReplicationSuite) TestReplication(c *chk.C) {
+	s.putBlob(c, "vhd/a", []byte("first"))
+	c.Assert(s.cli.SetBlobMetadata(s.cnt, "vhd/a", map[string]string{"k": "v"}, nil), chk.IsNil)
+	_, err := s.cli.SnapshotBlob(s.cnt, "vhd/a", 0, nil)
+	c.Assert(err, chk.IsNil)
+	s.putBlob(c, "vhd/a", []byte("second"))
+	c.Assert(s.cli.SetBlobMetadata(s.cnt, "vhd/a", map[string]string{"k": "w"}, nil), chk.IsNil)
+	s.putBlob(c, "vhd/b", s.data)
+	s.putBlob(c, "other", s.data)
+
+	journal := filepath.Join(c.MkDir(), "journal")
+	options := storage.ReplicationOptions{
+		Prefix:           "vhd/",
+		IncludeSnapshots: true,
+		Concurrency:      2,
+		JournalPath:      journal,
+		Wait:             storage.BlobCopyWaitOptions{MinPollInterval: time.Millisecond},
+	}
+	r := storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options)
+	report, err := r.Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Failed, chk.HasLen, 0)
+	c.Assert(report.Copied, chk.HasLen, 3)
+	c.Assert(report.Copied[0].IsSnapshot(), chk.Equals, true)
+	c.Assert(report.Copied[1], chk.Equals, storage.BlobRef{Container: s.cnt, Name: "vhd/a"})
+	c.Assert(report.Skipped, chk.HasLen, 0)
+	c.Assert(report.BytesCopied, chk.Equals, int64(len("first")+len("second")+len(s.data)))
+
+	list, err := s.cli.ListBlobs("replica", storage.ListBlobsParameters{Include: "snapshots,metadata"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 3)
+	c.Assert(list.Blobs[0].Snapshot, chk.Not(chk.Equals), "")
+	c.Assert(list.Blobs[0].Metadata, chk.DeepEquals, storage.BlobMetadata{"k": "v", "replicatedsnapshot": report.Copied[0].Snapshot.Format(snapshotFormat)})
+	c.Assert(list.Blobs[0].Properties.ContentLength, chk.Equals, int64(len("first")))
+	c.Assert(list.Blobs[1].Name, chk.Equals, "vhd/a")
+	c.Assert(list.Blobs[1].Metadata, chk.DeepEquals, storage.BlobMetadata{"k": "w"})
+	c.Assert(list.Blobs[2].Name, chk.Equals, "vhd/b")
+
+	// Everything is recorded as done in the journal.
+	report, err = r.Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Copied, chk.HasLen, 0)
+	c.Assert(report.Skipped, chk.HasLen, 3)
+
+	// Without a journal, base blobs are compared by Content-MD5.
+	s.putBlob(c, "vhd/b", []byte("changed"))
+	options.JournalPath = ""
+	options.IncludeSnapshots = false
+	report, err = storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options).Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Skipped, chk.DeepEquals, []storage.BlobRef{{Container: s.cnt, Name: "vhd/a"}})
+	c.Assert(report.Copied, chk.DeepEquals, []storage.BlobRef{{Container: s.cnt, Name: "vhd/b"}})
+	data, err := s.cli.GetBlob("replica", "vhd/b")
+	c.Assert(err, chk.IsNil)
+	defer data.Close()
+	b, err := ioutil.ReadAll(data)
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(b), chk.Equals, "changed")
+
+	_, err = storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), s.cnt, options).Run(context.Background())
+	c.Assert(err, chk.ErrorMatches, "storage: cannot replicate .*")
+}
+
+func (s *BlobReplicationSuite) TestReplicationSnapshotsAddedLater(c *chk.C) {
+	s.putBlob(c, "a", []byte("old"))
+	_, err := s.cli.SnapshotBlob(s.cnt, "a", 0, nil)
+	c.Assert(err, chk.IsNil)
+	s.putBlob(c, "a", []byte("new"))
+
+	options := storage.ReplicationOptions{
+		JournalPath: filepath.Join(c.MkDir(), "journal"),
+		Wait:        storage.BlobCopyWaitOptions{MinPollInterval: time.Millisecond},
+	}
+	run := func() storage.ReplicationReport {
+		report, err := storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options).Run(context.Background())
+		c.Assert(err, chk.IsNil)
+		c.Assert(report.Failed, chk.HasLen, 0)
+		return report
+	}
+	run()
+
+	// The snapshot is copied onto the destination blob before being
+	// snapshotted, so the base blob, already done, is copied again.
+	options.IncludeSnapshots = true
+	report := run()
+	c.Assert(report.Copied, chk.HasLen, 2)
+	data, err := s.cli.GetBlob("replica", "a")
+	c.Assert(err, chk.IsNil)
+	defer data.Close()
+	b, err := ioutil.ReadAll(data)
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(b), chk.Equals, "new")
+
+	// Without a journal, snapshots the destination holds are not taken again.
+	options.JournalPath = ""
+	report = run()
+	c.Assert(report.Copied, chk.HasLen, 0)
+	c.Assert(report.Skipped, chk.HasLen, 2)
+	list, err := s.cli.ListBlobs("replica", storage.ListBlobsParameters{Include: "snapshots"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+}
+
+// snapshotFormat is the format of snapshot times.
+const snapshotFormat = "2006-01-02T15:04:05.0000000Z"
+
+func (s *BlobReplicationSuite) TestReplicationSnapshotsWithoutMD5(c *chk.C) {
+	// Page blobs, like VHDs, have no Content-MD5.
+	c.Assert(s.cli.PutPageBlob(s.cnt, "disk", 512, nil), chk.IsNil)
+	c.Assert(s.cli.PutPage(s.cnt, "disk", 0, 511, storage.PageWriteTypeUpdate, bytes.Repeat([]byte{1}, 512), nil), chk.IsNil)
+	_, err := s.cli.SnapshotBlob(s.cnt, "disk", 0, nil)
+	c.Assert(err, chk.IsNil)
+
+	options := storage.ReplicationOptions{
+		IncludeSnapshots: true,
+		Wait:             storage.BlobCopyWaitOptions{MinPollInterval: time.Millisecond},
+	}
+	for i := 0; i < 2; i++ {
+		_, err := storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options).Run(context.Background())
+		c.Assert(err, chk.IsNil)
+	}
+	list, err := s.cli.ListBlobs("replica", storage.ListBlobsParameters{Include: "snapshots"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+}
+
+func (s *BlobReplicationSuite) TestReplicationResumeBeforeSnapshot(c *chk.C) {
+	s.putBlob(c, "blob", []byte("old"))
+	snapshot, err := s.cli.SnapshotBlob(s.cnt, "blob", 0, nil)
+	c.Assert(err, chk.IsNil)
+	s.putBlob(c, "blob", []byte("new"))
+	ref := storage.BlobRef{Container: s.cnt, Name: "blob", Snapshot: *snapshot}
+	props, err := s.cli.GetBlobPropertiesByRef(ref)
+	c.Assert(err, chk.IsNil)
+
+	// A crash left the snapshot copied onto the destination blob, but the
+	// destination blob not snapshotted.
+	c.Assert(s.cli.CreateContainer("replica", storage.ContainerAccessTypePrivate), chk.IsNil)
+	source, err := s.cli.GetBlobRefSASURI(ref, storage.SASOptions{Permissions: "r", Expiry: time.Now().Add(time.Hour)})
+	c.Assert(err, chk.IsNil)
+	copyID, err := s.cli.StartBlobCopy("replica", "blob", source)
+	c.Assert(err, chk.IsNil)
+	journal := filepath.Join(c.MkDir(), "journal")
+	line := fmt.Sprintf(`{"name":"blob","snapshot":%q,"etag":%q,"copyId":%q,"state":"snapshotting"}`+"\n",
+		snapshot.UTC().Format(snapshotFormat), props.Etag, copyID)
+	c.Assert(ioutil.WriteFile(journal, []byte(line), 0644), chk.IsNil)
+
+	options := storage.ReplicationOptions{
+		IncludeSnapshots: true,
+		JournalPath:      journal,
+		Wait:             storage.BlobCopyWaitOptions{MinPollInterval: time.Millisecond},
+	}
+	report, err := storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options).Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Failed, chk.HasLen, 0)
+	c.Assert(report.Copied, chk.HasLen, 2)
+
+	// The snapshot is taken of the copy left behind, not copied again.
+	list, err := s.cli.ListBlobs("replica", storage.ListBlobsParameters{Include: "snapshots,metadata"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+	c.Assert(list.Blobs[0].Snapshot, chk.Not(chk.Equals), "")
+	taken, err := time.Parse(time.RFC3339Nano, list.Blobs[0].Snapshot)
+	c.Assert(err, chk.IsNil)
+	copied, err := s.cli.GetBlobPropertiesByRef(storage.BlobRef{Container: "replica", Name: "blob", Snapshot: taken})
+	c.Assert(err, chk.IsNil)
+	c.Assert(copied.CopyID, chk.Equals, copyID)
+	c.Assert(list.Blobs[0].Metadata["replicatedsnapshot"], chk.Equals, snapshot.UTC().Format(snapshotFormat))
+
+	// A crash after the snapshot is taken leaves it to be found.
+	c.Assert(ioutil.WriteFile(journal, []byte(line), 0644), chk.IsNil)
+	report, err = storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", options).Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Skipped, chk.DeepEquals, []storage.BlobRef{ref, {Container: s.cnt, Name: "blob"}})
+	list, err = s.cli.ListBlobs("replica", storage.ListBlobsParameters{Include: "snapshots"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+}
+
+func (s *BlobReplicationSuite) TestReplicationResume(c *chk.C) {
+	s.putBlob(c, "blob", s.data)
+	c.Assert(s.cli.CreateContainer("replica", storage.ContainerAccessTypePrivate), chk.IsNil)
+	copyID, err := s.cli.StartBlobCopy("replica", "blob", s.cli.GetBlobURL(s.cnt, "blob"))
+	c.Assert(err, chk.IsNil)
+	props, err := s.cli.GetBlobProperties(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+
+	// A crash left the copy started, and a truncated line behind.
+	journal := filepath.Join(c.MkDir(), "journal")
+	started := fmt.Sprintf(`{"name":"blob","etag":%q,"copyId":%q,"state":"started"}`+"\n{\"name\":\"bl", props.Etag, copyID)
+	c.Assert(ioutil.WriteFile(journal, []byte(started), 0644), chk.IsNil)
+
+	r := storage.NewBlobReplicator(s.srv.Client(), s.cnt, s.srv.Client(), "replica", storage.ReplicationOptions{JournalPath: journal})
+	report, err := r.Run(context.Background())
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Copied, chk.HasLen, 1)
+	dst, err := s.cli.GetBlobProperties("replica", "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(dst.CopyID, chk.Equals, copyID)
+
+	data, err := ioutil.ReadFile(journal)
+	c.Assert(err, chk.IsNil)
+	c.Assert(strings.HasSuffix(string(data), `"state":"done"}`+"\n"), chk.Equals, true)
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUploadParallelism is the number of blocks uploaded concurrently
+	// by UploadStream when UploadOptions.Parallelism is not set.
+	DefaultUploadParallelism = 4
+
+	// DefaultUploadMaxRetries is the number of times a single block is
+	// retried by UploadStream when UploadOptions.MaxRetries is not set.
+	DefaultUploadMaxRetries = 3
+
+	defaultUploadRetryDelay = time.Second
+
+	// maxBlocksPerBlob is the maximum number of committed blocks a block
+	// blob can have.
+	maxBlocksPerBlob = 50000
+)
+
+// UploadOptions is the set of options that can be specified for UploadStream
+// and UploadFile. A zero struct uploads MaxBlobBlockSize blocks using
+// DefaultUploadParallelism workers.
+type UploadOptions struct {
+	// BlockSize is the size of each block in bytes. It must not exceed
+	// MaxBlobBlockSize.
+	BlockSize int
+
+	// Parallelism is the number of blocks uploaded concurrently.
+	Parallelism int
+
+	// MaxRetries is the number of times an individual block is retried
+	// before the whole upload is abandoned. Use a negative value to disable
+	// retries. It is ignored when the client has a RetryPolicy, which then
+	// retries the blocks instead.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry of a block. It is
+	// doubled on every subsequent retry of the same block.
+	RetryDelay time.Duration
+
+	// Headers are the properties set on the blob when its block list is
+	// committed. If ContentMD5 is empty the MD5 computed over the whole
+	// stream is used.
+	Headers BlobHeaders
+
+	// Metadata is the user-defined metadata set on the blob when its block
+	// list is committed.
+	Metadata map[string]string
+}
+
+// UploadResult describes a blob written by UploadStream or UploadFile.
+type UploadResult struct {
+	// Blocks is the committed block list, in blob order. It is empty for
+	// page blobs.
+	Blocks []Block
+
+	// Pages are the ranges written to a page blob. Zero pages are skipped
+	// and therefore never listed.
+	Pages []PageRange
+
+	// Size is the number of bytes uploaded.
+	Size int64
+
+	// ContentMD5 is the base64 encoded MD5 hash of the whole blob.
+	ContentMD5 string
+}
+
+type uploadBlockJob struct {
+	id    string
+	chunk []byte
+	md5   string
+}
+
+func (o UploadOptions) withDefaults() (UploadOptions, error) {
+	if o.BlockSize == 0 {
+		o.BlockSize = MaxBlobBlockSize
+	}
+	if o.BlockSize < 0 || o.BlockSize > MaxBlobBlockSize {
+		return o, fmt.Errorf("storage: block size must be between 1 and %d bytes, got %d", MaxBlobBlockSize, o.BlockSize)
+	}
+	if o.Parallelism <= 0 {
+		o.Parallelism = DefaultUploadParallelism
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultUploadMaxRetries
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultUploadRetryDelay
+	}
+	return o, nil
+}
+
+// blockIDFromIndex returns the block ID used for the block at the given
+// position of a blob. All IDs have the same length, as required by the
+// service.
+func blockIDFromIndex(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", index)))
+}
+
+// UploadStream reads r until EOF and writes it to the specified block blob.
+// The stream is split into blocks of options.BlockSize bytes which are
+// uploaded concurrently, each one carrying its own Content-MD5 and retried
+// independently on failure, by the RetryPolicy of the client if it has one.
+// The first block to fail abandons the blocks still in flight. Once every block is stored the block list is
+// committed in a single Put Block List call, so the blob is replaced
+// atomically and readers never observe a partial upload.
+//
+// At most options.Parallelism+1 blocks are held in memory at any time.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd135726.aspx and
+// https://msdn.microsoft.com/en-us/library/azure/dd179467.aspx
+func (b BlobStorageClient) UploadStream(container, name string, r io.Reader, options UploadOptions) (UploadResult, error) {
+	var result UploadResult
+	options, err := options.withDefaults()
+	if err != nil {
+		return result, err
+	}
+
+	ctx, cancel := context.WithCancel(b.client.requestContext())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan uploadBlockJob)
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := b.putBlockWithRetries(ctx, container, name, job, options); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	hash := md5.New()
+	for index := 0; ctx.Err() == nil; index++ {
+		buf := make([]byte, options.BlockSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if index >= maxBlocksPerBlob {
+				fail(fmt.Errorf("storage: stream exceeds %d blocks of %d bytes", maxBlocksPerBlob, options.BlockSize))
+				break
+			}
+			chunk := buf[:n]
+			hash.Write(chunk)
+			sum := md5.Sum(chunk)
+			job := uploadBlockJob{
+				id:    blockIDFromIndex(index),
+				chunk: chunk,
+				md5:   base64.StdEncoding.EncodeToString(sum[:]),
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+			}
+			result.Blocks = append(result.Blocks, Block{ID: job.id, Status: BlockStatusUncommitted})
+			result.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fail(fmt.Errorf("storage: error reading upload stream: %v", err))
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return UploadResult{}, firstErr
+	}
+
+	result.ContentMD5 = base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	blobHeaders := options.Headers
+	if blobHeaders.ContentMD5 == "" {
+		blobHeaders.ContentMD5 = result.ContentMD5
+	}
+	headers := mergeMDIntoExtraHeaders(options.Metadata, headersFromStruct(blobHeaders))
+	if err := b.putBlockList(container, name, result.Blocks, headers); err != nil {
+		return UploadResult{}, err
+	}
+	return result, nil
+}
+
+// UploadFile uploads the contents of the local file at path to the specified
+// block blob. See UploadStream for details.
+func (b BlobStorageClient) UploadFile(container, name, path string, options UploadOptions) (UploadResult, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if blocks := (fi.Size() + int64(options.BlockSize) - 1) / int64(options.BlockSize); blocks > maxBlocksPerBlob {
+		return UploadResult{}, fmt.Errorf("storage: %s needs %d blocks of %d bytes, the maximum is %d", path, blocks, options.BlockSize, maxBlocksPerBlob)
+	}
+
+	return b.UploadStream(container, name, f, options)
+}
+
+// putBlockWithRetries uploads a single block on ctx, so it is abandoned as
+// soon as another block fails. It is retried with exponential backoff until
+// it succeeds, the retries are exhausted or ctx is cancelled, unless the
+// client retries requests itself.
+func (b BlobStorageClient) putBlockWithRetries(ctx context.Context, container, name string, job uploadBlockJob, options UploadOptions) error {
+	retries := options.MaxRetries
+	if b.client.RetryPolicy != nil {
+		retries = 0
+	}
+	blobs := b.WithContext(ctx)
+	return retryWithBackoff(ctx, retries, options.RetryDelay, nil, func() error {
+		return blobs.PutBlockWithLength(container, name, job.id, uint64(len(job.chunk)), bytes.NewReader(job.chunk), map[string]string{
+			headerContentMD5: job.md5,
+		})
+	})
+}
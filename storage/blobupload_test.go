@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type BlobUploadSuite struct{}
+
+var _ = chk.Suite(&BlobUploadSuite{})
+
+// fakeBlockBlobServer stores the blocks and block lists it receives and can
+// fail the first attempts of a given block.
+type fakeBlockBlobServer struct {
+	mu        sync.Mutex
+	blocks    map[string][]byte
+	committed []byte
+	headers   http.Header
+	failures  map[string]int
+	attempts  map[string]int
+}
+
+func newFakeBlockBlobServer() *fakeBlockBlobServer {
+	return &fakeBlockBlobServer{
+		blocks:   make(map[string][]byte),
+		failures: make(map[string]int),
+		attempts: make(map[string]int),
+	}
+}
+
+func (f *fakeBlockBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.URL.Query().Get("comp") {
+	case "block":
+		id := r.URL.Query().Get("blockid")
+		f.attempts[id]++
+		if f.failures[id] > 0 {
+			f.failures[id]--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blocks[id] = body
+		w.WriteHeader(http.StatusCreated)
+	case "blocklist":
+		var list struct {
+			Uncommitted []string `xml:"Uncommitted"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, id := range list.Uncommitted {
+			blob = append(blob, f.blocks[id]...)
+		}
+		f.committed = blob
+		f.headers = r.Header
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *BlobUploadSuite) Test_blockIDFromIndex(c *chk.C) {
+	c.Assert(blockIDFromIndex(0), chk.Equals, base64.StdEncoding.EncodeToString([]byte("00000000")))
+	c.Assert(len(blockIDFromIndex(0)), chk.Equals, len(blockIDFromIndex(maxBlocksPerBlob-1)))
+}
+
+func (s *BlobUploadSuite) TestUploadOptionsDefaults(c *chk.C) {
+	o, err := UploadOptions{}.withDefaults()
+	c.Assert(err, chk.IsNil)
+	c.Assert(o.BlockSize, chk.Equals, MaxBlobBlockSize)
+	c.Assert(o.Parallelism, chk.Equals, DefaultUploadParallelism)
+	c.Assert(o.MaxRetries, chk.Equals, DefaultUploadMaxRetries)
+
+	o, err = UploadOptions{MaxRetries: -1}.withDefaults()
+	c.Assert(err, chk.IsNil)
+	c.Assert(o.MaxRetries, chk.Equals, 0)
+
+	_, err = UploadOptions{BlockSize: MaxBlobBlockSize + 1}.withDefaults()
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *BlobUploadSuite) TestUploadStream(c *chk.C) {
+	fake := newFakeBlockBlobServer()
+	fake.failures[blockIDFromIndex(1)] = 2
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	data := randBytes(10*1024 + 17)
+	res, err := cli.GetBlobService().UploadStream("container", "blob", bytes.NewReader(data), UploadOptions{
+		BlockSize:  1024,
+		RetryDelay: time.Millisecond,
+		Metadata:   map[string]string{"origin": "test"},
+		Headers:    BlobHeaders{ContentType: "application/octet-stream"},
+	})
+	c.Assert(err, chk.IsNil)
+
+	sum := md5.Sum(data)
+	c.Assert(res.Size, chk.Equals, int64(len(data)))
+	c.Assert(res.Blocks, chk.HasLen, 11)
+	c.Assert(res.ContentMD5, chk.Equals, base64.StdEncoding.EncodeToString(sum[:]))
+	c.Assert(fake.committed, chk.DeepEquals, data)
+	c.Assert(fake.attempts[blockIDFromIndex(1)], chk.Equals, 3)
+	c.Assert(fake.headers.Get("x-ms-blob-content-md5"), chk.Equals, res.ContentMD5)
+	c.Assert(fake.headers.Get("x-ms-blob-content-type"), chk.Equals, "application/octet-stream")
+	c.Assert(fake.headers.Get("x-ms-meta-origin"), chk.Equals, "test")
+}
+
+func (s *BlobUploadSuite) TestUploadStreamBlockFailure(c *chk.C) {
+	fake := newFakeBlockBlobServer()
+	fake.failures[blockIDFromIndex(2)] = 5
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	_, err := cli.GetBlobService().UploadStream("container", "blob", bytes.NewReader(randBytes(4096)), UploadOptions{
+		BlockSize:  512,
+		MaxRetries: 1,
+		RetryDelay: time.Millisecond,
+	})
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.committed, chk.IsNil)
+	c.Assert(fake.attempts[blockIDFromIndex(2)], chk.Equals, 2)
+}
+
+func (s *BlobUploadSuite) TestUploadStreamWithRetryPolicy(c *chk.C) {
+	fake := newFakeBlockBlobServer()
+	fake.failures[blockIDFromIndex(1)] = 5
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = ExponentialRetryPolicy{MaxRetries: 2, InitialDelay: time.Millisecond}
+
+	// The retries of the client replace the ones of the upload.
+	_, err := cli.GetBlobService().UploadStream("container", "blob", bytes.NewReader(randBytes(2048)), UploadOptions{
+		BlockSize:  1024,
+		MaxRetries: 3,
+		RetryDelay: time.Millisecond,
+	})
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.attempts[blockIDFromIndex(1)], chk.Equals, 3)
+}
+
+// stallingBlockServer rejects the first block and holds the others until
+// their requests are abandoned.
+type stallingBlockServer struct{}
+
+func (stallingBlockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("blockid") == blockIDFromIndex(0) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-r.Context().Done():
+	case <-time.After(5 * time.Second):
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *BlobUploadSuite) TestUploadStreamAbandonsBlocksInFlight(c *chk.C) {
+	cli, srv := getTestServerClient(c, stallingBlockServer{})
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := cli.GetBlobService().UploadStream("container", "blob", bytes.NewReader(randBytes(4096)), UploadOptions{
+		BlockSize:  1024,
+		MaxRetries: -1,
+	})
+	c.Assert(err, chk.NotNil)
+	c.Assert(time.Since(start) < 2*time.Second, chk.Equals, true)
+}
+
+func (s *BlobUploadSuite) TestUploadFile(c *chk.C) {
+	fake := newFakeBlockBlobServer()
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "upload")
+	c.Assert(err, chk.IsNil)
+	defer os.Remove(f.Name())
+	data := randBytes(3000)
+	_, err = f.Write(data)
+	c.Assert(err, chk.IsNil)
+	c.Assert(f.Close(), chk.IsNil)
+
+	res, err := cli.GetBlobService().UploadFile("container", "blob", f.Name(), UploadOptions{BlockSize: 1000})
+	c.Assert(err, chk.IsNil)
+	c.Assert(res.Blocks, chk.HasLen, 3)
+	c.Assert(fake.committed, chk.DeepEquals, data)
+}
@@ -3,6 +3,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
@@ -57,6 +58,19 @@ type Client struct {
 	// requests.  If it is nil, http.DefaultClient is used.
 	HTTPClient *http.Client
 
+	// RetryPolicy decides whether failed requests are sent again. If it
+	// is nil, requests are never retried.
+	RetryPolicy RetryPolicy
+
+	// Middleware is the chain every request is sent through, outermost
+	// first. See Middleware.
+	Middleware []Middleware
+
+	// Logger receives the log entries of the client, every one of them
+	// carrying the ID of the request it relates to. If it is nil nothing is
+	// logged.
+	Logger Logger
+
 	accountName      string
 	accountKey       []byte
 	useHTTPS         bool
@@ -64,6 +78,19 @@ type Client struct {
 	baseURL          string
 	apiVersion       string
 	userAgent        string
+
+	// sasToken authenticates the requests of clients created by
+	// NewAccountSASClient in place of the account key.
+	sasToken url.Values
+
+	// endpoints are the base URLs of the services given explicitly in a
+	// connection string, by service name. They override the URLs built
+	// from the account name and baseURL.
+	endpoints map[string]*url.URL
+
+	// ctx is the context every request is bound to. It is set through the
+	// WithContext method of the service clients.
+	ctx context.Context
 }
 
 type storageResponse struct {
@@ -174,6 +201,35 @@ func NewClient(accountName, accountKey, blobServiceBaseURL, apiVersion string, u
 	return c, nil
 }
 
+// NewAccountSASClient constructs a Client which authenticates its requests
+// with the shared access signature sasToken, such as one returned by
+// GetAccountSASToken, instead of an account key. The token is appended to
+// every request and requests are not signed, so the client cannot create
+// signatures itself.
+func NewAccountSASClient(accountName, sasToken string) (Client, error) {
+	var c Client
+	if accountName == "" {
+		return c, fmt.Errorf("azure: account name required")
+	}
+	token, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+	if err != nil {
+		return c, fmt.Errorf("azure: malformed SAS token: %v", err)
+	}
+	if token.Get("sig") == "" {
+		return c, fmt.Errorf("azure: SAS token without signature")
+	}
+
+	c = Client{
+		accountName: accountName,
+		useHTTPS:    defaultUseHTTPS,
+		baseURL:     DefaultBaseURL,
+		apiVersion:  DefaultAPIVersion,
+		sasToken:    token,
+	}
+	c.userAgent = c.getDefaultUserAgent()
+	return c, nil
+}
+
 func (c Client) getDefaultUserAgent() string {
 	return fmt.Sprintf("Go/%s (%s-%s) Azure-SDK-For-Go/%s storage-dataplane/%s",
 		runtime.Version(),
@@ -205,6 +261,10 @@ func (c *Client) protectUserAgent(extraheaders map[string]string) map[string]str
 }
 
 func (c Client) getBaseURL(service string) string {
+	if u, ok := c.endpoints[service]; ok {
+		return strings.TrimSuffix(u.String(), "/")
+	}
+
 	scheme := "http"
 	if c.useHTTPS {
 		scheme = "https"
@@ -246,11 +306,13 @@ func (c Client) getEndpoint(service, path string, params url.Values) string {
 		path = fmt.Sprintf("/%v", path)
 	}
 
-	if c.accountName == StorageEmulatorAccountName {
+	if _, ok := c.endpoints[service]; !ok && c.accountName == StorageEmulatorAccountName {
 		path = fmt.Sprintf("/%v%v", StorageEmulatorAccountName, path)
 	}
 
-	u.Path = path
+	// Explicit endpoints may have a path, such as the account name of
+	// emulators, under which resources are addressed.
+	u.Path = u.Path + path
 	u.RawQuery = params.Encode()
 	return u.String()
 }
@@ -311,6 +373,14 @@ func (c Client) GetFileService() FileServiceClient {
 	return f
 }
 
+// requestContext returns the context requests made by c are bound to.
+func (c Client) requestContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 func (c Client) getStandardHeaders() map[string]string {
 	return map[string]string{
 		userAgentHeader: c.userAgent,
@@ -319,47 +389,83 @@ func (c Client) getStandardHeaders() map[string]string {
 	}
 }
 
-func renderReq(req *http.Request) ([]byte, error) {
-	u := req.URL
-	//body, err := ioutil.ReadAll(req.Body)
-	body, err := "[...elided...]", error(nil)
+func (c Client) exec(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*storageResponse, error) {
+	return c.execRetried(verb, url, headers, body, auth, true)
+}
+
+// execNonIdempotent is exec for requests the service applies again every
+// time it receives them, like putting a message or appending a block. They
+// are only retried when they could not be sent.
+func (c Client) execNonIdempotent(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*storageResponse, error) {
+	return c.execRetried(verb, url, headers, body, auth, false)
+}
+
+func (c Client) execRetried(verb, url string, headers map[string]string, body io.Reader, auth authentication, idempotent bool) (*storageResponse, error) {
+	var resp *storageResponse
+	err := c.doWithRetries(body, idempotent, func(attempt int) (int, error) {
+		var err error
+		resp, err = c.execOnce(verb, url, retryHeaders(headers, attempt), body, auth)
+		if resp == nil {
+			return 0, err
+		}
+		return resp.statusCode, err
+	})
+	return resp, err
+}
+
+// retryHeaders refreshes the request date of headers before a retry, so
+// the signature computed for the new attempt is not rejected as stale.
+func retryHeaders(headers map[string]string, attempt int) map[string]string {
+	if _, ok := headers[headerXmsDate]; ok && attempt > 0 {
+		headers[headerXmsDate] = currentTimeRfc1123Formatted()
+	}
+	return headers
+}
+
+// requestBody returns the reader to send as the body of a request. Bodies
+// that can be closed are hidden behind a plain reader when requests may be
+// retried, so the transport does not close them after the first attempt.
+func (c Client) requestBody(body io.Reader) io.Reader {
+	if _, ok := body.(io.Closer); ok && c.RetryPolicy != nil {
+		return struct{ io.Reader }{body}
+	}
+	return body
+}
+
+func (c Client) execOnce(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*storageResponse, error) {
+	req, err := c.newRequest(verb, url, headers, body, auth)
 	if err != nil {
 		return nil, err
 	}
-	parts := struct {
-		Method        string
-		Scheme        string
-		Host          string
-		URI           string
-		Headers       map[string][]string
-		Query         url.Values
-		Body          string
-		ContentLength int64
-	}{
-		Method:        req.Method,
-		Scheme:        u.Scheme,
-		Host:          u.Host,
-		URI:           u.String(),
-		Headers:       map[string][]string(req.Header),
-		Query:         u.Query(),
-		Body:          string(body),
-		ContentLength: req.ContentLength,
-	}
-
-	str, err := json.MarshalIndent(parts, "", "  ")
-	return []byte(str), err
+
+	resp, err := c.send(req, serviceErrFromResponse)
+	if resp == nil {
+		return nil, err
+	}
+	return &storageResponse{
+		statusCode: resp.StatusCode,
+		headers:    resp.Header,
+		body:       resp.Body}, err
 }
 
-func (c Client) exec(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*storageResponse, error) {
-	headers, err := c.addAuthorizationHeader(verb, url, headers, auth)
+// newRequest signs a request and builds it, bound to the context of c.
+// Clients holding a SAS token append it to url instead of signing.
+func (c Client) newRequest(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*http.Request, error) {
+	var err error
+	if c.sasToken != nil {
+		url, err = addSASToken(url, c.sasToken)
+	} else {
+		headers, err = c.addAuthorizationHeader(verb, url, headers, auth)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(verb, url, body)
+	req, err := http.NewRequest(verb, url, c.requestBody(body))
 	if err != nil {
 		return nil, errors.New("azure/storage: error creating request: " + err.Error())
 	}
+	req = req.WithContext(c.requestContext())
 
 	if clstr, ok := headers["Content-Length"]; ok {
 		// content length header is being signed, but completely ignored by golang.
@@ -374,67 +480,53 @@ func (c Client) exec(verb, url string, headers map[string]string, body io.Reader
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
+	return req, nil
+}
 
-	httpClient := c.HTTPClient
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// serviceErrFromResponse builds the error of a blob, queue or file service
+// response from its XML body.
+func serviceErrFromResponse(resp *http.Response, body []byte) error {
+	requestID := resp.Header.Get("x-ms-request-id")
+	if len(body) == 0 {
+		// no error in response body, might happen in HEAD requests
+		return serviceErrFromStatusCode(resp.StatusCode, resp.Status, requestID)
 	}
+	// response contains storage service error object, unmarshal
+	storageErr, _ := serviceErrFromXML(body, resp.StatusCode, requestID)
+	return storageErr
+}
 
-	statusCode := resp.StatusCode
-	if statusCode >= 400 && statusCode <= 505 {
-		var respBody []byte
-		respBody, err = readResponseBody(resp)
-		if err != nil {
-			return nil, err
-		}
+func (c Client) execInternalJSON(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*odataResponse, error) {
+	return c.execInternalJSONRetried(verb, url, headers, body, auth, true)
+}
 
-		requestID := resp.Header.Get("x-ms-request-id")
-		if len(respBody) == 0 {
-			// no error in response body, might happen in HEAD requests
-			err = serviceErrFromStatusCode(resp.StatusCode, resp.Status, requestID)
-		} else {
-			// response contains storage service error object, unmarshal
-			storageErr, errIn := serviceErrFromXML(respBody, resp.StatusCode, requestID)
-			if err != nil { // error unmarshaling the error response
-				err = errIn
-			}
-			err = storageErr
-		}
-		return &storageResponse{
-			statusCode: resp.StatusCode,
-			headers:    resp.Header,
-			body:       ioutil.NopCloser(bytes.NewReader(respBody)), /* restore the body */
-		}, err
-	}
+// execInternalJSONNonIdempotent is execInternalJSON for requests that must
+// not be applied twice, which are only retried when they could not be sent.
+func (c Client) execInternalJSONNonIdempotent(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*odataResponse, error) {
+	return c.execInternalJSONRetried(verb, url, headers, body, auth, false)
+}
 
-	return &storageResponse{
-		statusCode: resp.StatusCode,
-		headers:    resp.Header,
-		body:       resp.Body}, nil
+func (c Client) execInternalJSONRetried(verb, url string, headers map[string]string, body io.Reader, auth authentication, idempotent bool) (*odataResponse, error) {
+	var resp *odataResponse
+	err := c.doWithRetries(body, idempotent, func(attempt int) (int, error) {
+		var err error
+		resp, err = c.execInternalJSONOnce(verb, url, retryHeaders(headers, attempt), body, auth)
+		if resp == nil {
+			return 0, err
+		}
+		return resp.statusCode, err
+	})
+	return resp, err
 }
 
-func (c Client) execInternalJSON(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*odataResponse, error) {
-	headers, err := c.addAuthorizationHeader(verb, url, headers, auth)
+func (c Client) execInternalJSONOnce(verb, url string, headers map[string]string, body io.Reader, auth authentication) (*odataResponse, error) {
+	req, err := c.newRequest(verb, url, headers, body, auth)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(verb, url, body)
-	for k, v := range headers {
-		req.Header.Add(k, v)
-	}
-
-	httpClient := c.HTTPClient
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	resp, err := c.send(req, serviceErrFromODataResponse)
+	if resp == nil {
 		return nil, err
 	}
 
@@ -443,25 +535,40 @@ func (c Client) execInternalJSON(verb, url string, headers map[string]string, bo
 	respToRet.statusCode = resp.StatusCode
 	respToRet.headers = resp.Header
 
-	statusCode := resp.StatusCode
-	if statusCode >= 400 && statusCode <= 505 {
-		var respBody []byte
-		respBody, err = readResponseBody(resp)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(respBody) == 0 {
-			// no error in response body, might happen in HEAD requests
-			err = serviceErrFromStatusCode(resp.StatusCode, resp.Status, resp.Header.Get("x-ms-request-id"))
+	// The error built by send, or by a middleware, is returned as is; the
+	// odata.error body is only decoded for the callers inspecting it.
+	if resp.StatusCode >= 400 && resp.StatusCode <= 505 {
+		respBody, rerr := readResponseBody(resp)
+		if rerr != nil {
+			if err == nil {
+				err = rerr
+			}
 			return respToRet, err
 		}
-		// try unmarshal as odata.error json
-		err = json.Unmarshal(respBody, &respToRet.odata)
-		return respToRet, err
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		respToRet.body = resp.Body
+		json.Unmarshal(respBody, &respToRet.odata)
 	}
+	return respToRet, err
+}
 
-	return respToRet, nil
+// serviceErrFromODataResponse builds the error of a table service response
+// from its odata.error body.
+func serviceErrFromODataResponse(resp *http.Response, body []byte) error {
+	requestID := resp.Header.Get("x-ms-request-id")
+	if len(body) == 0 {
+		return serviceErrFromStatusCode(resp.StatusCode, resp.Status, requestID)
+	}
+	var odata odataErrorMessage
+	if err := json.Unmarshal(body, &odata); err != nil {
+		return err
+	}
+	return AzureStorageServiceError{
+		Code:       odata.Err.Code,
+		Message:    odata.Err.Message.Value,
+		StatusCode: resp.StatusCode,
+		RequestID:  requestID,
+	}
 }
 
 func readResponseBody(resp *http.Response) ([]byte, error) {
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
@@ -42,6 +44,36 @@ func getEmulatorClient(c *chk.C) Client {
 	return cli
 }
 
+// redirectTransport sends every request to a test server while keeping the
+// original Host, so the account style URLs built by getEndpoint still reach
+// an httptest.Server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := *req
+	u := *req.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	redirected.URL = &u
+	redirected.Host = req.URL.Host
+	return http.DefaultTransport.RoundTrip(&redirected)
+}
+
+// getTestServerClient returns a client for a fake account whose requests are
+// all served by handler. Callers must close the returned server.
+func getTestServerClient(c *chk.C, handler http.Handler) (Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	target, err := url.Parse(srv.URL)
+	c.Assert(err, chk.IsNil)
+
+	cli, err := NewBasicClient("foo", "YmFy")
+	c.Assert(err, chk.IsNil)
+	cli.HTTPClient = &http.Client{Transport: redirectTransport{target: target}}
+	return cli, srv
+}
+
 func (s *StorageClientSuite) TestNewEmulatorClient(c *chk.C) {
 	cli, err := NewBasicClient(StorageEmulatorAccountName, "")
 	c.Assert(err, chk.IsNil)
@@ -242,3 +274,92 @@ func (s *StorageClientSuite) Test_protectUserAgent(c *chk.C) {
 		"3": "three",
 	})
 }
+
+// stallingHandler holds every request until release is closed.
+type stallingHandler struct {
+	release chan struct{}
+}
+
+func (h stallingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-h.release:
+	case <-time.After(5 * time.Second):
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *StorageClientSuite) TestWithContextDeadline(c *chk.C) {
+	h := stallingHandler{release: make(chan struct{})}
+	cli, srv := getTestServerClient(c, h)
+	defer srv.Close()
+	defer close(h.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	blob := cli.GetBlobService()
+	_, err := blob.WithContext(ctx).GetBlobProperties("container", "blob")
+	c.Assert(err, chk.NotNil)
+	c.Assert(time.Since(start) < 2*time.Second, chk.Equals, true)
+	c.Assert(blob.client.ctx, chk.IsNil)
+
+	start = time.Now()
+	table := cli.GetTableService()
+	_, err = table.WithContext(ctx).QueryTables()
+	c.Assert(err, chk.NotNil)
+	c.Assert(time.Since(start) < 2*time.Second, chk.Equals, true)
+	c.Assert(table.client.ctx, chk.IsNil)
+
+	start = time.Now()
+	err = table.WithContext(ctx).InsertEntity("table", &CustomEntity{PKey: "p", RKey: "r"})
+	c.Assert(err, chk.NotNil)
+	c.Assert(time.Since(start) < 2*time.Second, chk.Equals, true)
+}
+
+func (s *StorageClientSuite) TestWithContextCancel(c *chk.C) {
+	h := stallingHandler{release: make(chan struct{})}
+	cli, srv := getTestServerClient(c, h)
+	defer srv.Close()
+	defer close(h.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := cli.GetQueueService().WithContext(ctx).CreateQueue("queue")
+	c.Assert(err, chk.NotNil)
+	c.Assert(ctx.Err(), chk.Equals, context.Canceled)
+	c.Assert(time.Since(start) < 2*time.Second, chk.Equals, true)
+}
+
+func (s *StorageClientSuite) TestAccountSASClient(c *chk.C) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	c.Assert(err, chk.IsNil)
+
+	cli, err := NewAccountSASClient("foo", "?sv=2015-04-05&ss=q&srt=c&sp=r&se=2017-01-02T00%3A00%3A00Z&sig=c2ln")
+	c.Assert(err, chk.IsNil)
+	cli.HTTPClient = &http.Client{Transport: redirectTransport{target: target}}
+
+	ok, err := cli.GetQueueService().QueueExists("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+	c.Assert(got.Host, chk.Equals, "foo.queue.core.windows.net")
+	c.Assert(got.Header.Get(headerAuthorization), chk.Equals, "")
+	q := got.URL.Query()
+	c.Assert(q.Get("comp"), chk.Equals, "metadata")
+	c.Assert(q.Get("sig"), chk.Equals, "c2ln")
+	c.Assert(q.Get("se"), chk.Equals, "2017-01-02T00:00:00Z")
+
+	_, err = NewAccountSASClient("foo", "sv=2015-04-05")
+	c.Assert(err, chk.NotNil)
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Environment variables read by NewClientFromEnvironment, as used by the
+// Azure CLI.
+const (
+	ConnectionStringEnvVar = "AZURE_STORAGE_CONNECTION_STRING"
+	AccountNameEnvVar      = "AZURE_STORAGE_ACCOUNT"
+	AccountKeyEnvVar       = "AZURE_STORAGE_ACCESS_KEY"
+	SASTokenEnvVar         = "AZURE_STORAGE_SAS_TOKEN"
+)
+
+// Keys of a storage connection string.
+const (
+	connDefaultEndpointsProtocol   = "defaultendpointsprotocol"
+	connAccountName                = "accountname"
+	connAccountKey                 = "accountkey"
+	connSharedAccessSignature      = "sharedaccesssignature"
+	connEndpointSuffix             = "endpointsuffix"
+	connBlobEndpoint               = "blobendpoint"
+	connQueueEndpoint              = "queueendpoint"
+	connTableEndpoint              = "tableendpoint"
+	connFileEndpoint               = "fileendpoint"
+	connUseDevelopmentStorage      = "usedevelopmentstorage"
+	connDevelopmentStorageProxyURI = "developmentstorageproxyuri"
+)
+
+// connEndpoints maps the explicit endpoint keys to their service.
+var connEndpoints = map[string]string{
+	connBlobEndpoint:  blobServiceName,
+	connQueueEndpoint: queueServiceName,
+	connTableEndpoint: tableServiceName,
+	connFileEndpoint:  fileServiceName,
+}
+
+// NewClientFromConnectionString constructs a Client from a storage
+// connection string, such as the ones shown by the Azure portal:
+//
+//	DefaultEndpointsProtocol=https;AccountName=name;AccountKey=key;EndpointSuffix=core.chinacloudapi.cn
+//
+// Requests are authenticated with AccountKey or, when the string carries a
+// SharedAccessSignature instead, with that token. The endpoints of the
+// services are built from AccountName, DefaultEndpointsProtocol (https by
+// default) and EndpointSuffix (DefaultBaseURL by default), unless they are
+// given by BlobEndpoint, QueueEndpoint, TableEndpoint or FileEndpoint. A
+// string holding only explicit endpoints and a SharedAccessSignature takes
+// the account name from the first label of an endpoint host.
+// UseDevelopmentStorage=true returns the client of NewEmulatorClient.
+//
+// See https://docs.microsoft.com/azure/storage/common/storage-configure-connection-string
+func NewClientFromConnectionString(connectionString string) (Client, error) {
+	var c Client
+	settings, err := parseConnectionString(connectionString)
+	if err != nil {
+		return c, err
+	}
+
+	if v, ok := settings[connUseDevelopmentStorage]; ok {
+		if !strings.EqualFold(v, "true") {
+			return c, fmt.Errorf("azure: invalid UseDevelopmentStorage value %q", v)
+		}
+		if _, ok := settings[connDevelopmentStorageProxyURI]; ok {
+			return c, fmt.Errorf("azure: DevelopmentStorageProxyUri is not supported")
+		}
+		if len(settings) > 1 {
+			return c, fmt.Errorf("azure: UseDevelopmentStorage cannot be combined with other settings")
+		}
+		return NewEmulatorClient()
+	}
+	if _, ok := settings[connDevelopmentStorageProxyURI]; ok {
+		return c, fmt.Errorf("azure: DevelopmentStorageProxyUri requires UseDevelopmentStorage=true")
+	}
+
+	useHTTPS := defaultUseHTTPS
+	if v, ok := settings[connDefaultEndpointsProtocol]; ok {
+		switch strings.ToLower(v) {
+		case "https":
+		case "http":
+			useHTTPS = false
+		default:
+			return c, fmt.Errorf("azure: invalid DefaultEndpointsProtocol %q, expecting http or https", v)
+		}
+	}
+	suffix := DefaultBaseURL
+	if v, ok := settings[connEndpointSuffix]; ok {
+		if v = strings.Trim(v, "."); v == "" || strings.ContainsAny(v, "/:") {
+			return c, fmt.Errorf("azure: invalid EndpointSuffix %q", settings[connEndpointSuffix])
+		}
+		suffix = v
+	}
+
+	endpoints := make(map[string]*url.URL)
+	var firstEndpoint *url.URL
+	for _, key := range []string{connBlobEndpoint, connQueueEndpoint, connTableEndpoint, connFileEndpoint} {
+		v, ok := settings[key]
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return c, fmt.Errorf("azure: invalid %s endpoint %q, expecting an http or https URL", connEndpoints[key], v)
+		}
+		endpoints[connEndpoints[key]] = u
+		if firstEndpoint == nil {
+			firstEndpoint = u
+		}
+	}
+
+	accountName := settings[connAccountName]
+	if accountName == "" && firstEndpoint != nil {
+		accountName = strings.SplitN(firstEndpoint.Host, ".", 2)[0]
+	}
+	if accountName == "" {
+		return c, fmt.Errorf("azure: connection string has neither AccountName nor service endpoints")
+	}
+
+	key, hasKey := settings[connAccountKey]
+	sas, hasSAS := settings[connSharedAccessSignature]
+	switch {
+	case hasKey && hasSAS:
+		return c, fmt.Errorf("azure: connection string cannot have both AccountKey and SharedAccessSignature")
+	case hasKey:
+		c, err = NewClient(accountName, key, suffix, DefaultAPIVersion, useHTTPS)
+	case hasSAS:
+		if c, err = NewAccountSASClient(accountName, sas); err == nil {
+			c.baseURL = suffix
+			c.useHTTPS = useHTTPS
+		}
+	default:
+		return c, fmt.Errorf("azure: connection string has neither AccountKey nor SharedAccessSignature")
+	}
+	if err != nil {
+		return c, err
+	}
+	if len(endpoints) > 0 {
+		c.endpoints = endpoints
+	}
+	return c, nil
+}
+
+// parseConnectionString splits a connection string into its settings,
+// keyed by lower case name.
+func parseConnectionString(connectionString string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, segment := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(segment) == "" {
+			continue
+		}
+		// Values such as account keys and signatures may contain '='.
+		kv := strings.SplitN(segment, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("azure: malformed connection string segment %q, expecting key=value", segment)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch key {
+		case connDefaultEndpointsProtocol, connAccountName, connAccountKey, connSharedAccessSignature,
+			connEndpointSuffix, connUseDevelopmentStorage, connDevelopmentStorageProxyURI:
+		default:
+			if _, ok := connEndpoints[key]; !ok {
+				return nil, fmt.Errorf("azure: unknown connection string setting %q", strings.TrimSpace(kv[0]))
+			}
+		}
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("azure: connection string setting %q is repeated", strings.TrimSpace(kv[0]))
+		}
+		if value == "" {
+			return nil, fmt.Errorf("azure: connection string setting %q is empty", strings.TrimSpace(kv[0]))
+		}
+		settings[key] = value
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("azure: empty connection string")
+	}
+	return settings, nil
+}
+
+// NewClientFromEnvironment constructs a Client from the environment
+// variables the Azure CLI reads: the connection string in
+// AZURE_STORAGE_CONNECTION_STRING if set, otherwise the account name in
+// AZURE_STORAGE_ACCOUNT along with either the key in
+// AZURE_STORAGE_ACCESS_KEY or the SAS token in AZURE_STORAGE_SAS_TOKEN.
+func NewClientFromEnvironment() (Client, error) {
+	if cs := os.Getenv(ConnectionStringEnvVar); cs != "" {
+		return NewClientFromConnectionString(cs)
+	}
+	name := os.Getenv(AccountNameEnvVar)
+	if name == "" {
+		return Client{}, fmt.Errorf("azure: neither %s nor %s is set", ConnectionStringEnvVar, AccountNameEnvVar)
+	}
+	if key := os.Getenv(AccountKeyEnvVar); key != "" {
+		return NewBasicClient(name, key)
+	}
+	if sas := os.Getenv(SASTokenEnvVar); sas != "" {
+		return NewAccountSASClient(name, sas)
+	}
+	return Client{}, fmt.Errorf("azure: neither %s nor %s is set", AccountKeyEnvVar, SASTokenEnvVar)
+}
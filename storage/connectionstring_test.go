@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"os"
+
+	chk "gopkg.in/check.v1"
+)
+
+type ConnectionStringSuite struct{}
+
+var _ = chk.Suite(&ConnectionStringSuite{})
+
+const testSAS = "sv=2015-04-05&ss=b&srt=sco&sp=rl&se=2017-05-01T00:00:00Z&sig=c2lnbmF0dXJl"
+
+func (s *ConnectionStringSuite) TestAccountKey(c *chk.C) {
+	cli, err := NewClientFromConnectionString("DefaultEndpointsProtocol=http;AccountName=foo;AccountKey=YmFy;")
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.accountName, chk.Equals, "foo")
+	c.Assert(cli.accountKey, chk.DeepEquals, []byte("bar"))
+	c.Assert(cli.getEndpoint(blobServiceName, "cnt/blob", nil), chk.Equals, "http://foo.blob.core.windows.net/cnt/blob")
+
+	cli, err = NewClientFromConnectionString("accountname=foo; accountkey=YmFy; endpointsuffix=core.chinacloudapi.cn")
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.getEndpoint(queueServiceName, "q", nil), chk.Equals, "https://foo.queue.core.chinacloudapi.cn/q")
+}
+
+func (s *ConnectionStringSuite) TestExplicitEndpoints(c *chk.C) {
+	cli, err := NewClientFromConnectionString("AccountName=foo;AccountKey=YmFy;BlobEndpoint=https://cdn.example.com/;TableEndpoint=http://127.0.0.1:10002/foo")
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.getEndpoint(blobServiceName, "cnt/blob", nil), chk.Equals, "https://cdn.example.com/cnt/blob")
+	c.Assert(cli.getEndpoint(tableServiceName, "Tables", nil), chk.Equals, "http://127.0.0.1:10002/foo/Tables")
+	c.Assert(cli.getEndpoint(queueServiceName, "q", nil), chk.Equals, "https://foo.queue.core.windows.net/q")
+
+	// Requests to path-style endpoints sign the whole path.
+	cr, err := cli.buildCanonicalizedResource(cli.getEndpoint(tableServiceName, "Tables", nil), sharedKeyForTable)
+	c.Assert(err, chk.IsNil)
+	c.Assert(cr, chk.Equals, "/foo/foo/Tables")
+}
+
+func (s *ConnectionStringSuite) TestSAS(c *chk.C) {
+	cli, err := NewClientFromConnectionString("BlobEndpoint=https://foo.blob.core.windows.net;SharedAccessSignature=" + testSAS)
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.accountName, chk.Equals, "foo")
+	c.Assert(cli.accountKey, chk.HasLen, 0)
+	c.Assert(cli.sasToken.Get("sig"), chk.Equals, "c2lnbmF0dXJl")
+	c.Assert(cli.getEndpoint(blobServiceName, "cnt", nil), chk.Equals, "https://foo.blob.core.windows.net/cnt")
+
+	cli, err = NewClientFromConnectionString("DefaultEndpointsProtocol=http;AccountName=bar;SharedAccessSignature=?" + testSAS)
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.getEndpoint(fileServiceName, "share", nil), chk.Equals, "http://bar.file.core.windows.net/share")
+}
+
+func (s *ConnectionStringSuite) TestDevelopmentStorage(c *chk.C) {
+	cli, err := NewClientFromConnectionString("UseDevelopmentStorage=true")
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.accountName, chk.Equals, StorageEmulatorAccountName)
+	c.Assert(cli.getEndpoint(blobServiceName, "cnt", nil), chk.Equals, "http://127.0.0.1:10000/devstoreaccount1/cnt")
+}
+
+func (s *ConnectionStringSuite) TestMalformed(c *chk.C) {
+	for _, t := range []struct{ cs, err string }{
+		{"", "azure: empty connection string"},
+		{";;", "azure: empty connection string"},
+		{"AccountName", "azure: malformed connection string segment .*"},
+		{"=foo", "azure: malformed connection string segment .*"},
+		{"AccountName=foo;Accountname=bar", "azure: connection string setting \"Accountname\" is repeated"},
+		{"AccountName=foo;Color=blue", "azure: unknown connection string setting \"Color\""},
+		{"AccountName=;AccountKey=YmFy", "azure: connection string setting \"AccountName\" is empty"},
+		{"AccountName=foo", "azure: connection string has neither AccountKey nor SharedAccessSignature"},
+		{"AccountKey=YmFy", "azure: connection string has neither AccountName nor service endpoints"},
+		{"AccountName=foo;AccountKey=YmFy;SharedAccessSignature=" + testSAS, "azure: connection string cannot have both .*"},
+		{"AccountName=foo;AccountKey=not base64", "azure: malformed storage account key: .*"},
+		{"AccountName=foo;SharedAccessSignature=sv=2015-04-05", "azure: SAS token without signature"},
+		{"DefaultEndpointsProtocol=ftp;AccountName=foo;AccountKey=YmFy", "azure: invalid DefaultEndpointsProtocol .*"},
+		{"AccountName=foo;AccountKey=YmFy;EndpointSuffix=https://core.windows.net", "azure: invalid EndpointSuffix .*"},
+		{"AccountName=foo;AccountKey=YmFy;BlobEndpoint=foo.blob.core.windows.net", "azure: invalid blob endpoint .*"},
+		{"UseDevelopmentStorage=yes", "azure: invalid UseDevelopmentStorage value .*"},
+		{"UseDevelopmentStorage=true;AccountName=foo", "azure: UseDevelopmentStorage cannot be combined .*"},
+		{"UseDevelopmentStorage=true;DevelopmentStorageProxyUri=http://proxy", "azure: DevelopmentStorageProxyUri is not supported"},
+	} {
+		_, err := NewClientFromConnectionString(t.cs)
+		c.Assert(err, chk.ErrorMatches, t.err, chk.Commentf("%q", t.cs))
+	}
+}
+
+func (s *ConnectionStringSuite) TestEnvironment(c *chk.C) {
+	vars := []string{ConnectionStringEnvVar, AccountNameEnvVar, AccountKeyEnvVar, SASTokenEnvVar}
+	saved := make(map[string]string)
+	for _, v := range vars {
+		saved[v] = os.Getenv(v)
+		os.Unsetenv(v)
+	}
+	defer func() {
+		for _, v := range vars {
+			os.Setenv(v, saved[v])
+		}
+	}()
+
+	_, err := NewClientFromEnvironment()
+	c.Assert(err, chk.ErrorMatches, "azure: neither AZURE_STORAGE_CONNECTION_STRING nor AZURE_STORAGE_ACCOUNT is set")
+
+	os.Setenv(AccountNameEnvVar, "foo")
+	_, err = NewClientFromEnvironment()
+	c.Assert(err, chk.ErrorMatches, "azure: neither AZURE_STORAGE_ACCESS_KEY nor AZURE_STORAGE_SAS_TOKEN is set")
+
+	os.Setenv(SASTokenEnvVar, testSAS)
+	cli, err := NewClientFromEnvironment()
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.sasToken.Get("sig"), chk.Equals, "c2lnbmF0dXJl")
+
+	os.Setenv(AccountKeyEnvVar, "YmFy")
+	cli, err = NewClientFromEnvironment()
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.accountKey, chk.DeepEquals, []byte("bar"))
+
+	os.Setenv(ConnectionStringEnvVar, "AccountName=baz;AccountKey=YmFy")
+	cli, err = NewClientFromEnvironment()
+	c.Assert(err, chk.IsNil)
+	c.Assert(cli.accountName, chk.Equals, "baz")
+}
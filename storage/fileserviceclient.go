@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"net/http"
@@ -14,6 +15,17 @@ type FileServiceClient struct {
 	auth   authentication
 }
 
+// WithContext returns a copy of f whose requests are bound to ctx. Calls
+// made through the copy are abandoned as soon as ctx is cancelled or its
+// deadline expires. The provided ctx must be non-nil.
+func (f FileServiceClient) WithContext(ctx context.Context) FileServiceClient {
+	if ctx == nil {
+		panic("nil context")
+	}
+	f.client.ctx = ctx
+	return f
+}
+
 // ListSharesParameters defines the set of customizable parameters to make a
 // List Shares call.
 //
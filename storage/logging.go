@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+// Log levels, from the most to the least verbose.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger receives the log entries of a Client. fields holds structured
+// context for the entry, such as the "requestId" of the service request it
+// relates to. Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// stdLogger is a Logger writing to a *log.Logger, or to the standard logger
+// of the log package if nil.
+type stdLogger struct {
+	logger *log.Logger
+	min    LogLevel
+}
+
+// NewStdLogger returns a Logger writing entries of at least the given level
+// to logger, one line per entry, with fields in key=value form sorted by
+// key.
+func NewStdLogger(logger *log.Logger, min LogLevel) Logger {
+	return stdLogger{logger: logger, min: min}
+}
+
+func (l stdLogger) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	if level < l.min {
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{"level=" + level.String(), fmt.Sprintf("msg=%q", msg)}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	if l.logger == nil {
+		log.Print(strings.Join(parts, " "))
+		return
+	}
+	l.logger.Print(strings.Join(parts, " "))
+}
+
+// traceLogger receives the entries of LogTrace.
+var traceLogger Logger = stdLogger{min: LogDebug}
+
+// logRequest logs the outcome of a request sent by c: failed requests as
+// errors, error responses as warnings and everything else for debugging.
+func (c Client) logRequest(req *http.Request, resp *http.Response, err error, duration time.Duration) {
+	if c.Logger == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"method":    req.Method,
+		"url":       redactURL(req.URL),
+		"duration":  duration,
+		"requestId": requestIDFromError(err),
+	}
+	level, msg := LogDebug, "request completed"
+	if resp != nil {
+		fields["status"] = resp.StatusCode
+		fields["requestId"] = resp.Header.Get("x-ms-request-id")
+		if err != nil {
+			level, msg = LogWarning, "request returned an error"
+		}
+	} else {
+		level, msg = LogError, "request failed"
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	c.log(level, msg, fields)
+}
+
+// sasQueryParameters are the query parameters of shared access
+// signatures.
+var sasQueryParameters = []string{
+	"sv", "ss", "srt", "sr", "sp", "st", "se", "sip", "spr", "si", "sig",
+	"tn", "spk", "srk", "epk", "erk", "rscc", "rscd", "rsce", "rscl", "rsct",
+}
+
+// redactURL returns u as a string, with the values of the SAS query
+// parameters it holds replaced so that logs never carry a usable signature.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for _, k := range sasQueryParameters {
+		if _, ok := q[k]; ok {
+			q.Set(k, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	scrubbed := *u
+	scrubbed.RawQuery = q.Encode()
+	return scrubbed.String()
+}
+
+// requestIDFromError returns the ID of the request that failed with err, if
+// the service returned one.
+func requestIDFromError(err error) string {
+	if serr, ok := err.(AzureStorageServiceError); ok {
+		return serr.RequestID
+	}
+	return ""
+}
+
+// log sends an entry to the Logger of c, if any.
+func (c Client) log(level LogLevel, msg string, fields map[string]interface{}) {
+	if c.Logger != nil {
+		c.Logger.Log(level, msg, fields)
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	chk "gopkg.in/check.v1"
+)
+
+type LoggingSuite struct{}
+
+var _ = chk.Suite(&LoggingSuite{})
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger keeps every entry it receives.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+func (s *LoggingSuite) TestStdLogger(c *chk.C) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LogInfo)
+
+	logger.Log(LogDebug, "hidden", nil)
+	logger.Log(LogWarning, "request returned an error", map[string]interface{}{"status": 404, "requestId": "req-1"})
+	c.Assert(buf.String(), chk.Equals, `level=warning msg="request returned an error" requestId=req-1 status=404`+"\n")
+}
+
+func (s *LoggingSuite) TestRequestsAreLogged(c *chk.C) {
+	cli, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "req-"+r.Method)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	logger := &recordingLogger{}
+	cli.Logger = logger
+
+	queues := cli.GetQueueService()
+	c.Assert(queues.CreateQueue("queue"), chk.IsNil)
+	c.Assert(queues.DeleteQueue("queue"), chk.NotNil)
+
+	c.Assert(logger.entries, chk.HasLen, 2)
+	c.Assert(logger.entries[0].level, chk.Equals, LogDebug)
+	c.Assert(logger.entries[0].fields["requestId"], chk.Equals, "req-PUT")
+	c.Assert(logger.entries[0].fields["status"], chk.Equals, http.StatusCreated)
+	c.Assert(logger.entries[1].level, chk.Equals, LogWarning)
+	c.Assert(logger.entries[1].fields["requestId"], chk.Equals, "req-DELETE")
+	c.Assert(logger.entries[1].fields["error"], chk.NotNil)
+}
+
+func (s *LoggingSuite) TestRetriesAreLogged(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 1, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	logger := &recordingLogger{}
+	cli.Logger = logger
+	cli.RetryPolicy = testRetryPolicy
+
+	c.Assert(cli.GetQueueService().CreateQueue("queue"), chk.IsNil)
+
+	var msgs []string
+	for _, e := range logger.entries {
+		msgs = append(msgs, e.msg)
+	}
+	c.Assert(msgs, chk.DeepEquals, []string{"request returned an error", "retrying request", "request completed"})
+	c.Assert(logger.entries[1].level, chk.Equals, LogInfo)
+	c.Assert(logger.entries[1].fields["attempt"], chk.Equals, 1)
+}
+
+func (s *LoggingSuite) TestSASIsRedacted(c *chk.C) {
+	basic, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	cli, err := NewAccountSASClient("foo", "?sv=2015-04-05&ss=q&srt=c&sp=c&se=2017-01-02T00%3A00%3A00Z&sig=c2VjcmV0")
+	c.Assert(err, chk.IsNil)
+	cli.HTTPClient = basic.HTTPClient
+	logger := &recordingLogger{}
+	cli.Logger = logger
+	var buf bytes.Buffer
+	cli.Middleware = []Middleware{LoggingMiddleware(log.New(&buf, "", 0))}
+
+	c.Assert(cli.GetQueueService().CreateQueue("queue"), chk.IsNil)
+	c.Assert(logger.entries, chk.HasLen, 1)
+	logged := fmt.Sprint(logger.entries[0].fields["url"]) + buf.String()
+	c.Assert(strings.Contains(logged, "c2VjcmV0"), chk.Equals, false)
+	c.Assert(strings.Contains(logged, "sig=REDACTED"), chk.Equals, true)
+}
+
+func (s *LoggingSuite) TestLogTrace(c *chk.C) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	LogTrace("hello", "world")
+	c.Assert(buf.String(), chk.Matches, `.*level=debug msg="hello world" caller=.*logging_test.go:\d+ .*TestLogTrace\n`)
+}
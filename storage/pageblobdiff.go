@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// pageRangesDiffAPIVersion is the first service version that understands the
+// prevsnapshot parameter of Get Page Ranges.
+const pageRangesDiffAPIVersion = "2015-07-08"
+
+// GetPageRangesDiffResponse contains the response fields from a Get Page
+// Ranges call made with a previous snapshot.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/ee691973.aspx
+type GetPageRangesDiffResponse struct {
+	XMLName xml.Name `xml:"PageList"`
+
+	// PageList are the ranges written since the previous snapshot.
+	PageList []PageRange `xml:"PageRange"`
+
+	// ClearList are the ranges cleared since the previous snapshot.
+	ClearList []PageRange `xml:"ClearRange"`
+}
+
+// GetPageRangesDiff returns the page ranges of a page blob that were updated
+// or cleared between prevSnapshot and snapshot. An empty snapshot compares
+// the current content of the blob against prevSnapshot.
+//
+// The prevsnapshot parameter requires service version 2015-07-08, which is
+// used for this call if the client is configured with an older one.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/ee691973.aspx
+func (b BlobStorageClient) GetPageRangesDiff(container, name, snapshot, prevSnapshot string) (GetPageRangesDiffResponse, error) {
+	var out GetPageRangesDiffResponse
+	if prevSnapshot == "" {
+		return out, fmt.Errorf("storage: a previous snapshot is required to diff page ranges")
+	}
+
+	params := url.Values{
+		"comp":         {"pagelist"},
+		"prevsnapshot": {prevSnapshot},
+	}
+	if snapshot != "" {
+		params.Set("snapshot", snapshot)
+	}
+	uri := b.client.getEndpoint(blobServiceName, pathForBlob(container, name), params)
+	headers := b.client.getStandardHeaders()
+	if headers["x-ms-version"] < pageRangesDiffAPIVersion {
+		headers["x-ms-version"] = pageRangesDiffAPIVersion
+	}
+
+	resp, err := b.client.exec(http.MethodGet, uri, headers, nil, b.auth)
+	if err != nil {
+		return out, err
+	}
+	defer resp.body.Close()
+
+	if err = checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
+		return out, err
+	}
+	err = xmlUnmarshal(resp.body, &out)
+	return out, err
+}
+
+// ApplyPageRangesDiff brings w, a local copy of the page blob as it was at
+// the previous snapshot of diff, up to date with snapshot. Updated ranges are
+// fetched from snapshot the same way DownloadToWriterAt fetches them and
+// cleared ranges are overwritten with zeros.
+func (b BlobStorageClient) ApplyPageRangesDiff(container, name, snapshot string, diff GetPageRangesDiffResponse, w io.WriterAt, options DownloadOptions) error {
+	options, err := options.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, options.RangeSize)
+	for _, p := range diff.ClearList {
+		for _, r := range splitRange(byteRange{start: p.Start, end: p.End}, options.RangeSize) {
+			if _, err := w.WriteAt(zeros[:r.length()], r.start); err != nil {
+				return err
+			}
+		}
+	}
+	return b.downloadDiff(container, name, snapshot, diff, w, options)
+}
+
+// ApplyPageRangesDiffToBlob brings the page blob dstName, a copy of the page
+// blob as it was at the previous snapshot of diff, up to date with snapshot.
+// Updated ranges are read from snapshot and written with Put Page, cleared
+// ranges are cleared, so only the pages that changed are transferred. The
+// destination must have the same size as snapshot.
+//
+// options.RangeSize must be a multiple of 512 bytes and may not exceed
+// MaxBlobPageSize, the maximum size of a single Put Page call.
+func (b BlobStorageClient) ApplyPageRangesDiffToBlob(container, name, snapshot string, diff GetPageRangesDiffResponse, dstContainer, dstName string, options DownloadOptions) error {
+	options, err := options.withDefaults()
+	if err != nil {
+		return err
+	}
+	if options.RangeSize%pageSize != 0 || options.RangeSize > MaxBlobPageSize {
+		return fmt.Errorf("storage: page blob write size must be a multiple of %d bytes up to %d bytes, got %d", pageSize, MaxBlobPageSize, options.RangeSize)
+	}
+
+	for _, p := range diff.ClearList {
+		if err := b.PutPage(dstContainer, dstName, p.Start, p.End, PageWriteTypeClear, nil, nil); err != nil {
+			return err
+		}
+	}
+	return b.downloadDiff(container, name, snapshot, diff, pageBlobWriterAt{b: b, container: dstContainer, name: dstName}, options)
+}
+
+// downloadDiff copies the updated ranges of diff from snapshot into w.
+func (b BlobStorageClient) downloadDiff(container, name, snapshot string, diff GetPageRangesDiffResponse, w io.WriterAt, options DownloadOptions) error {
+	source, err := snapshotRef(container, name, snapshot)
+	if err != nil {
+		return err
+	}
+	props, err := b.GetBlobPropertiesByRef(source)
+	if err != nil {
+		return err
+	}
+
+	var ranges []byteRange
+	for _, p := range diff.PageList {
+		ranges = append(ranges, splitRange(byteRange{start: p.Start, end: p.End}, options.RangeSize)...)
+	}
+	return b.downloadRanges(source, props.Etag, ranges, nil, w, options, nil)
+}
+
+// pageBlobWriterAt writes to a page blob with Put Page. Every write must be
+// aligned to pages.
+type pageBlobWriterAt struct {
+	b         BlobStorageClient
+	container string
+	name      string
+}
+
+func (w pageBlobWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	sum := md5.Sum(p)
+	err := w.b.PutPage(w.container, w.name, off, off+int64(len(p))-1, PageWriteTypeUpdate, p, map[string]string{
+		headerContentMD5: base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
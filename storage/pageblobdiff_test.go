@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	chk "gopkg.in/check.v1"
+)
+
+type PageBlobDiffSuite struct{}
+
+var _ = chk.Suite(&PageBlobDiffSuite{})
+
+const (
+	testSnapshot     = "2017-03-01T10:00:00.0000000Z"
+	testPrevSnapshot = "2017-02-28T10:00:00.0000000Z"
+)
+
+// fakeSnapshotServer serves a single snapshot of a page blob and the diff
+// between it and its previous snapshot.
+type fakeSnapshotServer struct {
+	mu   sync.Mutex
+	data []byte
+	diff string
+	gets []string
+}
+
+func (f *fakeSnapshotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	if q.Get("snapshot") != testSnapshot {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Etag", `"0x8D0003"`)
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+		w.Header().Set("x-ms-blob-type", string(BlobTypePage))
+		w.WriteHeader(http.StatusOK)
+	case q.Get("comp") == "pagelist":
+		if q.Get("prevsnapshot") != testPrevSnapshot || r.Header.Get("x-ms-version") < pageRangesDiffAPIVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, f.diff)
+	default:
+		rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+		f.gets = append(f.gets, rng)
+		var start, end int
+		fmt.Sscanf(rng, "%d-%d", &start, &end)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(f.data[start : end+1])
+	}
+}
+
+const testPageRangesDiff = `<?xml version="1.0" encoding="utf-8"?>
+<PageList>
+  <PageRange><Start>0</Start><End>511</End></PageRange>
+  <ClearRange><Start>1024</Start><End>2047</End></ClearRange>
+  <PageRange><Start>3072</Start><End>4095</End></PageRange>
+</PageList>`
+
+func (s *PageBlobDiffSuite) TestGetPageRangesDiff(c *chk.C) {
+	cli, srv := getTestServerClient(c, &fakeSnapshotServer{diff: testPageRangesDiff})
+	defer srv.Close()
+
+	diff, err := cli.GetBlobService().GetPageRangesDiff("container", "disk.vhd", testSnapshot, testPrevSnapshot)
+	c.Assert(err, chk.IsNil)
+	c.Assert(diff.PageList, chk.DeepEquals, []PageRange{{0, 511}, {3072, 4095}})
+	c.Assert(diff.ClearList, chk.DeepEquals, []PageRange{{1024, 2047}})
+}
+
+func (s *PageBlobDiffSuite) TestGetPageRangesDiffRequiresPrevSnapshot(c *chk.C) {
+	_, err := BlobStorageClient{}.GetPageRangesDiff("container", "disk.vhd", testSnapshot, "")
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *PageBlobDiffSuite) TestApplyPageRangesDiff(c *chk.C) {
+	previous := sparseImage(8, 0, 2, 3, 6)
+	current := make([]byte, len(previous))
+	copy(current, previous)
+	copy(current[0:512], randBytes(512))
+	copy(current[1024:2048], make([]byte, 1024))
+	copy(current[3072:4096], randBytes(1024))
+
+	fake := &fakeSnapshotServer{data: current, diff: testPageRangesDiff}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "diff")
+	c.Assert(err, chk.IsNil)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(previous)
+	c.Assert(err, chk.IsNil)
+
+	b := cli.GetBlobService()
+	diff, err := b.GetPageRangesDiff("container", "disk.vhd", testSnapshot, testPrevSnapshot)
+	c.Assert(err, chk.IsNil)
+
+	c.Assert(b.ApplyPageRangesDiff("container", "disk.vhd", testSnapshot, diff, f, DownloadOptions{RangeSize: 512}), chk.IsNil)
+	c.Assert(fake.gets, chk.HasLen, 3)
+
+	got, err := ioutil.ReadFile(f.Name())
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, current)
+}
+
+func (s *PageBlobDiffSuite) TestApplyPageRangesDiffToBlob(c *chk.C) {
+	previous := sparseImage(8, 0, 2, 3, 6)
+	current := make([]byte, len(previous))
+	copy(current, previous)
+	copy(current[0:512], randBytes(512))
+	copy(current[1024:2048], make([]byte, 1024))
+	copy(current[3072:4096], randBytes(1024))
+
+	dst := newFakePageBlobServer()
+	dst.data = append([]byte(nil), previous...)
+	mux := http.NewServeMux()
+	mux.Handle("/container/disk.vhd", &fakeSnapshotServer{data: current, diff: testPageRangesDiff})
+	mux.Handle("/container/copy.vhd", dst)
+	cli, srv := getTestServerClient(c, mux)
+	defer srv.Close()
+
+	b := cli.GetBlobService()
+	diff, err := b.GetPageRangesDiff("container", "disk.vhd", testSnapshot, testPrevSnapshot)
+	c.Assert(err, chk.IsNil)
+	c.Assert(b.ApplyPageRangesDiffToBlob("container", "disk.vhd", testSnapshot, diff, "container", "copy.vhd", DownloadOptions{}), chk.IsNil)
+	sort.Strings(dst.puts[1:])
+	c.Assert(dst.puts, chk.DeepEquals, []string{"1024-2047", "0-511", "3072-4095"})
+	c.Assert(dst.data, chk.DeepEquals, current)
+}
+
+func (s *PageBlobDiffSuite) TestApplyPageRangesDiffToBlobRejectsUnalignedRanges(c *chk.C) {
+	err := BlobStorageClient{}.ApplyPageRangesDiffToBlob("container", "disk.vhd", testSnapshot, GetPageRangesDiffResponse{}, "container", "copy.vhd", DownloadOptions{RangeSize: 1000})
+	c.Assert(err, chk.ErrorMatches, "storage: page blob write size must be a multiple of 512 bytes .*")
+}
+
+func (s *PageBlobDiffSuite) TestApplyPageRangesDiffToBlobRejectsLargeRanges(c *chk.C) {
+	err := BlobStorageClient{}.ApplyPageRangesDiffToBlob("container", "disk.vhd", testSnapshot, GetPageRangesDiffResponse{}, "container", "copy.vhd", DownloadOptions{RangeSize: MaxBlobPageSize + pageSize})
+	c.Assert(err, chk.ErrorMatches, "storage: page blob write size must be a multiple of 512 bytes up to 4194304 bytes, got 4194816")
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// pageSize is the alignment required for every page blob write.
+const pageSize = 512
+
+type putPageJob struct {
+	start int64
+	chunk []byte
+	md5   string
+}
+
+// isZeroPage reports whether every byte of page is zero.
+func isZeroPage(page []byte) bool {
+	for _, b := range page {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadPageBlob creates the specified page blob with the given size and
+// writes the content of r into it. Pages that only contain zeros are not
+// sent, so a sparse disk image costs only as many requests and as much
+// bandwidth as the data it actually holds. Consecutive non-zero pages are
+// batched into Put Page calls of up to options.BlockSize bytes, which are
+// issued concurrently and retried individually. options.BlockSize defaults
+// to MaxBlobPageSize and must be a multiple of 512 bytes no larger than it.
+//
+// If size is not a multiple of 512 bytes the blob is rounded up to the next
+// page and padded with zeros. The MD5 of the whole blob, including the
+// zero pages, is stored as its Content-MD5 once every page is written.
+//
+// See https://msdn.microsoft.com/en-us/library/ee691975.aspx
+func (b BlobStorageClient) UploadPageBlob(container, name string, r io.ReaderAt, size int64, options UploadOptions) (UploadResult, error) {
+	var result UploadResult
+	if options.BlockSize == 0 {
+		options.BlockSize = MaxBlobPageSize
+	}
+	options, err := options.withDefaults()
+	if err != nil {
+		return result, err
+	}
+	if options.BlockSize%pageSize != 0 || options.BlockSize > MaxBlobPageSize {
+		return result, fmt.Errorf("storage: page blob write size must be a multiple of %d bytes up to %d bytes, got %d", pageSize, MaxBlobPageSize, options.BlockSize)
+	}
+
+	blobSize := (size + pageSize - 1) / pageSize * pageSize
+	extraHeaders := mergeMDIntoExtraHeaders(options.Metadata, headersFromStruct(options.Headers))
+	if err := b.PutPageBlob(container, name, blobSize, extraHeaders); err != nil {
+		return result, err
+	}
+
+	ctx, cancel := context.WithCancel(b.client.requestContext())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan putPageJob)
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				err := retryWithBackoff(ctx, options.MaxRetries, options.RetryDelay, nil, func() error {
+					return b.PutPage(container, name, job.start, job.start+int64(len(job.chunk))-1, PageWriteTypeUpdate, job.chunk, map[string]string{
+						headerContentMD5: job.md5,
+					})
+				})
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// run accumulates consecutive non-zero pages until a zero page or the
+	// maximum write size ends it.
+	var run []byte
+	var runStart int64
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		sum := md5.Sum(run)
+		job := putPageJob{start: runStart, chunk: run, md5: base64.StdEncoding.EncodeToString(sum[:])}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+		}
+		result.Pages = append(result.Pages, PageRange{Start: runStart, End: runStart + int64(len(run)) - 1})
+		result.Size += int64(len(run))
+		run = nil
+	}
+
+	hash := md5.New()
+	buf := make([]byte, options.BlockSize)
+	for offset := int64(0); offset < blobSize && ctx.Err() == nil; offset += int64(len(buf)) {
+		if remaining := blobSize - offset; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			fail(fmt.Errorf("storage: error reading page blob source: %v", err))
+			break
+		}
+		// Anything past the end of the source is padding.
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		hash.Write(buf)
+
+		for p := 0; p < len(buf); p += pageSize {
+			page := buf[p : p+pageSize]
+			if isZeroPage(page) {
+				flush()
+				continue
+			}
+			if len(run) == 0 {
+				runStart = offset + int64(p)
+			}
+			run = append(run, page...)
+			if len(run) >= options.BlockSize {
+				flush()
+			}
+		}
+	}
+	flush()
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return UploadResult{}, firstErr
+	}
+
+	result.ContentMD5 = base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	blobHeaders := options.Headers
+	if blobHeaders.ContentMD5 == "" {
+		blobHeaders.ContentMD5 = result.ContentMD5
+	}
+	if err := b.SetBlobProperties(container, name, blobHeaders); err != nil {
+		return UploadResult{}, err
+	}
+	return result, nil
+}
+
+// UploadPageBlobFromFile uploads the local file at path, typically a fixed
+// size VHD, to the specified page blob. See UploadPageBlob for details.
+func (b BlobStorageClient) UploadPageBlobFromFile(container, name, path string, options UploadOptions) (UploadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	return b.UploadPageBlob(container, name, f, fi.Size(), options)
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	chk "gopkg.in/check.v1"
+)
+
+type PageBlobTransferSuite struct{}
+
+var _ = chk.Suite(&PageBlobTransferSuite{})
+
+// fakePageBlobServer keeps a single page blob in memory together with the
+// set of pages that have been written.
+type fakePageBlobServer struct {
+	mu       sync.Mutex
+	data     []byte
+	written  map[int64]bool
+	headers  http.Header
+	puts     []string
+	gets     []string
+	etag     string
+	contentM string
+}
+
+func newFakePageBlobServer() *fakePageBlobServer {
+	return &fakePageBlobServer{written: make(map[int64]bool), etag: `"0x8D0001"`}
+}
+
+func (f *fakePageBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	comp := r.URL.Query().Get("comp")
+	w.Header().Set("Etag", f.etag)
+	switch {
+	case r.Method == http.MethodPut && comp == "":
+		size, _ := strconv.Atoi(r.Header.Get("x-ms-blob-content-length"))
+		f.data = make([]byte, size)
+		f.written = make(map[int64]bool)
+		f.headers = r.Header
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && comp == "page":
+		rng := strings.TrimPrefix(r.Header.Get("x-ms-range"), "bytes=")
+		f.puts = append(f.puts, rng)
+		var start, end int64
+		fmt.Sscanf(rng, "%d-%d", &start, &end)
+		if r.Header.Get("x-ms-page-write") == string(PageWriteTypeClear) {
+			copy(f.data[start:end+1], make([]byte, end-start+1))
+			for p := start; p < end; p += pageSize {
+				delete(f.written, p)
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		sum := md5.Sum(body)
+		if int64(len(body)) != end-start+1 || r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		copy(f.data[start:], body)
+		for p := start; p < end; p += pageSize {
+			f.written[p] = true
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && comp == "properties":
+		f.contentM = r.Header.Get("x-ms-blob-content-md5")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+		w.Header().Set("x-ms-blob-type", string(BlobTypePage))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && comp == "pagelist":
+		var out GetPageRangesResponse
+		var pages []int64
+		for p := range f.written {
+			pages = append(pages, p)
+		}
+		sort.Sort(int64s(pages))
+		for _, p := range pages {
+			if n := len(out.PageList); n > 0 && out.PageList[n-1].End+1 == p {
+				out.PageList[n-1].End += pageSize
+				continue
+			}
+			out.PageList = append(out.PageList, PageRange{Start: p, End: p + pageSize - 1})
+		}
+		b, _ := xml.Marshal(out)
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	case r.Method == http.MethodGet:
+		rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+		f.gets = append(f.gets, rng)
+		var start, end int
+		fmt.Sscanf(rng, "%d-%d", &start, &end)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(f.data[start : end+1])
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sparseImage returns a disk image of the given number of pages where only
+// the listed pages hold data.
+func sparseImage(pages int, data ...int) []byte {
+	img := make([]byte, pages*pageSize)
+	for _, p := range data {
+		copy(img[p*pageSize:(p+1)*pageSize], randBytes(pageSize))
+		img[p*pageSize] = 1 // never all zeros
+	}
+	return img
+}
+
+func (s *PageBlobTransferSuite) Test_isZeroPage(c *chk.C) {
+	c.Assert(isZeroPage(make([]byte, pageSize)), chk.Equals, true)
+	page := make([]byte, pageSize)
+	page[pageSize-1] = 1
+	c.Assert(isZeroPage(page), chk.Equals, false)
+}
+
+func (s *PageBlobTransferSuite) TestUploadPageBlobSkipsZeroPages(c *chk.C) {
+	fake := newFakePageBlobServer()
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	img := sparseImage(16, 1, 2, 3, 4, 9)
+	res, err := cli.GetBlobService().UploadPageBlob("container", "disk.vhd", bytes.NewReader(img), int64(len(img)), UploadOptions{
+		BlockSize: 3 * pageSize,
+	})
+	c.Assert(err, chk.IsNil)
+
+	sort.Strings(fake.puts)
+	c.Assert(fake.puts, chk.DeepEquals, []string{"2048-2559", "4608-5119", "512-2047"})
+	c.Assert(res.Pages, chk.HasLen, 3)
+	c.Assert(res.Size, chk.Equals, int64(5*pageSize))
+	c.Assert(fake.data, chk.DeepEquals, img)
+
+	sum := md5.Sum(img)
+	c.Assert(res.ContentMD5, chk.Equals, base64.StdEncoding.EncodeToString(sum[:]))
+	c.Assert(fake.contentM, chk.Equals, res.ContentMD5)
+}
+
+func (s *PageBlobTransferSuite) TestUploadPageBlobPadsUnalignedSize(c *chk.C) {
+	fake := newFakePageBlobServer()
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	img := sparseImage(2, 0, 1)[:700]
+	_, err := cli.GetBlobService().UploadPageBlob("container", "disk.vhd", bytes.NewReader(img), int64(len(img)), UploadOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.headers.Get("x-ms-blob-content-length"), chk.Equals, "1024")
+	c.Assert(fake.data[:700], chk.DeepEquals, img)
+	c.Assert(isZeroPage(fake.data[700:]), chk.Equals, true)
+}
+
+func (s *PageBlobTransferSuite) TestUploadPageBlobRejectsUnalignedWrites(c *chk.C) {
+	_, err := BlobStorageClient{}.UploadPageBlob("container", "disk.vhd", bytes.NewReader(nil), 0, UploadOptions{BlockSize: 1000})
+	c.Assert(err, chk.ErrorMatches, "storage: page blob write size must be a multiple of 512 bytes up to 4194304 bytes, got 1000")
+}
+
+func (s *PageBlobTransferSuite) TestDownloadPageBlobFetchesValidRanges(c *chk.C) {
+	fake := newFakePageBlobServer()
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "pageblob")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+
+	img := sparseImage(64, 0, 10, 11, 40)
+	src := filepath.Join(dir, "src.vhd")
+	c.Assert(ioutil.WriteFile(src, img, 0644), chk.IsNil)
+
+	b := cli.GetBlobService()
+	_, err = b.UploadPageBlobFromFile("container", "disk.vhd", src, UploadOptions{})
+	c.Assert(err, chk.IsNil)
+
+	dst := filepath.Join(dir, "dst.vhd")
+	_, err = b.DownloadToFile("container", "disk.vhd", dst, DownloadOptions{RangeSize: pageSize})
+	c.Assert(err, chk.IsNil)
+
+	sort.Strings(fake.gets)
+	c.Assert(fake.gets, chk.DeepEquals, []string{"0-511", "20480-20991", "5120-5631", "5632-6143"})
+	got, err := ioutil.ReadFile(dst)
+	c.Assert(err, chk.IsNil)
+	c.Assert(got, chk.DeepEquals, img)
+}
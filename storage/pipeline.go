@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Sender sends a signed storage request. For error responses it returns the
+// parsed service error, usually an AzureStorageServiceError, together with
+// the response, whose body can still be read.
+type Sender func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps a Sender to observe or alter every request a Client
+// sends, for example to log it, record metrics, add tracing headers or
+// inject faults. A middleware sees the request once it is signed, so any
+// header it adds is not covered by the signature. Retries happen outside of
+// the middleware chain, so every attempt goes through it.
+type Middleware func(next Sender) Sender
+
+// send passes req through the middleware of c to the HTTP client. The body
+// of error responses is read, turned into an error by parseErr and restored
+// so it can be read again.
+func (c Client) send(req *http.Request, parseErr func(resp *http.Response, body []byte) error) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	sender := Sender(func(req *http.Request) (*http.Response, error) {
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 400 || resp.StatusCode > 505 {
+			return resp, nil
+		}
+
+		body, err := readResponseBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body)) /* restore the body */
+		return resp, parseErr(resp, body)
+	})
+	for i := len(c.Middleware) - 1; i >= 0; i-- {
+		sender = c.Middleware[i](sender)
+	}
+
+	start := time.Now()
+	resp, err := sender(req)
+	if resp == nil && err == nil {
+		err = errors.New("storage: middleware returned neither a response nor an error")
+	}
+	c.logRequest(req, resp, err, time.Since(start))
+	return resp, err
+}
+
+// LoggingMiddleware returns a Middleware writing one line per request to
+// logger with its method, URL, status, duration, request ID and error. The
+// Authorization header and the request body are never logged, and the SAS
+// query parameters of the URL are redacted.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	return func(next Sender) Sender {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+
+			var status int
+			var requestID string
+			if resp != nil {
+				status = resp.StatusCode
+				requestID = resp.Header.Get("x-ms-request-id")
+			}
+			u := redactURL(req.URL)
+			if err != nil {
+				logger.Printf("storage: %s %s: status=%d duration=%v requestId=%s error=%v", req.Method, u, status, time.Since(start), requestID, err)
+			} else {
+				logger.Printf("storage: %s %s: status=%d duration=%v requestId=%s", req.Method, u, status, time.Since(start), requestID)
+			}
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	chk "gopkg.in/check.v1"
+)
+
+type PipelineSuite struct{}
+
+var _ = chk.Suite(&PipelineSuite{})
+
+const testBlobNotFound = `<?xml version="1.0" encoding="utf-8"?>
+<Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`
+
+func (s *PipelineSuite) TestMiddlewareOrderAndParsedError(c *chk.C) {
+	cli, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "req-1")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(testBlobNotFound))
+	}))
+	defer srv.Close()
+
+	var calls []string
+	var seen error
+	record := func(name string) Middleware {
+		return func(next Sender) Sender {
+			return func(req *http.Request) (*http.Response, error) {
+				c.Assert(req.Header.Get("Authorization"), chk.Not(chk.Equals), "")
+				calls = append(calls, name)
+				resp, err := next(req)
+				if name == "outer" {
+					seen = err
+				}
+				return resp, err
+			}
+		}
+	}
+	cli.Middleware = []Middleware{record("outer"), record("inner")}
+
+	_, err := cli.GetBlobService().GetBlob("container", "missing")
+	c.Assert(err, chk.NotNil)
+	c.Assert(calls, chk.DeepEquals, []string{"outer", "inner"})
+
+	serr, ok := seen.(AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(serr.Code, chk.Equals, "BlobNotFound")
+	c.Assert(serr.StatusCode, chk.Equals, http.StatusNotFound)
+	c.Assert(serr.RequestID, chk.Equals, "req-1")
+}
+
+func (s *PipelineSuite) TestMiddlewareFaultInjectionIsRetried(c *chk.C) {
+	fake := &flakyServer{ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	attempts := 0
+	cli.Middleware = []Middleware{func(next Sender) Sender {
+		return func(req *http.Request) (*http.Response, error) {
+			attempts++
+			if attempts == 1 {
+				return &http.Response{
+					StatusCode: http.StatusServiceUnavailable,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(strings.NewReader("")),
+				}, serviceErrFromStatusCode(http.StatusServiceUnavailable, "503 Server Busy", "")
+			}
+			return next(req)
+		}
+	}}
+
+	err := cli.GetBlobService().PutBlockWithLength("container", "blob", "YmxvY2s=", 5, bytes.NewReader([]byte("hello")), nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(attempts, chk.Equals, 2)
+	c.Assert(fake.bodies, chk.DeepEquals, []string{"hello"})
+}
+
+func (s *PipelineSuite) TestMiddlewareSeesTableError(c *chk.C) {
+	cli, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"odata.error":{"code":"TableAlreadyExists","message":{"lang":"en-US","value":"The table specified already exists."}}}`))
+	}))
+	defer srv.Close()
+
+	var seen error
+	cli.Middleware = []Middleware{func(next Sender) Sender {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := next(req)
+			seen = err
+			return resp, err
+		}
+	}}
+
+	table := cli.GetTableService()
+	c.Assert(table.CreateTable("tbl"), chk.NotNil)
+	serr, ok := seen.(AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(serr.Code, chk.Equals, "TableAlreadyExists")
+	c.Assert(serr.StatusCode, chk.Equals, http.StatusConflict)
+}
+
+func (s *PipelineSuite) TestLoggingMiddleware(c *chk.C) {
+	cli, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "req-2")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	cli.Middleware = []Middleware{LoggingMiddleware(log.New(&buf, "", 0))}
+	c.Assert(cli.GetQueueService().CreateQueue("queue"), chk.IsNil)
+
+	line := buf.String()
+	c.Assert(line, chk.Matches, "storage: PUT https://foo.queue.core.windows.net/queue: status=201 duration=.* requestId=req-2\n")
+	c.Assert(strings.Contains(line, "SharedKey"), chk.Equals, false)
+}
+
+func (s *PipelineSuite) TestTableErrorsAreKept(c *chk.C) {
+	status := http.StatusConflict
+	cli, srv := getTestServerClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"odata.error":{"code":"TableAlreadyExists","message":{"lang":"en-US","value":"The table specified already exists."}}}`))
+	}))
+	defer srv.Close()
+	uri := cli.getEndpoint(tableServiceName, "Tables", nil)
+
+	resp, err := cli.execInternalJSON(http.MethodPost, uri, cli.getStandardHeaders(), nil, sharedKeyForTable)
+	serr, ok := err.(AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(serr.Code, chk.Equals, "TableAlreadyExists")
+	c.Assert(resp.odata.Err.Code, chk.Equals, "TableAlreadyExists")
+
+	// Errors of middleware returned along with a successful response.
+	status = http.StatusCreated
+	rejected := errors.New("rejected by middleware")
+	cli.Middleware = []Middleware{func(next Sender) Sender {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, _ := next(req)
+			return resp, rejected
+		}
+	}}
+	_, err = cli.execInternalJSON(http.MethodPost, uri, cli.getStandardHeaders(), nil, sharedKeyForTable)
+	c.Assert(err, chk.Equals, rejected)
+}
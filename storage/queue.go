@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -18,8 +20,20 @@ const (
 // QueueServiceClient contains operations for Microsoft Azure Queue Storage
 // Service.
 type QueueServiceClient struct {
-	client Client
-	auth   authentication
+	client   Client
+	auth     authentication
+	messages QueueMessageOptions
+}
+
+// WithContext returns a copy of c whose requests are bound to ctx. Calls
+// made through the copy are abandoned as soon as ctx is cancelled or its
+// deadline expires. The provided ctx must be non-nil.
+func (c QueueServiceClient) WithContext(ctx context.Context) QueueServiceClient {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c.client.ctx = ctx
+	return c
 }
 
 func pathForQueue(queue string) string         { return fmt.Sprintf("/%s", queue) }
@@ -118,6 +132,19 @@ type GetMessageResponse struct {
 	TimeNextVisible string `xml:"TimeNextVisible"`
 	DequeueCount    int    `xml:"DequeueCount"`
 	MessageText     string `xml:"MessageText"`
+
+	// PayloadBlob is the name of the blob of the offload container holding
+	// the payload of the message, if it was too large for the message.
+	PayloadBlob string `xml:"-"`
+
+	// DecodeError is the error decoding the message with the message
+	// options of the client failed with, in which case MessageText is the
+	// text of the message as stored in the queue.
+	DecodeError error `xml:"-"`
+
+	// text is the text of the message as stored in queue.
+	text  string
+	queue string
 }
 
 // PeekMessagesResponse represents a response returned from Get Messages
@@ -135,6 +162,10 @@ type PeekMessageResponse struct {
 	ExpirationTime string `xml:"ExpirationTime"`
 	DequeueCount   int    `xml:"DequeueCount"`
 	MessageText    string `xml:"MessageText"`
+
+	// PayloadBlob and DecodeError are set as for GetMessageResponse.
+	PayloadBlob string `xml:"-"`
+	DecodeError error  `xml:"-"`
 }
 
 // QueueMetadataResponse represents user defined metadata and queue
@@ -247,18 +278,34 @@ func (c QueueServiceClient) QueueExists(name string) (bool, error) {
 }
 
 // PutMessage operation adds a new message to the back of the message queue.
+// The message is encoded according to the message options of the client.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/dd179346.aspx
 func (c QueueServiceClient) PutMessage(queue string, message string, params PutMessageParameters) error {
+	text, blob, err := c.encodeMessage(queue, message)
+	if err != nil {
+		return err
+	}
+	if err := c.putMessageText(queue, text, params); err != nil {
+		// The payload blob is unreachable without the message.
+		c.deletePayloadBlob(blob)
+		return err
+	}
+	return nil
+}
+
+// putMessageText adds a message with the given text to the queue, as is.
+func (c QueueServiceClient) putMessageText(queue string, text string, params PutMessageParameters) error {
 	uri := c.client.getEndpoint(queueServiceName, pathForQueueMessages(queue), params.getParameters())
-	req := putMessageRequest{MessageText: message}
+	req := putMessageRequest{MessageText: text}
 	body, nn, err := xmlMarshal(req)
 	if err != nil {
 		return err
 	}
 	headers := c.client.getStandardHeaders()
 	headers["Content-Length"] = strconv.Itoa(nn)
-	resp, err := c.client.exec(http.MethodPost, uri, headers, body, c.auth)
+	// A retried message that was put already would be queued twice.
+	resp, err := c.client.execNonIdempotent(http.MethodPost, uri, headers, body, c.auth)
 	if err != nil {
 		return err
 	}
@@ -280,7 +327,8 @@ func (c QueueServiceClient) ClearMessages(queue string) error {
 }
 
 // GetMessages operation retrieves one or more messages from the front of the
-// queue.
+// queue. The messages are decoded according to the message options of the
+// client; those that cannot be decoded have their DecodeError set.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/dd179474.aspx
 func (c QueueServiceClient) GetMessages(queue string, params GetMessagesParameters) (GetMessagesResponse, error) {
@@ -291,12 +339,20 @@ func (c QueueServiceClient) GetMessages(queue string, params GetMessagesParamete
 		return r, err
 	}
 	defer resp.body.Close()
-	err = xmlUnmarshal(resp.body, &r)
-	return r, err
+	if err = xmlUnmarshal(resp.body, &r); err != nil {
+		return r, err
+	}
+	for i := range r.QueueMessagesList {
+		m := &r.QueueMessagesList[i]
+		m.text, m.queue = m.MessageText, queue
+		m.MessageText, m.PayloadBlob, m.DecodeError = c.decodeMessage(queue, m.text)
+	}
+	return r, nil
 }
 
 // PeekMessages retrieves one or more messages from the front of the queue, but
-// does not alter the visibility of the message.
+// does not alter the visibility of the message. The messages are decoded as
+// by GetMessages.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/dd179472.aspx
 func (c QueueServiceClient) PeekMessages(queue string, params PeekMessagesParameters) (PeekMessagesResponse, error) {
@@ -307,8 +363,14 @@ func (c QueueServiceClient) PeekMessages(queue string, params PeekMessagesParame
 		return r, err
 	}
 	defer resp.body.Close()
-	err = xmlUnmarshal(resp.body, &r)
-	return r, err
+	if err = xmlUnmarshal(resp.body, &r); err != nil {
+		return r, err
+	}
+	for i := range r.QueueMessagesList {
+		m := &r.QueueMessagesList[i]
+		m.MessageText, m.PayloadBlob, m.DecodeError = c.decodeMessage(queue, m.MessageText)
+	}
+	return r, nil
 }
 
 // DeleteMessage operation deletes the specified message.
@@ -325,22 +387,48 @@ func (c QueueServiceClient) DeleteMessage(queue, messageID, popReceipt string) e
 	return checkRespCode(resp.statusCode, []int{http.StatusNoContent})
 }
 
-// UpdateMessage operation deletes the specified message.
+// UpdateMessage operation updates the specified message. The message is
+// encoded according to the message options of the client. The blob holding
+// the previous payload of an offloaded message is left in place.
 //
 // See https://msdn.microsoft.com/en-us/library/azure/hh452234.aspx
 func (c QueueServiceClient) UpdateMessage(queue string, messageID string, message string, params UpdateMessageParameters) error {
-	uri := c.client.getEndpoint(queueServiceName, pathForMessage(queue, messageID), params.getParameters())
-	req := putMessageRequest{MessageText: message}
-	body, nn, err := xmlMarshal(req)
+	text, blob, err := c.encodeMessage(queue, message)
 	if err != nil {
 		return err
 	}
+	if _, err := c.updateMessage(queue, messageID, &text, params); err != nil {
+		// The payload blob is unreachable without the message.
+		c.deletePayloadBlob(blob)
+		return err
+	}
+	return nil
+}
+
+// updateMessage updates the specified message and returns its new pop
+// receipt, which replaces the one in params. If text is nil only the
+// visibility of the message is updated.
+func (c QueueServiceClient) updateMessage(queue string, messageID string, text *string, params UpdateMessageParameters) (string, error) {
+	uri := c.client.getEndpoint(queueServiceName, pathForMessage(queue, messageID), params.getParameters())
 	headers := c.client.getStandardHeaders()
-	headers["Content-Length"] = fmt.Sprintf("%d", nn)
+	headers["Content-Length"] = "0"
+	var body io.Reader
+	if text != nil {
+		req := putMessageRequest{MessageText: *text}
+		var nn int
+		var err error
+		if body, nn, err = xmlMarshal(req); err != nil {
+			return "", err
+		}
+		headers["Content-Length"] = fmt.Sprintf("%d", nn)
+	}
 	resp, err := c.client.exec(http.MethodPut, uri, headers, body, c.auth)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.body.Close()
-	return checkRespCode(resp.statusCode, []int{http.StatusNoContent})
+	if err := checkRespCode(resp.statusCode, []int{http.StatusNoContent}); err != nil {
+		return "", err
+	}
+	return resp.headers.Get("x-ms-popreceipt"), nil
 }
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxQueueMessageSize is the largest message text the queue service
+// accepts, once XML escaped.
+const maxQueueMessageSize = 64 * 1024
+
+// QueueMessageEncoding converts the payloads of queue messages to and from
+// the text stored in the queue.
+type QueueMessageEncoding interface {
+	EncodeMessage(payload []byte) (string, error)
+	DecodeMessage(text string) ([]byte, error)
+}
+
+var (
+	// RawMessageEncoding stores payloads as is. They must be UTF-8 text
+	// made of characters XML documents can carry.
+	RawMessageEncoding QueueMessageEncoding = rawMessageEncoding{}
+
+	// Base64MessageEncoding stores payloads base64 encoded, so any payload
+	// can be sent. It is the default encoding of the .NET client library.
+	Base64MessageEncoding QueueMessageEncoding = base64MessageEncoding{}
+
+	// JSONMessageEncoding stores payloads that are JSON documents,
+	// compacted, and checks that received messages are JSON documents.
+	JSONMessageEncoding QueueMessageEncoding = jsonMessageEncoding{}
+)
+
+type rawMessageEncoding struct{}
+
+func (rawMessageEncoding) EncodeMessage(payload []byte) (string, error) {
+	if !utf8.Valid(payload) {
+		return "", errors.New("storage: raw queue message is not valid UTF-8")
+	}
+	for _, r := range string(payload) {
+		if !isXMLChar(r) {
+			return "", fmt.Errorf("storage: raw queue message contains %U, which XML cannot carry", r)
+		}
+	}
+	return string(payload), nil
+}
+
+func (rawMessageEncoding) DecodeMessage(text string) ([]byte, error) {
+	return []byte(text), nil
+}
+
+// isXMLChar reports whether r is in the Char production of XML 1.0.
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+type base64MessageEncoding struct{}
+
+func (base64MessageEncoding) EncodeMessage(payload []byte) (string, error) {
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+func (base64MessageEncoding) DecodeMessage(text string) ([]byte, error) {
+	payload, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("storage: queue message is not base64 encoded: %v", err)
+	}
+	return payload, nil
+}
+
+type jsonMessageEncoding struct{}
+
+func (jsonMessageEncoding) EncodeMessage(payload []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, payload); err != nil {
+		return "", fmt.Errorf("storage: queue message is not a JSON document: %v", err)
+	}
+	return buf.String(), nil
+}
+
+func (jsonMessageEncoding) DecodeMessage(text string) ([]byte, error) {
+	var doc json.RawMessage
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, fmt.Errorf("storage: queue message is not a JSON document: %v", err)
+	}
+	return []byte(text), nil
+}
+
+// QueueMessageOptions sets how a QueueServiceClient encodes the messages it
+// puts and updates, and decodes the messages it gets and peeks. The zero
+// value sends messages verbatim, as earlier versions of this package did.
+type QueueMessageOptions struct {
+	// Encoding converts payloads to message text. If nil payloads are sent
+	// as is, without any check.
+	Encoding QueueMessageEncoding
+
+	// OffloadContainer is the blob container in which the payloads whose
+	// encoding exceeds the 64 KB limit of messages are stored. The message
+	// then holds a reference to the blob, which is resolved when the
+	// message is received by a client with the same OffloadContainer. If
+	// empty, oversized payloads are rejected. The container must exist.
+	OffloadContainer string
+}
+
+// WithMessageOptions returns a copy of c encoding and decoding messages
+// according to options.
+func (c QueueServiceClient) WithMessageOptions(options QueueMessageOptions) QueueServiceClient {
+	c.messages = options
+	return c
+}
+
+// offloadMarker identifies the references to offloaded payloads written by
+// this package, and the version of their format.
+const offloadMarker = "azure-storage-offload/1"
+
+// payloadReference is the payload of a message whose actual payload is
+// stored in a blob of the offload container. The blob is named after the
+// queue of the message.
+type payloadReference struct {
+	Marker string `json:"$offloadedPayload"`
+	Blob   string `json:"blob"`
+}
+
+// parsePayloadReference returns the name of the blob payload refers to if
+// it is a reference to a payload offloaded for queue, exactly as written by
+// encodeMessage, or "" otherwise. Payloads that merely look alike, such as
+// JSON documents with the same keys, are not references.
+func parsePayloadReference(queue string, payload []byte) string {
+	var ref payloadReference
+	if json.Unmarshal(payload, &ref) != nil || ref.Marker != offloadMarker || !validPayloadBlob(queue, ref.Blob) {
+		return ""
+	}
+	canonical, err := json.Marshal(ref)
+	if err != nil || !bytes.Equal(canonical, payload) {
+		return ""
+	}
+	return ref.Blob
+}
+
+// validPayloadBlob reports whether blob may hold a payload offloaded for
+// queue.
+func validPayloadBlob(queue, blob string) bool {
+	name := strings.TrimPrefix(blob, queue+"/")
+	return queue != "" && len(name) < len(blob) && name != "" && !strings.Contains(name, "/")
+}
+
+// encodeMessage returns the text of a message of queue holding payload. If
+// the payload is offloaded, the name of its blob is returned as well.
+func (c QueueServiceClient) encodeMessage(queue, payload string) (string, string, error) {
+	text, err := c.encodePayload([]byte(payload))
+	if err != nil {
+		return "", "", err
+	}
+	size := escapedSize(text)
+	if size <= maxQueueMessageSize {
+		return text, "", nil
+	}
+	container := c.messages.OffloadContainer
+	if container == "" {
+		return "", "", fmt.Errorf("storage: queue message of %d bytes exceeds the limit of %d bytes", size, maxQueueMessageSize)
+	}
+
+	blob := queue + "/" + newUUID()
+	blobs := c.client.GetBlobService()
+	if _, err := blobs.UploadStream(container, blob, strings.NewReader(payload), UploadOptions{}); err != nil {
+		return "", "", err
+	}
+	ref, err := json.Marshal(payloadReference{Marker: offloadMarker, Blob: blob})
+	if err != nil {
+		return "", "", err
+	}
+	text, err = c.encodePayload(ref)
+	return text, blob, err
+}
+
+// escapedSize returns the size of text in the XML body of a request, where
+// characters like < and & are escaped.
+func escapedSize(text string) int {
+	var w countingWriter
+	xml.EscapeText(&w, []byte(text))
+	return int(w)
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func (c QueueServiceClient) encodePayload(payload []byte) (string, error) {
+	if c.messages.Encoding == nil {
+		return string(payload), nil
+	}
+	return c.messages.Encoding.EncodeMessage(payload)
+}
+
+// decodeMessage returns the payload of a message of queue with the given
+// text and the name of the blob it was offloaded to, if any. Only the blobs
+// named after queue are read. If the message cannot be decoded its text is
+// returned along with the error.
+func (c QueueServiceClient) decodeMessage(queue, text string) (string, string, error) {
+	payload := []byte(text)
+	if c.messages.Encoding != nil {
+		var err error
+		if payload, err = c.messages.Encoding.DecodeMessage(text); err != nil {
+			return text, "", err
+		}
+	}
+
+	container := c.messages.OffloadContainer
+	if container == "" {
+		return string(payload), "", nil
+	}
+	blob := parsePayloadReference(queue, payload)
+	if blob == "" {
+		return string(payload), "", nil
+	}
+	body, err := c.client.GetBlobService().GetBlob(container, blob)
+	if err != nil {
+		return text, "", fmt.Errorf("storage: cannot read queue message payload from blob %s/%s: %v", container, blob, err)
+	}
+	defer body.Close()
+	if payload, err = ioutil.ReadAll(body); err != nil {
+		return text, "", fmt.Errorf("storage: cannot read queue message payload from blob %s/%s: %v", container, blob, err)
+	}
+	return string(payload), blob, nil
+}
+
+// DeleteMessagePayload deletes the blob holding the payload of a received
+// message offloaded to the offload container, if any. Delete it once the
+// message itself is deleted; QueueProcessor does so itself. Only the blobs
+// named after the queue the message was received from are deleted.
+func (c QueueServiceClient) DeleteMessagePayload(message GetMessageResponse) error {
+	if message.PayloadBlob == "" {
+		return nil
+	}
+	if !validPayloadBlob(message.queue, message.PayloadBlob) {
+		return fmt.Errorf("storage: blob %s does not hold a payload of queue %s", message.PayloadBlob, message.queue)
+	}
+	return c.deletePayloadBlob(message.PayloadBlob)
+}
+
+func (c QueueServiceClient) deletePayloadBlob(blob string) error {
+	if blob == "" {
+		return nil
+	}
+	_, err := c.client.GetBlobService().DeleteBlobIfExists(c.messages.OffloadContainer, blob, nil)
+	return err
+}
@@ -0,0 +1,152 @@
+package storage_test
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/storage/storagetest"
+	chk "gopkg.in/check.v1"
+)
+
+type QueueMessageSuite struct {
+	srv *storagetest.Server
+	cli storage.QueueServiceClient
+}
+
+var _ = chk.Suite(&QueueMessageSuite{})
+
+func (s *QueueMessageSuite) SetUpTest(c *chk.C) {
+	s.srv = storagetest.NewServer()
+	s.cli = s.srv.Client().GetQueueService()
+	c.Assert(s.cli.CreateQueue("queue"), chk.IsNil)
+}
+
+func (s *QueueMessageSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *QueueMessageSuite) getOne(c *chk.C, cli storage.QueueServiceClient) storage.GetMessageResponse {
+	got, err := cli.GetMessages("queue", storage.GetMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, 1)
+	return got.QueueMessagesList[0]
+}
+
+func (s *QueueMessageSuite) TestMessageEncoding(c *chk.C) {
+	b64 := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.Base64MessageEncoding})
+	c.Assert(b64.PutMessage("queue", "\x00\xff<&>", storage.PutMessageParameters{}), chk.IsNil)
+	peeked, err := s.cli.PeekMessages("queue", storage.PeekMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(peeked.QueueMessagesList[0].MessageText, chk.Equals, "AP88Jj4=")
+	m := s.getOne(c, b64)
+	c.Assert(m.DecodeError, chk.IsNil)
+	c.Assert(m.MessageText, chk.Equals, "\x00\xff<&>")
+	c.Assert(b64.DeleteMessage("queue", m.MessageID, m.PopReceipt), chk.IsNil)
+
+	// Messages that are not base64 encoded are returned as is.
+	c.Assert(s.cli.PutMessage("queue", "not base64!", storage.PutMessageParameters{}), chk.IsNil)
+	m = s.getOne(c, b64)
+	c.Assert(m.DecodeError, chk.ErrorMatches, "storage: queue message is not base64 encoded: .*")
+	c.Assert(m.MessageText, chk.Equals, "not base64!")
+
+	raw := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.RawMessageEncoding})
+	err = raw.PutMessage("queue", "a\x00b", storage.PutMessageParameters{})
+	c.Assert(err, chk.ErrorMatches, "storage: raw queue message contains U\\+0000, .*")
+
+	js := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.JSONMessageEncoding})
+	c.Assert(js.PutMessage("queue", "not json", storage.PutMessageParameters{}), chk.ErrorMatches, "storage: queue message is not a JSON document: .*")
+	c.Assert(js.PutMessage("queue", `{ "a": [1, 2] }`, storage.PutMessageParameters{}), chk.IsNil)
+	peeked, err = js.PeekMessages("queue", storage.PeekMessagesParameters{NumOfMessages: 2})
+	c.Assert(err, chk.IsNil)
+	c.Assert(peeked.QueueMessagesList, chk.HasLen, 1)
+	c.Assert(peeked.QueueMessagesList[0].MessageText, chk.Equals, `{"a":[1,2]}`)
+}
+
+func (s *QueueMessageSuite) TestMessageOffload(c *chk.C) {
+	large := strings.Repeat("large payload ", 10000)
+	err := s.cli.PutMessage("queue", large, storage.PutMessageParameters{})
+	c.Assert(err, chk.ErrorMatches, "storage: queue message of 140000 bytes exceeds the limit of 65536 bytes")
+
+	blobs := s.srv.Client().GetBlobService()
+	c.Assert(blobs.CreateContainer("payloads", storage.ContainerAccessTypePrivate), chk.IsNil)
+	cli := s.cli.WithMessageOptions(storage.QueueMessageOptions{
+		Encoding:         storage.Base64MessageEncoding,
+		OffloadContainer: "payloads",
+	})
+	c.Assert(cli.PutMessage("queue", large, storage.PutMessageParameters{}), chk.IsNil)
+	c.Assert(cli.PutMessage("queue", "small", storage.PutMessageParameters{}), chk.IsNil)
+
+	// Clients without the offload container see the reference.
+	peeked, err := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.Base64MessageEncoding}).PeekMessages("queue", storage.PeekMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(peeked.QueueMessagesList[0].MessageText, chk.Matches, `\{"\$offloadedPayload":"azure-storage-offload/1","blob":"queue/.*"\}`)
+
+	got, err := cli.GetMessages("queue", storage.GetMessagesParameters{NumOfMessages: 2})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, 2)
+	m := got.QueueMessagesList[0]
+	c.Assert(m.DecodeError, chk.IsNil)
+	c.Assert(m.MessageText, chk.Equals, large)
+	c.Assert(m.PayloadBlob, chk.Matches, "queue/.*")
+	c.Assert(got.QueueMessagesList[1].MessageText, chk.Equals, "small")
+	c.Assert(got.QueueMessagesList[1].PayloadBlob, chk.Equals, "")
+
+	c.Assert(cli.DeleteMessage("queue", m.MessageID, m.PopReceipt), chk.IsNil)
+	c.Assert(cli.DeleteMessagePayload(m), chk.IsNil)
+	ok, err := blobs.BlobExists("payloads", m.PayloadBlob)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+	c.Assert(cli.DeleteMessage("queue", got.QueueMessagesList[1].MessageID, got.QueueMessagesList[1].PopReceipt), chk.IsNil)
+
+	// Producers cannot make consumers read or delete other blobs.
+	s.putBlob(c, blobs, "payloads", "other/secret", "secret")
+	s.putBlob(c, blobs, "payloads", "queue/x", "x")
+	raw := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.Base64MessageEncoding})
+	forged := []string{
+		`{"$offloadedPayload":"azure-storage-offload/1","blob":"other/secret"}`,
+		`{"$offloadedPayload":"azure-storage-offload/1","blob":"queue/../other/secret"}`,
+		`{"$offloadedPayload":"azure-storage-offload/1","blob":"queue/x","extra":1}`,
+		`{"$payloadBlob":"queue/x"}`,
+	}
+	for _, text := range forged {
+		c.Assert(raw.PutMessage("queue", text, storage.PutMessageParameters{}), chk.IsNil)
+	}
+	got, err = cli.GetMessages("queue", storage.GetMessagesParameters{NumOfMessages: 32})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, len(forged))
+	for i, m := range got.QueueMessagesList {
+		c.Assert(m.MessageText, chk.Equals, forged[i])
+		c.Assert(m.PayloadBlob, chk.Equals, "")
+	}
+	m.PayloadBlob = "other/secret"
+	c.Assert(cli.DeleteMessagePayload(m), chk.ErrorMatches, "storage: blob other/secret does not hold a payload of queue queue")
+	ok, err = blobs.BlobExists("payloads", "other/secret")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, true)
+}
+
+func (s *QueueMessageSuite) TestMessageOffloadOfEscapedText(c *chk.C) {
+	// Small enough as is, too large once XML escaped.
+	escaped := strings.Repeat("<&", 10000)
+	raw := s.cli.WithMessageOptions(storage.QueueMessageOptions{Encoding: storage.RawMessageEncoding})
+	err := raw.PutMessage("queue", escaped, storage.PutMessageParameters{})
+	c.Assert(err, chk.ErrorMatches, "storage: queue message of 90000 bytes exceeds the limit of 65536 bytes")
+
+	blobs := s.srv.Client().GetBlobService()
+	c.Assert(blobs.CreateContainer("payloads", storage.ContainerAccessTypePrivate), chk.IsNil)
+	cli := s.cli.WithMessageOptions(storage.QueueMessageOptions{
+		Encoding:         storage.RawMessageEncoding,
+		OffloadContainer: "payloads",
+	})
+	c.Assert(cli.PutMessage("queue", escaped, storage.PutMessageParameters{}), chk.IsNil)
+	got, err := cli.GetMessages("queue", storage.GetMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, 1)
+	c.Assert(got.QueueMessagesList[0].MessageText, chk.Equals, escaped)
+	c.Assert(got.QueueMessagesList[0].PayloadBlob, chk.Matches, "queue/.*")
+}
+
+// putBlob writes a block blob holding data.
+func (s *QueueMessageSuite) putBlob(c *chk.C, blobs storage.BlobStorageClient, container, name, data string) {
+	c.Assert(blobs.CreateBlockBlobFromReader(container, name, uint64(len(data)), strings.NewReader(data), nil), chk.IsNil)
+}
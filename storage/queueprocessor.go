@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQueueProcessorConcurrency is the number of messages handled
+	// concurrently when QueueProcessorOptions.Concurrency is not set.
+	DefaultQueueProcessorConcurrency = 4
+
+	// DefaultQueueVisibilityTimeout is how long a message being handled is
+	// hidden from other consumers, between two renewals, when
+	// QueueProcessorOptions.VisibilityTimeout is not set.
+	DefaultQueueVisibilityTimeout = 30 * time.Second
+
+	// DefaultQueueMaxDequeueCount is the number of times a message is
+	// handled before it is moved to the poison queue when
+	// QueueProcessorOptions.MaxDequeueCount is not set.
+	DefaultQueueMaxDequeueCount = 5
+
+	defaultQueueMinPollInterval = 100 * time.Millisecond
+	defaultQueueMaxPollInterval = 30 * time.Second
+
+	// poisonQueueSuffix is appended to the queue name to build the default
+	// poison queue name.
+	poisonQueueSuffix = "-poison"
+
+	// maxQueueMessagesPerGet is the largest number of messages Get Messages
+	// returns at once.
+	maxQueueMessagesPerGet = 32
+
+	maxQueueVisibilityTimeout = 7 * 24 * time.Hour
+)
+
+// QueueHandler handles a message received by a QueueProcessor. The message
+// is deleted if the handler returns nil. Otherwise it is left in the queue
+// and handled again once its visibility timeout expires. ctx is cancelled
+// if the processor fails to extend the visibility of the message, which
+// another consumer may then receive.
+type QueueHandler func(ctx context.Context, message GetMessageResponse) error
+
+// QueueProcessorOptions is the set of options that can be specified for a
+// QueueProcessor. A zero struct handles DefaultQueueProcessorConcurrency
+// messages at a time and moves the messages dequeued more than
+// DefaultQueueMaxDequeueCount times to the queue named after the processed
+// one followed by "-poison".
+type QueueProcessorOptions struct {
+	// Concurrency is the largest number of messages handled at once.
+	Concurrency int
+
+	// VisibilityTimeout is how long a received message is hidden from
+	// other consumers. It is extended by as much every half of it while
+	// the handler runs. It must be a whole number of seconds, from one
+	// second to seven days.
+	VisibilityTimeout time.Duration
+
+	// MaxDequeueCount is the number of times a message is handled before
+	// it is moved to the poison queue instead. Use a negative value to
+	// never move messages.
+	MaxDequeueCount int
+
+	// PoisonQueue is the queue the messages dequeued too many times are
+	// moved to. It must exist.
+	PoisonQueue string
+
+	// MinPollInterval and MaxPollInterval bound the delay between two
+	// polls of an empty queue. The delay starts at MinPollInterval and
+	// doubles on every poll that returns no message, up to
+	// MaxPollInterval.
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+}
+
+func (o QueueProcessorOptions) withDefaults(queue string) (QueueProcessorOptions, error) {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultQueueProcessorConcurrency
+	}
+	if o.VisibilityTimeout == 0 {
+		o.VisibilityTimeout = DefaultQueueVisibilityTimeout
+	}
+	if o.VisibilityTimeout < time.Second || o.VisibilityTimeout > maxQueueVisibilityTimeout || o.VisibilityTimeout%time.Second != 0 {
+		return o, fmt.Errorf("storage: invalid queue visibility timeout %v", o.VisibilityTimeout)
+	}
+	if o.MaxDequeueCount == 0 {
+		o.MaxDequeueCount = DefaultQueueMaxDequeueCount
+	}
+	if o.PoisonQueue == "" {
+		o.PoisonQueue = queue + poisonQueueSuffix
+	}
+	if o.PoisonQueue == queue {
+		return o, fmt.Errorf("storage: queue %s cannot be its own poison queue", queue)
+	}
+	if o.MinPollInterval <= 0 {
+		o.MinPollInterval = defaultQueueMinPollInterval
+	}
+	if o.MaxPollInterval <= 0 {
+		o.MaxPollInterval = defaultQueueMaxPollInterval
+	}
+	if o.MaxPollInterval < o.MinPollInterval {
+		o.MaxPollInterval = o.MinPollInterval
+	}
+	return o, nil
+}
+
+// QueueProcessor receives the messages of a queue and hands them to a
+// QueueHandler, extending their visibility while it runs and deleting them
+// once it succeeds. Messages that keep failing are moved to a poison queue.
+type QueueProcessor struct {
+	client  QueueServiceClient
+	queue   string
+	handler QueueHandler
+	options QueueProcessorOptions
+}
+
+// NewQueueProcessor returns a processor handing the messages of queue to
+// handler. The requests of the processor are bound to the context of c.
+func (c QueueServiceClient) NewQueueProcessor(queue string, handler QueueHandler, options QueueProcessorOptions) *QueueProcessor {
+	return &QueueProcessor{client: c, queue: queue, handler: handler, options: options}
+}
+
+// Run polls the queue and handles its messages until ctx is done. It then
+// stops polling and waits for the messages being handled, which are still
+// renewed and deleted as usual, so the context of the client should outlive
+// ctx. Failures to receive, renew, delete or move messages are logged
+// through the Logger of the client and do not stop Run, which only returns
+// an error for invalid options.
+func (p *QueueProcessor) Run(ctx context.Context) error {
+	options, err := p.options.withDefaults(p.queue)
+	if err != nil {
+		return err
+	}
+	visibility := int(options.VisibilityTimeout / time.Second)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, options.Concurrency)
+	delay := options.MinPollInterval
+	for {
+		n := acquireSlots(ctx, slots)
+		if n == 0 {
+			break
+		}
+		resp, err := p.client.GetMessages(p.queue, GetMessagesParameters{NumOfMessages: n, VisibilityTimeout: visibility})
+		if err != nil {
+			p.log(LogError, "receiving queue messages failed", GetMessageResponse{}, err)
+		}
+		messages := resp.QueueMessagesList
+		for i := len(messages); i < n; i++ {
+			<-slots
+		}
+
+		if len(messages) == 0 {
+			if !sleepContext(ctx, delay) {
+				break
+			}
+			if delay *= 2; delay > options.MaxPollInterval {
+				delay = options.MaxPollInterval
+			}
+			continue
+		}
+		delay = options.MinPollInterval
+		for _, m := range messages {
+			wg.Add(1)
+			go func(m GetMessageResponse) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				p.process(m, options)
+			}(m)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// acquireSlots waits for a free slot, then takes every other free one up to
+// the number of messages a poll can return. It returns the number of slots
+// taken, which is zero if ctx is done first.
+func acquireSlots(ctx context.Context, slots chan struct{}) int {
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0
+	}
+	n := 1
+	for n < maxQueueMessagesPerGet {
+		select {
+		case slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// sleepContext waits for d, or until ctx is done in which case it returns
+// false.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// process hands m to the handler, extending its visibility until the
+// handler returns, and deletes it on success.
+func (p *QueueProcessor) process(m GetMessageResponse, options QueueProcessorOptions) {
+	if options.MaxDequeueCount > 0 && m.DequeueCount > options.MaxDequeueCount {
+		p.poison(m, options.PoisonQueue)
+		return
+	}
+	if m.DecodeError != nil {
+		// Left to reappear until it is moved to the poison queue.
+		p.log(LogWarning, "decoding queue message failed", m, m.DecodeError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(p.client.client.requestContext())
+	defer cancel()
+
+	// The renewing goroutine owns the pop receipt, which every update
+	// replaces, until it is done.
+	popReceipt := m.PopReceipt
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(options.VisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			next, err := p.client.updateMessage(p.queue, m.MessageID, nil, UpdateMessageParameters{
+				PopReceipt:        popReceipt,
+				VisibilityTimeout: int(options.VisibilityTimeout / time.Second),
+			})
+			if err != nil {
+				p.log(LogError, "extending queue message visibility failed", m, err)
+				cancel()
+				return
+			}
+			popReceipt = next
+		}
+	}()
+
+	err := p.handler(ctx, m)
+	close(stop)
+	<-renewed
+
+	switch {
+	case err != nil:
+		p.log(LogWarning, "queue message handler failed", m, err)
+	case ctx.Err() != nil:
+		// The message may already be handled by another consumer.
+	default:
+		if err := p.client.DeleteMessage(p.queue, m.MessageID, popReceipt); err != nil {
+			p.log(LogError, "deleting queue message failed", m, err)
+		} else if err := p.client.DeleteMessagePayload(m); err != nil {
+			p.log(LogWarning, "deleting queue message payload failed", m, err)
+		}
+	}
+}
+
+// poison moves m to the poison queue. Its text is moved as is, except for
+// offloaded payloads, which are offloaded again under the name of the poison
+// queue since references are only resolved for the queue they were written
+// for.
+func (p *QueueProcessor) poison(m GetMessageResponse, poisonQueue string) {
+	var err error
+	if m.PayloadBlob != "" {
+		err = p.client.PutMessage(poisonQueue, m.MessageText, PutMessageParameters{})
+	} else {
+		err = p.client.putMessageText(poisonQueue, m.text, PutMessageParameters{})
+	}
+	if err != nil {
+		p.log(LogError, "moving queue message to the poison queue failed", m, err)
+		return
+	}
+	if err := p.client.DeleteMessage(p.queue, m.MessageID, m.PopReceipt); err != nil {
+		p.log(LogError, "deleting poison queue message failed", m, err)
+		return
+	}
+	if err := p.client.DeleteMessagePayload(m); err != nil {
+		p.log(LogWarning, "deleting queue message payload failed", m, err)
+	}
+	p.log(LogWarning, "moved queue message to the poison queue", m, nil)
+}
+
+func (p *QueueProcessor) log(level LogLevel, msg string, m GetMessageResponse, err error) {
+	fields := map[string]interface{}{"queue": p.queue}
+	if m.MessageID != "" {
+		fields["messageId"] = m.MessageID
+		fields["dequeueCount"] = m.DequeueCount
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		if id := requestIDFromError(err); id != "" {
+			fields["requestId"] = id
+		}
+	}
+	p.client.client.log(level, msg, fields)
+}
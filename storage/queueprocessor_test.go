@@ -0,0 +1,97 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/storage/storagetest"
+	chk "gopkg.in/check.v1"
+)
+
+type QueueProcessorSuite struct {
+	srv *storagetest.Server
+	cli storage.QueueServiceClient
+}
+
+var _ = chk.Suite(&QueueProcessorSuite{})
+
+func (s *QueueProcessorSuite) SetUpTest(c *chk.C) {
+	s.srv = storagetest.NewServer()
+	s.cli = s.srv.Client().GetQueueService()
+	c.Assert(s.cli.CreateQueue("queue"), chk.IsNil)
+}
+
+func (s *QueueProcessorSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *QueueProcessorSuite) TestProcessor(c *chk.C) {
+	c.Assert(s.cli.CreateQueue("queue-poison"), chk.IsNil)
+	for _, text := range []string{"ok", "slow", "fail"} {
+		c.Assert(s.cli.PutMessage("queue", text, storage.PutMessageParameters{}), chk.IsNil)
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	handler := func(ctx context.Context, m storage.GetMessageResponse) error {
+		mu.Lock()
+		handled[m.MessageText]++
+		mu.Unlock()
+		switch m.MessageText {
+		case "slow":
+			// Outlives the visibility timeout, which must be extended.
+			select {
+			case <-time.After(1500 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case "fail":
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	processor := s.cli.NewQueueProcessor("queue", handler, storage.QueueProcessorOptions{
+		VisibilityTimeout: time.Second,
+		MaxDequeueCount:   2,
+		MinPollInterval:   10 * time.Millisecond,
+		MaxPollInterval:   50 * time.Millisecond,
+	})
+	go func() { done <- processor.Run(ctx) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		poisoned, err := s.cli.PeekMessages("queue-poison", storage.PeekMessagesParameters{})
+		c.Assert(err, chk.IsNil)
+		if len(poisoned.QueueMessagesList) > 0 {
+			c.Assert(poisoned.QueueMessagesList[0].MessageText, chk.Equals, "fail")
+			break
+		}
+		c.Assert(time.Now().Before(deadline), chk.Equals, true)
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	c.Assert(<-done, chk.IsNil)
+
+	metadata, err := s.cli.GetMetadata("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata.ApproximateMessageCount, chk.Equals, 0)
+	c.Assert(handled, chk.DeepEquals, map[string]int{"ok": 1, "slow": 1, "fail": 2})
+}
+
+func (s *QueueProcessorSuite) TestProcessorInvalidOptions(c *chk.C) {
+	handler := func(context.Context, storage.GetMessageResponse) error { return nil }
+	for _, options := range []storage.QueueProcessorOptions{
+		{VisibilityTimeout: 1500 * time.Millisecond},
+		{VisibilityTimeout: 8 * 24 * time.Hour},
+		{PoisonQueue: "queue"},
+	} {
+		err := s.cli.NewQueueProcessor("queue", handler, options).Run(context.Background())
+		c.Assert(err, chk.ErrorMatches, "storage: .*")
+	}
+}
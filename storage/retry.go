@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultRetryMaxRetries is the number of times a request is retried
+	// when ExponentialRetryPolicy.MaxRetries is not set.
+	DefaultRetryMaxRetries = 3
+
+	// DefaultRetryInitialDelay is the delay before the first retry when
+	// ExponentialRetryPolicy.InitialDelay is not set.
+	DefaultRetryInitialDelay = 500 * time.Millisecond
+
+	// DefaultRetryMaxDelay is the longest delay between two attempts when
+	// ExponentialRetryPolicy.MaxDelay is not set.
+	DefaultRetryMaxDelay = 30 * time.Second
+)
+
+// RetryPolicy decides whether a failed request is sent again. It is
+// consulted after every failed attempt, and only for failures that can be
+// retried safely: the request body, if any, can be rewound, the context of
+// the request is not done, and the request is idempotent or never reached
+// the service. Putting a message, appending a block without an append
+// position condition and executing a table batch are not idempotent.
+type RetryPolicy interface {
+	// ShouldRetry is called after the given attempt, counted from zero,
+	// failed with err. statusCode is the status of the response or zero if
+	// none was received, and elapsed is the time since the first attempt
+	// started. It returns the delay before the next attempt and whether
+	// there should be one.
+	ShouldRetry(attempt int, elapsed time.Duration, statusCode int, err error) (time.Duration, bool)
+}
+
+// ExponentialRetryPolicy is a RetryPolicy retrying throttled requests,
+// server errors and network failures with exponentially growing delays.
+// A zero ExponentialRetryPolicy uses the DefaultRetry constants and no
+// jitter.
+type ExponentialRetryPolicy struct {
+	// MaxRetries is the maximum number of retries of a single request.
+	// Use a negative value to disable retries.
+	MaxRetries int
+
+	// InitialDelay is the delay before the first retry. It is doubled on
+	// every subsequent retry, up to MaxDelay.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+
+	// MaxElapsedTime stops retrying once the next attempt would start more
+	// than MaxElapsedTime after the first one. Zero means no limit.
+	MaxElapsedTime time.Duration
+
+	// Jitter is the fraction, between 0 and 1, by which each delay is
+	// randomly shortened or lengthened so clients throttled together do not
+	// retry together.
+	Jitter float64
+}
+
+// ShouldRetry implements RetryPolicy.
+func (p ExponentialRetryPolicy) ShouldRetry(attempt int, elapsed time.Duration, statusCode int, err error) (time.Duration, bool) {
+	maxRetries := p.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultRetryMaxRetries
+	}
+	if attempt >= maxRetries || !IsRetriableError(statusCode, err) {
+		return 0, false
+	}
+
+	delay, maxDelay := p.InitialDelay, p.MaxDelay
+	if delay <= 0 {
+		delay = DefaultRetryInitialDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryMaxDelay
+	}
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (2*rand.Float64() - 1))
+	}
+
+	if p.MaxElapsedTime > 0 && elapsed+delay > p.MaxElapsedTime {
+		return 0, false
+	}
+	return delay, true
+}
+
+// IsRetriableError reports whether a request that failed with err, and
+// statusCode if a response was received, may succeed if sent again.
+// Throttling (503 Server Busy), timeouts, server errors and dropped
+// connections are retriable; every other client error, notably 409 Conflict
+// and 412 Precondition Failed, is not.
+func IsRetriableError(statusCode int, err error) bool {
+	switch statusCode {
+	case 0:
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	switch err := err.(type) {
+	case *net.OpError:
+		return true
+	case net.Error:
+		return err.Timeout() || err.Temporary()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// notSent reports whether a request that failed with err, and statusCode
+// if a response was received, never reached the service: no response was
+// received because the connection to the service could not be opened.
+func notSent(statusCode int, err error) bool {
+	if statusCode != 0 {
+		return false
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	operr, ok := err.(*net.OpError)
+	return ok && operr.Op == "dial"
+}
+
+// doWithRetries calls send until it succeeds or c.RetryPolicy gives up,
+// rewinding body between attempts. send returns the status code of the
+// response, or zero if none was received; error statuses count as failures
+// even without an error, as the table service reports them. A body that
+// cannot be rewound is never sent twice, and requests that are not
+// idempotent are only sent again when the failed attempt never reached the
+// service, since one that timed out or failed with a server error may have
+// been applied anyway.
+func (c Client) doWithRetries(body io.Reader, idempotent bool, send func(attempt int) (int, error)) error {
+	start := time.Now()
+	ctx := c.requestContext()
+
+	rewinds := body == nil
+	var seeker io.Seeker
+	var offset int64
+	if s, ok := body.(io.Seeker); ok && c.RetryPolicy != nil {
+		if o, err := s.Seek(0, io.SeekCurrent); err == nil {
+			seeker, offset, rewinds = s, o, true
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		statusCode, err := send(attempt)
+		failed := err != nil || statusCode >= http.StatusBadRequest
+		if !failed || c.RetryPolicy == nil || !rewinds || ctx.Err() != nil {
+			return err
+		}
+		if !idempotent && !notSent(statusCode, err) {
+			return err
+		}
+		delay, retry := c.RetryPolicy.ShouldRetry(attempt, time.Since(start), statusCode, err)
+		if !retry {
+			return err
+		}
+		fields := map[string]interface{}{
+			"attempt":   attempt + 1,
+			"delay":     delay,
+			"status":    statusCode,
+			"requestId": requestIDFromError(err),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		c.log(LogInfo, "retrying request", fields)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if seeker != nil {
+			if _, serr := seeker.Seek(offset, io.SeekStart); serr != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = chk.Suite(&RetrySuite{})
+
+// flakyServer fails the first failures requests with status and succeeds
+// afterwards, recording every request body it receives.
+type flakyServer struct {
+	mu       sync.Mutex
+	status   int
+	failures int
+	ok       int
+	bodies   []string
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	f.bodies = append(f.bodies, string(body))
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(f.status)
+		return
+	}
+	w.WriteHeader(f.ok)
+	if r.Method == http.MethodGet {
+		w.Write([]byte(`{"value":[]}`))
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var testRetryPolicy = ExponentialRetryPolicy{InitialDelay: time.Millisecond}
+
+func (s *RetrySuite) TestIsRetriableError(c *chk.C) {
+	c.Assert(IsRetriableError(http.StatusServiceUnavailable, nil), chk.Equals, true)
+	c.Assert(IsRetriableError(http.StatusInternalServerError, nil), chk.Equals, true)
+	c.Assert(IsRetriableError(http.StatusConflict, nil), chk.Equals, false)
+	c.Assert(IsRetriableError(http.StatusPreconditionFailed, nil), chk.Equals, false)
+	c.Assert(IsRetriableError(http.StatusNotFound, nil), chk.Equals, false)
+
+	c.Assert(IsRetriableError(0, &url.Error{Op: "Get", URL: "u", Err: timeoutError{}}), chk.Equals, true)
+	c.Assert(IsRetriableError(0, &url.Error{Op: "Put", URL: "u", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}), chk.Equals, true)
+	c.Assert(IsRetriableError(0, io.ErrUnexpectedEOF), chk.Equals, true)
+	c.Assert(IsRetriableError(0, context.Canceled), chk.Equals, false)
+}
+
+func (s *RetrySuite) TestExponentialRetryPolicyDelays(c *chk.C) {
+	p := ExponentialRetryPolicy{MaxRetries: 5, InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay, ok := p.ShouldRetry(attempt, 0, http.StatusServiceUnavailable, nil)
+		c.Assert(ok, chk.Equals, true)
+		c.Assert(delay, chk.Equals, want)
+	}
+	_, ok := p.ShouldRetry(5, 0, http.StatusServiceUnavailable, nil)
+	c.Assert(ok, chk.Equals, false)
+
+	p.MaxElapsedTime = 10 * time.Second
+	_, ok = p.ShouldRetry(2, 7*time.Second, http.StatusServiceUnavailable, nil)
+	c.Assert(ok, chk.Equals, false)
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay, _ := p.ShouldRetry(0, 0, http.StatusServiceUnavailable, nil)
+		c.Assert(delay >= time.Second/2 && delay <= 3*time.Second/2, chk.Equals, true)
+	}
+
+	_, ok = ExponentialRetryPolicy{MaxRetries: -1}.ShouldRetry(0, 0, http.StatusServiceUnavailable, nil)
+	c.Assert(ok, chk.Equals, false)
+}
+
+func (s *RetrySuite) TestRetryRewindsBody(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 2, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	err := cli.GetBlobService().PutBlockWithLength("container", "blob", "YmxvY2s=", 5, bytes.NewReader([]byte("hello")), nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.bodies, chk.DeepEquals, []string{"hello", "hello", "hello"})
+}
+
+func (s *RetrySuite) TestNoRetryWithoutPolicy(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 1, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	err := cli.GetBlobService().PutBlockWithLength("container", "blob", "YmxvY2s=", 5, bytes.NewReader([]byte("hello")), nil)
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.bodies, chk.HasLen, 1)
+}
+
+func (s *RetrySuite) TestNoRetryOnConflict(c *chk.C) {
+	fake := &flakyServer{status: http.StatusConflict, failures: 1, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	err := cli.GetBlobService().PutBlockWithLength("container", "blob", "YmxvY2s=", 5, bytes.NewReader([]byte("hello")), nil)
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.bodies, chk.HasLen, 1)
+}
+
+func (s *RetrySuite) TestNoRetryOfUnseekableBody(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 1, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	body := io.MultiReader(bytes.NewReader([]byte("hello")))
+	err := cli.GetBlobService().PutBlockWithLength("container", "blob", "YmxvY2s=", 5, body, nil)
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.bodies, chk.HasLen, 1)
+}
+
+func (s *RetrySuite) TestRetryTableRequest(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 1, ok: http.StatusOK}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	table := cli.GetTableService()
+	tables, err := table.QueryTables()
+	c.Assert(err, chk.IsNil)
+	c.Assert(tables, chk.HasLen, 0)
+	c.Assert(fake.bodies, chk.HasLen, 2)
+}
+
+// dialFailure fails the first request it sends as if the connection could
+// not be opened.
+type dialFailure struct {
+	transport http.RoundTripper
+	failed    bool
+}
+
+func (t *dialFailure) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.failed {
+		t.failed = true
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func (s *RetrySuite) TestNoRetryOfNonIdempotentRequest(c *chk.C) {
+	fake := &flakyServer{status: http.StatusServiceUnavailable, failures: 1, ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+
+	err := cli.GetQueueService().PutMessage("queue", "hello", PutMessageParameters{})
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.bodies, chk.HasLen, 1)
+
+	fake.failures = 1
+	err = cli.GetBlobService().AppendBlock("container", "blob", []byte("hello"), nil)
+	c.Assert(err, chk.NotNil)
+	c.Assert(fake.bodies, chk.HasLen, 2)
+
+	fake.failures = 1
+	err = cli.GetBlobService().AppendBlock("container", "blob", []byte("hello"), map[string]string{
+		"x-ms-blob-condition-appendpos": "0",
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.bodies, chk.HasLen, 4)
+}
+
+func (s *RetrySuite) TestRetryOfUnsentNonIdempotentRequest(c *chk.C) {
+	fake := &flakyServer{ok: http.StatusCreated}
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+	cli.RetryPolicy = testRetryPolicy
+	cli.HTTPClient.Transport = &dialFailure{transport: cli.HTTPClient.Transport}
+
+	err := cli.GetQueueService().PutMessage("queue", "hello", PutMessageParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.bodies, chk.HasLen, 1)
+}
@@ -0,0 +1,436 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// serviceSASVersion is the signed version (sv) of the signatures built by
+// the service SAS methods. It is independent of the x-ms-version the client
+// sends and is the first version supporting signed IPs and protocols.
+const serviceSASVersion = "2015-04-05"
+
+// Signed resource (sr) values of a service SAS.
+const (
+	sasResourceBlob      = "b"
+	sasResourceContainer = "c"
+	sasResourceFile      = "f"
+	sasResourceShare     = "s"
+)
+
+// Permissions accepted by each kind of signed resource, in the order the
+// service expects them. Signed permissions are put in this order before
+// signing, so "wr" is signed as "rw".
+const (
+	blobSASPermissions      = "racwd"
+	containerSASPermissions = "racwdl"
+	queueSASPermissions     = "raup"
+	tableSASPermissions     = "raud"
+	fileSASPermissions      = "rcwd"
+	shareSASPermissions     = "rcwdl"
+)
+
+// SASOptions are the parameters of a service shared access signature.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+type SASOptions struct {
+	// Permissions are the signed permissions (sp), such as "rw", in any
+	// order. They may be left empty when Identifier names a policy that
+	// sets them.
+	Permissions string
+
+	// Start is the time the signature becomes valid (st). The zero value
+	// makes it valid immediately.
+	Start time.Time
+
+	// Expiry is the time the signature stops being valid (se). It may be
+	// left zero when Identifier names a policy that sets it.
+	Expiry time.Time
+
+	// Identifier is the name of a stored access policy on the container,
+	// queue, table or share (si).
+	Identifier string
+
+	// IPRange restricts the addresses the signature is accepted from (sip),
+	// either a single IP or a range such as "168.1.5.60-168.1.5.70".
+	IPRange string
+
+	// HTTPSOnly rejects requests made over plain HTTP (spr).
+	HTTPSOnly bool
+
+	// Response header overrides, honoured for blob and file signatures
+	// only (rscc, rscd, rsce, rscl and rsct).
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentType        string
+}
+
+// TableSASOptions are the parameters of a table shared access signature.
+// The key ranges are inclusive and restrict the entities the signature
+// grants access to.
+type TableSASOptions struct {
+	SASOptions
+
+	StartPartitionKey string
+	StartRowKey       string
+	EndPartitionKey   string
+	EndRowKey         string
+}
+
+// Characters accepted in the fields of an account SAS.
+const (
+	accountSASServices      = "bqtf"
+	accountSASResourceTypes = "sco"
+	accountSASPermissions   = "rwdlacup"
+)
+
+// AccountSASOptions are the parameters of an account shared access
+// signature, which grants access to the services of the account rather
+// than to a single resource.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/mt584140.aspx
+type AccountSASOptions struct {
+	// Services are the signed services (ss), any of "b" (blob), "q"
+	// (queue), "t" (table) and "f" (file).
+	Services string
+
+	// ResourceTypes are the signed resource types (srt), any of "s"
+	// (service), "c" (container) and "o" (object).
+	ResourceTypes string
+
+	// Permissions are the signed permissions (sp), such as "rl".
+	Permissions string
+
+	Start     time.Time
+	Expiry    time.Time
+	IPRange   string
+	HTTPSOnly bool
+}
+
+// GetAccountSASToken creates an account Shared Access Signature from
+// options. The returned token is the query string to append to request
+// URLs, or to pass to NewAccountSASClient.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/mt584140.aspx
+func (c Client) GetAccountSASToken(options AccountSASOptions) (string, error) {
+	if err := c.checkSigningKey(); err != nil {
+		return "", err
+	}
+	for _, f := range []struct{ name, value, allowed string }{
+		{"services", options.Services, accountSASServices},
+		{"resource types", options.ResourceTypes, accountSASResourceTypes},
+		{"permissions", options.Permissions, accountSASPermissions},
+	} {
+		if f.value == "" {
+			return "", fmt.Errorf("storage: account SAS %s are required", f.name)
+		}
+		for _, r := range f.value {
+			if !strings.ContainsRune(f.allowed, r) {
+				return "", fmt.Errorf("storage: invalid account SAS %s %q, want a subset of %q", f.name, r, f.allowed)
+			}
+		}
+	}
+	if options.Expiry.IsZero() {
+		return "", errors.New("storage: account SAS expiry time is required")
+	}
+	options.Permissions, _ = canonicalPermissions(options.Permissions, accountSASPermissions)
+	if !options.Start.IsZero() && !options.Start.Before(options.Expiry) {
+		return "", errors.New("storage: SAS start time must be before its expiry time")
+	}
+
+	var protocols string
+	if options.HTTPSOnly {
+		protocols = "https"
+	}
+	// The string to sign ends with a newline.
+	stringToSign := strings.Join([]string{
+		c.getCanonicalizedAccountName(),
+		options.Permissions,
+		options.Services,
+		options.ResourceTypes,
+		formatSASTime(options.Start),
+		formatSASTime(options.Expiry),
+		options.IPRange,
+		protocols,
+		serviceSASVersion,
+		"",
+	}, "\n")
+
+	params := url.Values{
+		"sv":  {serviceSASVersion},
+		"ss":  {options.Services},
+		"srt": {options.ResourceTypes},
+		"sp":  {options.Permissions},
+		"se":  {formatSASTime(options.Expiry)},
+		"sig": {c.computeHmac256(stringToSign)},
+	}
+	if !options.Start.IsZero() {
+		params.Set("st", formatSASTime(options.Start))
+	}
+	if options.IPRange != "" {
+		params.Set("sip", options.IPRange)
+	}
+	if protocols != "" {
+		params.Set("spr", protocols)
+	}
+	return params.Encode(), nil
+}
+
+// GetContainerSASURI creates an URL to the specified container which
+// contains a service Shared Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (b BlobStorageClient) GetContainerSASURI(container string, options SASOptions) (string, error) {
+	uri := b.client.getEndpoint(blobServiceName, pathForContainer(container), url.Values{})
+	params, err := b.client.serviceSASParams(blobServiceName, uri, sasResourceContainer, containerSASPermissions, options, nil)
+	if err != nil {
+		return "", err
+	}
+	return sasURI(uri, params)
+}
+
+// GetBlobSASURIWithOptions creates an URL to the specified blob which
+// contains a service Shared Access Signature built from options. Unlike
+// GetBlobSASURI it supports start times, stored access policies and
+// response header overrides. Use GetBlobRefSASURI for snapshots.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (b BlobStorageClient) GetBlobSASURIWithOptions(container, name string, options SASOptions) (string, error) {
+	return b.GetBlobRefSASURI(BlobRef{Container: container, Name: name}, options)
+}
+
+// GetBlobRefSASURI creates an URL to the blob or snapshot addressed by ref
+// which contains a service Shared Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (b BlobStorageClient) GetBlobRefSASURI(ref BlobRef, options SASOptions) (string, error) {
+	uri := b.GetBlobURL(ref.Container, ref.Name)
+	params, err := b.client.serviceSASParams(blobServiceName, uri, sasResourceBlob, blobSASPermissions, options, nil)
+	if err != nil {
+		return "", err
+	}
+	return sasURI(uri, mergeParams(params, ref.query()))
+}
+
+// GetQueueSASURI creates an URL to the specified queue which contains a
+// service Shared Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (c QueueServiceClient) GetQueueSASURI(queue string, options SASOptions) (string, error) {
+	uri := c.client.getEndpoint(queueServiceName, pathForQueue(queue), url.Values{})
+	params, err := c.client.serviceSASParams(queueServiceName, uri, "", queueSASPermissions, options, nil)
+	if err != nil {
+		return "", err
+	}
+	return sasURI(uri, params)
+}
+
+// GetTableSASURI creates an URL to the specified table which contains a
+// service Shared Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (c *TableServiceClient) GetTableSASURI(table AzureTable, options TableSASOptions) (string, error) {
+	// Table names are case-insensitive and signed in lower case.
+	signed := c.client.getEndpoint(tableServiceName, "/"+strings.ToLower(string(table)), url.Values{})
+	params, err := c.client.serviceSASParams(tableServiceName, signed, "", tableSASPermissions, options.SASOptions, &options)
+	if err != nil {
+		return "", err
+	}
+	params.Set("tn", string(table))
+	return sasURI(c.client.getEndpoint(tableServiceName, "/"+string(table), url.Values{}), params)
+}
+
+// GetSASURI creates an URL to the share which contains a service Shared
+// Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (s *Share) GetSASURI(options SASOptions) (string, error) {
+	uri := s.URL()
+	params, err := s.fsc.client.serviceSASParams(fileServiceName, uri, sasResourceShare, shareSASPermissions, options, nil)
+	if err != nil {
+		return "", err
+	}
+	return sasURI(uri, params)
+}
+
+// GetSASURI creates an URL to the file which contains a service Shared
+// Access Signature built from options.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func (f *File) GetSASURI(options SASOptions) (string, error) {
+	uri := f.URL()
+	params, err := f.fsc.client.serviceSASParams(fileServiceName, uri, sasResourceFile, fileSASPermissions, options, nil)
+	if err != nil {
+		return "", err
+	}
+	return sasURI(uri, params)
+}
+
+// validate checks o against the permissions accepted by the signed
+// resource and puts the permissions of o in their canonical order.
+func (o *SASOptions) validate(service, permissions string) error {
+	if o.Identifier == "" {
+		if o.Expiry.IsZero() {
+			return errors.New("storage: SAS expiry time is required without a stored access policy")
+		}
+		if o.Permissions == "" {
+			return errors.New("storage: SAS permissions are required without a stored access policy")
+		}
+	}
+	var err error
+	if o.Permissions, err = canonicalPermissions(o.Permissions, permissions); err != nil {
+		return err
+	}
+	if !o.Start.IsZero() && !o.Expiry.IsZero() && !o.Start.Before(o.Expiry) {
+		return errors.New("storage: SAS start time must be before its expiry time")
+	}
+	if service != blobServiceName && service != fileServiceName && o.hasResponseHeaders() {
+		return fmt.Errorf("storage: response header overrides are not supported for %s SAS", service)
+	}
+	return nil
+}
+
+// canonicalPermissions returns the letters of permissions in the order of
+// allowed, the order the service expects them in. The service rejects
+// signatures with permissions out of order.
+func canonicalPermissions(permissions, allowed string) (string, error) {
+	for _, p := range permissions {
+		if !strings.ContainsRune(allowed, p) {
+			return "", fmt.Errorf("storage: invalid SAS permission %q, want a subset of %q", p, allowed)
+		}
+	}
+	canonical := make([]byte, 0, len(permissions))
+	for i := 0; i < len(allowed); i++ {
+		if strings.IndexByte(permissions, allowed[i]) >= 0 {
+			canonical = append(canonical, allowed[i])
+		}
+	}
+	return string(canonical), nil
+}
+
+func (o SASOptions) hasResponseHeaders() bool {
+	return o.CacheControl != "" || o.ContentDisposition != "" || o.ContentEncoding != "" ||
+		o.ContentLanguage != "" || o.ContentType != ""
+}
+
+// serviceSASParams signs options for the resource at uri and returns the
+// query parameters of the SAS. table carries the key ranges of table
+// signatures and is nil for the other services.
+func (c *Client) serviceSASParams(service, uri, resource, permissions string, options SASOptions, table *TableSASOptions) (url.Values, error) {
+	if err := c.checkSigningKey(); err != nil {
+		return nil, err
+	}
+	if err := options.validate(service, permissions); err != nil {
+		return nil, err
+	}
+	canonicalizedResource, err := c.sasCanonicalizedResource(service, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var protocols string
+	if options.HTTPSOnly {
+		protocols = "https"
+	}
+	fields := []string{
+		options.Permissions,
+		formatSASTime(options.Start),
+		formatSASTime(options.Expiry),
+		canonicalizedResource,
+		options.Identifier,
+		options.IPRange,
+		protocols,
+		serviceSASVersion,
+	}
+	switch service {
+	case blobServiceName, fileServiceName:
+		fields = append(fields, options.CacheControl, options.ContentDisposition,
+			options.ContentEncoding, options.ContentLanguage, options.ContentType)
+	case tableServiceName:
+		fields = append(fields, table.StartPartitionKey, table.StartRowKey,
+			table.EndPartitionKey, table.EndRowKey)
+	}
+
+	params := url.Values{
+		"sv":  {serviceSASVersion},
+		"sig": {c.computeHmac256(strings.Join(fields, "\n"))},
+	}
+	for _, p := range []struct{ key, value string }{
+		{"sr", resource},
+		{"sp", options.Permissions},
+		{"st", formatSASTime(options.Start)},
+		{"se", formatSASTime(options.Expiry)},
+		{"si", options.Identifier},
+		{"sip", options.IPRange},
+		{"spr", protocols},
+		{"rscc", options.CacheControl},
+		{"rscd", options.ContentDisposition},
+		{"rsce", options.ContentEncoding},
+		{"rscl", options.ContentLanguage},
+		{"rsct", options.ContentType},
+	} {
+		if p.value != "" {
+			params.Set(p.key, p.value)
+		}
+	}
+	if table != nil {
+		for _, p := range []struct{ key, value string }{
+			{"spk", table.StartPartitionKey},
+			{"srk", table.StartRowKey},
+			{"epk", table.EndPartitionKey},
+			{"erk", table.EndRowKey},
+		} {
+			if p.value != "" {
+				params.Set(p.key, p.value)
+			}
+		}
+	}
+	return params, nil
+}
+
+// sasCanonicalizedResource returns the URL-decoded canonical path of the
+// resource at uri, prefixed with the service name as required since
+// version 2015-02-21.
+func (c *Client) sasCanonicalizedResource(service, uri string) (string, error) {
+	canonicalizedResource, err := c.buildCanonicalizedResource(uri, sharedKey)
+	if err != nil {
+		return "", err
+	}
+	// Keep + literal, it is not a space in the path component.
+	canonicalizedResource = strings.Replace(canonicalizedResource, "+", "%2b", -1)
+	canonicalizedResource, err = url.QueryUnescape(canonicalizedResource)
+	if err != nil {
+		return "", err
+	}
+	return "/" + service + canonicalizedResource, nil
+}
+
+// checkSigningKey fails for clients which authenticate with a SAS token and
+// so hold no key to sign with.
+func (c Client) checkSigningKey() error {
+	if len(c.accountKey) == 0 {
+		return errors.New("storage: an account key is required to create a SAS")
+	}
+	return nil
+}
+
+func formatSASTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func sasURI(uri string, params url.Values) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
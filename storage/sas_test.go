@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type SASSuite struct {
+	cli Client
+}
+
+var _ = chk.Suite(&SASSuite{})
+
+func (s *SASSuite) SetUpTest(c *chk.C) {
+	cli, err := NewBasicClient("foo", "YmFy")
+	c.Assert(err, chk.IsNil)
+	s.cli = cli
+}
+
+var (
+	sasStart  = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	sasExpiry = time.Date(2017, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+)
+
+// parseSAS splits uri into its address and SAS parameters.
+func parseSAS(c *chk.C, uri string) (string, url.Values) {
+	u, err := url.Parse(uri)
+	c.Assert(err, chk.IsNil)
+	query := u.Query()
+	u.RawQuery = ""
+	return u.String(), query
+}
+
+// sign returns the signature of the newline-joined fields.
+func (s *SASSuite) sign(fields ...string) string {
+	return s.cli.computeHmac256(strings.Join(fields, "\n"))
+}
+
+func (s *SASSuite) TestContainerSAS(c *chk.C) {
+	u, err := s.cli.GetBlobService().GetContainerSASURI("cnt", SASOptions{
+		Permissions: "rl",
+		Start:       sasStart,
+		Expiry:      sasExpiry,
+		IPRange:     "10.0.0.1-10.0.0.9",
+		HTTPSOnly:   true,
+	})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.blob.core.windows.net/cnt")
+	c.Assert(query, chk.DeepEquals, url.Values{
+		"sv":  {"2015-04-05"},
+		"sr":  {"c"},
+		"sp":  {"rl"},
+		"st":  {"2017-01-01T00:00:00Z"},
+		"se":  {"2017-01-01T23:00:00Z"},
+		"sip": {"10.0.0.1-10.0.0.9"},
+		"spr": {"https"},
+		"sig": {s.sign("rl", "2017-01-01T00:00:00Z", "2017-01-01T23:00:00Z", "/blob/foo/cnt",
+			"", "10.0.0.1-10.0.0.9", "https", "2015-04-05", "", "", "", "", "")},
+	})
+}
+
+func (s *SASSuite) TestBlobSASResponseHeaders(c *chk.C) {
+	u, err := s.cli.GetBlobService().GetBlobSASURIWithOptions("cnt", "dir/a+b.txt", SASOptions{
+		Permissions:        "r",
+		Expiry:             sasExpiry,
+		ContentDisposition: "attachment",
+		ContentType:        "text/plain",
+	})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.blob.core.windows.net/cnt/dir/a+b.txt")
+	c.Assert(query.Get("sr"), chk.Equals, "b")
+	c.Assert(query.Get("rscd"), chk.Equals, "attachment")
+	c.Assert(query.Get("rsct"), chk.Equals, "text/plain")
+	c.Assert(query.Get("sig"), chk.Equals, s.sign("r", "", "2017-01-01T23:00:00Z", "/blob/foo/cnt/dir/a+b.txt",
+		"", "", "", "2015-04-05", "", "attachment", "", "", "text/plain"))
+}
+
+func (s *SASSuite) TestBlobRefSAS(c *chk.C) {
+	ref := BlobRef{Container: "cnt", Name: "blob", Snapshot: time.Date(2017, 3, 1, 10, 0, 0, 935596100, time.UTC)}
+	u, err := s.cli.GetBlobService().GetBlobRefSASURI(ref, SASOptions{Permissions: "r", Expiry: sasExpiry})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.blob.core.windows.net/cnt/blob")
+	c.Assert(query.Get("snapshot"), chk.Equals, "2017-03-01T10:00:00.9355961Z")
+	c.Assert(query.Get("sig"), chk.Equals, s.sign("r", "", "2017-01-01T23:00:00Z", "/blob/foo/cnt/blob",
+		"", "", "", "2015-04-05", "", "", "", "", ""))
+}
+
+func (s *SASSuite) TestBlobSASMatchesLegacy(c *chk.C) {
+	cli, err := NewClient("foo", "YmFy", DefaultBaseURL, "2015-04-05", true)
+	c.Assert(err, chk.IsNil)
+	legacy, err := cli.GetBlobService().GetBlobSASURIWithSignedIPAndProtocol("cnt", "blob", sasExpiry, "r", "127.0.0.1", true)
+	c.Assert(err, chk.IsNil)
+	u, err := cli.GetBlobService().GetBlobSASURIWithOptions("cnt", "blob", SASOptions{
+		Permissions: "r",
+		Expiry:      sasExpiry,
+		IPRange:     "127.0.0.1",
+		HTTPSOnly:   true,
+	})
+	c.Assert(err, chk.IsNil)
+	_, want := parseSAS(c, legacy)
+	_, got := parseSAS(c, u)
+	c.Assert(got, chk.DeepEquals, want)
+}
+
+func (s *SASSuite) TestQueueSASPolicy(c *chk.C) {
+	u, err := s.cli.GetQueueService().GetQueueSASURI("queue", SASOptions{Identifier: "readers"})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.queue.core.windows.net/queue")
+	c.Assert(query, chk.DeepEquals, url.Values{
+		"sv":  {"2015-04-05"},
+		"si":  {"readers"},
+		"sig": {s.sign("", "", "", "/queue/foo/queue", "readers", "", "", "2015-04-05")},
+	})
+}
+
+func (s *SASSuite) TestTableSAS(c *chk.C) {
+	tables := s.cli.GetTableService()
+	u, err := tables.GetTableSASURI("MyTable", TableSASOptions{
+		SASOptions:        SASOptions{Permissions: "ra", Expiry: sasExpiry},
+		StartPartitionKey: "p1",
+		EndPartitionKey:   "p2",
+		EndRowKey:         "r9",
+	})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.table.core.windows.net/MyTable")
+	c.Assert(query, chk.DeepEquals, url.Values{
+		"sv":  {"2015-04-05"},
+		"tn":  {"MyTable"},
+		"sp":  {"ra"},
+		"se":  {"2017-01-01T23:00:00Z"},
+		"spk": {"p1"},
+		"epk": {"p2"},
+		"erk": {"r9"},
+		"sig": {s.sign("ra", "", "2017-01-01T23:00:00Z", "/table/foo/mytable", "", "", "", "2015-04-05",
+			"p1", "", "p2", "r9")},
+	})
+}
+
+func (s *SASSuite) TestFileSAS(c *chk.C) {
+	share := s.cli.GetFileService().GetShareReference("share")
+	u, err := share.GetSASURI(SASOptions{Permissions: "rl", Expiry: sasExpiry})
+	c.Assert(err, chk.IsNil)
+	addr, query := parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.file.core.windows.net/share")
+	c.Assert(query.Get("sr"), chk.Equals, "s")
+	c.Assert(query.Get("sig"), chk.Equals, s.sign("rl", "", "2017-01-01T23:00:00Z", "/file/foo/share",
+		"", "", "", "2015-04-05", "", "", "", "", ""))
+
+	f := share.GetRootDirectoryReference().GetDirectoryReference("dir").GetFileReference("my file")
+	u, err = f.GetSASURI(SASOptions{Permissions: "r", Expiry: sasExpiry, CacheControl: "no-cache"})
+	c.Assert(err, chk.IsNil)
+	addr, query = parseSAS(c, u)
+	c.Assert(addr, chk.Equals, "https://foo.file.core.windows.net/share/dir/my%20file")
+	c.Assert(query.Get("sr"), chk.Equals, "f")
+	c.Assert(query.Get("rscc"), chk.Equals, "no-cache")
+	c.Assert(query.Get("sig"), chk.Equals, s.sign("r", "", "2017-01-01T23:00:00Z", "/file/foo/share/dir/my file",
+		"", "", "", "2015-04-05", "no-cache", "", "", "", ""))
+}
+
+func (s *SASSuite) TestPermissionsAreCanonicalized(c *chk.C) {
+	u, err := s.cli.GetBlobService().GetContainerSASURI("cnt", SASOptions{Permissions: "lwr", Expiry: sasExpiry})
+	c.Assert(err, chk.IsNil)
+	_, query := parseSAS(c, u)
+	c.Assert(query.Get("sp"), chk.Equals, "rwl")
+	c.Assert(query.Get("sig"), chk.Equals, s.sign("rwl", "", "2017-01-01T23:00:00Z", "/blob/foo/cnt",
+		"", "", "", "2015-04-05", "", "", "", "", ""))
+
+	token, err := s.cli.GetAccountSASToken(AccountSASOptions{Services: "b", ResourceTypes: "o", Permissions: "lr", Expiry: sasExpiry})
+	c.Assert(err, chk.IsNil)
+	query, err = url.ParseQuery(token)
+	c.Assert(err, chk.IsNil)
+	c.Assert(query.Get("sp"), chk.Equals, "rl")
+}
+
+func (s *SASSuite) TestInvalidOptions(c *chk.C) {
+	blobs := s.cli.GetBlobService()
+	queues := s.cli.GetQueueService()
+	for _, err := range []error{
+		getErr(blobs.GetContainerSASURI("cnt", SASOptions{Permissions: "r"})),
+		getErr(blobs.GetContainerSASURI("cnt", SASOptions{Expiry: sasExpiry})),
+		getErr(blobs.GetBlobSASURIWithOptions("cnt", "blob", SASOptions{Permissions: "rl", Expiry: sasExpiry})),
+		getErr(blobs.GetContainerSASURI("cnt", SASOptions{Permissions: "r", Start: sasExpiry, Expiry: sasStart})),
+		getErr(queues.GetQueueSASURI("queue", SASOptions{Permissions: "r", Expiry: sasExpiry, ContentType: "text/plain"})),
+	} {
+		c.Assert(err, chk.ErrorMatches, "storage: .*")
+	}
+}
+
+func getErr(_ string, err error) error {
+	return err
+}
+
+func (s *SASSuite) TestAccountSAS(c *chk.C) {
+	token, err := s.cli.GetAccountSASToken(AccountSASOptions{
+		Services:      "bq",
+		ResourceTypes: "co",
+		Permissions:   "rl",
+		Expiry:        sasExpiry,
+		HTTPSOnly:     true,
+	})
+	c.Assert(err, chk.IsNil)
+	query, err := url.ParseQuery(token)
+	c.Assert(err, chk.IsNil)
+	c.Assert(query, chk.DeepEquals, url.Values{
+		"sv":  {"2015-04-05"},
+		"ss":  {"bq"},
+		"srt": {"co"},
+		"sp":  {"rl"},
+		"se":  {"2017-01-01T23:00:00Z"},
+		"spr": {"https"},
+		"sig": {s.sign("foo", "rl", "bq", "co", "", "2017-01-01T23:00:00Z", "", "https", "2015-04-05", "")},
+	})
+
+	for _, options := range []AccountSASOptions{
+		{ResourceTypes: "o", Permissions: "r", Expiry: sasExpiry},
+		{Services: "bx", ResourceTypes: "o", Permissions: "r", Expiry: sasExpiry},
+		{Services: "b", ResourceTypes: "o", Permissions: "r"},
+	} {
+		_, err := s.cli.GetAccountSASToken(options)
+		c.Assert(err, chk.ErrorMatches, "storage: .*")
+	}
+}
+
+func (s *SASSuite) TestSASClientCannotSign(c *chk.C) {
+	cli, err := NewAccountSASClient("foo", "?sv=2015-04-05&sig=abc")
+	c.Assert(err, chk.IsNil)
+	_, err = cli.GetAccountSASToken(AccountSASOptions{Services: "b", ResourceTypes: "o", Permissions: "r", Expiry: sasExpiry})
+	c.Assert(err, chk.ErrorMatches, "storage: an account key is required .*")
+	_, err = cli.GetBlobService().GetBlobSASURI("cnt", "blob", sasExpiry, "r")
+	c.Assert(err, chk.ErrorMatches, "storage: an account key is required .*")
+}
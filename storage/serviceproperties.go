@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// analyticsVersion is the only version of Storage Analytics logging and
+	// metrics.
+	analyticsVersion = "1.0"
+
+	// staticWebsiteAPIVersion is the first API version in which the blob
+	// service properties carry the static website settings. Blob service
+	// properties are always read and written with it.
+	staticWebsiteAPIVersion = "2018-03-28"
+
+	// secondaryAccountSuffix is appended to the account name to build the
+	// endpoint of the secondary location of geo-replicated accounts.
+	secondaryAccountSuffix = "-secondary"
+)
+
+// ServiceProperties are the properties of a storage service: its Storage
+// Analytics logging and metrics and its CORS rules. The settings left nil
+// are left unchanged by SetServiceProperties.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/set-blob-service-properties
+type ServiceProperties struct {
+	XMLName xml.Name `xml:"StorageServiceProperties"`
+
+	// Logging is not supported by the file service.
+	Logging       *Logging `xml:"Logging,omitempty"`
+	HourMetrics   *Metrics `xml:"HourMetrics,omitempty"`
+	MinuteMetrics *Metrics `xml:"MinuteMetrics,omitempty"`
+	Cors          *Cors    `xml:"Cors,omitempty"`
+
+	// DefaultServiceVersion is the API version used for the anonymous
+	// requests that do not specify one. Blob service only.
+	DefaultServiceVersion string `xml:"DefaultServiceVersion,omitempty"`
+
+	// StaticWebsite serves the $web container as a static website. Blob
+	// service only.
+	StaticWebsite *StaticWebsite `xml:"StaticWebsite,omitempty"`
+}
+
+// Logging sets which requests Storage Analytics logs to the $logs container.
+type Logging struct {
+	Version         string                   `xml:"Version"`
+	Delete          bool                     `xml:"Delete"`
+	Read            bool                     `xml:"Read"`
+	Write           bool                     `xml:"Write"`
+	RetentionPolicy AnalyticsRetentionPolicy `xml:"RetentionPolicy"`
+}
+
+// MarshalXML encodes l, defaulting its version to 1.0.
+func (l Logging) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type logging Logging
+	if l.Version == "" {
+		l.Version = analyticsVersion
+	}
+	return e.EncodeElement(logging(l), start)
+}
+
+// Metrics sets whether Storage Analytics aggregates request statistics in
+// the $Metrics tables.
+type Metrics struct {
+	Version string `xml:"Version"`
+	Enabled bool   `xml:"Enabled"`
+
+	// IncludeAPIs adds statistics for each API operation.
+	IncludeAPIs     bool                     `xml:"IncludeAPIs"`
+	RetentionPolicy AnalyticsRetentionPolicy `xml:"RetentionPolicy"`
+}
+
+// MarshalXML encodes m, defaulting its version to 1.0. IncludeAPIs is only
+// sent for enabled metrics, as the service requires.
+func (m Metrics) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := struct {
+		Version         string                   `xml:"Version"`
+		Enabled         bool                     `xml:"Enabled"`
+		IncludeAPIs     *bool                    `xml:"IncludeAPIs,omitempty"`
+		RetentionPolicy AnalyticsRetentionPolicy `xml:"RetentionPolicy"`
+	}{m.Version, m.Enabled, nil, m.RetentionPolicy}
+	if x.Version == "" {
+		x.Version = analyticsVersion
+	}
+	if m.Enabled {
+		x.IncludeAPIs = &m.IncludeAPIs
+	}
+	return e.EncodeElement(x, start)
+}
+
+// AnalyticsRetentionPolicy sets how long Storage Analytics keeps logs and
+// metrics. Days must be between 1 and 365 when the policy is enabled.
+type AnalyticsRetentionPolicy struct {
+	Enabled bool `xml:"Enabled"`
+	Days    int  `xml:"Days,omitempty"`
+}
+
+// Cors holds the CORS rules of a service, up to five. An empty list removes
+// all rules.
+type Cors struct {
+	Rules []CorsRule `xml:"CorsRule"`
+}
+
+// CorsRule allows cross-origin requests from browsers.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/cross-origin-resource-sharing--cors--support-for-the-azure-storage-services
+type CorsRule struct {
+	// AllowedOrigins are the origins allowed to send requests, or "*".
+	AllowedOrigins []string
+
+	// AllowedMethods are the HTTP methods the origins may use.
+	AllowedMethods []string
+
+	// AllowedHeaders and ExposedHeaders are the request headers allowed and
+	// the response headers exposed to the origins. A name may end with "*"
+	// to match a prefix.
+	AllowedHeaders []string
+	ExposedHeaders []string
+
+	// MaxAgeInSeconds is how long browsers may cache the preflight
+	// response.
+	MaxAgeInSeconds int
+}
+
+// corsRule is the wire form of CorsRule, which carries lists as comma
+// separated values.
+type corsRule struct {
+	AllowedOrigins  string `xml:"AllowedOrigins"`
+	AllowedMethods  string `xml:"AllowedMethods"`
+	AllowedHeaders  string `xml:"AllowedHeaders"`
+	ExposedHeaders  string `xml:"ExposedHeaders"`
+	MaxAgeInSeconds int    `xml:"MaxAgeInSeconds"`
+}
+
+// MarshalXML encodes r in the comma separated form of the service.
+func (r CorsRule) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(corsRule{
+		AllowedOrigins:  strings.Join(r.AllowedOrigins, ","),
+		AllowedMethods:  strings.Join(r.AllowedMethods, ","),
+		AllowedHeaders:  strings.Join(r.AllowedHeaders, ","),
+		ExposedHeaders:  strings.Join(r.ExposedHeaders, ","),
+		MaxAgeInSeconds: r.MaxAgeInSeconds,
+	}, start)
+}
+
+// UnmarshalXML decodes r from the comma separated form of the service.
+func (r *CorsRule) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var x corsRule
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	*r = CorsRule{
+		AllowedOrigins:  splitCorsList(x.AllowedOrigins),
+		AllowedMethods:  splitCorsList(x.AllowedMethods),
+		AllowedHeaders:  splitCorsList(x.AllowedHeaders),
+		ExposedHeaders:  splitCorsList(x.ExposedHeaders),
+		MaxAgeInSeconds: x.MaxAgeInSeconds,
+	}
+	return nil
+}
+
+func splitCorsList(s string) []string {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil
+	}
+	values := strings.Split(s, ",")
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// StaticWebsite sets whether the blob service serves the $web container as
+// a static website.
+type StaticWebsite struct {
+	Enabled              bool   `xml:"Enabled"`
+	IndexDocument        string `xml:"IndexDocument,omitempty"`
+	ErrorDocument404Path string `xml:"ErrorDocument404Path,omitempty"`
+}
+
+// ServiceStats are the replication statistics of a service of a
+// geo-replicated account.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-blob-service-stats
+type ServiceStats struct {
+	XMLName        xml.Name       `xml:"StorageServiceStats"`
+	GeoReplication GeoReplication `xml:"GeoReplication"`
+}
+
+// GeoReplicationStatus is the state of the secondary location of an account.
+type GeoReplicationStatus string
+
+// Geo-replication statuses.
+const (
+	GeoReplicationLive        GeoReplicationStatus = "live"
+	GeoReplicationBootstrap   GeoReplicationStatus = "bootstrap"
+	GeoReplicationUnavailable GeoReplicationStatus = "unavailable"
+)
+
+// GeoReplication is the replication state of the secondary location.
+// LastSyncTime is the time before which every write is available from the
+// secondary location. It is zero while the status is not live.
+type GeoReplication struct {
+	Status       GeoReplicationStatus
+	LastSyncTime time.Time
+}
+
+// UnmarshalXML decodes g, whose LastSyncTime is in RFC 1123 format and
+// empty when unknown.
+func (g *GeoReplication) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var x struct {
+		Status       GeoReplicationStatus `xml:"Status"`
+		LastSyncTime string               `xml:"LastSyncTime"`
+	}
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	g.Status = x.Status
+	g.LastSyncTime = time.Time{}
+	if x.LastSyncTime != "" {
+		t, err := time.Parse(time.RFC1123, x.LastSyncTime)
+		if err != nil {
+			return fmt.Errorf("storage: invalid geo-replication last sync time %q: %v", x.LastSyncTime, err)
+		}
+		g.LastSyncTime = t
+	}
+	return nil
+}
+
+// serviceParams are the query parameters addressing the properties and
+// stats of a service.
+func serviceParams(comp string) url.Values {
+	return url.Values{
+		"restype": {"service"},
+		"comp":    {comp},
+	}
+}
+
+func (c Client) getServiceProperties(service string, headers map[string]string, auth authentication) (*ServiceProperties, error) {
+	uri := c.getEndpoint(service, "", serviceParams("properties"))
+	resp, err := c.exec(http.MethodGet, uri, headers, nil, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.body.Close()
+
+	if err := checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
+		return nil, err
+	}
+	var props ServiceProperties
+	if err := xmlUnmarshal(resp.body, &props); err != nil {
+		return nil, err
+	}
+	return &props, nil
+}
+
+func (c Client) setServiceProperties(service string, headers map[string]string, props ServiceProperties, auth authentication) error {
+	body, length, err := xmlMarshal(props)
+	if err != nil {
+		return err
+	}
+	uri := c.getEndpoint(service, "", serviceParams("properties"))
+	headers["Content-Type"] = "application/xml"
+	headers["Content-Length"] = fmt.Sprintf("%d", length)
+	resp, err := c.exec(http.MethodPut, uri, headers, body, auth)
+	if err != nil {
+		return err
+	}
+	defer resp.body.Close()
+	return checkRespCode(resp.statusCode, []int{http.StatusAccepted})
+}
+
+// getServiceStats reads the stats of service from the secondary location
+// of the account, which is the only one serving them.
+func (c Client) getServiceStats(service string, auth authentication) (*ServiceStats, error) {
+	u, err := url.Parse(c.getEndpoint(service, "", serviceParams("stats")))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.accountName == StorageEmulatorAccountName && c.endpoints[service] == nil:
+		u.Path = "/" + StorageEmulatorAccountName + secondaryAccountSuffix + "/"
+	case strings.HasPrefix(u.Host, c.accountName+"."):
+		u.Host = c.accountName + secondaryAccountSuffix + strings.TrimPrefix(u.Host, c.accountName)
+	default:
+		return nil, fmt.Errorf("storage: cannot tell the secondary location of the %s endpoint %s", service, u.Host)
+	}
+	resp, err := c.exec(http.MethodGet, u.String(), c.getStandardHeaders(), nil, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.body.Close()
+
+	if err := checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
+		return nil, err
+	}
+	var stats ServiceStats
+	if err := xmlUnmarshal(resp.body, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// blobServiceHeaders are the headers of the blob service properties
+// requests, which use an API version that knows the static website
+// settings.
+func (b BlobStorageClient) blobServiceHeaders() map[string]string {
+	headers := b.client.getStandardHeaders()
+	headers["x-ms-version"] = staticWebsiteAPIVersion
+	return headers
+}
+
+// GetServiceProperties returns the properties of the blob service.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-blob-service-properties
+func (b BlobStorageClient) GetServiceProperties() (*ServiceProperties, error) {
+	return b.client.getServiceProperties(blobServiceName, b.blobServiceHeaders(), b.auth)
+}
+
+// SetServiceProperties sets the properties of the blob service. The
+// settings left nil in props are left unchanged.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/set-blob-service-properties
+func (b BlobStorageClient) SetServiceProperties(props ServiceProperties) error {
+	return b.client.setServiceProperties(blobServiceName, b.blobServiceHeaders(), props, b.auth)
+}
+
+// GetServiceStats returns the replication statistics of the blob service.
+// The account must have read-access geo-redundant replication enabled.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-blob-service-stats
+func (b BlobStorageClient) GetServiceStats() (*ServiceStats, error) {
+	return b.client.getServiceStats(blobServiceName, b.auth)
+}
+
+// GetServiceProperties returns the properties of the queue service.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-queue-service-properties
+func (c QueueServiceClient) GetServiceProperties() (*ServiceProperties, error) {
+	return c.client.getServiceProperties(queueServiceName, c.client.getStandardHeaders(), c.auth)
+}
+
+// SetServiceProperties sets the properties of the queue service. The
+// settings left nil in props are left unchanged.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/set-queue-service-properties
+func (c QueueServiceClient) SetServiceProperties(props ServiceProperties) error {
+	return c.client.setServiceProperties(queueServiceName, c.client.getStandardHeaders(), props, c.auth)
+}
+
+// GetServiceStats returns the replication statistics of the queue service.
+// The account must have read-access geo-redundant replication enabled.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-queue-service-stats
+func (c QueueServiceClient) GetServiceStats() (*ServiceStats, error) {
+	return c.client.getServiceStats(queueServiceName, c.auth)
+}
+
+// GetServiceProperties returns the properties of the table service.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-table-service-properties
+func (c *TableServiceClient) GetServiceProperties() (*ServiceProperties, error) {
+	return c.client.getServiceProperties(tableServiceName, c.client.getStandardHeaders(), c.auth)
+}
+
+// SetServiceProperties sets the properties of the table service. The
+// settings left nil in props are left unchanged.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/set-table-service-properties
+func (c *TableServiceClient) SetServiceProperties(props ServiceProperties) error {
+	return c.client.setServiceProperties(tableServiceName, c.client.getStandardHeaders(), props, c.auth)
+}
+
+// GetServiceStats returns the replication statistics of the table service.
+// The account must have read-access geo-redundant replication enabled.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-table-service-stats
+func (c *TableServiceClient) GetServiceStats() (*ServiceStats, error) {
+	return c.client.getServiceStats(tableServiceName, c.auth)
+}
+
+// GetServiceProperties returns the properties of the file service, which
+// has metrics and CORS rules but no logging.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/get-file-service-properties
+func (f FileServiceClient) GetServiceProperties() (*ServiceProperties, error) {
+	if err := f.checkForStorageEmulator(); err != nil {
+		return nil, err
+	}
+	return f.client.getServiceProperties(fileServiceName, f.client.getStandardHeaders(), f.auth)
+}
+
+// SetServiceProperties sets the properties of the file service. The
+// settings left nil in props are left unchanged.
+//
+// See https://docs.microsoft.com/rest/api/storageservices/set-file-service-properties
+func (f FileServiceClient) SetServiceProperties(props ServiceProperties) error {
+	if err := f.checkForStorageEmulator(); err != nil {
+		return err
+	}
+	if props.Logging != nil {
+		return errors.New("storage: the file service does not support logging")
+	}
+	return f.client.setServiceProperties(fileServiceName, f.client.getStandardHeaders(), props, f.auth)
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type ServicePropertiesSuite struct{}
+
+var _ = chk.Suite(&ServicePropertiesSuite{})
+
+// propertiesServer keeps the last service properties document it was sent
+// and serves it back.
+type propertiesServer struct {
+	c        *chk.C
+	document []byte
+	hosts    []string
+	versions []string
+}
+
+func (f *propertiesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.hosts = append(f.hosts, r.Host)
+	f.versions = append(f.versions, r.Header.Get("x-ms-version"))
+	q := r.URL.Query()
+	f.c.Check(q.Get("restype"), chk.Equals, "service")
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "properties":
+		body, err := ioutil.ReadAll(r.Body)
+		f.c.Assert(err, chk.IsNil)
+		f.document = body
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet && q.Get("comp") == "properties":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(f.document)
+	case r.Method == http.MethodGet && q.Get("comp") == "stats":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><StorageServiceStats><GeoReplication><Status>live</Status><LastSyncTime>Wed, 12 Apr 2017 08:09:10 GMT</LastSyncTime></GeoReplication></StorageServiceStats>`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testServiceProperties() ServiceProperties {
+	return ServiceProperties{
+		Logging: &Logging{
+			Delete:          true,
+			Write:           true,
+			RetentionPolicy: AnalyticsRetentionPolicy{Enabled: true, Days: 7},
+		},
+		HourMetrics: &Metrics{
+			Enabled:         true,
+			RetentionPolicy: AnalyticsRetentionPolicy{Enabled: true, Days: 30},
+		},
+		MinuteMetrics: &Metrics{},
+		Cors: &Cors{Rules: []CorsRule{{
+			AllowedOrigins:  []string{"https://a.example.com", "https://b.example.com"},
+			AllowedMethods:  []string{"GET", "PUT"},
+			AllowedHeaders:  []string{"x-ms-meta-*"},
+			MaxAgeInSeconds: 600,
+		}}},
+	}
+}
+
+func (s *ServicePropertiesSuite) TestMarshal(c *chk.C) {
+	b, err := xml.Marshal(testServiceProperties())
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(b), chk.Equals, "<StorageServiceProperties>"+
+		"<Logging><Version>1.0</Version><Delete>true</Delete><Read>false</Read><Write>true</Write>"+
+		"<RetentionPolicy><Enabled>true</Enabled><Days>7</Days></RetentionPolicy></Logging>"+
+		"<HourMetrics><Version>1.0</Version><Enabled>true</Enabled><IncludeAPIs>false</IncludeAPIs>"+
+		"<RetentionPolicy><Enabled>true</Enabled><Days>30</Days></RetentionPolicy></HourMetrics>"+
+		"<MinuteMetrics><Version>1.0</Version><Enabled>false</Enabled>"+
+		"<RetentionPolicy><Enabled>false</Enabled></RetentionPolicy></MinuteMetrics>"+
+		"<Cors><CorsRule><AllowedOrigins>https://a.example.com,https://b.example.com</AllowedOrigins>"+
+		"<AllowedMethods>GET,PUT</AllowedMethods><AllowedHeaders>x-ms-meta-*</AllowedHeaders>"+
+		"<ExposedHeaders></ExposedHeaders><MaxAgeInSeconds>600</MaxAgeInSeconds></CorsRule></Cors>"+
+		"</StorageServiceProperties>")
+
+	b, err = xml.Marshal(ServiceProperties{Cors: &Cors{}})
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(b), chk.Equals, "<StorageServiceProperties><Cors></Cors></StorageServiceProperties>")
+}
+
+func (s *ServicePropertiesSuite) TestRoundTrip(c *chk.C) {
+	f := &propertiesServer{c: c}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	want := testServiceProperties()
+	want.Logging.Version = analyticsVersion
+	want.HourMetrics.Version = analyticsVersion
+	want.MinuteMetrics.Version = analyticsVersion
+	want.XMLName = xml.Name{Local: "StorageServiceProperties"}
+
+	queues := cli.GetQueueService()
+	c.Assert(queues.SetServiceProperties(testServiceProperties()), chk.IsNil)
+	got, err := queues.GetServiceProperties()
+	c.Assert(err, chk.IsNil)
+	c.Assert(*got, chk.DeepEquals, want)
+
+	tables := cli.GetTableService()
+	c.Assert(tables.SetServiceProperties(testServiceProperties()), chk.IsNil)
+	got, err = tables.GetServiceProperties()
+	c.Assert(err, chk.IsNil)
+	c.Assert(*got, chk.DeepEquals, want)
+
+	blobs := cli.GetBlobService()
+	props := ServiceProperties{
+		DefaultServiceVersion: "2015-02-21",
+		StaticWebsite:         &StaticWebsite{Enabled: true, IndexDocument: "index.html", ErrorDocument404Path: "404.html"},
+	}
+	c.Assert(blobs.SetServiceProperties(props), chk.IsNil)
+	got, err = blobs.GetServiceProperties()
+	c.Assert(err, chk.IsNil)
+	props.XMLName = want.XMLName
+	c.Assert(*got, chk.DeepEquals, props)
+
+	c.Assert(f.hosts, chk.DeepEquals, []string{
+		"foo.queue.core.windows.net", "foo.queue.core.windows.net",
+		"foo.table.core.windows.net", "foo.table.core.windows.net",
+		"foo.blob.core.windows.net", "foo.blob.core.windows.net",
+	})
+	c.Assert(f.versions, chk.DeepEquals, []string{
+		DefaultAPIVersion, DefaultAPIVersion,
+		DefaultAPIVersion, DefaultAPIVersion,
+		staticWebsiteAPIVersion, staticWebsiteAPIVersion,
+	})
+}
+
+func (s *ServicePropertiesSuite) TestFileLogging(c *chk.C) {
+	cli, err := NewBasicClient("foo", "YmFy")
+	c.Assert(err, chk.IsNil)
+	err = cli.GetFileService().SetServiceProperties(ServiceProperties{Logging: &Logging{}})
+	c.Assert(err, chk.ErrorMatches, "storage: .*")
+}
+
+func (s *ServicePropertiesSuite) TestStats(c *chk.C) {
+	f := &propertiesServer{c: c}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	stats, err := cli.GetBlobService().GetServiceStats()
+	c.Assert(err, chk.IsNil)
+	c.Assert(stats.GeoReplication.Status, chk.Equals, GeoReplicationLive)
+	c.Assert(stats.GeoReplication.LastSyncTime.Equal(time.Date(2017, 4, 12, 8, 9, 10, 0, time.UTC)), chk.Equals, true)
+	c.Assert(f.hosts, chk.DeepEquals, []string{"foo-secondary.blob.core.windows.net"})
+
+	var empty ServiceStats
+	c.Assert(xml.Unmarshal([]byte("<StorageServiceStats><GeoReplication><Status>bootstrap</Status><LastSyncTime></LastSyncTime></GeoReplication></StorageServiceStats>"), &empty), chk.IsNil)
+	c.Assert(empty.GeoReplication, chk.DeepEquals, GeoReplication{Status: GeoReplicationBootstrap})
+}
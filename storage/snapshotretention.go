@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is a grandfather-father-son policy deciding which
+// snapshots of a blob are kept. Each tier keeps the newest snapshot of each
+// of its most recent periods that contain a snapshot; a snapshot retained by
+// any tier is kept and every other snapshot is deleted. Periods are
+// computed in UTC and weeks are ISO 8601 weeks.
+type RetentionPolicy struct {
+	// Last is the number of most recent snapshots kept regardless of
+	// their age.
+	Last int
+
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+
+	// Metadata restricts the policy to the snapshots carrying all of the
+	// given metadata values, such as the tags set through Snapshot. Other
+	// snapshots are neither kept nor deleted and do not appear in the
+	// report. Keys are compared case-insensitively.
+	Metadata map[string]string
+}
+
+// RetentionFailure is a snapshot the retention manager could not process.
+type RetentionFailure struct {
+	Ref BlobRef
+	Err error
+}
+
+// RetentionReport lists what ApplySnapshotRetention did with every snapshot
+// it considered. In dry-run mode Deleted lists the snapshots that would
+// have been deleted.
+type RetentionReport struct {
+	Kept    []BlobRef
+	Deleted []BlobRef
+	Failed  []RetentionFailure
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.Last < 0 || p.Hourly < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 {
+		return fmt.Errorf("storage: retention counts cannot be negative")
+	}
+	if p.Last+p.Hourly+p.Daily+p.Weekly+p.Monthly == 0 {
+		return fmt.Errorf("storage: retention policy keeps no snapshots")
+	}
+	return nil
+}
+
+// matches reports whether metadata carries every value the policy selects
+// on. Listed metadata keys are always lower case.
+func (p RetentionPolicy) matches(metadata BlobMetadata) bool {
+	for k, v := range p.Metadata {
+		if metadata[strings.ToLower(k)] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// retainedSnapshots returns which of the given snapshot times, sorted from
+// newest to oldest, the policy keeps.
+func (p RetentionPolicy) retainedSnapshots(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+	for i := 0; i < p.Last && i < len(times); i++ {
+		keep[i] = true
+	}
+
+	tiers := []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{p.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, tier := range tiers {
+		seen := make(map[string]bool)
+		for i, t := range times {
+			if len(seen) == tier.count {
+				break
+			}
+			period := tier.period(t.UTC())
+			if !seen[period] {
+				seen[period] = true
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// newestSnapshotsFirst sorts snapshots of the same blob from newest to
+// oldest.
+type newestSnapshotsFirst []BlobRef
+
+func (s newestSnapshotsFirst) Len() int           { return len(s) }
+func (s newestSnapshotsFirst) Less(i, j int) bool { return s[i].Snapshot.After(s[j].Snapshot) }
+func (s newestSnapshotsFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ApplySnapshotRetention lists the snapshots of the blobs in container whose
+// names start with prefix and applies policy to the snapshots of each blob
+// separately. If dryRun is true nothing is deleted and the report describes
+// what would happen. A snapshot that fails to be deleted is reported in
+// Failed and does not stop the others from being processed.
+//
+// An error is only returned if the policy is invalid or the snapshots
+// cannot be listed.
+func (b BlobStorageClient) ApplySnapshotRetention(container, prefix string, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	var report RetentionReport
+	if err := policy.validate(); err != nil {
+		return report, err
+	}
+
+	snapshots := make(map[string][]BlobRef)
+	var names []string
+	params := ListBlobsParameters{Prefix: prefix, Include: "snapshots,metadata"}
+	for {
+		resp, err := b.ListBlobs(container, params)
+		if err != nil {
+			return report, err
+		}
+		for _, blob := range resp.Blobs {
+			if blob.Snapshot == "" || !policy.matches(blob.Metadata) {
+				continue
+			}
+			ref := BlobRef{Container: container, Name: blob.Name}
+			if ref.Snapshot, err = time.Parse(time.RFC3339, blob.Snapshot); err != nil {
+				report.Failed = append(report.Failed, RetentionFailure{Ref: ref, Err: err})
+				continue
+			}
+			if _, ok := snapshots[blob.Name]; !ok {
+				names = append(names, blob.Name)
+			}
+			snapshots[blob.Name] = append(snapshots[blob.Name], ref)
+		}
+		if resp.NextMarker == "" {
+			break
+		}
+		params.Marker = resp.NextMarker
+	}
+
+	for _, name := range names {
+		refs := snapshots[name]
+		sort.Sort(newestSnapshotsFirst(refs))
+		times := make([]time.Time, len(refs))
+		for i, ref := range refs {
+			times[i] = ref.Snapshot
+		}
+
+		for i, keep := range policy.retainedSnapshots(times) {
+			ref := refs[i]
+			switch {
+			case keep:
+				report.Kept = append(report.Kept, ref)
+			case dryRun:
+				report.Deleted = append(report.Deleted, ref)
+			default:
+				if err := b.DeleteBlobByRef(ref, DeleteSnapshotsNone, nil); err != nil {
+					report.Failed = append(report.Failed, RetentionFailure{Ref: ref, Err: err})
+				} else {
+					report.Deleted = append(report.Deleted, ref)
+				}
+			}
+		}
+	}
+	return report, nil
+}
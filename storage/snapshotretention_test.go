@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type SnapshotRetentionSuite struct{}
+
+var _ = chk.Suite(&SnapshotRetentionSuite{})
+
+// fakeSnapshotListServer lists the given snapshots two per page and deletes
+// them on request.
+type fakeSnapshotListServer struct {
+	mu      sync.Mutex
+	blobs   []Blob
+	deleted []string
+	failing map[string]bool
+}
+
+func (f *fakeSnapshotListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		if q.Get("include") != "snapshots,metadata" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var start int
+		if q.Get("marker") != "" {
+			start = 2
+		}
+		out := BlobListResponse{Blobs: f.blobs[start:]}
+		if start == 0 && len(f.blobs) > 2 {
+			out.Blobs = f.blobs[:2]
+			out.NextMarker = "page2"
+		}
+		b, _ := xml.Marshal(out)
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	case http.MethodDelete:
+		snapshot := q.Get("snapshot")
+		if f.failing[snapshot] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.deleted = append(f.deleted, snapshot)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func retentionTimes(values ...string) []time.Time {
+	var times []time.Time
+	for _, v := range values {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			panic(err)
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+func (s *SnapshotRetentionSuite) Test_retainedSnapshots(c *chk.C) {
+	times := retentionTimes(
+		"2017-03-14T10:30:00Z",
+		"2017-03-14T10:00:00Z",
+		"2017-03-14T09:00:00Z",
+		"2017-03-13T23:00:00Z",
+		"2017-03-12T23:00:00Z",
+		"2017-03-05T23:00:00Z",
+		"2017-02-20T23:00:00Z",
+	)
+
+	c.Assert(RetentionPolicy{Last: 1}.retainedSnapshots(times), chk.DeepEquals,
+		[]bool{true, false, false, false, false, false, false})
+	c.Assert(RetentionPolicy{Hourly: 2}.retainedSnapshots(times), chk.DeepEquals,
+		[]bool{true, false, true, false, false, false, false})
+	c.Assert(RetentionPolicy{Daily: 3}.retainedSnapshots(times), chk.DeepEquals,
+		[]bool{true, false, false, true, true, false, false})
+	c.Assert(RetentionPolicy{Weekly: 3, Monthly: 2}.retainedSnapshots(times), chk.DeepEquals,
+		[]bool{true, false, false, false, true, true, true})
+}
+
+func (s *SnapshotRetentionSuite) TestRetentionPolicyValidate(c *chk.C) {
+	c.Assert(RetentionPolicy{}.validate(), chk.NotNil)
+	c.Assert(RetentionPolicy{Daily: -1, Weekly: 2}.validate(), chk.NotNil)
+	c.Assert(RetentionPolicy{Daily: 7}.validate(), chk.IsNil)
+}
+
+func newRetentionFake() *fakeSnapshotListServer {
+	return &fakeSnapshotListServer{
+		blobs: []Blob{
+			{Name: "disk.vhd"},
+			{Name: "disk.vhd", Snapshot: "2017-03-12T23:00:00.0000000Z", Metadata: BlobMetadata{"kind": "nightly"}},
+			{Name: "disk.vhd", Snapshot: "2017-03-13T23:00:00.0000000Z", Metadata: BlobMetadata{"kind": "nightly"}},
+			{Name: "disk.vhd", Snapshot: "2017-03-14T23:00:00.0000000Z", Metadata: BlobMetadata{"kind": "nightly"}},
+			{Name: "disk.vhd", Snapshot: "2017-03-11T23:00:00.0000000Z", Metadata: BlobMetadata{"kind": "manual"}},
+		},
+		failing: make(map[string]bool),
+	}
+}
+
+func (s *SnapshotRetentionSuite) TestApplySnapshotRetentionDryRun(c *chk.C) {
+	fake := newRetentionFake()
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	report, err := cli.GetBlobService().ApplySnapshotRetention("vhds", "disk", RetentionPolicy{
+		Daily:    1,
+		Metadata: map[string]string{"Kind": "nightly"},
+	}, true)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.deleted, chk.HasLen, 0)
+	c.Assert(report.Kept, chk.HasLen, 1)
+	c.Assert(report.Kept[0].Snapshot.Day(), chk.Equals, 14)
+	c.Assert(report.Deleted, chk.HasLen, 2)
+	c.Assert(report.Failed, chk.HasLen, 0)
+}
+
+func (s *SnapshotRetentionSuite) TestApplySnapshotRetentionDeletes(c *chk.C) {
+	fake := newRetentionFake()
+	fake.failing["2017-03-12T23:00:00.0000000Z"] = true
+	cli, srv := getTestServerClient(c, fake)
+	defer srv.Close()
+
+	report, err := cli.GetBlobService().ApplySnapshotRetention("vhds", "disk", RetentionPolicy{Last: 1}, false)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.deleted, chk.DeepEquals, []string{"2017-03-13T23:00:00.0000000Z", "2017-03-11T23:00:00.0000000Z"})
+	c.Assert(report.Kept, chk.HasLen, 1)
+	c.Assert(report.Deleted, chk.HasLen, 2)
+	c.Assert(report.Failed, chk.HasLen, 1)
+	c.Assert(report.Failed[0].Ref.Snapshot.Day(), chk.Equals, 12)
+}
@@ -0,0 +1,194 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// See: https://docs.microsoft.com/rest/api/storageservices/fileservices/authentication-for-the-azure-storage-services
+
+// maxClockSkew is how far the date of a request may be from the time it
+// is received.
+const maxClockSkew = 15 * time.Minute
+
+// authenticate checks the SharedKey or SharedKeyLite signature of req.
+func (s *Server) authenticate(req *request) error {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return newError(http.StatusForbidden, "NoAuthenticationInformation", "Server failed to authenticate the request. Please refer to the information in the www-authenticate header.")
+	}
+
+	scheme, credentials := splitPair(auth, " ")
+	account, signature := splitPair(credentials, ":")
+	if account != AccountName {
+		return errAuthentication(fmt.Sprintf("The account %q in the Authorization header does not exist.", account))
+	}
+
+	var stringToSign string
+	switch scheme {
+	case "SharedKey":
+		stringToSign = sharedKeyString(req)
+	case "SharedKeyLite":
+		stringToSign = sharedKeyLiteString(req)
+	default:
+		return errAuthentication(fmt.Sprintf("Authentication scheme %q is not supported.", scheme))
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(stringToSign))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errAuthentication(fmt.Sprintf("The MAC signature found in the HTTP request '%s' is not the same as any computed signature. Server used following string to sign: '%s'.", signature, stringToSign))
+	}
+
+	date := req.Header.Get("x-ms-date")
+	if date == "" {
+		date = req.Header.Get("Date")
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return errAuthentication("Request date header not specified or not in RFC1123 format.")
+	}
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return errAuthentication(fmt.Sprintf("Request date header too old: '%s'.", date))
+	}
+	return nil
+}
+
+func errAuthentication(detail string) error {
+	err := newError(http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. Make sure the value of Authorization header is formed correctly including the signature.")
+	err.detail = detail
+	return err
+}
+
+// splitPair splits s around the first sep.
+func splitPair(s, sep string) (string, string) {
+	parts := strings.SplitN(s, sep, 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// sharedKeyString returns the string a SharedKey signature of req is
+// computed from.
+func sharedKeyString(req *request) string {
+	if req.service == tableService {
+		return strings.Join([]string{
+			req.Method,
+			req.Header.Get("Content-MD5"),
+			req.Header.Get("Content-Type"),
+			tableDate(req),
+			canonicalizedResource(req, false),
+		}, "\n")
+	}
+
+	contentLength := req.Header.Get("Content-Length")
+	if contentLength == "0" && req.Header.Get("x-ms-version") >= "2015-02-21" {
+		contentLength = ""
+	}
+	date := req.Header.Get("Date")
+	if req.Header.Get("x-ms-date") != "" {
+		date = ""
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		date,
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalizedHeaders(req.Header),
+		canonicalizedResource(req, true),
+	}, "\n")
+}
+
+// sharedKeyLiteString returns the string a SharedKeyLite signature of req
+// is computed from.
+func sharedKeyLiteString(req *request) string {
+	if req.service == tableService {
+		return tableDate(req) + "\n" + canonicalizedResource(req, false)
+	}
+
+	date := req.Header.Get("Date")
+	if req.Header.Get("x-ms-date") != "" {
+		date = ""
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		date,
+		canonicalizedHeaders(req.Header),
+		canonicalizedResource(req, false),
+	}, "\n")
+}
+
+// tableDate returns the date a table service request is signed with.
+func tableDate(req *request) string {
+	if date := req.Header.Get("x-ms-date"); date != "" {
+		return date
+	}
+	return req.Header.Get("Date")
+}
+
+// canonicalizedHeaders returns the x-ms-* headers of h, sorted by name.
+func canonicalizedHeaders(h http.Header) string {
+	values := make(map[string][]string)
+	var names []string
+	for k, v := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			values[k] = v
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ":" + strings.Join(values[name], ",")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalizedResource returns the resource req is for, followed by all
+// its query parameters when full is set, or by its comp parameter only.
+func canonicalizedResource(req *request, full bool) string {
+	cr := bytes.NewBufferString("/" + AccountName + req.URL.EscapedPath())
+	if !full {
+		if comp, ok := req.query["comp"]; ok {
+			cr.WriteString("?comp=" + comp[0])
+		}
+		return cr.String()
+	}
+
+	params := make(map[string][]string)
+	var names []string
+	for k, v := range req.query {
+		k = strings.ToLower(k)
+		if _, ok := params[k]; !ok {
+			names = append(names, k)
+		}
+		params[k] = append(params[k], v...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		cr.WriteString("\n" + name + ":" + strings.Join(values, ","))
+	}
+	return cr.String()
+}
@@ -0,0 +1,221 @@
+package storagetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxBatchOperations is the largest number of operations an entity group
+// transaction may contain.
+const maxBatchOperations = 100
+
+// serveBatch serves an entity group transaction. The operations of its
+// changeset are applied in order and all of them are rolled back if one
+// fails, in which case only the response to the failing one is returned.
+func (s *Server) serveBatch(req *request) error {
+	if req.Method != http.MethodPost {
+		return errNotImplemented(req)
+	}
+	ops, err := readBatch(req.Header.Get("Content-Type"), bytes.NewReader(req.body))
+	if err != nil {
+		return errInvalidInput("the batch request is malformed: " + err.Error())
+	}
+	if len(ops) == 0 || len(ops) > maxBatchOperations {
+		return errInvalidInput(fmt.Sprintf("a batch must contain between 1 and %d operations.", maxBatchOperations))
+	}
+
+	subs := make([]*request, len(ops))
+	recs := make([]*httptest.ResponseRecorder, len(ops))
+	var t *table
+	var partitionKey string
+	keys := make(map[entityKey]bool)
+	for i, op := range ops {
+		subs[i], recs[i] = batchRequest(req, op)
+		name, key, err := s.batchOperationKey(subs[i])
+		if err == nil && t == nil {
+			t, partitionKey = s.tables[name], key.partitionKey
+		}
+		switch {
+		case err != nil:
+		case t == nil:
+			err = newError(http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+		case t != s.tables[name] || key.partitionKey != partitionKey:
+			err = newError(http.StatusBadRequest, "CommandsInBatchActOnDifferentPartitions", "All commands in a batch must operate on same entity group.")
+		case keys[key]:
+			err = newError(http.StatusBadRequest, "InvalidDuplicateRow", "The batch request contains multiple changes with same row key. An entity can appear only once in a batch request.")
+		}
+		if err != nil {
+			return s.replyBatch(req, []*response{batchError(subs[i], i, err)})
+		}
+		keys[key] = true
+	}
+
+	saved := t.cloneEntities()
+	responses := make([]*response, len(ops))
+	for i, sub := range subs {
+		if err := s.serveTable(sub); err != nil {
+			t.entities = saved
+			return s.replyBatch(req, []*response{batchError(sub, i, err)})
+		}
+		responses[i] = newResponse(sub.Request, recs[i])
+	}
+	return s.replyBatch(req, responses)
+}
+
+// batchOperationKey returns the table and the entity key an operation of a
+// batch applies to.
+func (s *Server) batchOperationKey(req *request) (string, entityKey, error) {
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/")
+	name, keys := path, ""
+	if i := strings.Index(path, "("); i >= 0 {
+		name, keys = path[:i], path[i:]
+	}
+	if name == "" || strings.EqualFold(name, "Tables") || strings.HasPrefix(name, "$") {
+		return "", entityKey{}, errInvalidURI()
+	}
+	name = strings.ToLower(name)
+	if keys != "" && keys != "()" {
+		key, ok := parseEntityKey(keys)
+		if !ok {
+			return "", entityKey{}, errInvalidURI()
+		}
+		return name, key, nil
+	}
+	properties, err := entityBody(req)
+	if err != nil {
+		return "", entityKey{}, err
+	}
+	pk, _ := properties["PartitionKey"].(string)
+	rk, _ := properties["RowKey"].(string)
+	return name, entityKey{pk, rk}, nil
+}
+
+// readBatch reads the operations of a multipart/mixed batch request body,
+// flattening the changesets it contains.
+func readBatch(contentType string, body io.Reader) ([]*http.Request, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected content type %q", mediaType)
+	}
+	var ops []*http.Request
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t := part.Header.Get("Content-Type"); strings.HasPrefix(t, "multipart/") {
+			changeset, err := readBatch(t, part)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, changeset...)
+			continue
+		}
+		op, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return nil, err
+		}
+		// The body must be read before moving on to the next part.
+		b, err := ioutil.ReadAll(op.Body)
+		if err != nil {
+			return nil, err
+		}
+		op.Body = ioutil.NopCloser(bytes.NewReader(b))
+		ops = append(ops, op)
+	}
+}
+
+// batchRequest returns the request serving the operation op of the batch
+// req, along with the recorder of its response. The body of op has already
+// been read by readBatch.
+func batchRequest(req *request, op *http.Request) (*request, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	body, _ := ioutil.ReadAll(op.Body)
+	sub := &request{Request: op, w: rec, id: req.id, service: tableService, query: op.URL.Query(), body: body}
+	return sub, rec
+}
+
+// batchError returns the response to the operation at index i of a batch
+// failing with err. The service prefixes the message with the index.
+func batchError(req *request, i int, err error) *response {
+	if serr, ok := err.(*serviceError); ok {
+		copied := *serr
+		copied.message = fmt.Sprintf("%d:%s", i, serr.message)
+		err = &copied
+	}
+	rec := httptest.NewRecorder()
+	req.w = rec
+	req.replyError(err)
+	return newResponse(req.Request, rec)
+}
+
+// response is the response to an operation of a batch.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newResponse(op *http.Request, rec *httptest.ResponseRecorder) *response {
+	header := rec.HeaderMap
+	if id := op.Header.Get("Content-ID"); id != "" {
+		header.Set("Content-ID", id)
+	}
+	return &response{status: rec.Code, header: header, body: rec.Body.Bytes()}
+}
+
+// replyBatch sends responses as the changeset of a batch response.
+func (s *Server) replyBatch(req *request, responses []*response) error {
+	var body bytes.Buffer
+	changesetBoundary := "changesetresponse_" + newUUID()
+	batch := multipart.NewWriter(&body)
+	if err := batch.SetBoundary("batchresponse_" + newUUID()); err != nil {
+		return err
+	}
+	part, err := batch.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/mixed; boundary=" + changesetBoundary},
+	})
+	if err != nil {
+		return err
+	}
+	changeset := multipart.NewWriter(part)
+	if err := changeset.SetBoundary(changesetBoundary); err != nil {
+		return err
+	}
+
+	for _, resp := range responses {
+		w, err := changeset.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", resp.status, http.StatusText(resp.status))
+		resp.header.Set("Content-Length", strconv.Itoa(len(resp.body)))
+		resp.header.Write(w)
+		fmt.Fprint(w, "\r\n")
+		w.Write(resp.body)
+	}
+	changeset.Close()
+	batch.Close()
+	req.replyBody(http.StatusAccepted, "multipart/mixed; boundary="+batch.Boundary(), body.Bytes())
+	return nil
+}
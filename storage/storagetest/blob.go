@@ -0,0 +1,1319 @@
+package storagetest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the blob service, as of API version 2015-02-21.
+const (
+	maxPutBlobSize   = 64 * 1024 * 1024
+	maxBlockSize     = 4 * 1024 * 1024
+	maxPageWriteSize = 4 * 1024 * 1024
+	maxGetMD5Size    = 4 * 1024 * 1024
+	pageSize         = 512
+)
+
+// container is a blob container.
+type container struct {
+	name      string
+	metadata  map[string]string
+	access    string
+	acl       []byte
+	etag      string
+	modified  time.Time
+	blobs     map[string]*blob
+	snapshots map[string][]*blob
+}
+
+// blob is a blob or a snapshot of one.
+type blob struct {
+	name     string
+	snapshot string
+	blobType string
+
+	// committed is false for block blobs which only have uncommitted
+	// blocks, and are not visible yet.
+	committed   bool
+	blocks      []block
+	uncommitted []block
+
+	data           []byte  // block and append blobs
+	pages          extents // page blobs
+	size           int64   // page blobs
+	appendCount    int
+	sequenceNumber int64
+
+	properties blobProperties
+	metadata   map[string]string
+	etag       string
+	modified   time.Time
+	lease      lease
+	copy       *blobCopy
+}
+
+type block struct {
+	id   string
+	data []byte
+}
+
+type blobProperties struct {
+	contentType        string
+	contentEncoding    string
+	contentLanguage    string
+	contentMD5         string
+	cacheControl       string
+	contentDisposition string
+}
+
+type blobCopy struct {
+	id             string
+	source         string
+	status         string
+	progress       string
+	completionTime time.Time
+}
+
+// length returns the size of the content of b.
+func (b *blob) length() int64 {
+	if b.blobType == "PageBlob" {
+		return b.size
+	}
+	return int64(len(b.data))
+}
+
+// read returns the content of b in [start, end).
+func (b *blob) read(start, end int64) []byte {
+	if b.blobType == "PageBlob" {
+		return b.pages.read(start, end)
+	}
+	return b.data[start:end]
+}
+
+// clone returns a copy of the committed content and properties of b.
+func (b *blob) clone() *blob {
+	c := *b
+	c.blocks = append([]block(nil), b.blocks...)
+	c.uncommitted = nil
+	c.data = append([]byte(nil), b.data...)
+	c.pages = b.pages.clone()
+	c.metadata = copyMetadata(b.metadata)
+	c.lease = lease{}
+	return &c
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// serveBlob serves a request to the blob service.
+func (s *Server) serveBlob(req *request) error {
+	segments := req.pathSegments()
+	switch {
+	case len(segments) == 0:
+		if req.Method == http.MethodGet && req.query.Get("comp") == "list" {
+			return s.listContainers(req)
+		}
+		return errNotImplemented(req)
+	case len(segments) == 1:
+		if req.query.Get("restype") != "container" {
+			return errNotImplemented(req)
+		}
+		return s.serveContainer(req, segments[0])
+	}
+
+	c, ok := s.containers[segments[0]]
+	if !ok {
+		return errContainerNotFound()
+	}
+	name := segments[1]
+	comp := req.query.Get("comp")
+	switch {
+	case req.Method == http.MethodPut && comp == "":
+		if req.Header.Get("x-ms-copy-source") != "" {
+			return s.copyBlob(req, c, name)
+		}
+		return s.putBlob(req, c, name)
+	case req.Method == http.MethodPut && comp == "block":
+		return s.putBlock(req, c, name)
+	case req.Method == http.MethodPut && comp == "blocklist":
+		return s.putBlockList(req, c, name)
+	case req.Method == http.MethodGet && comp == "blocklist":
+		return s.getBlockList(req, c, name)
+	case req.Method == http.MethodPut && comp == "page":
+		return s.putPage(req, c, name)
+	case req.Method == http.MethodGet && comp == "pagelist":
+		return s.getPageRanges(req, c, name)
+	case req.Method == http.MethodPut && comp == "appendblock":
+		return s.appendBlock(req, c, name)
+	case req.Method == http.MethodPut && comp == "properties":
+		return s.setBlobProperties(req, c, name)
+	case req.Method == http.MethodPut && comp == "metadata":
+		return s.setBlobMetadata(req, c, name)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "metadata":
+		return s.getBlobMetadata(req, c, name)
+	case req.Method == http.MethodPut && comp == "snapshot":
+		return s.snapshotBlob(req, c, name)
+	case req.Method == http.MethodPut && comp == "lease":
+		return s.leaseBlob(req, c, name)
+	case req.Method == http.MethodPut && comp == "copy":
+		return s.abortCopyBlob(req, c, name)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "":
+		return s.getBlob(req, c, name)
+	case req.Method == http.MethodDelete && comp == "":
+		return s.deleteBlob(req, c, name)
+	}
+	return errNotImplemented(req)
+}
+
+func errContainerNotFound() error {
+	return newError(http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+}
+
+func errBlobNotFound() error {
+	return newError(http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+}
+
+func errInvalidBlobType() error {
+	return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+}
+
+// serveContainer serves a request to a container.
+func (s *Server) serveContainer(req *request, name string) error {
+	comp := req.query.Get("comp")
+	if req.Method == http.MethodPut && comp == "" {
+		return s.createContainer(req, name)
+	}
+
+	c, ok := s.containers[name]
+	if !ok {
+		return errContainerNotFound()
+	}
+	h := req.w.Header()
+	switch {
+	case req.Method == http.MethodDelete && comp == "":
+		delete(s.containers, name)
+		req.reply(http.StatusAccepted)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && (comp == "" || comp == "metadata"):
+		setModifiedHeaders(h, c.etag, c.modified)
+		setMetadataHeaders(h, c.metadata)
+		if comp == "" {
+			h.Set("x-ms-lease-status", "unlocked")
+			h.Set("x-ms-lease-state", "available")
+			if c.access != "" {
+				h.Set("x-ms-blob-public-access", c.access)
+			}
+		}
+		req.reply(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "metadata":
+		c.metadata = metadataFromHeaders(req.Header)
+		c.etag, c.modified = s.newETag(), s.now()
+		setModifiedHeaders(h, c.etag, c.modified)
+		req.reply(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "acl":
+		if len(req.body) > 0 {
+			var acl struct{}
+			if err := req.xmlBody(&acl); err != nil {
+				return err
+			}
+		}
+		c.access = req.Header.Get("x-ms-blob-public-access")
+		c.acl = req.body
+		c.etag, c.modified = s.newETag(), s.now()
+		setModifiedHeaders(h, c.etag, c.modified)
+		req.reply(http.StatusOK)
+	case req.Method == http.MethodGet && comp == "acl":
+		setModifiedHeaders(h, c.etag, c.modified)
+		if c.access != "" {
+			h.Set("x-ms-blob-public-access", c.access)
+		}
+		acl := c.acl
+		if len(acl) == 0 {
+			acl = []byte(xml.Header + "<SignedIdentifiers />")
+		}
+		req.replyBody(http.StatusOK, "application/xml", acl)
+	case req.Method == http.MethodGet && comp == "list":
+		return s.listBlobs(req, c)
+	default:
+		return errNotImplemented(req)
+	}
+	return nil
+}
+
+func (s *Server) createContainer(req *request, name string) error {
+	if !validName(name) {
+		return errInvalidName()
+	}
+	if _, ok := s.containers[name]; ok {
+		return newError(http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+	}
+	access := req.Header.Get("x-ms-blob-public-access")
+	if access != "" && access != "blob" && access != "container" {
+		return errInvalidHeader("x-ms-blob-public-access")
+	}
+	c := &container{
+		name:      name,
+		metadata:  metadataFromHeaders(req.Header),
+		access:    access,
+		etag:      s.newETag(),
+		modified:  s.now(),
+		blobs:     make(map[string]*blob),
+		snapshots: make(map[string][]*blob),
+	}
+	s.containers[name] = c
+	setModifiedHeaders(req.w.Header(), c.etag, c.modified)
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+type containerXML struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified string `xml:"Last-Modified"`
+		Etag         string `xml:"Etag"`
+		LeaseStatus  string `xml:"LeaseStatus"`
+		LeaseState   string `xml:"LeaseState"`
+		PublicAccess string `xml:"PublicAccess,omitempty"`
+	} `xml:"Properties"`
+	Metadata metadataXML `xml:"Metadata,omitempty"`
+}
+
+func (s *Server) listContainers(req *request) error {
+	max, err := req.maxResults()
+	if err != nil {
+		return err
+	}
+	prefix, marker := req.query.Get("prefix"), req.query.Get("marker")
+	withMetadata := strings.Contains(req.query.Get("include"), "metadata")
+
+	var names []string
+	for name := range s.containers {
+		if strings.HasPrefix(name, prefix) && name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := struct {
+		listing
+		Containers []containerXML `xml:"Containers>Container"`
+		NextMarker string         `xml:"NextMarker"`
+	}{listing: listing{ServiceEndpoint: req.serviceEndpoint(), Prefix: prefix, Marker: marker, MaxResults: max}}
+	for i, name := range names {
+		if i == max {
+			out.NextMarker = name
+			break
+		}
+		c := s.containers[name]
+		var x containerXML
+		x.Name = name
+		x.Properties.LastModified = c.modified.Format(http.TimeFormat)
+		x.Properties.Etag = c.etag
+		x.Properties.LeaseStatus = "unlocked"
+		x.Properties.LeaseState = "available"
+		x.Properties.PublicAccess = c.access
+		if withMetadata {
+			x.Metadata = c.metadata
+		}
+		out.Containers = append(out.Containers, x)
+	}
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+type blobXML struct {
+	Name       string            `xml:"Name"`
+	Snapshot   string            `xml:"Snapshot,omitempty"`
+	Properties blobPropertiesXML `xml:"Properties"`
+	Metadata   metadataXML       `xml:"Metadata,omitempty"`
+}
+
+type blobPropertiesXML struct {
+	LastModified          string `xml:"Last-Modified"`
+	Etag                  string `xml:"Etag"`
+	ContentLength         int64  `xml:"Content-Length"`
+	ContentType           string `xml:"Content-Type"`
+	ContentEncoding       string `xml:"Content-Encoding"`
+	ContentLanguage       string `xml:"Content-Language"`
+	ContentMD5            string `xml:"Content-MD5"`
+	CacheControl          string `xml:"Cache-Control"`
+	ContentDisposition    string `xml:"Content-Disposition"`
+	SequenceNumber        *int64 `xml:"x-ms-blob-sequence-number,omitempty"`
+	BlobType              string `xml:"BlobType"`
+	LeaseStatus           string `xml:"LeaseStatus"`
+	LeaseState            string `xml:"LeaseState"`
+	LeaseDuration         string `xml:"LeaseDuration,omitempty"`
+	CopyID                string `xml:"CopyId,omitempty"`
+	CopyStatus            string `xml:"CopyStatus,omitempty"`
+	CopySource            string `xml:"CopySource,omitempty"`
+	CopyProgress          string `xml:"CopyProgress,omitempty"`
+	CopyCompletionTime    string `xml:"CopyCompletionTime,omitempty"`
+	CopyStatusDescription string `xml:"CopyStatusDescription,omitempty"`
+}
+
+// listBlobs lists the blobs of c. Its markers are the opaque encoding of
+// the sort key of the next item to list.
+func (s *Server) listBlobs(req *request, c *container) error {
+	max, err := req.maxResults()
+	if err != nil {
+		return err
+	}
+	prefix, delimiter := req.query.Get("prefix"), req.query.Get("delimiter")
+	marker := req.query.Get("marker")
+	var from string
+	if marker != "" {
+		key, err := base64.URLEncoding.DecodeString(marker)
+		if err != nil {
+			return errInvalidQuery("marker")
+		}
+		from = string(key)
+	}
+	include := make(map[string]bool)
+	for _, v := range strings.Split(req.query.Get("include"), ",") {
+		include[v] = true
+	}
+
+	names := make(map[string]bool)
+	for name, b := range c.blobs {
+		if b.committed || include["uncommittedblobs"] {
+			names[name] = true
+		}
+	}
+	if include["snapshots"] {
+		for name := range c.snapshots {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if strings.HasPrefix(name, prefix) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	out := struct {
+		listing
+		Delimiter    string    `xml:"Delimiter,omitempty"`
+		Blobs        []blobXML `xml:"Blobs>Blob"`
+		BlobPrefixes []string  `xml:"Blobs>BlobPrefix>Name"`
+		NextMarker   string    `xml:"NextMarker"`
+	}{listing: listing{ServiceEndpoint: req.serviceEndpoint(), Prefix: prefix, Marker: marker, MaxResults: max}, Delimiter: delimiter}
+
+	count := 0
+	// add lists an item with the given sort key, and reports whether the
+	// listing goes on.
+	add := func(key string, list func()) bool {
+		if key < from {
+			return true
+		}
+		if count == max {
+			out.NextMarker = base64.URLEncoding.EncodeToString([]byte(key))
+			return false
+		}
+		count++
+		list()
+		return true
+	}
+
+	lastPrefix := ""
+	now := time.Now()
+	for _, name := range sorted {
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if p == lastPrefix {
+					continue
+				}
+				lastPrefix = p
+				if !add(p, func() { out.BlobPrefixes = append(out.BlobPrefixes, p) }) {
+					break
+				}
+				continue
+			}
+		}
+
+		var items []*blob
+		if include["snapshots"] {
+			items = append(items, c.snapshots[name]...)
+		}
+		if b, ok := c.blobs[name]; ok && (b.committed || include["uncommittedblobs"]) {
+			items = append(items, b)
+		}
+		done := false
+		for _, b := range items {
+			b := b
+			key := name + "\x02"
+			if b.snapshot != "" {
+				key = name + "\x01" + b.snapshot
+			}
+			if !add(key, func() { out.Blobs = append(out.Blobs, b.listXML(include, now)) }) {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+// listXML returns b as an entry of a blob listing.
+func (b *blob) listXML(include map[string]bool, now time.Time) blobXML {
+	x := blobXML{Name: b.name, Snapshot: b.snapshot}
+	p := &x.Properties
+	p.LastModified = b.modified.Format(http.TimeFormat)
+	p.Etag = b.etag
+	p.ContentLength = b.length()
+	p.ContentType = b.properties.contentType
+	p.ContentEncoding = b.properties.contentEncoding
+	p.ContentLanguage = b.properties.contentLanguage
+	p.ContentMD5 = b.properties.contentMD5
+	p.CacheControl = b.properties.cacheControl
+	p.ContentDisposition = b.properties.contentDisposition
+	if b.blobType == "PageBlob" {
+		seq := b.sequenceNumber
+		p.SequenceNumber = &seq
+	}
+	p.BlobType = b.blobType
+	p.LeaseStatus, p.LeaseState, p.LeaseDuration = b.lease.headers(now)
+	if include["copy"] && b.copy != nil {
+		p.CopyID = b.copy.id
+		p.CopyStatus = b.copy.status
+		p.CopySource = b.copy.source
+		p.CopyProgress = b.copy.progress
+		p.CopyCompletionTime = b.copy.completionTime.Format(http.TimeFormat)
+	}
+	if include["metadata"] {
+		x.Metadata = b.metadata
+	}
+	return x
+}
+
+// lookupBlob returns the committed blob, or the snapshot of it, req is for.
+func lookupBlob(req *request, c *container, name string) (*blob, error) {
+	snapshot, err := snapshotParam(req, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != "" {
+		for _, b := range c.snapshots[name] {
+			if b.snapshot == snapshot {
+				return b, nil
+			}
+		}
+		return nil, errBlobNotFound()
+	}
+	b, ok := c.blobs[name]
+	if !ok || !b.committed {
+		return nil, errBlobNotFound()
+	}
+	return b, nil
+}
+
+// snapshotParam returns the snapshot time in the given query parameter of
+// req, in the format of the service.
+func snapshotParam(req *request, param string) (string, error) {
+	v := req.query.Get(param)
+	if v == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return "", errInvalidQuery(param)
+	}
+	return t.UTC().Format(timestampFormat), nil
+}
+
+// writableBlob returns the base blob a write request is for, checking the
+// lease and conditions of the request. A snapshot cannot be written.
+func writableBlob(req *request, c *container, name string) (*blob, error) {
+	if req.query.Get("snapshot") != "" {
+		return nil, newError(http.StatusBadRequest, "InvalidQueryParameterValue", "The snapshot of a blob cannot be modified.")
+	}
+	b, ok := c.blobs[name]
+	if !ok || !b.committed {
+		return nil, errBlobNotFound()
+	}
+	if err := b.lease.checkWrite(req); err != nil {
+		return nil, err
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkConditions applies the conditional headers of req to a resource
+// with the given ETag and modification time.
+func checkConditions(req *request, etag string, modified time.Time) error {
+	read := req.Method == http.MethodGet || req.Method == http.MethodHead
+	notModified := newError(http.StatusNotModified, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+	failed := newError(http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+
+	if m := req.Header.Get("If-Match"); m != "" && m != "*" && m != etag {
+		return failed
+	}
+	if m := req.Header.Get("If-None-Match"); m != "" && (m == "*" || m == etag) {
+		if read {
+			return notModified
+		}
+		return failed
+	}
+	if v := req.Header.Get("If-Modified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && !modified.After(t) {
+			if read {
+				return notModified
+			}
+			return failed
+		}
+	}
+	if v := req.Header.Get("If-Unmodified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && modified.After(t) {
+			return failed
+		}
+	}
+	return nil
+}
+
+// newBlobProperties returns the properties set by the x-ms-blob-content-*
+// headers of req, falling back to the standard headers if standard is set.
+func newBlobProperties(req *request, standard bool) blobProperties {
+	get := func(name string) string {
+		if v := req.Header.Get("x-ms-blob-" + name); v != "" || !standard {
+			return v
+		}
+		return req.Header.Get(name)
+	}
+	return blobProperties{
+		contentType:        get("Content-Type"),
+		contentEncoding:    get("Content-Encoding"),
+		contentLanguage:    get("Content-Language"),
+		contentMD5:         req.Header.Get("x-ms-blob-content-md5"),
+		cacheControl:       get("Cache-Control"),
+		contentDisposition: get("Content-Disposition"),
+	}
+}
+
+func (s *Server) putBlob(req *request, c *container, name string) error {
+	old, exists := c.blobs[name]
+	if exists && old.committed {
+		if err := old.lease.checkWrite(req); err != nil {
+			return err
+		}
+		if err := checkConditions(req, old.etag, old.modified); err != nil {
+			return err
+		}
+	} else if req.Header.Get("If-Match") != "" {
+		return errBlobNotFound()
+	}
+
+	b := &blob{
+		name:       name,
+		blobType:   req.Header.Get("x-ms-blob-type"),
+		committed:  true,
+		properties: newBlobProperties(req, true),
+		metadata:   metadataFromHeaders(req.Header),
+	}
+	switch b.blobType {
+	case "":
+		return errMissingHeader("x-ms-blob-type")
+	case "BlockBlob":
+		if len(req.body) > maxPutBlobSize {
+			return errBodyTooLarge()
+		}
+		b.data = req.body
+		if b.properties.contentMD5 == "" {
+			b.properties.contentMD5 = md5Sum(b.data)
+		}
+	case "PageBlob":
+		size, err := strconv.ParseInt(req.Header.Get("x-ms-blob-content-length"), 10, 64)
+		if err != nil || size < 0 || size%pageSize != 0 {
+			return errInvalidHeader("x-ms-blob-content-length")
+		}
+		b.size = size
+		if v := req.Header.Get("x-ms-blob-sequence-number"); v != "" {
+			if b.sequenceNumber, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return errInvalidHeader("x-ms-blob-sequence-number")
+			}
+		}
+	case "AppendBlob":
+	default:
+		return errInvalidHeader("x-ms-blob-type")
+	}
+	if b.blobType != "BlockBlob" && len(req.body) > 0 {
+		return errInvalidHeader("Content-Length")
+	}
+	if b.properties.contentType == "" {
+		b.properties.contentType = "application/octet-stream"
+	}
+	if exists && old.committed {
+		b.lease = old.lease
+	}
+	b.etag, b.modified = s.newETag(), s.now()
+	c.blobs[name] = b
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	if b.blobType == "BlockBlob" {
+		h.Set("Content-MD5", md5Sum(req.body))
+	}
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) putBlock(req *request, c *container, name string) error {
+	id := req.query.Get("blockid")
+	if id == "" {
+		return newError(http.StatusBadRequest, "MissingRequiredQueryParameter", "A query parameter that's mandatory for this request is not specified: blockid.")
+	}
+	if raw, err := base64.StdEncoding.DecodeString(id); err != nil || len(raw) > 64 {
+		return newError(http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid: blockid.")
+	}
+	if len(req.body) > maxBlockSize {
+		return errBodyTooLarge()
+	}
+
+	b, ok := c.blobs[name]
+	if !ok {
+		b = &blob{name: name, blobType: "BlockBlob", metadata: map[string]string{}}
+		c.blobs[name] = b
+	} else if b.blobType != "BlockBlob" {
+		return errInvalidBlobType()
+	}
+	if b.committed {
+		if err := b.lease.checkWrite(req); err != nil {
+			return err
+		}
+	}
+	for i, blk := range b.uncommitted {
+		if blk.id == id {
+			b.uncommitted = append(b.uncommitted[:i], b.uncommitted[i+1:]...)
+			break
+		}
+	}
+	b.uncommitted = append(b.uncommitted, block{id: id, data: req.body})
+
+	req.w.Header().Set("Content-MD5", md5Sum(req.body))
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) putBlockList(req *request, c *container, name string) error {
+	var list struct {
+		Blocks []struct {
+			XMLName xml.Name
+			ID      string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := req.xmlBody(&list); err != nil {
+		return err
+	}
+
+	b, ok := c.blobs[name]
+	if !ok {
+		b = &blob{name: name, blobType: "BlockBlob"}
+	} else if b.blobType != "BlockBlob" {
+		return errInvalidBlobType()
+	}
+	if b.committed {
+		if err := b.lease.checkWrite(req); err != nil {
+			return err
+		}
+		if err := checkConditions(req, b.etag, b.modified); err != nil {
+			return err
+		}
+	} else if req.Header.Get("If-Match") != "" {
+		return errBlobNotFound()
+	}
+
+	find := func(blocks []block, id string) (block, bool) {
+		for _, blk := range blocks {
+			if blk.id == id {
+				return blk, true
+			}
+		}
+		return block{}, false
+	}
+	var blocks []block
+	var data []byte
+	for _, x := range list.Blocks {
+		id := strings.TrimSpace(x.ID)
+		var blk block
+		found := false
+		switch x.XMLName.Local {
+		case "Committed":
+			blk, found = find(b.blocks, id)
+		case "Uncommitted":
+			blk, found = find(b.uncommitted, id)
+		case "Latest":
+			if blk, found = find(b.uncommitted, id); !found {
+				blk, found = find(b.blocks, id)
+			}
+		default:
+			return newError(http.StatusBadRequest, "InvalidXmlNodeValue", "The value for one of the XML nodes is not in the correct format: "+x.XMLName.Local+".")
+		}
+		if !found {
+			return newError(http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+		}
+		blocks = append(blocks, blk)
+		data = append(data, blk.data...)
+	}
+
+	b.committed = true
+	b.blocks = blocks
+	b.uncommitted = nil
+	b.data = data
+	b.properties = newBlobProperties(req, false)
+	if b.properties.contentType == "" {
+		b.properties.contentType = "application/octet-stream"
+	}
+	b.metadata = metadataFromHeaders(req.Header)
+	b.etag, b.modified = s.newETag(), s.now()
+	c.blobs[name] = b
+
+	setModifiedHeaders(req.w.Header(), b.etag, b.modified)
+	req.w.Header().Set("Content-MD5", md5Sum(req.body))
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+type blockXML struct {
+	Name string `xml:"Name"`
+	Size int    `xml:"Size"`
+}
+
+func (s *Server) getBlockList(req *request, c *container, name string) error {
+	b, ok := c.blobs[name]
+	if snapshot := req.query.Get("snapshot"); snapshot != "" {
+		var err error
+		if b, err = lookupBlob(req, c, name); err != nil {
+			return err
+		}
+		ok = true
+	}
+	if !ok {
+		return errBlobNotFound()
+	}
+	if b.blobType != "BlockBlob" {
+		return errInvalidBlobType()
+	}
+
+	listType := req.query.Get("blocklisttype")
+	if listType == "" {
+		listType = "committed"
+	}
+	out := struct {
+		XMLName     xml.Name   `xml:"BlockList"`
+		Committed   []blockXML `xml:"CommittedBlocks>Block"`
+		Uncommitted []blockXML `xml:"UncommittedBlocks>Block"`
+	}{}
+	switch listType {
+	case "all", "committed", "uncommitted":
+	default:
+		return errInvalidQuery("blocklisttype")
+	}
+	if listType != "uncommitted" {
+		for _, blk := range b.blocks {
+			out.Committed = append(out.Committed, blockXML{blk.id, len(blk.data)})
+		}
+	}
+	if listType != "committed" {
+		for _, blk := range b.uncommitted {
+			out.Uncommitted = append(out.Uncommitted, blockXML{blk.id, len(blk.data)})
+		}
+	}
+
+	h := req.w.Header()
+	if b.committed {
+		setModifiedHeaders(h, b.etag, b.modified)
+	}
+	h.Set("x-ms-blob-content-length", strconv.FormatInt(b.length(), 10))
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+func (s *Server) putPage(req *request, c *container, name string) error {
+	b, err := writableBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if b.blobType != "PageBlob" {
+		return errInvalidBlobType()
+	}
+	rng := req.requestRange()
+	if rng == "" {
+		return errMissingHeader("x-ms-range")
+	}
+	start, end, ok := parseRange(rng)
+	if !ok || end < 0 {
+		return errInvalidHeader("x-ms-range")
+	}
+	if start%pageSize != 0 || (end+1)%pageSize != 0 || end >= b.size {
+		return newError(http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange", "The page range specified is invalid.")
+	}
+
+	switch req.Header.Get("x-ms-page-write") {
+	case "update":
+		if int64(len(req.body)) != end-start+1 {
+			return errInvalidHeader("Content-Length")
+		}
+		if len(req.body) > maxPageWriteSize {
+			return errBodyTooLarge()
+		}
+		b.pages = b.pages.write(start, req.body)
+		req.w.Header().Set("Content-MD5", md5Sum(req.body))
+	case "clear":
+		if len(req.body) > 0 {
+			return errInvalidHeader("Content-Length")
+		}
+		b.pages = b.pages.clear(start, end+1)
+	case "":
+		return errMissingHeader("x-ms-page-write")
+	default:
+		return errInvalidHeader("x-ms-page-write")
+	}
+	b.etag, b.modified = s.newETag(), s.now()
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	h.Set("x-ms-blob-sequence-number", strconv.FormatInt(b.sequenceNumber, 10))
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+type pageRangeXML struct {
+	Start int64 `xml:"Start"`
+	End   int64 `xml:"End"`
+}
+
+// getPageRanges lists the valid pages of a page blob, or the pages changed
+// since the snapshot given as prevsnapshot. Pages are compared by content,
+// so a page rewritten with the same data is not reported as changed.
+func (s *Server) getPageRanges(req *request, c *container, name string) error {
+	b, err := lookupBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if b.blobType != "PageBlob" {
+		return errInvalidBlobType()
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return err
+	}
+
+	start, end := int64(0), b.size
+	if rng := req.requestRange(); rng != "" {
+		first, last, ok := parseRange(rng)
+		if !ok {
+			return errInvalidHeader("x-ms-range")
+		}
+		start = first
+		if last >= 0 && last+1 < end {
+			end = last + 1
+		}
+	}
+
+	out := struct {
+		XMLName    xml.Name       `xml:"PageList"`
+		PageRange  []pageRangeXML `xml:"PageRange"`
+		ClearRange []pageRangeXML `xml:"ClearRange"`
+	}{}
+	prevSnapshot, err := snapshotParam(req, "prevsnapshot")
+	if err != nil {
+		return err
+	}
+	if prevSnapshot == "" {
+		for _, r := range b.pages.ranges(start, end) {
+			out.PageRange = append(out.PageRange, pageRangeXML{r[0], r[1]})
+		}
+	} else {
+		var prev *blob
+		for _, snap := range c.snapshots[name] {
+			if snap.snapshot == prevSnapshot {
+				prev = snap
+			}
+		}
+		if prev == nil {
+			return newError(http.StatusNotFound, "PreviousSnapshotNotFound", "The previous snapshot is not found.")
+		}
+		updated, cleared := pageDiff(b.pages, prev.pages, start, end)
+		for _, r := range updated {
+			out.PageRange = append(out.PageRange, pageRangeXML{r[0], r[1]})
+		}
+		for _, r := range cleared {
+			out.ClearRange = append(out.ClearRange, pageRangeXML{r[0], r[1]})
+		}
+	}
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	h.Set("x-ms-blob-content-length", strconv.FormatInt(b.size, 10))
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+// pageDiff returns the pages in [start, end) whose content differs between
+// cur and prev, and the ones valid in prev but not in cur.
+func pageDiff(cur, prev extents, start, end int64) (updated, cleared [][2]int64) {
+	pages := make(map[int64]bool)
+	for _, e := range []extents{cur, prev} {
+		for _, r := range e.ranges(start, end) {
+			for p := r[0] / pageSize * pageSize; p <= r[1]; p += pageSize {
+				pages[p] = true
+			}
+		}
+	}
+	sorted := make([]int64, 0, len(pages))
+	for p := range pages {
+		sorted = append(sorted, p)
+	}
+	sort.Sort(int64s(sorted))
+
+	add := func(ranges [][2]int64, p int64) [][2]int64 {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == p {
+			ranges[n-1][1] = p + pageSize - 1
+			return ranges
+		}
+		return append(ranges, [2]int64{p, p + pageSize - 1})
+	}
+	for _, p := range sorted {
+		inCur, inPrev := cur.has(p), prev.has(p)
+		switch {
+		case inCur && (!inPrev || !bytes.Equal(cur.read(p, p+pageSize), prev.read(p, p+pageSize))):
+			updated = add(updated, p)
+		case !inCur && inPrev:
+			cleared = add(cleared, p)
+		}
+	}
+	return updated, cleared
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (s *Server) appendBlock(req *request, c *container, name string) error {
+	b, err := writableBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if b.blobType != "AppendBlob" {
+		return errInvalidBlobType()
+	}
+	if len(req.body) > maxBlockSize {
+		return errBodyTooLarge()
+	}
+	offset := len(b.data)
+	b.data = append(b.data, req.body...)
+	b.appendCount++
+	b.etag, b.modified = s.newETag(), s.now()
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	h.Set("Content-MD5", md5Sum(req.body))
+	h.Set("x-ms-blob-append-offset", strconv.Itoa(offset))
+	h.Set("x-ms-blob-committed-block-count", strconv.Itoa(b.appendCount))
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) setBlobProperties(req *request, c *container, name string) error {
+	b, err := writableBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if v := req.Header.Get("x-ms-blob-content-length"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if b.blobType != "PageBlob" || err != nil || size < 0 || size%pageSize != 0 {
+			return errInvalidHeader("x-ms-blob-content-length")
+		}
+		b.size = size
+		b.pages = b.pages.truncate(size)
+	}
+	b.properties = newBlobProperties(req, false)
+	b.etag, b.modified = s.newETag(), s.now()
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	if b.blobType == "PageBlob" {
+		h.Set("x-ms-blob-sequence-number", strconv.FormatInt(b.sequenceNumber, 10))
+	}
+	req.reply(http.StatusOK)
+	return nil
+}
+
+func (s *Server) setBlobMetadata(req *request, c *container, name string) error {
+	b, err := writableBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	b.metadata = metadataFromHeaders(req.Header)
+	b.etag, b.modified = s.newETag(), s.now()
+	setModifiedHeaders(req.w.Header(), b.etag, b.modified)
+	req.reply(http.StatusOK)
+	return nil
+}
+
+func (s *Server) getBlobMetadata(req *request, c *container, name string) error {
+	b, err := lookupBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return err
+	}
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	setMetadataHeaders(h, b.metadata)
+	req.reply(http.StatusOK)
+	return nil
+}
+
+func (s *Server) snapshotBlob(req *request, c *container, name string) error {
+	b, ok := c.blobs[name]
+	if !ok || !b.committed {
+		return errBlobNotFound()
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return err
+	}
+	snap := b.clone()
+	snap.snapshot = s.now().Format(timestampFormat)
+	if metadata := metadataFromHeaders(req.Header); len(metadata) > 0 {
+		snap.metadata = metadata
+	}
+	c.snapshots[name] = append(c.snapshots[name], snap)
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	h.Set("x-ms-snapshot", snap.snapshot)
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+// copyBlob copies a blob of the account. Copies complete before the
+// response is sent, as they usually do within an account.
+func (s *Server) copyBlob(req *request, c *container, name string) error {
+	source := req.Header.Get("x-ms-copy-source")
+	u, err := url.Parse(source)
+	if err != nil {
+		return errInvalidHeader("x-ms-copy-source")
+	}
+	if !strings.HasPrefix(u.Host, AccountName+".blob.") {
+		return newError(http.StatusNotImplemented, "NotImplemented", "storagetest: copying blobs from outside of the account is not implemented.")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		return errInvalidHeader("x-ms-copy-source")
+	}
+	cannotVerify := newError(http.StatusNotFound, "CannotVerifyCopySource", "The specified blob does not exist.")
+	srcContainer, ok := s.containers[parts[0]]
+	if !ok {
+		return cannotVerify
+	}
+	srcReq := &request{Request: req.Request, query: u.Query()}
+	src, err := lookupBlob(srcReq, srcContainer, parts[1])
+	if err != nil {
+		return cannotVerify
+	}
+
+	old, exists := c.blobs[name]
+	if exists && old.committed {
+		if err := old.lease.checkWrite(req); err != nil {
+			return err
+		}
+		if err := checkConditions(req, old.etag, old.modified); err != nil {
+			return err
+		}
+	}
+
+	b := src.clone()
+	b.name = name
+	b.snapshot = ""
+	b.committed = true
+	if metadata := metadataFromHeaders(req.Header); len(metadata) > 0 {
+		b.metadata = metadata
+	}
+	if exists && old.committed {
+		b.lease = old.lease
+	}
+	b.etag, b.modified = s.newETag(), s.now()
+	b.copy = &blobCopy{
+		id:             newUUID(),
+		source:         source,
+		status:         "success",
+		progress:       fmt.Sprintf("%d/%d", b.length(), b.length()),
+		completionTime: b.modified,
+	}
+	c.blobs[name] = b
+
+	h := req.w.Header()
+	setModifiedHeaders(h, b.etag, b.modified)
+	h.Set("x-ms-copy-id", b.copy.id)
+	h.Set("x-ms-copy-status", b.copy.status)
+	req.reply(http.StatusAccepted)
+	return nil
+}
+
+func (s *Server) abortCopyBlob(req *request, c *container, name string) error {
+	b, err := writableBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if b.copy == nil || b.copy.id != req.query.Get("copyid") {
+		return newError(http.StatusConflict, "CopyIdMismatch", "The specified copy ID did not match the copy ID for the pending copy operation.")
+	}
+	return newError(http.StatusConflict, "NoPendingCopyOperation", "There is currently no pending copy operation.")
+}
+
+func (s *Server) getBlob(req *request, c *container, name string) error {
+	b, err := lookupBlob(req, c, name)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return err
+	}
+
+	h := req.w.Header()
+	b.setHeaders(h, time.Now())
+	size := b.length()
+	rng := req.requestRange()
+	if req.Method == http.MethodHead || rng == "" {
+		if b.properties.contentMD5 != "" {
+			h.Set("Content-MD5", b.properties.contentMD5)
+		}
+		if req.Method == http.MethodHead {
+			h.Set("Content-Length", strconv.FormatInt(size, 10))
+			req.reply(http.StatusOK)
+			return nil
+		}
+		req.replyBody(http.StatusOK, "", b.read(0, size))
+		return nil
+	}
+
+	start, end, ok := parseRange(rng)
+	if !ok {
+		return errInvalidHeader("Range")
+	}
+	if start >= size {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if req.Header.Get("x-ms-range-get-content-md5") == "true" {
+		if end-start+1 > maxGetMD5Size {
+			return newError(http.StatusBadRequest, "OutOfRangeInput", "One of the request inputs is out of range.")
+		}
+		h.Set("Content-MD5", md5Sum(b.read(start, end+1)))
+	} else if b.properties.contentMD5 != "" {
+		h.Set("x-ms-blob-content-md5", b.properties.contentMD5)
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	req.replyBody(http.StatusPartialContent, "", b.read(start, end+1))
+	return nil
+}
+
+// setHeaders adds the properties of b to h.
+func (b *blob) setHeaders(h http.Header, now time.Time) {
+	setModifiedHeaders(h, b.etag, b.modified)
+	setMetadataHeaders(h, b.metadata)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Type", b.properties.contentType)
+	if b.properties.contentEncoding != "" {
+		h.Set("Content-Encoding", b.properties.contentEncoding)
+	}
+	if b.properties.contentLanguage != "" {
+		h.Set("Content-Language", b.properties.contentLanguage)
+	}
+	if b.properties.cacheControl != "" {
+		h.Set("Cache-Control", b.properties.cacheControl)
+	}
+	if b.properties.contentDisposition != "" {
+		h.Set("Content-Disposition", b.properties.contentDisposition)
+	}
+	h.Set("x-ms-blob-type", b.blobType)
+	switch b.blobType {
+	case "PageBlob":
+		h.Set("x-ms-blob-sequence-number", strconv.FormatInt(b.sequenceNumber, 10))
+	case "AppendBlob":
+		h.Set("x-ms-blob-committed-block-count", strconv.Itoa(b.appendCount))
+	}
+	status, state, duration := b.lease.headers(now)
+	h.Set("x-ms-lease-status", status)
+	h.Set("x-ms-lease-state", state)
+	if duration != "" {
+		h.Set("x-ms-lease-duration", duration)
+	}
+	if b.copy != nil {
+		h.Set("x-ms-copy-id", b.copy.id)
+		h.Set("x-ms-copy-source", b.copy.source)
+		h.Set("x-ms-copy-status", b.copy.status)
+		h.Set("x-ms-copy-progress", b.copy.progress)
+		h.Set("x-ms-copy-completion-time", b.copy.completionTime.Format(http.TimeFormat))
+	}
+}
+
+func (s *Server) deleteBlob(req *request, c *container, name string) error {
+	option := req.Header.Get("x-ms-delete-snapshots")
+	if req.query.Get("snapshot") != "" {
+		snap, err := lookupBlob(req, c, name)
+		if err != nil {
+			return err
+		}
+		if option != "" {
+			return errInvalidHeader("x-ms-delete-snapshots")
+		}
+		snapshots := c.snapshots[name]
+		for i, b := range snapshots {
+			if b == snap {
+				c.snapshots[name] = append(snapshots[:i:i], snapshots[i+1:]...)
+				break
+			}
+		}
+		if len(c.snapshots[name]) == 0 {
+			delete(c.snapshots, name)
+		}
+		req.reply(http.StatusAccepted)
+		return nil
+	}
+
+	if _, err := writableBlob(req, c, name); err != nil {
+		return err
+	}
+	switch option {
+	case "":
+		if len(c.snapshots[name]) > 0 {
+			return newError(http.StatusConflict, "SnapshotsPresent", "This operation is not permitted because the blob has snapshots.")
+		}
+		delete(c.blobs, name)
+	case "include":
+		delete(c.blobs, name)
+		delete(c.snapshots, name)
+	case "only":
+		delete(c.snapshots, name)
+	default:
+		return errInvalidHeader("x-ms-delete-snapshots")
+	}
+	req.reply(http.StatusAccepted)
+	return nil
+}
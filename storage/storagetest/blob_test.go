@@ -0,0 +1,264 @@
+package storagetest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type BlobSuite struct {
+	srv  *Server
+	cli  storage.BlobStorageClient
+	cnt  string
+	data []byte
+}
+
+var _ = chk.Suite(&BlobSuite{})
+
+func (s *BlobSuite) SetUpTest(c *chk.C) {
+	s.srv = NewServer()
+	s.cli = s.srv.Client().GetBlobService()
+	s.cnt = "container"
+	s.data = []byte("hello, world")
+	c.Assert(s.cli.CreateContainer(s.cnt, storage.ContainerAccessTypePrivate), chk.IsNil)
+}
+
+func (s *BlobSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *BlobSuite) putBlob(c *chk.C, name string, data []byte) {
+	err := s.cli.CreateBlockBlobFromReader(s.cnt, name, uint64(len(data)), bytes.NewReader(data), nil)
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *BlobSuite) getBlob(c *chk.C, name string) []byte {
+	r, err := s.cli.GetBlob(s.cnt, name)
+	c.Assert(err, chk.IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, chk.IsNil)
+	return data
+}
+
+func (s *BlobSuite) TestContainers(c *chk.C) {
+	err := s.cli.CreateContainer(s.cnt, storage.ContainerAccessTypePrivate)
+	assertServiceError(c, err, http.StatusConflict, "ContainerAlreadyExists")
+	err = s.cli.CreateContainer("Bad_Name", storage.ContainerAccessTypePrivate)
+	assertServiceError(c, err, http.StatusBadRequest, "InvalidResourceName")
+
+	c.Assert(s.cli.CreateContainer("other", storage.ContainerAccessTypeBlob), chk.IsNil)
+	list, err := s.cli.ListContainers(storage.ListContainersParameters{MaxResults: 1})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Containers, chk.HasLen, 1)
+	c.Assert(list.Containers[0].Name, chk.Equals, "container")
+	c.Assert(list.NextMarker, chk.Equals, "other")
+
+	ok, err := s.cli.ContainerExists("other")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(s.cli.DeleteContainer("other"), chk.IsNil)
+	ok, err = s.cli.ContainerExists("other")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+	assertServiceError(c, s.cli.DeleteContainer("other"), http.StatusNotFound, "ContainerNotFound")
+}
+
+func (s *BlobSuite) TestBlockBlob(c *chk.C) {
+	s.putBlob(c, "blob", s.data)
+	c.Assert(s.getBlob(c, "blob"), chk.DeepEquals, s.data)
+
+	props, err := s.cli.GetBlobProperties(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ContentLength, chk.Equals, int64(len(s.data)))
+	c.Assert(props.BlobType, chk.Equals, storage.BlobTypeBlock)
+	c.Assert(props.ContentMD5, chk.Equals, md5Sum(s.data))
+
+	r, err := s.cli.GetBlobRange(s.cnt, "blob", "7-11", nil)
+	c.Assert(err, chk.IsNil)
+	part, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(part), chk.Equals, "world")
+
+	_, err = s.cli.GetBlobRange(s.cnt, "blob", "100-", nil)
+	assertServiceError(c, err, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+
+	c.Assert(s.cli.DeleteBlob(s.cnt, "blob", nil), chk.IsNil)
+	_, err = s.cli.GetBlob(s.cnt, "blob")
+	assertServiceError(c, err, http.StatusNotFound, "BlobNotFound")
+}
+
+func (s *BlobSuite) TestBlockList(c *chk.C) {
+	id1 := base64.StdEncoding.EncodeToString([]byte("block-1"))
+	id2 := base64.StdEncoding.EncodeToString([]byte("block-2"))
+	c.Assert(s.cli.PutBlock(s.cnt, "blob", id1, []byte("hello, ")), chk.IsNil)
+	c.Assert(s.cli.PutBlock(s.cnt, "blob", id2, []byte("world")), chk.IsNil)
+
+	exists, err := s.cli.BlobExists(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(exists, chk.Equals, false)
+
+	list, err := s.cli.GetBlockList(s.cnt, "blob", storage.BlockListTypeAll)
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.CommittedBlocks, chk.HasLen, 0)
+	c.Assert(list.UncommittedBlocks, chk.HasLen, 2)
+
+	err = s.cli.PutBlockList(s.cnt, "blob", []storage.Block{{ID: id1, Status: storage.BlockStatusCommitted}})
+	assertServiceError(c, err, http.StatusBadRequest, "InvalidBlockList")
+
+	err = s.cli.PutBlockList(s.cnt, "blob", []storage.Block{
+		{ID: id1, Status: storage.BlockStatusUncommitted},
+		{ID: id2, Status: storage.BlockStatusLatest},
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(s.getBlob(c, "blob")), chk.Equals, "hello, world")
+
+	list, err = s.cli.GetBlockList(s.cnt, "blob", storage.BlockListTypeCommitted)
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.CommittedBlocks, chk.DeepEquals, []storage.BlockResponse{{Name: id1, Size: 7}, {Name: id2, Size: 5}})
+}
+
+func (s *BlobSuite) TestPageBlob(c *chk.C) {
+	c.Assert(s.cli.PutPageBlob(s.cnt, "page", 4*pageSize, nil), chk.IsNil)
+	page := bytes.Repeat([]byte{'x'}, 2*pageSize)
+	c.Assert(s.cli.PutPage(s.cnt, "page", pageSize, 3*pageSize-1, storage.PageWriteTypeUpdate, page, nil), chk.IsNil)
+	c.Assert(s.cli.PutPage(s.cnt, "page", pageSize, 2*pageSize-1, storage.PageWriteTypeClear, nil, nil), chk.IsNil)
+
+	ranges, err := s.cli.GetPageRanges(s.cnt, "page")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges.PageList, chk.DeepEquals, []storage.PageRange{{Start: 2 * pageSize, End: 3*pageSize - 1}})
+
+	data := s.getBlob(c, "page")
+	c.Assert(data, chk.HasLen, 4*pageSize)
+	c.Assert(data[2*pageSize:3*pageSize], chk.DeepEquals, page[:pageSize])
+	c.Assert(data[:2*pageSize], chk.DeepEquals, make([]byte, 2*pageSize))
+
+	err = s.cli.PutPage(s.cnt, "page", 1, pageSize, storage.PageWriteTypeUpdate, page[:pageSize], nil)
+	assertServiceError(c, err, http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange")
+}
+
+func (s *BlobSuite) TestAppendBlob(c *chk.C) {
+	c.Assert(s.cli.PutAppendBlob(s.cnt, "append", nil), chk.IsNil)
+	c.Assert(s.cli.AppendBlock(s.cnt, "append", []byte("hello, "), nil), chk.IsNil)
+	c.Assert(s.cli.AppendBlock(s.cnt, "append", []byte("world"), nil), chk.IsNil)
+	c.Assert(string(s.getBlob(c, "append")), chk.Equals, "hello, world")
+
+	s.putBlob(c, "block", s.data)
+	err := s.cli.AppendBlock(s.cnt, "block", s.data, nil)
+	assertServiceError(c, err, http.StatusConflict, "InvalidBlobType")
+}
+
+func (s *BlobSuite) TestListBlobs(c *chk.C) {
+	for _, name := range []string{"a/1", "a/2", "b", "c/1"} {
+		s.putBlob(c, name, s.data)
+	}
+	list, err := s.cli.ListBlobs(s.cnt, storage.ListBlobsParameters{Delimiter: "/", MaxResults: 2})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.BlobPrefixes, chk.DeepEquals, []string{"a/"})
+	c.Assert(list.Blobs, chk.HasLen, 1)
+	c.Assert(list.Blobs[0].Name, chk.Equals, "b")
+	c.Assert(list.NextMarker, chk.Not(chk.Equals), "")
+
+	list, err = s.cli.ListBlobs(s.cnt, storage.ListBlobsParameters{Delimiter: "/", Marker: list.NextMarker})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.BlobPrefixes, chk.DeepEquals, []string{"c/"})
+	c.Assert(list.Blobs, chk.HasLen, 0)
+	c.Assert(list.NextMarker, chk.Equals, "")
+
+	list, err = s.cli.ListBlobs(s.cnt, storage.ListBlobsParameters{Prefix: "a/", Include: "metadata"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+	c.Assert(list.Blobs[1].Properties.ContentLength, chk.Equals, int64(len(s.data)))
+}
+
+func (s *BlobSuite) TestMetadataAndProperties(c *chk.C) {
+	s.putBlob(c, "blob", s.data)
+	c.Assert(s.cli.SetBlobMetadata(s.cnt, "blob", map[string]string{"Key": "value"}, nil), chk.IsNil)
+	metadata, err := s.cli.GetBlobMetadata(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata, chk.DeepEquals, map[string]string{"key": "value"})
+
+	c.Assert(s.cli.SetBlobProperties(s.cnt, "blob", storage.BlobHeaders{ContentType: "text/plain"}), chk.IsNil)
+	props, err := s.cli.GetBlobProperties(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ContentType, chk.Equals, "text/plain")
+	c.Assert(props.ContentMD5, chk.Equals, "")
+}
+
+func (s *BlobSuite) TestSnapshots(c *chk.C) {
+	s.putBlob(c, "blob", s.data)
+	snapshot, err := s.cli.SnapshotBlob(s.cnt, "blob", 0, nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(snapshot, chk.NotNil)
+	s.putBlob(c, "blob", []byte("changed"))
+
+	list, err := s.cli.ListBlobs(s.cnt, storage.ListBlobsParameters{Include: "snapshots"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Blobs, chk.HasLen, 2)
+	c.Assert(list.Blobs[0].Snapshot, chk.Not(chk.Equals), "")
+	c.Assert(list.Blobs[0].Properties.ContentLength, chk.Equals, int64(len(s.data)))
+	c.Assert(list.Blobs[1].Snapshot, chk.Equals, "")
+
+	err = s.cli.DeleteBlob(s.cnt, "blob", nil)
+	assertServiceError(c, err, http.StatusConflict, "SnapshotsPresent")
+	c.Assert(s.cli.DeleteBlob(s.cnt, "blob", map[string]string{"x-ms-delete-snapshots": "include"}), chk.IsNil)
+}
+
+func (s *BlobSuite) TestLeases(c *chk.C) {
+	s.putBlob(c, "blob", s.data)
+	id, err := s.cli.AcquireLease(s.cnt, "blob", 30, "")
+	c.Assert(err, chk.IsNil)
+	_, err = s.cli.AcquireLease(s.cnt, "blob", 30, "")
+	assertServiceError(c, err, http.StatusConflict, "LeaseAlreadyPresent")
+
+	err = s.cli.SetBlobMetadata(s.cnt, "blob", map[string]string{"k": "v"}, nil)
+	assertServiceError(c, err, http.StatusPreconditionFailed, "LeaseIdMissing")
+	c.Assert(s.cli.SetBlobMetadata(s.cnt, "blob", map[string]string{"k": "v"}, map[string]string{"x-ms-lease-id": id}), chk.IsNil)
+
+	props, err := s.cli.GetBlobProperties(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.LeaseStatus, chk.Equals, "locked")
+	c.Assert(props.LeaseState, chk.Equals, "leased")
+
+	c.Assert(s.cli.RenewLease(s.cnt, "blob", id), chk.IsNil)
+	newID, err := s.cli.ChangeLease(s.cnt, "blob", id, "c9a5e1b5-4b68-4c9f-8c7a-5a3b1f4c2d10")
+	c.Assert(err, chk.IsNil)
+	err = s.cli.ReleaseLease(s.cnt, "blob", id)
+	assertServiceError(c, err, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+
+	remaining, err := s.cli.BreakLeaseWithBreakPeriod(s.cnt, "blob", 0)
+	c.Assert(err, chk.IsNil)
+	c.Assert(remaining, chk.Equals, 0)
+	props, err = s.cli.GetBlobProperties(s.cnt, "blob")
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.LeaseState, chk.Equals, "broken")
+	c.Assert(s.cli.ReleaseLease(s.cnt, "blob", newID), chk.IsNil)
+}
+
+func (s *BlobSuite) TestCopyBlob(c *chk.C) {
+	s.putBlob(c, "source", s.data)
+	c.Assert(s.cli.CopyBlob(s.cnt, "copy", s.cli.GetBlobURL(s.cnt, "source")), chk.IsNil)
+	c.Assert(s.getBlob(c, "copy"), chk.DeepEquals, s.data)
+
+	err := s.cli.CopyBlob(s.cnt, "copy", s.cli.GetBlobURL(s.cnt, "missing"))
+	assertServiceError(c, err, http.StatusNotFound, "CannotVerifyCopySource")
+}
+
+func (s *BlobSuite) TestPageDiff(c *chk.C) {
+	var cur, prev extents
+	prev = prev.write(0, bytes.Repeat([]byte{1}, 3*pageSize))
+	cur = prev.clone()
+	cur = cur.write(pageSize, bytes.Repeat([]byte{2}, pageSize))
+	cur = cur.write(0, bytes.Repeat([]byte{1}, pageSize))
+	cur = cur.clear(2*pageSize, 3*pageSize)
+	cur = cur.write(4*pageSize, bytes.Repeat([]byte{3}, pageSize))
+
+	updated, cleared := pageDiff(cur, prev, 0, 5*pageSize)
+	c.Assert(updated, chk.DeepEquals, [][2]int64{{pageSize, 2*pageSize - 1}, {4 * pageSize, 5*pageSize - 1}})
+	c.Assert(cleared, chk.DeepEquals, [][2]int64{{2 * pageSize, 3*pageSize - 1}})
+}
@@ -0,0 +1,134 @@
+package storagetest
+
+// extent is a written range of a page blob or file.
+type extent struct {
+	start int64
+	data  []byte
+}
+
+func (e extent) end() int64 { return e.start + int64(len(e.data)) }
+
+// extents holds the written ranges of a page blob or file, sorted by start
+// and neither overlapping nor touching one another. Unwritten bytes read as
+// zeros, so large sparse resources cost no memory.
+type extents []extent
+
+// write returns e with p written at off.
+func (e extents) write(off int64, p []byte) extents {
+	if len(p) == 0 {
+		return e
+	}
+	end := off + int64(len(p))
+	var out extents
+	merged := extent{start: off}
+	mergedEnd := end
+	var touching extents
+	for _, x := range e {
+		switch {
+		case x.end() < off:
+			out = append(out, x)
+		case x.start > end:
+			continue
+		default:
+			touching = append(touching, x)
+			if x.start < merged.start {
+				merged.start = x.start
+			}
+			if x.end() > mergedEnd {
+				mergedEnd = x.end()
+			}
+		}
+	}
+	merged.data = make([]byte, mergedEnd-merged.start)
+	for _, x := range touching {
+		copy(merged.data[x.start-merged.start:], x.data)
+	}
+	copy(merged.data[off-merged.start:], p)
+	out = append(out, merged)
+	for _, x := range e {
+		if x.start > end {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// clear returns e without the bytes in [start, end).
+func (e extents) clear(start, end int64) extents {
+	var out extents
+	for _, x := range e {
+		if x.end() <= start || x.start >= end {
+			out = append(out, x)
+			continue
+		}
+		if x.start < start {
+			out = append(out, extent{start: x.start, data: x.data[:start-x.start]})
+		}
+		if x.end() > end {
+			out = append(out, extent{start: end, data: x.data[end-x.start:]})
+		}
+	}
+	return out
+}
+
+// read returns the bytes in [start, end).
+func (e extents) read(start, end int64) []byte {
+	p := make([]byte, end-start)
+	for _, x := range e {
+		if x.end() <= start || x.start >= end {
+			continue
+		}
+		lo, hi := x.start, x.end()
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		copy(p[lo-start:hi-start], x.data[lo-x.start:hi-x.start])
+	}
+	return p
+}
+
+// ranges returns the written ranges within [start, end), as inclusive
+// [first, last] byte offsets.
+func (e extents) ranges(start, end int64) [][2]int64 {
+	var out [][2]int64
+	for _, x := range e {
+		lo, hi := x.start, x.end()
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			out = append(out, [2]int64{lo, hi - 1})
+		}
+	}
+	return out
+}
+
+// truncate returns e without the bytes at or after size.
+func (e extents) truncate(size int64) extents {
+	return e.clear(size, 1<<62)
+}
+
+// clone returns a copy of e sharing no memory with it.
+func (e extents) clone() extents {
+	out := make(extents, len(e))
+	for i, x := range e {
+		out[i] = extent{start: x.start, data: append([]byte(nil), x.data...)}
+	}
+	return out
+}
+
+// has reports whether the byte at off has been written.
+func (e extents) has(off int64) bool {
+	for _, x := range e {
+		if off >= x.start && off < x.end() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,606 @@
+package storagetest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the file service, as of API version 2015-02-21.
+const (
+	defaultShareQuota = 5120 // GiB
+	maxShareQuota     = 5120
+	maxFileSize       = 1 << 40
+	maxRangeWriteSize = 4 * 1024 * 1024
+)
+
+// share is a file share.
+type share struct {
+	name     string
+	metadata map[string]string
+	quota    int
+	etag     string
+	modified time.Time
+	root     *directory
+}
+
+// directory is a directory of a share.
+type directory struct {
+	metadata map[string]string
+	etag     string
+	modified time.Time
+	dirs     map[string]*directory
+	files    map[string]*file
+}
+
+// file is a file of a share.
+type file struct {
+	metadata   map[string]string
+	properties fileProperties
+	size       int64
+	data       extents
+	etag       string
+	modified   time.Time
+}
+
+type fileProperties struct {
+	contentType        string
+	contentEncoding    string
+	contentLanguage    string
+	contentMD5         string
+	cacheControl       string
+	contentDisposition string
+}
+
+func newDirectory(s *Server, metadata map[string]string) *directory {
+	return &directory{
+		metadata: metadata,
+		etag:     s.newETag(),
+		modified: s.now(),
+		dirs:     make(map[string]*directory),
+		files:    make(map[string]*file),
+	}
+}
+
+func errShareNotFound() error {
+	return newError(http.StatusNotFound, "ShareNotFound", "The specified share does not exist.")
+}
+
+func errParentNotFound() error {
+	return newError(http.StatusNotFound, "ParentNotFound", "The specified parent path does not exist.")
+}
+
+func errResourceAlreadyExists() error {
+	return newError(http.StatusConflict, "ResourceAlreadyExists", "The specified resource already exists.")
+}
+
+// serveFile serves a request to the file service.
+func (s *Server) serveFile(req *request) error {
+	segments := req.pathSegments()
+	if len(segments) == 0 {
+		if req.Method == http.MethodGet && req.query.Get("comp") == "list" {
+			return s.listShares(req)
+		}
+		return errNotImplemented(req)
+	}
+	restype := req.query.Get("restype")
+	if len(segments) == 1 && restype == "share" {
+		return s.serveShare(req, segments[0])
+	}
+
+	sh, ok := s.shares[segments[0]]
+	if !ok {
+		return errShareNotFound()
+	}
+	var names []string
+	if len(segments) == 2 && strings.Trim(segments[1], "/") != "" {
+		names = strings.Split(strings.Trim(segments[1], "/"), "/")
+	}
+	switch restype {
+	case "directory":
+		return s.serveDirectory(req, sh, names)
+	case "":
+		if len(names) == 0 {
+			return errInvalidURI()
+		}
+		return s.serveFileResource(req, sh, names)
+	}
+	return errInvalidQuery("restype")
+}
+
+// lookupDir returns the directory of sh with the given path.
+func lookupDir(sh *share, names []string) (*directory, bool) {
+	d := sh.root
+	for _, name := range names {
+		next, ok := d.dirs[name]
+		if !ok {
+			return nil, false
+		}
+		d = next
+	}
+	return d, true
+}
+
+// serveShare serves a request to a share itself.
+func (s *Server) serveShare(req *request, name string) error {
+	comp := req.query.Get("comp")
+	if req.Method == http.MethodPut && comp == "" {
+		if !validName(name) {
+			return errInvalidName()
+		}
+		if _, ok := s.shares[name]; ok {
+			return newError(http.StatusConflict, "ShareAlreadyExists", "The specified share already exists.")
+		}
+		quota, err := shareQuota(req, defaultShareQuota)
+		if err != nil {
+			return err
+		}
+		sh := &share{
+			name:     name,
+			metadata: metadataFromHeaders(req.Header),
+			quota:    quota,
+			etag:     s.newETag(),
+			modified: s.now(),
+			root:     newDirectory(s, map[string]string{}),
+		}
+		s.shares[name] = sh
+		setModifiedHeaders(req.w.Header(), sh.etag, sh.modified)
+		req.reply(http.StatusCreated)
+		return nil
+	}
+
+	sh, ok := s.shares[name]
+	if !ok {
+		return errShareNotFound()
+	}
+	h := req.w.Header()
+	switch {
+	case req.Method == http.MethodDelete && comp == "":
+		delete(s.shares, name)
+		req.reply(http.StatusAccepted)
+		return nil
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && (comp == "" || comp == "metadata"):
+		setMetadataHeaders(h, sh.metadata)
+		if comp == "" {
+			h.Set("x-ms-share-quota", strconv.Itoa(sh.quota))
+		}
+	case req.Method == http.MethodPut && comp == "metadata":
+		sh.metadata = metadataFromHeaders(req.Header)
+		sh.etag, sh.modified = s.newETag(), s.now()
+	case req.Method == http.MethodPut && comp == "properties":
+		quota, err := shareQuota(req, sh.quota)
+		if err != nil {
+			return err
+		}
+		sh.quota = quota
+		sh.etag, sh.modified = s.newETag(), s.now()
+	default:
+		return errNotImplemented(req)
+	}
+	setModifiedHeaders(h, sh.etag, sh.modified)
+	req.reply(http.StatusOK)
+	return nil
+}
+
+// shareQuota returns the x-ms-share-quota header of req, or def.
+func shareQuota(req *request, def int) (int, error) {
+	v := req.Header.Get("x-ms-share-quota")
+	if v == "" {
+		return def, nil
+	}
+	quota, err := strconv.Atoi(v)
+	if err != nil || quota < 1 || quota > maxShareQuota {
+		return 0, errInvalidHeader("x-ms-share-quota")
+	}
+	return quota, nil
+}
+
+type shareXML struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified string `xml:"Last-Modified"`
+		Etag         string `xml:"Etag"`
+		Quota        int    `xml:"Quota"`
+	} `xml:"Properties"`
+	Metadata metadataXML `xml:"Metadata,omitempty"`
+}
+
+func (s *Server) listShares(req *request) error {
+	max, err := req.maxResults()
+	if err != nil {
+		return err
+	}
+	prefix, marker := req.query.Get("prefix"), req.query.Get("marker")
+	withMetadata := strings.Contains(req.query.Get("include"), "metadata")
+
+	var names []string
+	for name := range s.shares {
+		if strings.HasPrefix(name, prefix) && name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := struct {
+		listing
+		Shares     []shareXML `xml:"Shares>Share"`
+		NextMarker string     `xml:"NextMarker"`
+	}{listing: listing{ServiceEndpoint: req.serviceEndpoint(), Prefix: prefix, Marker: marker, MaxResults: max}}
+	for i, name := range names {
+		if i == max {
+			out.NextMarker = name
+			break
+		}
+		sh := s.shares[name]
+		var x shareXML
+		x.Name = name
+		x.Properties.LastModified = sh.modified.Format(http.TimeFormat)
+		x.Properties.Etag = sh.etag
+		x.Properties.Quota = sh.quota
+		if withMetadata {
+			x.Metadata = sh.metadata
+		}
+		out.Shares = append(out.Shares, x)
+	}
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+// serveDirectory serves a request to the directory of sh with the given
+// path, which is empty for the root directory.
+func (s *Server) serveDirectory(req *request, sh *share, names []string) error {
+	comp := req.query.Get("comp")
+	if req.Method == http.MethodPut && comp == "" {
+		if len(names) == 0 {
+			return errResourceAlreadyExists()
+		}
+		parent, ok := lookupDir(sh, names[:len(names)-1])
+		if !ok {
+			return errParentNotFound()
+		}
+		name := names[len(names)-1]
+		if _, ok := parent.dirs[name]; ok {
+			return errResourceAlreadyExists()
+		}
+		if _, ok := parent.files[name]; ok {
+			return errResourceAlreadyExists()
+		}
+		d := newDirectory(s, metadataFromHeaders(req.Header))
+		parent.dirs[name] = d
+		setModifiedHeaders(req.w.Header(), d.etag, d.modified)
+		req.reply(http.StatusCreated)
+		return nil
+	}
+
+	d, ok := lookupDir(sh, names)
+	if !ok {
+		return errResourceNotFound()
+	}
+	h := req.w.Header()
+	switch {
+	case req.Method == http.MethodDelete && comp == "":
+		if len(names) == 0 {
+			return newError(http.StatusBadRequest, "InvalidUri", "The root directory of a share cannot be deleted.")
+		}
+		if len(d.dirs) > 0 || len(d.files) > 0 {
+			return newError(http.StatusConflict, "DirectoryNotEmpty", "The specified directory is not empty.")
+		}
+		parent, _ := lookupDir(sh, names[:len(names)-1])
+		delete(parent.dirs, names[len(names)-1])
+		req.reply(http.StatusAccepted)
+		return nil
+	case req.Method == http.MethodGet && comp == "list":
+		return s.listDirectory(req, sh, names, d)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && (comp == "" || comp == "metadata"):
+		setMetadataHeaders(h, d.metadata)
+	case req.Method == http.MethodPut && comp == "metadata":
+		d.metadata = metadataFromHeaders(req.Header)
+		d.etag, d.modified = s.newETag(), s.now()
+	default:
+		return errNotImplemented(req)
+	}
+	setModifiedHeaders(h, d.etag, d.modified)
+	req.reply(http.StatusOK)
+	return nil
+}
+
+type fileEntryXML struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		ContentLength int64 `xml:"Content-Length"`
+	} `xml:"Properties"`
+}
+
+type directoryEntryXML struct {
+	Name string `xml:"Name"`
+}
+
+func (s *Server) listDirectory(req *request, sh *share, names []string, d *directory) error {
+	max, err := req.maxResults()
+	if err != nil {
+		return err
+	}
+	marker := req.query.Get("marker")
+
+	var entries []string
+	for name := range d.dirs {
+		entries = append(entries, name)
+	}
+	for name := range d.files {
+		entries = append(entries, name)
+	}
+	sort.Strings(entries)
+
+	out := struct {
+		listing
+		ShareName     string              `xml:"ShareName,attr"`
+		DirectoryPath string              `xml:"DirectoryPath,attr"`
+		Files         []fileEntryXML      `xml:"Entries>File"`
+		Directories   []directoryEntryXML `xml:"Entries>Directory"`
+		NextMarker    string              `xml:"NextMarker"`
+	}{
+		listing:       listing{ServiceEndpoint: req.serviceEndpoint(), Marker: marker, MaxResults: max},
+		ShareName:     sh.name,
+		DirectoryPath: strings.Join(names, "/"),
+	}
+	count := 0
+	for _, name := range entries {
+		if name < marker {
+			continue
+		}
+		if count == max {
+			out.NextMarker = name
+			break
+		}
+		count++
+		if f, ok := d.files[name]; ok {
+			x := fileEntryXML{Name: name}
+			x.Properties.ContentLength = f.size
+			out.Files = append(out.Files, x)
+		} else {
+			out.Directories = append(out.Directories, directoryEntryXML{name})
+		}
+	}
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+// newFileProperties returns the properties set by the x-ms-content-*
+// headers of req.
+func newFileProperties(req *request) fileProperties {
+	return fileProperties{
+		contentType:        req.Header.Get("x-ms-content-type"),
+		contentEncoding:    req.Header.Get("x-ms-content-encoding"),
+		contentLanguage:    req.Header.Get("x-ms-content-language"),
+		contentMD5:         req.Header.Get("x-ms-content-md5"),
+		cacheControl:       req.Header.Get("x-ms-cache-control"),
+		contentDisposition: req.Header.Get("x-ms-content-disposition"),
+	}
+}
+
+// fileSize returns the x-ms-content-length header of req.
+func fileSize(req *request) (int64, error) {
+	size, err := strconv.ParseInt(req.Header.Get("x-ms-content-length"), 10, 64)
+	if err != nil || size < 0 || size > maxFileSize {
+		return 0, errInvalidHeader("x-ms-content-length")
+	}
+	return size, nil
+}
+
+// serveFileResource serves a request to the file of sh with the given
+// path.
+func (s *Server) serveFileResource(req *request, sh *share, names []string) error {
+	parent, ok := lookupDir(sh, names[:len(names)-1])
+	if !ok {
+		return errParentNotFound()
+	}
+	name := names[len(names)-1]
+	comp := req.query.Get("comp")
+	if req.Method == http.MethodPut && comp == "" {
+		return s.createFile(req, parent, name)
+	}
+
+	f, ok := parent.files[name]
+	if !ok {
+		return errResourceNotFound()
+	}
+	h := req.w.Header()
+	switch {
+	case req.Method == http.MethodDelete && comp == "":
+		delete(parent.files, name)
+		req.reply(http.StatusAccepted)
+		return nil
+	case req.Method == http.MethodPut && comp == "range":
+		return s.putRange(req, f)
+	case req.Method == http.MethodGet && comp == "rangelist":
+		return s.listRanges(req, f)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "":
+		return s.getFile(req, f)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "metadata":
+		setMetadataHeaders(h, f.metadata)
+	case req.Method == http.MethodPut && comp == "metadata":
+		f.metadata = metadataFromHeaders(req.Header)
+		f.etag, f.modified = s.newETag(), s.now()
+	case req.Method == http.MethodPut && comp == "properties":
+		if req.Header.Get("x-ms-content-length") != "" {
+			size, err := fileSize(req)
+			if err != nil {
+				return err
+			}
+			f.size = size
+			f.data = f.data.truncate(size)
+		}
+		f.properties = newFileProperties(req)
+		f.etag, f.modified = s.newETag(), s.now()
+	default:
+		return errNotImplemented(req)
+	}
+	setModifiedHeaders(h, f.etag, f.modified)
+	req.reply(http.StatusOK)
+	return nil
+}
+
+func (s *Server) createFile(req *request, parent *directory, name string) error {
+	if req.Header.Get("x-ms-type") != "file" {
+		return errInvalidHeader("x-ms-type")
+	}
+	if _, ok := parent.dirs[name]; ok {
+		return errResourceAlreadyExists()
+	}
+	size, err := fileSize(req)
+	if err != nil {
+		return err
+	}
+	// Creating a file replaces any existing one.
+	f := &file{
+		metadata:   metadataFromHeaders(req.Header),
+		properties: newFileProperties(req),
+		size:       size,
+		etag:       s.newETag(),
+		modified:   s.now(),
+	}
+	if f.properties.contentType == "" {
+		f.properties.contentType = "application/octet-stream"
+	}
+	parent.files[name] = f
+	setModifiedHeaders(req.w.Header(), f.etag, f.modified)
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+func errInvalidFileRange() error {
+	return newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+}
+
+func (s *Server) putRange(req *request, f *file) error {
+	rng := req.requestRange()
+	if rng == "" {
+		return errMissingHeader("x-ms-range")
+	}
+	start, end, ok := parseRange(rng)
+	if !ok || end < 0 {
+		return errInvalidHeader("x-ms-range")
+	}
+	if end >= f.size {
+		return errInvalidFileRange()
+	}
+
+	h := req.w.Header()
+	switch req.Header.Get("x-ms-write") {
+	case "update":
+		if int64(len(req.body)) != end-start+1 {
+			return errInvalidHeader("Content-Length")
+		}
+		if len(req.body) > maxRangeWriteSize {
+			return errBodyTooLarge()
+		}
+		f.data = f.data.write(start, req.body)
+		h.Set("Content-MD5", md5Sum(req.body))
+	case "clear":
+		if len(req.body) > 0 {
+			return errInvalidHeader("Content-Length")
+		}
+		f.data = f.data.clear(start, end+1)
+	case "":
+		return errMissingHeader("x-ms-write")
+	default:
+		return errInvalidHeader("x-ms-write")
+	}
+	f.etag, f.modified = s.newETag(), s.now()
+	setModifiedHeaders(h, f.etag, f.modified)
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) listRanges(req *request, f *file) error {
+	start, end := int64(0), f.size
+	if rng := req.requestRange(); rng != "" {
+		first, last, ok := parseRange(rng)
+		if !ok {
+			return errInvalidHeader("x-ms-range")
+		}
+		start = first
+		if last >= 0 && last+1 < end {
+			end = last + 1
+		}
+	}
+
+	type rangeXML struct {
+		Start int64 `xml:"Start"`
+		End   int64 `xml:"End"`
+	}
+	out := struct {
+		XMLName xml.Name   `xml:"Ranges"`
+		Ranges  []rangeXML `xml:"Range"`
+	}{}
+	for _, r := range f.data.ranges(start, end) {
+		out.Ranges = append(out.Ranges, rangeXML{r[0], r[1]})
+	}
+
+	h := req.w.Header()
+	setModifiedHeaders(h, f.etag, f.modified)
+	h.Set("x-ms-content-length", strconv.FormatInt(f.size, 10))
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+func (s *Server) getFile(req *request, f *file) error {
+	h := req.w.Header()
+	setModifiedHeaders(h, f.etag, f.modified)
+	setMetadataHeaders(h, f.metadata)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("x-ms-type", "File")
+	h.Set("Content-Type", f.properties.contentType)
+	for name, v := range map[string]string{
+		"Content-Encoding":    f.properties.contentEncoding,
+		"Content-Language":    f.properties.contentLanguage,
+		"Cache-Control":       f.properties.cacheControl,
+		"Content-Disposition": f.properties.contentDisposition,
+	} {
+		if v != "" {
+			h.Set(name, v)
+		}
+	}
+
+	rng := req.requestRange()
+	if req.Method == http.MethodHead || rng == "" {
+		if f.properties.contentMD5 != "" {
+			h.Set("Content-MD5", f.properties.contentMD5)
+		}
+		if req.Method == http.MethodHead {
+			h.Set("Content-Length", strconv.FormatInt(f.size, 10))
+			req.reply(http.StatusOK)
+			return nil
+		}
+		req.replyBody(http.StatusOK, "", f.data.read(0, f.size))
+		return nil
+	}
+
+	start, end, ok := parseRange(rng)
+	if !ok {
+		return errInvalidHeader("Range")
+	}
+	if start >= f.size {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", f.size))
+		return errInvalidFileRange()
+	}
+	if end < 0 || end >= f.size {
+		end = f.size - 1
+	}
+	data := f.data.read(start, end+1)
+	if req.Header.Get("x-ms-range-get-content-md5") == "true" {
+		if len(data) > maxGetMD5Size {
+			return newError(http.StatusBadRequest, "OutOfRangeInput", "One of the request inputs is out of range.")
+		}
+		h.Set("Content-MD5", md5Sum(data))
+	} else if f.properties.contentMD5 != "" {
+		h.Set("x-ms-content-md5", f.properties.contentMD5)
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, f.size))
+	req.replyBody(http.StatusPartialContent, "", data)
+	return nil
+}
@@ -0,0 +1,119 @@
+package storagetest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type FileSuite struct {
+	srv   *Server
+	cli   storage.FileServiceClient
+	share storage.Share
+}
+
+var _ = chk.Suite(&FileSuite{})
+
+func (s *FileSuite) SetUpTest(c *chk.C) {
+	s.srv = NewServer()
+	s.cli = s.srv.Client().GetFileService()
+	s.share = s.cli.GetShareReference("share")
+	c.Assert(s.share.Create(), chk.IsNil)
+}
+
+func (s *FileSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *FileSuite) TestShares(c *chk.C) {
+	assertServiceError(c, s.share.Create(), http.StatusConflict, "ShareAlreadyExists")
+
+	s.share.Properties.Quota = 10
+	c.Assert(s.share.SetProperties(), chk.IsNil)
+	s.share.Metadata = map[string]string{"key": "value"}
+	c.Assert(s.share.SetMetadata(), chk.IsNil)
+
+	list, err := s.cli.ListShares(storage.ListSharesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Shares, chk.HasLen, 1)
+	c.Assert(list.Shares[0].Name, chk.Equals, "share")
+	c.Assert(list.Shares[0].Properties.Quota, chk.Equals, 10)
+
+	other := s.cli.GetShareReference("other")
+	ok, err := other.Exists()
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+	assertServiceError(c, other.Delete(), http.StatusNotFound, "ShareNotFound")
+	c.Assert(s.share.Delete(), chk.IsNil)
+}
+
+func (s *FileSuite) TestDirectories(c *chk.C) {
+	root := s.share.GetRootDirectoryReference()
+	dir := root.GetDirectoryReference("dir")
+	c.Assert(dir.Create(), chk.IsNil)
+	assertServiceError(c, dir.Create(), http.StatusConflict, "ResourceAlreadyExists")
+	err := dir.GetDirectoryReference("a").GetDirectoryReference("b").Create()
+	assertServiceError(c, err, http.StatusNotFound, "ParentNotFound")
+
+	c.Assert(dir.GetDirectoryReference("sub").Create(), chk.IsNil)
+	c.Assert(dir.GetFileReference("file").Create(10), chk.IsNil)
+	list, err := dir.ListDirsAndFiles(storage.ListDirsAndFilesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(list.Directories, chk.HasLen, 1)
+	c.Assert(list.Directories[0].Name, chk.Equals, "sub")
+	c.Assert(list.Files, chk.HasLen, 1)
+	c.Assert(list.Files[0].Name, chk.Equals, "file")
+	c.Assert(list.Files[0].Properties.Length, chk.Equals, uint64(10))
+
+	assertServiceError(c, dir.Delete(), http.StatusConflict, "DirectoryNotEmpty")
+	c.Assert(dir.GetDirectoryReference("sub").Delete(), chk.IsNil)
+	c.Assert(dir.GetFileReference("file").Delete(), chk.IsNil)
+	c.Assert(dir.Delete(), chk.IsNil)
+	ok, err := dir.Exists()
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+}
+
+func (s *FileSuite) TestRanges(c *chk.C) {
+	f := s.share.GetRootDirectoryReference().GetFileReference("file")
+	c.Assert(f.Create(1024), chk.IsNil)
+	data := bytes.Repeat([]byte{'x'}, 100)
+	c.Assert(f.WriteRange(bytes.NewReader(data), storage.FileRange{Start: 100, End: 199}, nil), chk.IsNil)
+	c.Assert(f.WriteRange(bytes.NewReader(data), storage.FileRange{Start: 200, End: 299}, nil), chk.IsNil)
+	c.Assert(f.ClearRange(storage.FileRange{Start: 150, End: 249}), chk.IsNil)
+
+	ranges, err := f.ListRanges(nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(ranges.ContentLength, chk.Equals, uint64(1024))
+	c.Assert(ranges.FileRanges, chk.DeepEquals, []storage.FileRange{{Start: 100, End: 149}, {Start: 250, End: 299}})
+
+	stream, err := f.DownloadRangeToStream(storage.FileRange{Start: 140, End: 159}, true)
+	c.Assert(err, chk.IsNil)
+	got, err := ioutil.ReadAll(stream.Body)
+	stream.Body.Close()
+	c.Assert(err, chk.IsNil)
+	want := append(bytes.Repeat([]byte{'x'}, 10), make([]byte, 10)...)
+	c.Assert(got, chk.DeepEquals, want)
+	c.Assert(stream.ContentMD5, chk.Equals, md5Sum(want))
+
+	err = f.WriteRange(bytes.NewReader(data), storage.FileRange{Start: 1000, End: 1099}, nil)
+	assertServiceError(c, err, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+}
+
+func (s *FileSuite) TestProperties(c *chk.C) {
+	f := s.share.GetRootDirectoryReference().GetFileReference("file")
+	c.Assert(f.Create(10), chk.IsNil)
+	f.Properties.Type = "text/plain"
+	c.Assert(f.SetProperties(), chk.IsNil)
+	f.Metadata = map[string]string{"key": "value"}
+	c.Assert(f.SetMetadata(), chk.IsNil)
+
+	g := s.share.GetRootDirectoryReference().GetFileReference("file")
+	c.Assert(g.FetchAttributes(), chk.IsNil)
+	c.Assert(g.Properties.Type, chk.Equals, "text/plain")
+	c.Assert(g.Properties.Length, chk.Equals, uint64(10))
+	c.Assert(g.Metadata, chk.DeepEquals, map[string]string{"key": "value"})
+}
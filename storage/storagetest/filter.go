@@ -0,0 +1,353 @@
+package storagetest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// filterExpr is a node of a parsed $filter expression of a table query.
+//
+// Values are strings, float64s, int64s, bools or time.Times; binary values
+// are compared in their base64 form. Comparing values of different types,
+// or a property an entity lacks, yields false as it does in the service.
+type filterExpr interface {
+	eval(e *entity) interface{}
+}
+
+type (
+	literalExpr  struct{ value interface{} }
+	propertyExpr struct{ name string }
+	notExpr      struct{ x filterExpr }
+	binaryExpr   struct {
+		op   string
+		x, y filterExpr
+	}
+)
+
+func (x literalExpr) eval(*entity) interface{} { return x.value }
+
+func (x propertyExpr) eval(e *entity) interface{} {
+	v, ok := e.get(x.name)
+	if !ok {
+		return nil
+	}
+	return normalize(v)
+}
+
+func (x notExpr) eval(e *entity) interface{} {
+	b, ok := x.x.eval(e).(bool)
+	return ok && !b
+}
+
+func (x binaryExpr) eval(e *entity) interface{} {
+	switch x.op {
+	case "and":
+		return x.x.eval(e) == true && x.y.eval(e) == true
+	case "or":
+		return x.x.eval(e) == true || x.y.eval(e) == true
+	}
+	c, ok := compare(x.x.eval(e), x.y.eval(e))
+	if !ok {
+		return false
+	}
+	switch x.op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+// normalize converts a property value decoded from JSON to the types
+// compared by filters.
+func normalize(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// compare compares two values of the same type, or numbers.
+func compare(a, b interface{}) (int, bool) {
+	if i, ok := a.(int64); ok {
+		if _, ok := b.(float64); ok {
+			a = float64(i)
+		}
+	}
+	if i, ok := b.(int64); ok {
+		if _, ok := a.(float64); ok {
+			b = float64(i)
+		}
+	}
+	// Dates sent without an odata.type annotation are strings.
+	if t, ok := a.(time.Time); ok {
+		if s, ok := b.(string); ok {
+			if u, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return compareTimes(t, u), true
+			}
+		}
+	}
+	if s, ok := a.(string); ok {
+		if t, ok := b.(time.Time); ok {
+			if u, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return compareTimes(u, t), true
+			}
+		}
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			return sign(x - y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x == y {
+			return 0, true
+		} else if ok {
+			return 1, true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return compareTimes(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func sign(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+// filterParser is a recursive descent parser of $filter expressions:
+//
+//	or      = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | compare
+//	compare = operand [ ("eq" | "ne" | "gt" | "ge" | "lt" | "le") operand ]
+//	operand = "(" or ")" | literal | property
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseFilter parses a $filter expression.
+func parseFilter(s string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	x, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in $filter", p.tokens[p.pos])
+	}
+	return x, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) or() (filterExpr, error) {
+	x, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var y filterExpr
+		if y, err = p.and(); err == nil {
+			x = binaryExpr{"or", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	x, err := p.not()
+	for err == nil && p.peek() == "and" {
+		p.next()
+		var y filterExpr
+		if y, err = p.not(); err == nil {
+			x = binaryExpr{"and", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *filterParser) not() (filterExpr, error) {
+	if p.peek() == "not" {
+		p.next()
+		x, err := p.not()
+		return notExpr{x}, err
+	}
+	return p.compare()
+}
+
+func (p *filterParser) compare() (filterExpr, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+		p.next()
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op, x, y}, nil
+	}
+	return x, nil
+}
+
+func (p *filterParser) operand() (filterExpr, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of $filter")
+	case t == "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in $filter")
+		}
+		return x, nil
+	case t == "true" || t == "false":
+		return literalExpr{t == "true"}, nil
+	case t[0] == '\'':
+		return literalExpr{t[1:]}, nil
+	case strings.HasPrefix(t, "datetime'"):
+		v, err := time.Parse(time.RFC3339Nano, t[len("datetime'"):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid datetime %q in $filter", t)
+		}
+		return literalExpr{v}, nil
+	case strings.HasPrefix(t, "guid'"):
+		return literalExpr{t[len("guid'"):]}, nil
+	case strings.HasPrefix(t, "X'") || strings.HasPrefix(t, "binary'"):
+		// Binary properties are stored as their base64 JSON encoding.
+		b, err := hex.DecodeString(t[strings.Index(t, "'")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary %q in $filter", t)
+		}
+		return literalExpr{base64.StdEncoding.EncodeToString(b)}, nil
+	case t[0] == '-' || t[0] >= '0' && t[0] <= '9':
+		if i, err := strconv.ParseInt(strings.TrimSuffix(t, "L"), 10, 64); err == nil {
+			return literalExpr{i}, nil
+		}
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in $filter", t)
+		}
+		return literalExpr{f}, nil
+	case unicode.IsLetter(rune(t[0])) || t[0] == '_':
+		return propertyExpr{t}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in $filter", t)
+}
+
+// tokenizeFilter splits a $filter expression into tokens. Quoted strings
+// are returned unquoted, after their opening quote and any type prefix.
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			start := i
+			for i < len(s) && s[i] != ' ' && s[i] != '(' && s[i] != ')' && s[i] != '\'' {
+				i++
+			}
+			prefix := s[start:i]
+			if i == len(s) || s[i] != '\'' {
+				tokens = append(tokens, prefix)
+				continue
+			}
+			// A quoted string, with quotes escaped by doubling them.
+			var value []byte
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated string in $filter")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				value = append(value, s[i])
+			}
+			tokens = append(tokens, prefix+"'"+string(value))
+		}
+	}
+	return tokens, nil
+}
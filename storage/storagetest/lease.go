@@ -0,0 +1,185 @@
+package storagetest
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// lease is the lease of a blob. Its zero value is no lease.
+type lease struct {
+	id       string
+	duration int // seconds, -1 for an infinite lease
+	expires  time.Time
+	broken   time.Time // when a broken lease stops being breaking
+}
+
+// Lease states, as reported in x-ms-lease-state.
+const (
+	leaseAvailable = "available"
+	leaseLeased    = "leased"
+	leaseExpired   = "expired"
+	leaseBreaking  = "breaking"
+	leaseBroken    = "broken"
+)
+
+// state returns the state of l at now.
+func (l *lease) state(now time.Time) string {
+	switch {
+	case l.id == "":
+		return leaseAvailable
+	case !l.broken.IsZero() && now.Before(l.broken):
+		return leaseBreaking
+	case !l.broken.IsZero():
+		return leaseBroken
+	case l.duration > 0 && !now.Before(l.expires):
+		return leaseExpired
+	}
+	return leaseLeased
+}
+
+// active reports whether l locks its blob at now.
+func (l *lease) active(now time.Time) bool {
+	state := l.state(now)
+	return state == leaseLeased || state == leaseBreaking
+}
+
+// headers returns the lease status, state and duration of l at now.
+func (l *lease) headers(now time.Time) (status, state, duration string) {
+	state = l.state(now)
+	if state == leaseLeased {
+		duration = "fixed"
+		if l.duration < 0 {
+			duration = "infinite"
+		}
+	}
+	status = "unlocked"
+	if l.active(now) {
+		status = "locked"
+	}
+	return status, state, duration
+}
+
+// checkWrite checks the lease ID given by a request writing to the blob
+// locked by l.
+func (l *lease) checkWrite(req *request) error {
+	id := req.Header.Get("x-ms-lease-id")
+	if !l.active(time.Now()) {
+		if id != "" {
+			return newError(http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation", "There is currently no lease on the blob.")
+		}
+		return nil
+	}
+	switch id {
+	case "":
+		return newError(http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request.")
+	case l.id:
+		return nil
+	}
+	return newError(http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation", "The lease ID specified did not match the lease ID for the blob.")
+}
+
+// leaseBlob acquires, renews, changes, releases or breaks the lease of a
+// blob.
+func (s *Server) leaseBlob(req *request, c *container, name string) error {
+	b, ok := c.blobs[name]
+	if !ok || !b.committed {
+		return errBlobNotFound()
+	}
+	if err := checkConditions(req, b.etag, b.modified); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	l := &b.lease
+	id := req.Header.Get("x-ms-lease-id")
+	mismatch := newError(http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+	h := req.w.Header()
+	status := http.StatusOK
+
+	switch action := req.Header.Get("x-ms-lease-action"); action {
+	case "acquire":
+		duration := -1
+		if v := req.Header.Get("x-ms-lease-duration"); v != "" {
+			d, err := strconv.Atoi(v)
+			if err != nil || d != -1 && (d < 15 || d > 60) {
+				return errInvalidHeader("x-ms-lease-duration")
+			}
+			duration = d
+		}
+		proposed := req.Header.Get("x-ms-proposed-lease-id")
+		if l.active(now) && (l.state(now) == leaseBreaking || proposed != l.id) {
+			return newError(http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+		}
+		if proposed == "" {
+			proposed = newUUID()
+		}
+		*l = lease{id: proposed, duration: duration, expires: now.Add(time.Duration(duration) * time.Second)}
+		h.Set("x-ms-lease-id", l.id)
+		status = http.StatusCreated
+	case "renew":
+		if id != l.id || l.state(now) == leaseAvailable {
+			return mismatch
+		}
+		if !l.broken.IsZero() {
+			return newError(http.StatusConflict, "LeaseIsBrokenAndCannotBeRenewed", "The lease ID matched, but the lease has been broken explicitly and cannot be renewed.")
+		}
+		l.expires = now.Add(time.Duration(l.duration) * time.Second)
+		h.Set("x-ms-lease-id", l.id)
+	case "change":
+		proposed := req.Header.Get("x-ms-proposed-lease-id")
+		if proposed == "" {
+			return errMissingHeader("x-ms-proposed-lease-id")
+		}
+		if !l.active(now) {
+			return newError(http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		}
+		if id != l.id && proposed != l.id {
+			return mismatch
+		}
+		l.id = proposed
+		h.Set("x-ms-lease-id", l.id)
+	case "release":
+		if id != l.id || l.state(now) == leaseAvailable {
+			return mismatch
+		}
+		*l = lease{}
+	case "break":
+		if !l.active(now) && l.state(now) != leaseBroken {
+			return newError(http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		}
+		remaining := 0
+		if l.active(now) {
+			period := l.duration
+			if l.duration > 0 {
+				period = int(l.expires.Sub(now) / time.Second)
+			}
+			if v := req.Header.Get("x-ms-lease-break-period"); v != "" {
+				p, err := strconv.Atoi(v)
+				if err != nil || p < 0 || p > 60 {
+					return errInvalidHeader("x-ms-lease-break-period")
+				}
+				if period < 0 || p < period {
+					period = p
+				}
+			}
+			if period < 0 {
+				period = 0
+			}
+			if l.broken.IsZero() || now.Add(time.Duration(period)*time.Second).Before(l.broken) {
+				l.broken = now.Add(time.Duration(period) * time.Second)
+			}
+			remaining = int(l.broken.Sub(now) / time.Second)
+		}
+		h.Set("x-ms-lease-time", strconv.Itoa(remaining))
+		status = http.StatusAccepted
+	case "":
+		return errMissingHeader("x-ms-lease-action")
+	default:
+		return errInvalidHeader("x-ms-lease-action")
+	}
+
+	setModifiedHeaders(h, b.etag, b.modified)
+	req.reply(status)
+	return nil
+}
@@ -0,0 +1,306 @@
+package storagetest
+
+import (
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Limits of the queue service, as of API version 2015-02-21.
+const (
+	maxMessageSize           = 64 * 1024
+	maxMessagesPerGet        = 32
+	defaultMessageTTL        = 7 * 24 * time.Hour
+	defaultVisibilityTimeout = 30 * time.Second
+	maxVisibilityTimeout     = 7 * 24 * time.Hour
+)
+
+// queue is a message queue.
+type queue struct {
+	name     string
+	metadata map[string]string
+	messages []*message
+}
+
+// message is a message of a queue.
+type message struct {
+	id           string
+	text         string
+	insertion    time.Time
+	expiration   time.Time
+	nextVisible  time.Time
+	popReceipt   string
+	dequeueCount int
+}
+
+// expire removes the expired messages of q.
+func (q *queue) expire(now time.Time) {
+	live := q.messages[:0]
+	for _, m := range q.messages {
+		if now.Before(m.expiration) {
+			live = append(live, m)
+		}
+	}
+	q.messages = live
+}
+
+// serveQueue serves a request to the queue service.
+func (s *Server) serveQueue(req *request) error {
+	segments := req.pathSegments()
+	if len(segments) == 0 {
+		return errNotImplemented(req)
+	}
+	name := segments[0]
+	if len(segments) == 1 {
+		return s.serveQueueResource(req, name)
+	}
+
+	q, ok := s.queues[name]
+	if !ok {
+		return errQueueNotFound()
+	}
+	q.expire(time.Now())
+	switch path := segments[1]; {
+	case path == "messages" && req.Method == http.MethodPost:
+		return s.putMessage(req, q)
+	case path == "messages" && req.Method == http.MethodGet:
+		return s.getMessages(req, q)
+	case path == "messages" && req.Method == http.MethodDelete:
+		q.messages = nil
+		req.reply(http.StatusNoContent)
+		return nil
+	case len(path) > len("messages/") && path[:len("messages/")] == "messages/":
+		id := path[len("messages/"):]
+		switch req.Method {
+		case http.MethodDelete:
+			return s.deleteMessage(req, q, id)
+		case http.MethodPut:
+			return s.updateMessage(req, q, id)
+		}
+	}
+	return errNotImplemented(req)
+}
+
+func errQueueNotFound() error {
+	return newError(http.StatusNotFound, "QueueNotFound", "The specified queue does not exist.")
+}
+
+// serveQueueResource serves a request to a queue itself.
+func (s *Server) serveQueueResource(req *request, name string) error {
+	comp := req.query.Get("comp")
+	if req.Method == http.MethodPut && comp == "" {
+		if !validName(name) {
+			return errInvalidName()
+		}
+		metadata := metadataFromHeaders(req.Header)
+		if q, ok := s.queues[name]; ok {
+			if !reflect.DeepEqual(q.metadata, metadata) {
+				return newError(http.StatusConflict, "QueueAlreadyExists", "The specified queue already exists.")
+			}
+			req.reply(http.StatusNoContent)
+			return nil
+		}
+		s.queues[name] = &queue{name: name, metadata: metadata}
+		req.reply(http.StatusCreated)
+		return nil
+	}
+
+	q, ok := s.queues[name]
+	if !ok {
+		return errQueueNotFound()
+	}
+	switch {
+	case req.Method == http.MethodDelete && comp == "":
+		delete(s.queues, name)
+		req.reply(http.StatusNoContent)
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && comp == "metadata":
+		q.expire(time.Now())
+		h := req.w.Header()
+		setMetadataHeaders(h, q.metadata)
+		h.Set("x-ms-approximate-messages-count", strconv.Itoa(len(q.messages)))
+		req.reply(http.StatusOK)
+	case req.Method == http.MethodPut && comp == "metadata":
+		q.metadata = metadataFromHeaders(req.Header)
+		req.reply(http.StatusNoContent)
+	default:
+		return errNotImplemented(req)
+	}
+	return nil
+}
+
+// secondsParam returns the query parameter of req with the given name as
+// a duration in seconds within [min, max], or def if it is not set.
+func secondsParam(req *request, name string, def, min, max time.Duration) (time.Duration, error) {
+	v := req.query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	d := time.Duration(n) * time.Second
+	if err != nil || d < min || d > max {
+		return 0, newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "One of the query parameters specified in the request URI is outside the permissible range: "+name+".")
+	}
+	return d, nil
+}
+
+// messageText decodes the QueueMessage document of req.
+func messageText(req *request) (string, error) {
+	var body struct {
+		XMLName     xml.Name `xml:"QueueMessage"`
+		MessageText string   `xml:"MessageText"`
+	}
+	if err := req.xmlBody(&body); err != nil {
+		return "", err
+	}
+	if len(body.MessageText) > maxMessageSize {
+		return "", errBodyTooLarge()
+	}
+	return body.MessageText, nil
+}
+
+func (s *Server) putMessage(req *request, q *queue) error {
+	text, err := messageText(req)
+	if err != nil {
+		return err
+	}
+	ttl, err := secondsParam(req, "messagettl", defaultMessageTTL, time.Second, maxVisibilityTimeout)
+	if err != nil {
+		return err
+	}
+	visibility, err := secondsParam(req, "visibilitytimeout", 0, 0, maxVisibilityTimeout)
+	if err != nil {
+		return err
+	}
+	if visibility >= ttl {
+		return newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "One of the query parameters specified in the request URI is outside the permissible range: visibilitytimeout.")
+	}
+
+	now := s.now()
+	q.messages = append(q.messages, &message{
+		id:          newUUID(),
+		text:        text,
+		insertion:   now,
+		expiration:  now.Add(ttl),
+		nextVisible: now.Add(visibility),
+		popReceipt:  newUUID(),
+	})
+	req.reply(http.StatusCreated)
+	return nil
+}
+
+type messageXML struct {
+	MessageID       string `xml:"MessageId"`
+	InsertionTime   string `xml:"InsertionTime"`
+	ExpirationTime  string `xml:"ExpirationTime"`
+	PopReceipt      string `xml:"PopReceipt,omitempty"`
+	TimeNextVisible string `xml:"TimeNextVisible,omitempty"`
+	DequeueCount    int    `xml:"DequeueCount"`
+	MessageText     string `xml:"MessageText"`
+}
+
+// getMessages gets or peeks at the visible messages of q, oldest first.
+func (s *Server) getMessages(req *request, q *queue) error {
+	n := 1
+	if v := req.query.Get("numofmessages"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxMessagesPerGet {
+			return newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "One of the query parameters specified in the request URI is outside the permissible range: numofmessages.")
+		}
+	}
+	peek := req.query.Get("peekonly") == "true"
+	visibility, err := secondsParam(req, "visibilitytimeout", defaultVisibilityTimeout, time.Second, maxVisibilityTimeout)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	out := struct {
+		XMLName  xml.Name     `xml:"QueueMessagesList"`
+		Messages []messageXML `xml:"QueueMessage"`
+	}{}
+	for _, m := range q.messages {
+		if len(out.Messages) == n {
+			break
+		}
+		if now.Before(m.nextVisible) {
+			continue
+		}
+		x := messageXML{
+			MessageID:      m.id,
+			InsertionTime:  m.insertion.Format(http.TimeFormat),
+			ExpirationTime: m.expiration.Format(http.TimeFormat),
+			DequeueCount:   m.dequeueCount,
+			MessageText:    m.text,
+		}
+		if !peek {
+			m.dequeueCount++
+			m.popReceipt = newUUID()
+			m.nextVisible = now.Add(visibility)
+			x.DequeueCount = m.dequeueCount
+			x.PopReceipt = m.popReceipt
+			x.TimeNextVisible = m.nextVisible.Format(http.TimeFormat)
+		}
+		out.Messages = append(out.Messages, x)
+	}
+	req.replyXML(http.StatusOK, out)
+	return nil
+}
+
+// findMessage returns the index in q of the message with the given ID, if
+// the pop receipt of req is its current one.
+func findMessage(req *request, q *queue, id string) (int, error) {
+	receipt := req.query.Get("popreceipt")
+	if receipt == "" {
+		return 0, newError(http.StatusBadRequest, "MissingRequiredQueryParameter", "A query parameter that's mandatory for this request is not specified: popreceipt.")
+	}
+	for i, m := range q.messages {
+		if m.id != id {
+			continue
+		}
+		if m.popReceipt != receipt {
+			return 0, newError(http.StatusBadRequest, "PopReceiptMismatch", "The specified pop receipt did not match the pop receipt for a dequeued message.")
+		}
+		return i, nil
+	}
+	return 0, newError(http.StatusNotFound, "MessageNotFound", "The specified message does not exist.")
+}
+
+func (s *Server) deleteMessage(req *request, q *queue, id string) error {
+	i, err := findMessage(req, q, id)
+	if err != nil {
+		return err
+	}
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+	req.reply(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) updateMessage(req *request, q *queue, id string) error {
+	i, err := findMessage(req, q, id)
+	if err != nil {
+		return err
+	}
+	if req.query.Get("visibilitytimeout") == "" {
+		return newError(http.StatusBadRequest, "MissingRequiredQueryParameter", "A query parameter that's mandatory for this request is not specified: visibilitytimeout.")
+	}
+	visibility, err := secondsParam(req, "visibilitytimeout", 0, 0, maxVisibilityTimeout)
+	if err != nil {
+		return err
+	}
+	m := q.messages[i]
+	if len(req.body) > 0 {
+		if m.text, err = messageText(req); err != nil {
+			return err
+		}
+	}
+	m.popReceipt = newUUID()
+	m.nextVisible = s.now().Add(visibility)
+
+	h := req.w.Header()
+	h.Set("x-ms-popreceipt", m.popReceipt)
+	h.Set("x-ms-time-next-visible", m.nextVisible.Format(http.TimeFormat))
+	req.reply(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,98 @@
+package storagetest
+
+import (
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type QueueSuite struct {
+	srv *Server
+	cli storage.QueueServiceClient
+}
+
+var _ = chk.Suite(&QueueSuite{})
+
+func (s *QueueSuite) SetUpTest(c *chk.C) {
+	s.srv = NewServer()
+	s.cli = s.srv.Client().GetQueueService()
+	c.Assert(s.cli.CreateQueue("queue"), chk.IsNil)
+}
+
+func (s *QueueSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *QueueSuite) TestQueues(c *chk.C) {
+	ok, err := s.cli.QueueExists("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, true)
+
+	c.Assert(s.cli.SetMetadata("queue", map[string]string{"Key": "value"}), chk.IsNil)
+	metadata, err := s.cli.GetMetadata("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata.UserDefinedMetadata, chk.DeepEquals, map[string]string{"key": "value"})
+
+	c.Assert(s.cli.DeleteQueue("queue"), chk.IsNil)
+	ok, err = s.cli.QueueExists("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(ok, chk.Equals, false)
+	assertServiceError(c, s.cli.DeleteQueue("queue"), http.StatusNotFound, "QueueNotFound")
+}
+
+func (s *QueueSuite) TestMessages(c *chk.C) {
+	for _, text := range []string{"one", "two", "three"} {
+		c.Assert(s.cli.PutMessage("queue", text, storage.PutMessageParameters{}), chk.IsNil)
+	}
+	metadata, err := s.cli.GetMetadata("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata.ApproximateMessageCount, chk.Equals, 3)
+
+	peeked, err := s.cli.PeekMessages("queue", storage.PeekMessagesParameters{NumOfMessages: 2})
+	c.Assert(err, chk.IsNil)
+	c.Assert(peeked.QueueMessagesList, chk.HasLen, 2)
+	c.Assert(peeked.QueueMessagesList[0].MessageText, chk.Equals, "one")
+	c.Assert(peeked.QueueMessagesList[0].DequeueCount, chk.Equals, 0)
+
+	got, err := s.cli.GetMessages("queue", storage.GetMessagesParameters{NumOfMessages: 2, VisibilityTimeout: 60})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, 2)
+	first := got.QueueMessagesList[0]
+	c.Assert(first.MessageText, chk.Equals, "one")
+	c.Assert(first.DequeueCount, chk.Equals, 1)
+
+	// Dequeued messages are invisible until their timeout expires.
+	got, err = s.cli.GetMessages("queue", storage.GetMessagesParameters{NumOfMessages: 32})
+	c.Assert(err, chk.IsNil)
+	c.Assert(got.QueueMessagesList, chk.HasLen, 1)
+	c.Assert(got.QueueMessagesList[0].MessageText, chk.Equals, "three")
+
+	err = s.cli.DeleteMessage("queue", first.MessageID, "wrong")
+	assertServiceError(c, err, http.StatusBadRequest, "PopReceiptMismatch")
+	c.Assert(s.cli.DeleteMessage("queue", first.MessageID, first.PopReceipt), chk.IsNil)
+	err = s.cli.DeleteMessage("queue", first.MessageID, first.PopReceipt)
+	assertServiceError(c, err, http.StatusNotFound, "MessageNotFound")
+
+	c.Assert(s.cli.ClearMessages("queue"), chk.IsNil)
+	metadata, err = s.cli.GetMetadata("queue")
+	c.Assert(err, chk.IsNil)
+	c.Assert(metadata.ApproximateMessageCount, chk.Equals, 0)
+}
+
+func (s *QueueSuite) TestUpdateMessage(c *chk.C) {
+	c.Assert(s.cli.PutMessage("queue", "old", storage.PutMessageParameters{}), chk.IsNil)
+	got, err := s.cli.GetMessages("queue", storage.GetMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	msg := got.QueueMessagesList[0]
+
+	err = s.cli.UpdateMessage("queue", msg.MessageID, "new", storage.UpdateMessageParameters{PopReceipt: msg.PopReceipt, VisibilityTimeout: 1})
+	c.Assert(err, chk.IsNil)
+	peeked, err := s.cli.PeekMessages("queue", storage.PeekMessagesParameters{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(peeked.QueueMessagesList, chk.HasLen, 0)
+
+	// The pop receipt changes with every update.
+	err = s.cli.UpdateMessage("queue", msg.MessageID, "new", storage.UpdateMessageParameters{PopReceipt: msg.PopReceipt, VisibilityTimeout: 1})
+	assertServiceError(c, err, http.StatusBadRequest, "PopReceiptMismatch")
+}
@@ -0,0 +1,501 @@
+// Package storagetest provides an in-memory fake of the Azure Storage blob,
+// queue, table and file services, for hermetic tests of code built on the
+// storage package.
+//
+// A Server answers the REST calls made by a storage.Client, checks their
+// SharedKey or SharedKeyLite signature and returns the XML or OData errors
+// the service would:
+//
+//	srv := storagetest.NewServer()
+//	defer srv.Close()
+//	blobs := srv.Client().GetBlobService()
+//
+// Only the operations and parameters used by the storage package are
+// implemented. Other requests fail with a NotImplemented error.
+package storagetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	// AccountName is the name of the storage account served by a Server.
+	AccountName = "storagetest"
+
+	// AccountKey is the key requests sent to a Server must be signed with.
+	AccountKey = "c3RvcmFnZXRlc3QtYWNjb3VudC1rZXktMDEyMzQ1Njc4OWFiY2RlZg=="
+
+	blobService  = "blob"
+	queueService = "queue"
+	tableService = "table"
+	fileService  = "file"
+
+	timestampFormat = "2006-01-02T15:04:05.0000000Z"
+)
+
+// Server is a fake storage account listening on a local address. All its
+// state is kept in memory and lost once it is closed.
+type Server struct {
+	// URL is the base URL of the underlying HTTP server, of the form
+	// http://ipaddr:port with no trailing slash. Requests must carry the
+	// Host of the account endpoint they are meant for, as the ones sent by
+	// the client returned by HTTPClient do.
+	URL string
+
+	srv *httptest.Server
+	key []byte
+
+	mu         sync.Mutex
+	seq        int64
+	last       time.Time
+	containers map[string]*container
+	queues     map[string]*queue
+	tables     map[string]*table
+	shares     map[string]*share
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	key, err := base64.StdEncoding.DecodeString(AccountKey)
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		key:        key,
+		containers: make(map[string]*container),
+		queues:     make(map[string]*queue),
+		tables:     make(map[string]*table),
+		shares:     make(map[string]*share),
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server and blocks until all outstanding requests
+// on it have completed.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// HTTPClient returns an http.Client sending every request to s, whatever
+// its URL, while keeping the account endpoint as the Host of the request.
+func (s *Server) HTTPClient() *http.Client {
+	target, err := url.Parse(s.URL)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Client{Transport: redirectTransport{target: target}}
+}
+
+// Client returns a storage.Client for the account served by s, using the
+// default API version.
+func (s *Server) Client() storage.Client {
+	cli, err := storage.NewBasicClient(AccountName, AccountKey)
+	if err != nil {
+		panic(err)
+	}
+	cli.HTTPClient = s.HTTPClient()
+	return cli
+}
+
+// redirectTransport sends requests to target instead of the host of their
+// URL.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := *req
+	u := *req.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	redirected.URL = &u
+	redirected.Host = req.URL.Host
+	return http.DefaultTransport.RoundTrip(&redirected)
+}
+
+// request is a request being served along with its response.
+type request struct {
+	*http.Request
+	w       http.ResponseWriter
+	id      string
+	service string
+	query   url.Values
+	body    []byte
+}
+
+// ServeHTTP serves a request sent to the account of s.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &request{
+		Request: r,
+		w:       w,
+		id:      newUUID(),
+		service: serviceFromHost(r.Host),
+		query:   r.URL.Query(),
+	}
+	h := w.Header()
+	h.Set("x-ms-request-id", req.id)
+	h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if v := r.Header.Get("x-ms-version"); v != "" {
+		h.Set("x-ms-version", v)
+	}
+
+	err := s.authenticate(req)
+	if err == nil {
+		err = req.readBody()
+	}
+	if err == nil {
+		s.mu.Lock()
+		switch req.service {
+		case blobService:
+			err = s.serveBlob(req)
+		case queueService:
+			err = s.serveQueue(req)
+		case tableService:
+			err = s.serveTable(req)
+		case fileService:
+			err = s.serveFile(req)
+		default:
+			err = newError(http.StatusBadRequest, "InvalidUri", "The requested URI does not represent any resource on the server.")
+		}
+		s.mu.Unlock()
+	}
+	if err != nil {
+		req.replyError(err)
+	}
+}
+
+// serviceFromHost returns the service of an account endpoint such as
+// account.blob.core.windows.net.
+func serviceFromHost(host string) string {
+	parts := strings.SplitN(host, ".", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// readBody reads the body of req, checking it against its Content-MD5.
+func (req *request) readBody() error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return newError(http.StatusBadRequest, "InvalidInput", "The request body could not be read.")
+	}
+	req.body = body
+	if want := req.Header.Get("Content-MD5"); want != "" && len(body) > 0 {
+		if got := md5Sum(body); got != want {
+			return newError(http.StatusBadRequest, "Md5Mismatch", fmt.Sprintf("The MD5 value specified in the request did not match with the MD5 value calculated by the server. Specified: %s, calculated: %s.", want, got))
+		}
+	}
+	return nil
+}
+
+// reply sends a response without body.
+func (req *request) reply(status int) {
+	req.w.WriteHeader(status)
+}
+
+// replyBody sends a response with the given body.
+func (req *request) replyBody(status int, contentType string, body []byte) {
+	h := req.w.Header()
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	req.w.WriteHeader(status)
+	if req.Method != http.MethodHead {
+		req.w.Write(body)
+	}
+}
+
+// replyXML sends v as an XML document.
+func (req *request) replyXML(status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		req.replyError(err)
+		return
+	}
+	req.replyBody(status, "application/xml", append([]byte(xml.Header), body...))
+}
+
+// replyJSON sends v as a JSON document without OData metadata.
+func (req *request) replyJSON(status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		req.replyError(err)
+		return
+	}
+	req.replyBody(status, "application/json;odata=nometadata;streaming=true;charset=utf-8", body)
+}
+
+// serviceError is an error returned by the storage service.
+type serviceError struct {
+	status  int
+	code    string
+	message string
+	detail  string
+}
+
+func newError(status int, code, message string) *serviceError {
+	return &serviceError{status: status, code: code, message: message}
+}
+
+func (e *serviceError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func errNotImplemented(req *request) error {
+	return newError(http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("storagetest: %s %s is not implemented.", req.Method, req.URL.RequestURI()))
+}
+
+func errMissingHeader(name string) error {
+	return newError(http.StatusBadRequest, "MissingRequiredHeader", fmt.Sprintf("An HTTP header that's mandatory for this request is not specified: %s.", name))
+}
+
+func errInvalidHeader(name string) error {
+	return newError(http.StatusBadRequest, "InvalidHeaderValue", fmt.Sprintf("The value for one of the HTTP headers is not in the correct format: %s.", name))
+}
+
+func errInvalidQuery(name string) error {
+	return newError(http.StatusBadRequest, "InvalidQueryParameterValue", fmt.Sprintf("Value for one of the query parameters specified in the request URI is invalid: %s.", name))
+}
+
+func errInvalidName() error {
+	return newError(http.StatusBadRequest, "InvalidResourceName", "The specifed resource name contains invalid characters.")
+}
+
+func errBodyTooLarge() error {
+	return newError(http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large and exceeds the maximum permissible limit.")
+}
+
+// replyError sends err as an XML error document, or as an OData one for
+// the table service.
+func (req *request) replyError(err error) {
+	serr, ok := err.(*serviceError)
+	if !ok {
+		serr = newError(http.StatusInternalServerError, "InternalError", "The server encountered an internal error: "+err.Error())
+	}
+	if serr.status == http.StatusNotModified {
+		req.reply(serr.status)
+		return
+	}
+	message := fmt.Sprintf("%s\nRequestId:%s\nTime:%s", serr.message, req.id, time.Now().UTC().Format(timestampFormat))
+
+	if req.service == tableService {
+		var body struct {
+			Err struct {
+				Code    string `json:"code"`
+				Message struct {
+					Lang  string `json:"lang"`
+					Value string `json:"value"`
+				} `json:"message"`
+			} `json:"odata.error"`
+		}
+		body.Err.Code = serr.code
+		body.Err.Message.Lang = "en-US"
+		body.Err.Message.Value = message
+		req.replyJSON(serr.status, body)
+		return
+	}
+
+	body := struct {
+		XMLName                   xml.Name `xml:"Error"`
+		Code                      string   `xml:"Code"`
+		Message                   string   `xml:"Message"`
+		AuthenticationErrorDetail string   `xml:"AuthenticationErrorDetail,omitempty"`
+	}{Code: serr.code, Message: message, AuthenticationErrorDetail: serr.detail}
+	out, _ := xml.Marshal(body)
+	req.replyBody(serr.status, "application/xml", append([]byte(xml.Header), out...))
+}
+
+// now returns the current time, always after the previous result, at the
+// 100ns resolution of the service timestamps.
+func (s *Server) now() time.Time {
+	t := time.Now().UTC().Truncate(100 * time.Nanosecond)
+	if !t.After(s.last) {
+		t = s.last.Add(100 * time.Nanosecond)
+	}
+	s.last = t
+	return t
+}
+
+// newETag returns a new ETag.
+func (s *Server) newETag() string {
+	s.seq++
+	return fmt.Sprintf("\"0x8D4%012X\"", s.seq)
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func md5Sum(p []byte) string {
+	sum := md5.Sum(p)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validName reports whether name is a valid container, queue or share name.
+func validName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataFromHeaders returns the x-ms-meta-* headers of h, with their
+// names in lower case and without prefix.
+func metadataFromHeaders(h http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-meta-") && len(v) > 0 {
+			metadata[strings.TrimPrefix(k, "x-ms-meta-")] = v[len(v)-1]
+		}
+	}
+	return metadata
+}
+
+// setMetadataHeaders adds metadata to h as x-ms-meta-* headers.
+func setMetadataHeaders(h http.Header, metadata map[string]string) {
+	for k, v := range metadata {
+		h.Set("x-ms-meta-"+k, v)
+	}
+}
+
+// setModifiedHeaders adds the ETag and Last-Modified headers of a resource
+// to h.
+func setModifiedHeaders(h http.Header, etag string, modified time.Time) {
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", modified.Format(http.TimeFormat))
+}
+
+// parseRange parses a "bytes=start-end" range, where end may be omitted.
+func parseRange(s string) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if parts[1] == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// requestRange returns the x-ms-range or Range header of req.
+func (req *request) requestRange() string {
+	if v := req.Header.Get("x-ms-range"); v != "" {
+		return v
+	}
+	return req.Header.Get("Range")
+}
+
+// pathSegments splits the path of req into its segments, the first one
+// being a container, queue, table or share name.
+func (req *request) pathSegments() []string {
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.SplitN(p, "/", 2)
+}
+
+// listing is the common part of the XML listings of the services.
+type listing struct {
+	XMLName         xml.Name `xml:"EnumerationResults"`
+	ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+	Prefix          string   `xml:"Prefix,omitempty"`
+	Marker          string   `xml:"Marker,omitempty"`
+	MaxResults      int      `xml:"MaxResults,omitempty"`
+}
+
+// serviceEndpoint returns the endpoint of the service req was sent to.
+func (req *request) serviceEndpoint() string {
+	return fmt.Sprintf("https://%s/", req.Host)
+}
+
+// maxResults returns the maxresults parameter of req, defaulting to 5000.
+func (req *request) maxResults() (int, error) {
+	v := req.query.Get("maxresults")
+	if v == "" {
+		return 5000, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, errInvalidQuery("maxresults")
+	}
+	return n, nil
+}
+
+// metadataXML encodes metadata as the Metadata element of listings.
+type metadataXML map[string]string
+
+func (m metadataXML) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(m) {
+		if err := enc.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// xmlBody decodes the XML body of req into v.
+func (req *request) xmlBody(v interface{}) error {
+	if err := xml.NewDecoder(bytes.NewReader(req.body)).Decode(v); err != nil {
+		return newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package storagetest
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+// Hook up gocheck to testing
+func Test(t *testing.T) { chk.TestingT(t) }
+
+type ServerSuite struct {
+	srv *Server
+}
+
+var _ = chk.Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *chk.C) {
+	s.srv = NewServer()
+}
+
+func (s *ServerSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+// assertServiceError checks that err is a service error with the given
+// status and code.
+func assertServiceError(c *chk.C, err error, status int, code string) {
+	c.Assert(err, chk.NotNil)
+	serr, ok := err.(storage.AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	c.Assert(serr.StatusCode, chk.Equals, status)
+	c.Assert(serr.Code, chk.Equals, code)
+	c.Assert(serr.RequestID, chk.Not(chk.Equals), "")
+}
+
+func (s *ServerSuite) TestWrongKey(c *chk.C) {
+	cli, err := storage.NewBasicClient(AccountName, "d3Jvbmcta2V5")
+	c.Assert(err, chk.IsNil)
+	cli.HTTPClient = s.srv.HTTPClient()
+
+	_, err = cli.GetQueueService().QueueExists("queue")
+	assertServiceError(c, err, http.StatusForbidden, "AuthenticationFailed")
+	c.Assert(err.(storage.AzureStorageServiceError).AuthenticationErrorDetail, chk.Matches, "(?s)The MAC signature found in the HTTP request .*")
+}
+
+func (s *ServerSuite) TestWrongAccount(c *chk.C) {
+	cli, err := storage.NewBasicClient("other", AccountKey)
+	c.Assert(err, chk.IsNil)
+	cli.HTTPClient = s.srv.HTTPClient()
+
+	err = cli.GetBlobService().CreateContainer("container", storage.ContainerAccessTypePrivate)
+	assertServiceError(c, err, http.StatusForbidden, "AuthenticationFailed")
+}
+
+func (s *ServerSuite) TestAnonymous(c *chk.C) {
+	req, err := http.NewRequest(http.MethodGet, "https://storagetest.blob.core.windows.net/?comp=list", nil)
+	c.Assert(err, chk.IsNil)
+	resp, err := s.srv.HTTPClient().Do(req)
+	c.Assert(err, chk.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, chk.Equals, http.StatusForbidden)
+	c.Assert(resp.Header.Get("Content-Type"), chk.Equals, "application/xml")
+}
+
+func (s *ServerSuite) TestSharedKeyLite(c *chk.C) {
+	cli := s.srv.Client()
+	cli.UseSharedKeyLite = true
+
+	blobs := cli.GetBlobService()
+	c.Assert(blobs.CreateContainer("lite", storage.ContainerAccessTypePrivate), chk.IsNil)
+	c.Assert(blobs.CreateBlockBlobFromReader("lite", "blob", 3, bytes.NewReader([]byte("abc")), nil), chk.IsNil)
+
+	tables := cli.GetTableService()
+	c.Assert(tables.CreateTable("lite"), chk.IsNil)
+	names, err := tables.QueryTables()
+	c.Assert(err, chk.IsNil)
+	c.Assert(names, chk.DeepEquals, []storage.AzureTable{"lite"})
+}
+
+func (s *ServerSuite) TestParseRange(c *chk.C) {
+	for _, t := range []struct {
+		in         string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-511", 0, 511, true},
+		{"bytes=512-", 512, -1, true},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=-5", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	} {
+		start, end, ok := parseRange(t.in)
+		c.Assert([]interface{}{start, end, ok}, chk.DeepEquals, []interface{}{t.start, t.end, t.ok}, chk.Commentf(t.in))
+	}
+}
+
+func (s *ServerSuite) TestValidName(c *chk.C) {
+	c.Assert(validName("a-b-1"), chk.Equals, true)
+	c.Assert(validName("ab"), chk.Equals, false)
+	c.Assert(validName("-ab"), chk.Equals, false)
+	c.Assert(validName("a--b"), chk.Equals, false)
+	c.Assert(validName("Abc"), chk.Equals, false)
+}
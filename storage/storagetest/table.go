@@ -0,0 +1,558 @@
+package storagetest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTop is the largest number of entities a query may return at once.
+const maxTop = 1000
+
+// table is a table of entities.
+type table struct {
+	name     string
+	acl      []byte
+	entities map[entityKey]*entity
+}
+
+// cloneEntities returns a copy of the entities of t, which the operations
+// applied to t leave untouched.
+func (t *table) cloneEntities() map[entityKey]*entity {
+	entities := make(map[entityKey]*entity, len(t.entities))
+	for k, e := range t.entities {
+		c := *e
+		c.properties = make(map[string]interface{}, len(e.properties))
+		for name, v := range e.properties {
+			c.properties[name] = v
+		}
+		entities[k] = &c
+	}
+	return entities
+}
+
+type entityKey struct {
+	partitionKey, rowKey string
+}
+
+// entity is an entity of a table. Its properties hold the values decoded
+// from the JSON documents of requests, with numbers as json.Number.
+type entity struct {
+	entityKey
+	properties map[string]interface{}
+	timestamp  time.Time
+}
+
+func (e *entity) etag() string {
+	return fmt.Sprintf("W/\"datetime'%s'\"", url.QueryEscape(e.timestamp.Format(timestampFormat)))
+}
+
+// odataType is the suffix of the keys of the odata.type annotations of
+// properties, which are stored along with them.
+const odataType = "@odata.type"
+
+// document returns e as a JSON object, with the OData metadata of its
+// properties if minimal is true.
+func (e *entity) document(minimal bool) map[string]interface{} {
+	doc := make(map[string]interface{}, len(e.properties)+5)
+	for k, v := range e.properties {
+		if minimal || !strings.HasSuffix(k, odataType) {
+			doc[k] = v
+		}
+	}
+	doc["PartitionKey"] = e.partitionKey
+	doc["RowKey"] = e.rowKey
+	doc["Timestamp"] = e.timestamp.Format(timestampFormat)
+	if minimal {
+		doc["odata.etag"] = e.etag()
+		doc["Timestamp"+odataType] = "Edm.DateTime"
+	}
+	return doc
+}
+
+// get returns the value of the property of e with the given name, typed
+// according to its odata.type annotation.
+func (e *entity) get(name string) (interface{}, bool) {
+	switch name {
+	case "PartitionKey":
+		return e.partitionKey, true
+	case "RowKey":
+		return e.rowKey, true
+	case "Timestamp":
+		return e.timestamp, true
+	}
+	v, ok := e.properties[name]
+	s, isString := v.(string)
+	switch e.properties[name+odataType] {
+	case "Edm.Int64":
+		if i, err := strconv.ParseInt(s, 10, 64); isString && err == nil {
+			return i, true
+		}
+	case "Edm.DateTime":
+		if t, err := time.Parse(time.RFC3339Nano, s); isString && err == nil {
+			return t, true
+		}
+	}
+	return v, ok
+}
+
+// minimalMetadata reports whether the entities returned to req carry their
+// OData metadata.
+func (req *request) minimalMetadata() bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "odata=minimalmetadata") || strings.Contains(accept, "odata=fullmetadata")
+}
+
+// replyEntities sends v, a JSON document holding entities, with the OData
+// metadata level req accepts.
+func (req *request) replyEntities(status int, v interface{}) {
+	if !req.minimalMetadata() {
+		req.replyJSON(status, v)
+		return
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		req.replyError(err)
+		return
+	}
+	req.replyBody(status, "application/json;odata=minimalmetadata;streaming=true;charset=utf-8", body)
+}
+
+// serveTable serves a request to the table service.
+func (s *Server) serveTable(req *request) error {
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/")
+	switch {
+	case path == "$batch":
+		return s.serveBatch(req)
+	case path == "Tables":
+		switch req.Method {
+		case http.MethodGet:
+			return s.queryTables(req)
+		case http.MethodPost:
+			return s.createTable(req)
+		}
+		return errNotImplemented(req)
+	case strings.HasPrefix(path, "Tables("):
+		name, ok := parseTableName(path)
+		if !ok {
+			return errInvalidURI()
+		}
+		if req.Method != http.MethodDelete {
+			return errNotImplemented(req)
+		}
+		if _, ok := s.tables[strings.ToLower(name)]; !ok {
+			return errResourceNotFound()
+		}
+		delete(s.tables, strings.ToLower(name))
+		req.reply(http.StatusNoContent)
+		return nil
+	}
+
+	name, keys := path, ""
+	if i := strings.Index(path, "("); i >= 0 {
+		name, keys = path[:i], path[i:]
+	}
+	t, ok := s.tables[strings.ToLower(name)]
+	if !ok {
+		return newError(http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+	}
+	if comp := req.query.Get("comp"); comp != "" {
+		if comp != "acl" || keys != "" {
+			return errNotImplemented(req)
+		}
+		return s.serveTableACL(req, t)
+	}
+	if keys == "" || keys == "()" {
+		switch req.Method {
+		case http.MethodGet:
+			return s.queryEntities(req, t)
+		case http.MethodPost:
+			return s.insertEntity(req, t)
+		}
+		return errNotImplemented(req)
+	}
+
+	key, ok := parseEntityKey(keys)
+	if !ok {
+		return errInvalidURI()
+	}
+	switch req.Method {
+	case http.MethodGet:
+		e, ok := t.entities[key]
+		if !ok {
+			return errResourceNotFound()
+		}
+		req.w.Header().Set("ETag", e.etag())
+		req.replyEntities(http.StatusOK, e.document(req.minimalMetadata()))
+		return nil
+	case http.MethodPut, "MERGE":
+		return s.updateEntity(req, t, key)
+	case http.MethodDelete:
+		return s.deleteEntity(req, t, key)
+	}
+	return errNotImplemented(req)
+}
+
+func errInvalidURI() error {
+	return newError(http.StatusBadRequest, "InvalidUri", "The requested URI does not represent any resource on the server.")
+}
+
+func errResourceNotFound() error {
+	return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+}
+
+func errInvalidInput(message string) error {
+	return newError(http.StatusBadRequest, "InvalidInput", "One of the request inputs is not valid: "+message)
+}
+
+// parseTableName parses the name out of a Tables('name') path.
+func parseTableName(path string) (string, bool) {
+	v := strings.TrimSuffix(strings.TrimPrefix(path, "Tables("), ")")
+	if len(v) < 2 || v[0] != '\'' || v[len(v)-1] != '\'' {
+		return "", false
+	}
+	name, err := url.QueryUnescape(v[1 : len(v)-1])
+	return name, err == nil
+}
+
+// parseEntityKey parses a (PartitionKey='pk',RowKey='rk') path suffix,
+// whose keys are URL-encoded with quotes doubled.
+func parseEntityKey(s string) (entityKey, bool) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "("), ")")
+	var key entityKey
+	for _, part := range []string{"PartitionKey", "RowKey"} {
+		prefix := part + "='"
+		if !strings.HasPrefix(s, prefix) {
+			return key, false
+		}
+		s = s[len(prefix):]
+		end := strings.Index(s, "'")
+		for end >= 0 && end+1 < len(s) && s[end+1] == '\'' {
+			next := strings.Index(s[end+2:], "'")
+			if next < 0 {
+				return key, false
+			}
+			end += 2 + next
+		}
+		if end < 0 {
+			return key, false
+		}
+		v, err := url.QueryUnescape(s[:end])
+		if err != nil {
+			return key, false
+		}
+		v = strings.Replace(v, "''", "'", -1)
+		if part == "PartitionKey" {
+			key.partitionKey = v
+		} else {
+			key.rowKey = v
+		}
+		s = strings.TrimPrefix(s[end+1:], ",")
+	}
+	return key, s == ""
+}
+
+// validTableName reports whether name is a valid table name.
+func validTableName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || strings.EqualFold(name, "Tables") {
+		return false
+	}
+	for i, r := range name {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) queryTables(req *request) error {
+	names := make([]string, 0, len(s.tables))
+	for _, t := range s.tables {
+		names = append(names, t.name)
+	}
+	sort.Strings(names)
+
+	type tableJSON struct {
+		TableName string `json:"TableName"`
+	}
+	out := struct {
+		Value []tableJSON `json:"value"`
+	}{Value: []tableJSON{}}
+	for _, name := range names {
+		out.Value = append(out.Value, tableJSON{name})
+	}
+	req.replyJSON(http.StatusOK, out)
+	return nil
+}
+
+func (s *Server) createTable(req *request) error {
+	var body struct {
+		TableName string `json:"TableName"`
+	}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		return errInvalidInput("the request body is not a valid JSON document.")
+	}
+	if !validTableName(body.TableName) {
+		return newError(http.StatusBadRequest, "InvalidResourceName", "The specifed resource name contains invalid characters.")
+	}
+	key := strings.ToLower(body.TableName)
+	if _, ok := s.tables[key]; ok {
+		return newError(http.StatusConflict, "TableAlreadyExists", "The table specified already exists.")
+	}
+	s.tables[key] = &table{name: body.TableName, entities: make(map[entityKey]*entity)}
+	req.replyJSON(http.StatusCreated, body)
+	return nil
+}
+
+func (s *Server) serveTableACL(req *request, t *table) error {
+	switch req.Method {
+	case http.MethodPut:
+		if len(req.body) > 0 {
+			var acl struct{}
+			if err := req.xmlBody(&acl); err != nil {
+				return err
+			}
+		}
+		t.acl = req.body
+		req.reply(http.StatusNoContent)
+	case http.MethodGet:
+		acl := t.acl
+		if len(acl) == 0 {
+			acl = []byte(xml.Header + "<SignedIdentifiers />")
+		}
+		req.replyBody(http.StatusOK, "application/xml", acl)
+	default:
+		return errNotImplemented(req)
+	}
+	return nil
+}
+
+// entityBody decodes the properties of the entity in the body of req.
+func entityBody(req *request) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(req.body))
+	dec.UseNumber()
+	var properties map[string]interface{}
+	if err := dec.Decode(&properties); err != nil || properties == nil {
+		return nil, errInvalidInput("the request body is not a valid JSON object.")
+	}
+	return properties, nil
+}
+
+func (s *Server) insertEntity(req *request, t *table) error {
+	properties, err := entityBody(req)
+	if err != nil {
+		return err
+	}
+	pk, ok1 := properties["PartitionKey"].(string)
+	rk, ok2 := properties["RowKey"].(string)
+	if !ok1 || !ok2 {
+		return newError(http.StatusBadRequest, "PropertiesNeedValue", "The values are not specified for all properties in the entity.")
+	}
+	key := entityKey{pk, rk}
+	if _, ok := t.entities[key]; ok {
+		return newError(http.StatusConflict, "EntityAlreadyExists", "The specified entity already exists.")
+	}
+	e := &entity{entityKey: key, properties: properties, timestamp: s.now()}
+	delete(properties, "PartitionKey")
+	delete(properties, "RowKey")
+	delete(properties, "Timestamp")
+	t.entities[key] = e
+
+	req.w.Header().Set("ETag", e.etag())
+	if req.Header.Get("Prefer") == "return-no-content" {
+		req.w.Header().Set("Preference-Applied", "return-no-content")
+		req.reply(http.StatusNoContent)
+		return nil
+	}
+	req.replyEntities(http.StatusCreated, e.document(req.minimalMetadata()))
+	return nil
+}
+
+// updateEntity replaces the entity with the given key, or merges into it
+// for a MERGE request. Without If-Match, missing entities are inserted.
+func (s *Server) updateEntity(req *request, t *table, key entityKey) error {
+	properties, err := entityBody(req)
+	if err != nil {
+		return err
+	}
+	delete(properties, "PartitionKey")
+	delete(properties, "RowKey")
+	delete(properties, "Timestamp")
+
+	e, exists := t.entities[key]
+	if err := checkEntityMatch(req, e, exists, false); err != nil {
+		return err
+	}
+	if !exists {
+		e = &entity{entityKey: key, properties: map[string]interface{}{}}
+		t.entities[key] = e
+	}
+	if req.Method == "MERGE" {
+		// A merged property loses the annotation it no longer has.
+		for k := range properties {
+			if !strings.HasSuffix(k, odataType) {
+				delete(e.properties, k+odataType)
+			}
+		}
+		for k, v := range properties {
+			e.properties[k] = v
+		}
+	} else {
+		e.properties = properties
+	}
+	e.timestamp = s.now()
+
+	req.w.Header().Set("ETag", e.etag())
+	req.reply(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) deleteEntity(req *request, t *table, key entityKey) error {
+	e, exists := t.entities[key]
+	if err := checkEntityMatch(req, e, exists, true); err != nil {
+		return err
+	}
+	delete(t.entities, key)
+	req.reply(http.StatusNoContent)
+	return nil
+}
+
+// checkEntityMatch checks the If-Match header of req against e.
+func checkEntityMatch(req *request, e *entity, exists, required bool) error {
+	match := req.Header.Get("If-Match")
+	if match == "" {
+		if required {
+			return errMissingHeader("If-Match")
+		}
+		return nil
+	}
+	if !exists {
+		return errResourceNotFound()
+	}
+	if match != "*" && match != e.etag() {
+		return newError(http.StatusPreconditionFailed, "UpdateConditionNotSatisfied", "The update condition specified in the request was not satisfied.")
+	}
+	return nil
+}
+
+// queryEntities returns the entities of t matching the query of req, in
+// key order.
+func (s *Server) queryEntities(req *request, t *table) error {
+	var selected []string
+	if v := req.query.Get("$select"); v != "" {
+		selected = strings.Split(v, ",")
+	}
+	top := maxTop
+	if v := req.query.Get("$top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTop {
+			return errInvalidInput("$top must be between 1 and 1000.")
+		}
+		top = n
+	}
+	var filter filterExpr
+	if v := req.query.Get("$filter"); v != "" {
+		var err error
+		if filter, err = parseFilter(v); err != nil {
+			return errInvalidInput(err.Error())
+		}
+	}
+	var from entityKey
+	if v := req.query.Get("NextPartitionKey"); v != "" {
+		pk, err1 := decodeContinuation(v)
+		rk, err2 := decodeContinuation(req.query.Get("NextRowKey"))
+		if err1 != nil || err2 != nil {
+			return errInvalidInput("the continuation token is invalid.")
+		}
+		from = entityKey{pk, rk}
+	}
+
+	keys := make([]entityKey, 0, len(t.entities))
+	for key := range t.entities {
+		if !key.less(from) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(entityKeys(keys))
+
+	minimal := req.minimalMetadata()
+	out := struct {
+		Metadata string                   `json:"odata.metadata,omitempty"`
+		Value    []map[string]interface{} `json:"value"`
+	}{Value: []map[string]interface{}{}}
+	if minimal {
+		out.Metadata = req.serviceEndpoint() + "$metadata#" + t.name
+	}
+	for _, key := range keys {
+		e := t.entities[key]
+		if filter != nil && filter.eval(e) != true {
+			continue
+		}
+		if len(out.Value) == top {
+			h := req.w.Header()
+			h.Set("x-ms-continuation-NextPartitionKey", encodeContinuation(key.partitionKey))
+			h.Set("x-ms-continuation-NextRowKey", encodeContinuation(key.rowKey))
+			break
+		}
+		out.Value = append(out.Value, project(e.document(minimal), selected))
+	}
+	req.replyEntities(http.StatusOK, out)
+	return nil
+}
+
+// project returns the properties of doc listed in selected, with their
+// annotations, or doc itself if selected is empty.
+func project(doc map[string]interface{}, selected []string) map[string]interface{} {
+	if len(selected) == 0 {
+		return doc
+	}
+	out := make(map[string]interface{}, 2*len(selected)+1)
+	if etag, ok := doc["odata.etag"]; ok {
+		out["odata.etag"] = etag
+	}
+	for _, name := range selected {
+		name = strings.TrimSpace(name)
+		for _, k := range []string{name, name + odataType} {
+			if v, ok := doc[k]; ok {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+// encodeContinuation encodes a key as a continuation token, which is never
+// empty and is safe to use in a URL as is.
+func encodeContinuation(key string) string {
+	return "1!" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeContinuation(token string) (string, error) {
+	if !strings.HasPrefix(token, "1!") {
+		return "", fmt.Errorf("invalid continuation token %q", token)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(token[2:])
+	return string(key), err
+}
+
+func (k entityKey) less(o entityKey) bool {
+	if k.partitionKey != o.partitionKey {
+		return k.partitionKey < o.partitionKey
+	}
+	return k.rowKey < o.rowKey
+}
+
+type entityKeys []entityKey
+
+func (a entityKeys) Len() int           { return len(a) }
+func (a entityKeys) Less(i, j int) bool { return a[i].less(a[j]) }
+func (a entityKeys) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,202 @@
+package storagetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type TableSuite struct {
+	srv *Server
+	cli storage.TableServiceClient
+}
+
+var _ = chk.Suite(&TableSuite{})
+
+type testEntity struct {
+	pk, rk string
+	Name   string
+	Count  int
+}
+
+func (e *testEntity) PartitionKey() string { return e.pk }
+func (e *testEntity) RowKey() string       { return e.rk }
+
+func (e *testEntity) SetPartitionKey(pk string) error {
+	e.pk = pk
+	return nil
+}
+
+func (e *testEntity) SetRowKey(rk string) error {
+	e.rk = rk
+	return nil
+}
+
+// assertStatus checks that err reports the given status. The table client
+// only decodes OData errors for some operations.
+func assertStatus(c *chk.C, err error, status int) {
+	c.Assert(err, chk.NotNil)
+	switch err := err.(type) {
+	case storage.AzureStorageServiceError:
+		c.Assert(err.StatusCode, chk.Equals, status)
+	case storage.UnexpectedStatusCodeError:
+		c.Assert(err.Got(), chk.Equals, status)
+	default:
+		c.Fatalf("unexpected error %T: %v", err, err)
+	}
+}
+
+func (s *TableSuite) SetUpTest(c *chk.C) {
+	s.srv = NewServer()
+	s.cli = s.srv.Client().GetTableService()
+	c.Assert(s.cli.CreateTable("table"), chk.IsNil)
+}
+
+func (s *TableSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+func (s *TableSuite) query(c *chk.C, top int, filter string, token *storage.ContinuationToken) ([]*testEntity, *storage.ContinuationToken) {
+	entities, next, err := s.cli.QueryTableEntities("table", token, reflect.TypeOf(&testEntity{}), top, filter)
+	c.Assert(err, chk.IsNil)
+	out := make([]*testEntity, len(entities))
+	for i, e := range entities {
+		out[i] = e.(*testEntity)
+	}
+	return out, next
+}
+
+func (s *TableSuite) TestTables(c *chk.C) {
+	assertStatus(c, s.cli.CreateTable("Table"), http.StatusConflict)
+	assertStatus(c, s.cli.CreateTable("1table"), http.StatusBadRequest)
+
+	c.Assert(s.cli.CreateTable("other"), chk.IsNil)
+	tables, err := s.cli.QueryTables()
+	c.Assert(err, chk.IsNil)
+	c.Assert(tables, chk.DeepEquals, []storage.AzureTable{"other", "table"})
+
+	c.Assert(s.cli.DeleteTable("other"), chk.IsNil)
+	assertStatus(c, s.cli.DeleteTable("other"), http.StatusNotFound)
+
+	_, _, err = s.cli.QueryTableEntities("other", nil, reflect.TypeOf(&testEntity{}), 1, "")
+	assertStatus(c, err, http.StatusNotFound)
+}
+
+func (s *TableSuite) TestEntities(c *chk.C) {
+	e := &testEntity{pk: "p", rk: "r's", Name: "first", Count: 1}
+	c.Assert(s.cli.InsertEntity("table", e), chk.IsNil)
+	assertStatus(c, s.cli.InsertEntity("table", e), http.StatusConflict)
+
+	e.Name = "second"
+	c.Assert(s.cli.UpdateEntity("table", e), chk.IsNil)
+	c.Assert(s.cli.InsertOrMergeEntity("table", &testEntity{pk: "p", rk: "other key"}), chk.IsNil)
+
+	entities, next := s.query(c, 10, "", nil)
+	c.Assert(next, chk.IsNil)
+	c.Assert(entities, chk.DeepEquals, []*testEntity{
+		{pk: "p", rk: "other key"},
+		{pk: "p", rk: "r's", Name: "second", Count: 1},
+	})
+
+	c.Assert(s.cli.DeleteEntity("table", e, "*"), chk.IsNil)
+	assertStatus(c, s.cli.DeleteEntity("table", e, "*"), http.StatusNotFound)
+	err := s.cli.DeleteEntity("table", &testEntity{pk: "p", rk: "other key"}, `W/"datetime'2000-01-01T00%3A00%3A00.0000000Z'"`)
+	perr, ok := err.(storage.TablePreconditionFailedError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	assertStatus(c, perr.Err, http.StatusPreconditionFailed)
+}
+
+func (s *TableSuite) TestQuery(c *chk.C) {
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		c.Assert(s.cli.InsertEntity("table", &testEntity{pk: "p", rk: name, Name: name, Count: i}), chk.IsNil)
+	}
+
+	entities, next := s.query(c, 2, "Count ge 1 and not (Name eq 'e')", nil)
+	c.Assert(entities, chk.HasLen, 2)
+	c.Assert(entities[0].rk, chk.Equals, "b")
+	c.Assert(next, chk.NotNil)
+	entities, next = s.query(c, 2, "Count ge 1 and not (Name eq 'e')", next)
+	c.Assert(entities, chk.HasLen, 1)
+	c.Assert(entities[0].rk, chk.Equals, "d")
+	c.Assert(next, chk.IsNil)
+
+	entities, _ = s.query(c, 10, "RowKey lt 'b' or Count eq 4", nil)
+	c.Assert(entities, chk.HasLen, 2)
+
+	_, _, err := s.cli.QueryTableEntities("table", nil, reflect.TypeOf(&testEntity{}), 10, "Count eq")
+	assertStatus(c, err, http.StatusBadRequest)
+}
+
+func (s *TableSuite) TestParseEntityKey(c *chk.C) {
+	key, ok := parseEntityKey("(PartitionKey='a%2Bb',RowKey='it''s')")
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(key, chk.Equals, entityKey{"a+b", "it's"})
+
+	_, ok = parseEntityKey("(RowKey='a')")
+	c.Assert(ok, chk.Equals, false)
+}
+
+func (s *TableSuite) TestFilter(c *chk.C) {
+	e := &entity{
+		entityKey:  entityKey{"p", "r"},
+		properties: map[string]interface{}{"Age": json.Number("42"), "Score": json.Number("1.5"), "Active": true, "Hash": "3q0="},
+	}
+	for filter, want := range map[string]bool{
+		"Age eq 42":                        true,
+		"Age gt 41L and Score lt 2":        true,
+		"Active eq false or RowKey eq 'r'": true,
+		"not Active":                       false,
+		"Missing eq 1":                     false,
+		"Age eq '42'":                      false,
+		"PartitionKey eq 'it''s'":          false,
+		"Hash eq X'dead'":                  true,
+	} {
+		x, err := parseFilter(filter)
+		c.Assert(err, chk.IsNil, chk.Commentf(filter))
+		c.Assert(x.eval(e), chk.Equals, want, chk.Commentf(filter))
+	}
+	for _, filter := range []string{"Age eq", "(Age eq 1", "Name eq 'x"} {
+		_, err := parseFilter(filter)
+		c.Assert(err, chk.NotNil, chk.Commentf(filter))
+	}
+}
+
+func (s *TableSuite) TestBatch(c *chk.C) {
+	c.Assert(s.cli.InsertEntity("table", &testEntity{pk: "p", rk: "old", Name: "old"}), chk.IsNil)
+
+	batch := s.cli.NewBatch("table")
+	batch.InsertEntity(&testEntity{pk: "p", rk: "a", Name: "a"})
+	batch.InsertOrMergeEntity(&testEntity{pk: "p", rk: "b", Count: 2})
+	batch.DeleteEntity(&testEntity{pk: "p", rk: "old"}, "*")
+	results, err := batch.ExecuteBatch()
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.HasLen, 3)
+	for _, r := range results {
+		c.Assert(r.StatusCode, chk.Equals, http.StatusNoContent)
+	}
+	c.Assert(results[0].ETag, chk.Not(chk.Equals), "")
+
+	// The failing insert rolls back the update before it.
+	batch = s.cli.NewBatch("table")
+	batch.UpdateEntity(&testEntity{pk: "p", rk: "b", Name: "changed"})
+	batch.InsertEntity(&testEntity{pk: "p", rk: "a"})
+	_, err = batch.ExecuteBatch()
+	berr, ok := err.(storage.TableBatchError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	c.Assert(berr.Index, chk.Equals, 1)
+	c.Assert(berr.Err.(storage.AzureStorageServiceError).Code, chk.Equals, "EntityAlreadyExists")
+
+	entities, _ := s.query(c, 10, "", nil)
+	c.Assert(entities, chk.DeepEquals, []*testEntity{
+		{pk: "p", rk: "a", Name: "a"},
+		{pk: "p", rk: "b", Count: 2},
+	})
+
+	batch = s.cli.NewBatch("missing")
+	batch.InsertEntity(&testEntity{pk: "p", rk: "a"})
+	_, err = batch.ExecuteBatch()
+	c.Assert(err.(storage.TableBatchError).Err.(storage.AzureStorageServiceError).Code, chk.Equals, "TableNotFound")
+}
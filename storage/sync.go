@@ -0,0 +1,675 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSyncParallelism is the number of files a sync transfers at once
+// when SyncOptions.Parallelism is not set.
+const DefaultSyncParallelism = 4
+
+// SyncDirection selects which side of a sync is the source.
+type SyncDirection int
+
+// Directions of a sync.
+const (
+	// SyncUpload makes the remote tree match the local one.
+	SyncUpload SyncDirection = iota
+
+	// SyncDownload makes the local tree match the remote one.
+	SyncDownload
+)
+
+var errSyncInvalidName = errors.New("storage: remote name cannot be mapped to a local path")
+
+// SyncOptions is the set of options that can be specified for
+// BlobStorageClient.SyncDirectory and Directory.SyncDirectory. A zero
+// struct uploads the new and changed local files without deleting
+// anything.
+type SyncOptions struct {
+	Direction SyncDirection
+
+	// Delete removes the destination files that are missing from the
+	// source. Only files are removed, directories are left in place.
+	Delete bool
+
+	// DryRun reports what would be done without transferring or deleting
+	// anything.
+	DryRun bool
+
+	// Include, if set, restricts the sync to the files matching one of
+	// its patterns. Exclude leaves out the files matching one of its
+	// patterns, on both sides: excluded destination files are never
+	// deleted. Patterns use the syntax of path.Match and are matched
+	// against the slash-separated path relative to the synced
+	// directories, or against the base name when they contain no slash.
+	Include []string
+	Exclude []string
+
+	// Parallelism is the number of files compared and transferred
+	// concurrently.
+	Parallelism int
+}
+
+func (o SyncOptions) withDefaults() SyncOptions {
+	if o.Parallelism <= 0 {
+		o.Parallelism = DefaultSyncParallelism
+	}
+	return o
+}
+
+func (o SyncOptions) validate() error {
+	if o.Direction != SyncUpload && o.Direction != SyncDownload {
+		return fmt.Errorf("storage: invalid sync direction %d", o.Direction)
+	}
+	for _, p := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("storage: invalid sync pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// selects reports whether the file at the slash-separated path name is
+// part of the sync.
+func (o SyncOptions) selects(name string) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			s := name
+			if !strings.Contains(p, "/") {
+				s = path.Base(name)
+			}
+			if ok, _ := path.Match(p, s); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(o.Include) == 0 || matches(o.Include)) && !matches(o.Exclude)
+}
+
+// SyncFailure is a file a sync could not compare, transfer or delete.
+type SyncFailure struct {
+	Path string
+	Err  error
+}
+
+// SyncReport lists what a sync did with every file it considered, by
+// slash-separated path relative to the synced directories. In dry-run mode
+// Uploaded, Downloaded and Deleted list what would have been done.
+// BytesTransferred is the size of the uploaded or downloaded files.
+type SyncReport struct {
+	Uploaded         []string
+	Downloaded       []string
+	Deleted          []string
+	Unchanged        []string
+	Failed           []SyncFailure
+	BytesTransferred int64
+}
+
+// syncEntry describes a file on either side of a sync. The modification
+// time and MD5 of remote files may only be known once stat is called.
+type syncEntry struct {
+	size     int64
+	modified time.Time
+	md5      string
+	complete bool
+}
+
+// syncRemote is the remote tree of a sync, whose files are named by their
+// slash-separated path relative to its root.
+type syncRemote interface {
+	list() (map[string]syncEntry, error)
+	stat(name string, e syncEntry) (syncEntry, error)
+	upload(name, localPath string) error
+	download(name, localPath string) (time.Time, error)
+	remove(name string) error
+}
+
+// SyncDirectory makes the blobs of container under prefix, taken as a
+// virtual directory, match the local directory localDir, or localDir match
+// the blobs when options.Direction is SyncDownload.
+//
+// A file is transferred when it is missing from the destination, when its
+// size differs or, for files of the same size, when its Content-MD5
+// differs. When the remote file has no Content-MD5 it is transferred if
+// the source was modified after the destination. Uploads set the
+// Content-MD5 and downloads set the modification time of the local files
+// to the Last-Modified time of the remote ones, so that unchanged files
+// are skipped by the next sync.
+//
+// The failures of individual files are listed in the report; the error is
+// only set if the sync could not start, such as when listing fails.
+func (b BlobStorageClient) SyncDirectory(localDir, container, prefix string, options SyncOptions) (SyncReport, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return runSync(localDir, &blobSyncRemote{b: b, container: container, prefix: prefix}, options)
+}
+
+// SyncDirectory makes the files under d match the local directory
+// localDir, or localDir match the files under d when options.Direction is
+// SyncDownload. Missing directories are created on both sides. See
+// BlobStorageClient.SyncDirectory for how files are compared.
+func (d *Directory) SyncDirectory(localDir string, options SyncOptions) (SyncReport, error) {
+	return runSync(localDir, &fileSyncRemote{root: d, created: map[string]bool{}}, options)
+}
+
+// syncAction is what a sync does, or did, with a file.
+type syncAction int
+
+const (
+	syncIgnore syncAction = iota
+	syncUnchanged
+	syncTransfer
+	syncDelete
+	syncFailed
+)
+
+type syncJob struct {
+	name          string
+	local, remote *syncEntry
+}
+
+type syncResult struct {
+	action syncAction
+	size   int64
+	err    error
+}
+
+func runSync(localDir string, remote syncRemote, options SyncOptions) (SyncReport, error) {
+	var report SyncReport
+	options = options.withDefaults()
+	if err := options.validate(); err != nil {
+		return report, err
+	}
+
+	locals, err := listLocalTree(localDir, options.Direction == SyncDownload)
+	if err != nil {
+		return report, err
+	}
+	remotes, err := remote.list()
+	if err != nil {
+		return report, err
+	}
+
+	var jobs []syncJob
+	for name, e := range locals {
+		if options.selects(name) {
+			e := e
+			jobs = append(jobs, syncJob{name: name, local: &e})
+		}
+	}
+	byName := make(map[string]int, len(jobs))
+	for i, j := range jobs {
+		byName[j.name] = i
+	}
+	for name, e := range remotes {
+		if !options.selects(name) {
+			continue
+		}
+		e := e
+		if i, ok := byName[name]; ok {
+			jobs[i].remote = &e
+		} else {
+			jobs = append(jobs, syncJob{name: name, remote: &e})
+		}
+	}
+	sort.Sort(syncJobs(jobs))
+
+	results := make([]syncResult, len(jobs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				results[j] = syncFile(localDir, remote, jobs[j], options)
+			}
+		}()
+	}
+	for j := range jobs {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	for i, r := range results {
+		name := jobs[i].name
+		switch r.action {
+		case syncUnchanged:
+			report.Unchanged = append(report.Unchanged, name)
+		case syncTransfer:
+			if options.Direction == SyncUpload {
+				report.Uploaded = append(report.Uploaded, name)
+			} else {
+				report.Downloaded = append(report.Downloaded, name)
+			}
+			report.BytesTransferred += r.size
+		case syncDelete:
+			report.Deleted = append(report.Deleted, name)
+		case syncFailed:
+			report.Failed = append(report.Failed, SyncFailure{Path: name, Err: r.err})
+		}
+	}
+	return report, nil
+}
+
+type syncJobs []syncJob
+
+func (s syncJobs) Len() int           { return len(s) }
+func (s syncJobs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s syncJobs) Less(i, j int) bool { return s[i].name < s[j].name }
+
+// syncFile compares the two sides of job and brings the destination in
+// line with the source.
+func syncFile(localDir string, remote syncRemote, job syncJob, options SyncOptions) syncResult {
+	if !validSyncName(job.name) {
+		return syncResult{action: syncFailed, err: errSyncInvalidName}
+	}
+	localPath := filepath.Join(localDir, filepath.FromSlash(job.name))
+	src, dst := job.local, job.remote
+	if options.Direction == SyncDownload {
+		src, dst = dst, src
+	}
+
+	switch {
+	case src == nil && !options.Delete:
+		return syncResult{action: syncIgnore}
+	case src == nil:
+		if !options.DryRun {
+			var err error
+			if options.Direction == SyncUpload {
+				err = remote.remove(job.name)
+			} else {
+				err = os.Remove(localPath)
+			}
+			if err != nil {
+				return syncResult{action: syncFailed, err: err}
+			}
+		}
+		return syncResult{action: syncDelete}
+	case dst != nil:
+		changed, err := syncChanged(remote, job.name, localPath, *job.local, *job.remote, options.Direction)
+		if err != nil {
+			return syncResult{action: syncFailed, err: err}
+		}
+		if !changed {
+			return syncResult{action: syncUnchanged}
+		}
+	}
+
+	if !options.DryRun {
+		if options.Direction == SyncUpload {
+			if err := remote.upload(job.name, localPath); err != nil {
+				return syncResult{action: syncFailed, err: err}
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+				return syncResult{action: syncFailed, err: err}
+			}
+			modified, err := remote.download(job.name, localPath)
+			if err != nil {
+				return syncResult{action: syncFailed, err: err}
+			}
+			if !modified.IsZero() {
+				if err := os.Chtimes(localPath, modified, modified); err != nil {
+					return syncResult{action: syncFailed, err: err}
+				}
+			}
+		}
+	}
+	return syncResult{action: syncTransfer, size: src.size}
+}
+
+// syncChanged reports whether the local and remote copies of a file
+// differ, in which case the source copy is newer if they cannot be told
+// apart by their Content-MD5. Modification times are compared to the
+// second, the resolution of Last-Modified.
+func syncChanged(remote syncRemote, name, localPath string, local, r syncEntry, direction SyncDirection) (bool, error) {
+	if local.size != r.size {
+		return true, nil
+	}
+	r, err := remote.stat(name, r)
+	if err != nil {
+		return false, err
+	}
+	if r.md5 != "" {
+		sum, err := fileMD5(localPath)
+		if err != nil {
+			return false, err
+		}
+		return sum != r.md5, nil
+	}
+	l, rm := local.modified.Truncate(time.Second), r.modified.Truncate(time.Second)
+	if direction == SyncUpload {
+		return l.After(rm), nil
+	}
+	return rm.After(l), nil
+}
+
+// validSyncName reports whether name is a clean relative path which stays
+// within the local directory once joined to it.
+func validSyncName(name string) bool {
+	return name != "" && name == path.Clean(name) && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.ContainsRune(name, '\\')
+}
+
+// listLocalTree returns the regular files under dir by slash-separated
+// relative path. A missing dir is an empty tree when allowMissing is set.
+func listLocalTree(dir string, allowMissing bool) (map[string]syncEntry, error) {
+	entries := make(map[string]syncEntry)
+	if _, err := os.Stat(dir); os.IsNotExist(err) && allowMissing {
+		return entries, nil
+	}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entries[filepath.ToSlash(rel)] = syncEntry{size: info.Size(), modified: info.ModTime(), complete: true}
+		return nil
+	})
+	return entries, err
+}
+
+// fileMD5 returns the base64 encoded MD5 hash of the local file at p.
+func fileMD5(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomically writes the file at p through write, which is given a
+// temporary file in the same directory renamed to p once it succeeds. The
+// file keeps the mode of the one it replaces; new files get 0666 less the
+// umask, like os.Create gives them.
+func writeFileAtomically(p string, write func(f *os.File) error) error {
+	f, err := createTempFile(filepath.Dir(p), "."+filepath.Base(p)+".sync")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if fi, serr := os.Stat(p); err == nil && serr == nil {
+		err = os.Chmod(f.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// createTempFile creates a new file in dir whose name starts with prefix.
+// Unlike ioutil.TempFile, which creates it with mode 0600, it is created
+// with mode 0666 before the umask.
+func createTempFile(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, prefix+newUUID()), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// parseLastModified parses a Last-Modified value, returning the zero time
+// if it is malformed.
+func parseLastModified(s string) time.Time {
+	t, _ := time.Parse(http.TimeFormat, s)
+	return t
+}
+
+// blobSyncRemote is a virtual directory of a container.
+type blobSyncRemote struct {
+	b         BlobStorageClient
+	container string
+	prefix    string
+}
+
+func (r *blobSyncRemote) list() (map[string]syncEntry, error) {
+	entries := make(map[string]syncEntry)
+	it := r.b.NewBlobIterator(r.container, BlobIteratorOptions{Prefix: r.prefix})
+	for it.Next() {
+		blob := it.Blob()
+		name := strings.TrimPrefix(blob.Name, r.prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		entries[name] = syncEntry{
+			size:     blob.Properties.ContentLength,
+			modified: parseLastModified(blob.Properties.LastModified),
+			md5:      blob.Properties.ContentMD5,
+			complete: true,
+		}
+	}
+	return entries, it.Err()
+}
+
+func (r *blobSyncRemote) stat(name string, e syncEntry) (syncEntry, error) {
+	return e, nil
+}
+
+func (r *blobSyncRemote) upload(name, localPath string) error {
+	_, err := r.b.UploadFile(r.container, r.prefix+name, localPath, UploadOptions{
+		Headers: BlobHeaders{ContentType: mime.TypeByExtension(path.Ext(name))},
+	})
+	return err
+}
+
+func (r *blobSyncRemote) download(name, localPath string) (time.Time, error) {
+	var props *BlobProperties
+	err := writeFileAtomically(localPath, func(f *os.File) error {
+		var err error
+		if props, err = r.b.DownloadToWriterAt(r.container, r.prefix+name, f, DownloadOptions{}); err != nil {
+			return err
+		}
+		// Page blobs may end with a hole, which is never written.
+		return f.Truncate(props.ContentLength)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseLastModified(props.LastModified), nil
+}
+
+func (r *blobSyncRemote) remove(name string) error {
+	return r.b.DeleteBlob(r.container, r.prefix+name, nil)
+}
+
+// fileSyncRemote is a directory of a share. Listing only returns the size
+// of the files, their other properties are fetched by stat.
+type fileSyncRemote struct {
+	root *Directory
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func (r *fileSyncRemote) list() (map[string]syncEntry, error) {
+	entries := make(map[string]syncEntry)
+	var walk func(d *Directory, prefix string) error
+	walk = func(d *Directory, prefix string) error {
+		params := ListDirsAndFilesParameters{}
+		for {
+			if err := d.fsc.client.requestContext().Err(); err != nil {
+				return err
+			}
+			resp, err := d.ListDirsAndFiles(params)
+			if err != nil {
+				return err
+			}
+			for _, f := range resp.Files {
+				entries[prefix+f.Name] = syncEntry{size: int64(f.Properties.Length)}
+			}
+			for _, sub := range resp.Directories {
+				if err := walk(d.GetDirectoryReference(sub.Name), prefix+sub.Name+"/"); err != nil {
+					return err
+				}
+			}
+			if resp.NextMarker == "" {
+				return nil
+			}
+			params.Marker = resp.NextMarker
+		}
+	}
+	return entries, walk(r.root, "")
+}
+
+// file returns a reference to the file named name.
+func (r *fileSyncRemote) file(name string) *File {
+	d := r.root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		d = d.GetDirectoryReference(part)
+	}
+	return d.GetFileReference(parts[len(parts)-1])
+}
+
+func (r *fileSyncRemote) stat(name string, e syncEntry) (syncEntry, error) {
+	if e.complete {
+		return e, nil
+	}
+	f := r.file(name)
+	if err := f.FetchAttributes(); err != nil {
+		return e, err
+	}
+	return syncEntry{
+		size:     int64(f.Properties.Length),
+		modified: parseLastModified(f.Properties.LastModified),
+		md5:      f.Properties.MD5,
+		complete: true,
+	}, nil
+}
+
+// createParents creates the directories leading to the file named name,
+// once per sync.
+func (r *fileSyncRemote) createParents(name string) error {
+	d := r.root
+	parts := strings.Split(name, "/")
+	for i, part := range parts[:len(parts)-1] {
+		d = d.GetDirectoryReference(part)
+		p := strings.Join(parts[:i+1], "/")
+		r.mu.Lock()
+		done := r.created[p]
+		r.mu.Unlock()
+		if done {
+			continue
+		}
+		if _, err := d.CreateIfNotExists(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.created[p] = true
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *fileSyncRemote) upload(name, localPath string) error {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := r.createParents(name); err != nil {
+		return err
+	}
+
+	f := r.file(name)
+	if err := f.Create(uint64(info.Size())); err != nil {
+		return err
+	}
+	hash := md5.New()
+	buf := make([]byte, fourMB)
+	for offset := uint64(0); ; {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			if werr := f.WriteRange(bytes.NewReader(buf[:n]), FileRange{Start: offset, End: offset + uint64(n) - 1}, nil); werr != nil {
+				return werr
+			}
+			offset += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.Properties.MD5 = base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	f.Properties.Type = mime.TypeByExtension(path.Ext(name))
+	return f.SetProperties()
+}
+
+func (r *fileSyncRemote) download(name, localPath string) (time.Time, error) {
+	f := r.file(name)
+	if err := f.FetchAttributes(); err != nil {
+		return time.Time{}, err
+	}
+	err := writeFileAtomically(localPath, func(out *os.File) error {
+		for offset := uint64(0); offset < f.Properties.Length; offset += fourMB {
+			end := offset + fourMB - 1
+			if end >= f.Properties.Length {
+				end = f.Properties.Length - 1
+			}
+			fs, err := f.DownloadRangeToStream(FileRange{Start: offset, End: end}, false)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, fs.Body)
+			fs.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseLastModified(f.Properties.LastModified), nil
+}
+
+func (r *fileSyncRemote) remove(name string) error {
+	f := r.file(name)
+	return f.Delete()
+}
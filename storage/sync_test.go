@@ -0,0 +1,193 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/storage/storagetest"
+	chk "gopkg.in/check.v1"
+)
+
+type BlobSyncSuite struct {
+	blobServerSuite
+}
+
+var _ = chk.Suite(&BlobSyncSuite{})
+
+type FileSyncSuite struct {
+	srv   *storagetest.Server
+	share storage.Share
+}
+
+var _ = chk.Suite(&FileSyncSuite{})
+
+func (s *FileSyncSuite) SetUpTest(c *chk.C) {
+	s.srv = storagetest.NewServer()
+	s.share = s.srv.Client().GetFileService().GetShareReference("share")
+	c.Assert(s.share.Create(), chk.IsNil)
+}
+
+func (s *FileSyncSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+// writeFiles writes the local files of tree, keyed by slash-separated path,
+// under dir.
+func writeFiles(c *chk.C, dir string, tree map[string]string) {
+	for name, content := range tree {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		c.Assert(os.MkdirAll(filepath.Dir(p), 0755), chk.IsNil)
+		c.Assert(ioutil.WriteFile(p, []byte(content), 0644), chk.IsNil)
+	}
+}
+
+// readFile returns the content of the local file name under dir.
+func readFile(c *chk.C, dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	c.Assert(err, chk.IsNil)
+	return string(b)
+}
+
+// listBlobs returns the names of the blobs of the container.
+func (s *BlobSyncSuite) listBlobs(c *chk.C) []string {
+	var names []string
+	it := s.cli.NewBlobIterator(s.cnt, storage.BlobIteratorOptions{})
+	for it.Next() {
+		names = append(names, it.Blob().Name)
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	return names
+}
+
+func (s *BlobSyncSuite) TestSyncDirectory(c *chk.C) {
+	local := c.MkDir()
+	writeFiles(c, local, map[string]string{"a.txt": "a", "b/c.txt": "cc", "b/d.tmp": "tmp"})
+	s.putBlob(c, "site/old.txt", s.data)
+	s.putBlob(c, "other", s.data)
+
+	options := storage.SyncOptions{Delete: true, Exclude: []string{"*.tmp"}, DryRun: true}
+	report, err := s.cli.SyncDirectory(local, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Uploaded, chk.DeepEquals, []string{"a.txt", "b/c.txt"})
+	c.Assert(report.Deleted, chk.DeepEquals, []string{"old.txt"})
+	c.Assert(report.BytesTransferred, chk.Equals, int64(3))
+	c.Assert(s.listBlobs(c), chk.DeepEquals, []string{"other", "site/old.txt"})
+
+	options.DryRun = false
+	report, err = s.cli.SyncDirectory(local, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Failed, chk.HasLen, 0)
+	c.Assert(s.listBlobs(c), chk.DeepEquals, []string{"other", "site/a.txt", "site/b/c.txt"})
+	c.Assert(string(s.getBlob(c, "site/b/c.txt")), chk.Equals, "cc")
+	props, err := s.cli.GetBlobProperties(s.cnt, "site/a.txt")
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ContentType, chk.Equals, "text/plain; charset=utf-8")
+
+	// Same size, different content: told apart by Content-MD5.
+	writeFiles(c, local, map[string]string{"b/c.txt": "dd"})
+	report, err = s.cli.SyncDirectory(local, s.cnt, "site/", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Uploaded, chk.DeepEquals, []string{"b/c.txt"})
+	c.Assert(report.Unchanged, chk.DeepEquals, []string{"a.txt"})
+	c.Assert(string(s.getBlob(c, "site/b/c.txt")), chk.Equals, "dd")
+
+	// Downloads into an empty directory, then leave it alone.
+	dst := filepath.Join(c.MkDir(), "copy")
+	options = storage.SyncOptions{Direction: storage.SyncDownload, Include: []string{"b/*"}}
+	report, err = s.cli.SyncDirectory(dst, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Downloaded, chk.DeepEquals, []string{"b/c.txt"})
+	c.Assert(readFile(c, dst, "b/c.txt"), chk.Equals, "dd")
+	report, err = s.cli.SyncDirectory(dst, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Downloaded, chk.HasLen, 0)
+	c.Assert(report.Unchanged, chk.DeepEquals, []string{"b/c.txt"})
+
+	_, err = s.cli.SyncDirectory(local, s.cnt, "site", storage.SyncOptions{Include: []string{"["}})
+	c.Assert(err, chk.ErrorMatches, "storage: invalid sync pattern .*")
+}
+
+func (s *BlobSyncSuite) TestSyncDirectoryFileModes(c *chk.C) {
+	if runtime.GOOS == "windows" {
+		c.Skip("file modes are not supported on Windows")
+	}
+	s.putBlob(c, "site/a.txt", s.data)
+	local := c.MkDir()
+	probe, err := os.Create(filepath.Join(c.MkDir(), "probe"))
+	c.Assert(err, chk.IsNil)
+	c.Assert(probe.Close(), chk.IsNil)
+	created, err := os.Stat(probe.Name())
+	c.Assert(err, chk.IsNil)
+
+	// New files get the mode os.Create gives them.
+	options := storage.SyncOptions{Direction: storage.SyncDownload}
+	_, err = s.cli.SyncDirectory(local, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	fi, err := os.Stat(filepath.Join(local, "a.txt"))
+	c.Assert(err, chk.IsNil)
+	c.Assert(fi.Mode(), chk.Equals, created.Mode())
+
+	// Replaced files keep their mode.
+	c.Assert(os.Chmod(filepath.Join(local, "a.txt"), 0640), chk.IsNil)
+	s.putBlob(c, "site/a.txt", []byte("changed"))
+	report, err := s.cli.SyncDirectory(local, s.cnt, "site", options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Downloaded, chk.DeepEquals, []string{"a.txt"})
+	c.Assert(readFile(c, local, "a.txt"), chk.Equals, "changed")
+	fi, err = os.Stat(filepath.Join(local, "a.txt"))
+	c.Assert(err, chk.IsNil)
+	c.Assert(fi.Mode(), chk.Equals, os.FileMode(0640))
+}
+
+func (s *BlobSyncSuite) TestSyncDirectoryUnsafeNames(c *chk.C) {
+	s.putBlob(c, "site/../escape", s.data)
+	s.putBlob(c, "site/ok", s.data)
+	local := c.MkDir()
+	report, err := s.cli.SyncDirectory(local, s.cnt, "site", storage.SyncOptions{Direction: storage.SyncDownload})
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Downloaded, chk.DeepEquals, []string{"ok"})
+	c.Assert(report.Failed, chk.HasLen, 1)
+	c.Assert(report.Failed[0].Path, chk.Equals, "../escape")
+	_, err = os.Stat(filepath.Join(local, "..", "escape"))
+	c.Assert(os.IsNotExist(err), chk.Equals, true)
+}
+
+func (s *FileSyncSuite) TestSyncDirectory(c *chk.C) {
+	local := c.MkDir()
+	writeFiles(c, local, map[string]string{"a.txt": "a", "b/c/d.bin": "ddd"})
+	root := s.share.GetRootDirectoryReference()
+	stale := root.GetFileReference("stale")
+	c.Assert(stale.Create(1), chk.IsNil)
+
+	options := storage.SyncOptions{Delete: true}
+	report, err := root.SyncDirectory(local, options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Failed, chk.HasLen, 0)
+	c.Assert(report.Uploaded, chk.DeepEquals, []string{"a.txt", "b/c/d.bin"})
+	c.Assert(report.Deleted, chk.DeepEquals, []string{"stale"})
+	f := root.GetDirectoryReference("b").GetDirectoryReference("c").GetFileReference("d.bin")
+	c.Assert(f.FetchAttributes(), chk.IsNil)
+	c.Assert(f.Properties.Length, chk.Equals, uint64(3))
+	c.Assert(f.Properties.MD5, chk.Not(chk.Equals), "")
+
+	report, err = root.SyncDirectory(local, options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Uploaded, chk.HasLen, 0)
+	c.Assert(report.Unchanged, chk.DeepEquals, []string{"a.txt", "b/c/d.bin"})
+
+	dst := c.MkDir()
+	writeFiles(c, dst, map[string]string{"a.txt": "x", "extra": "e"})
+	options.Direction = storage.SyncDownload
+	report, err = root.SyncDirectory(dst, options)
+	c.Assert(err, chk.IsNil)
+	c.Assert(report.Failed, chk.HasLen, 0)
+	c.Assert(report.Downloaded, chk.DeepEquals, []string{"a.txt", "b/c/d.bin"})
+	c.Assert(report.Deleted, chk.DeepEquals, []string{"extra"})
+	c.Assert(readFile(c, dst, "a.txt"), chk.Equals, "a")
+	c.Assert(readFile(c, dst, "b/c/d.bin"), chk.Equals, "ddd")
+	_, err = os.Stat(filepath.Join(dst, "extra"))
+	c.Assert(os.IsNotExist(err), chk.Equals, true)
+}
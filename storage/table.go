@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,6 +19,20 @@ type TableServiceClient struct {
 	auth   authentication
 }
 
+// WithContext returns a copy of c whose requests are bound to ctx. Calls
+// made through the copy are abandoned as soon as ctx is cancelled or its
+// deadline expires. The provided ctx must be non-nil. The copy is returned
+// as a pointer, like the methods of TableServiceClient take it, so calls
+// can be chained on it.
+func (c *TableServiceClient) WithContext(ctx context.Context) *TableServiceClient {
+	if ctx == nil {
+		panic("nil context")
+	}
+	t := *c
+	t.client.ctx = ctx
+	return &t
+}
+
 // AzureTable is the typedef of the Azure Table name
 type AzureTable string
 
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxBatchOperations is the largest number of operations an entity group
+// transaction may contain.
+const maxBatchOperations = 100
+
+// TableBatch collects insert, update, merge and delete operations on the
+// entities of one partition of a table and executes them as a single
+// entity group transaction: either all of them are applied or none is.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd894038.aspx
+type TableBatch struct {
+	client     TableServiceClient
+	table      AzureTable
+	operations []tableBatchOperation
+}
+
+type tableBatchOperation struct {
+	operation tableOperation
+	entity    TableEntity
+	ifMatch   string
+}
+
+// TableBatchResponse is the outcome of one operation of a batch.
+type TableBatchResponse struct {
+	StatusCode int
+	ETag       string
+}
+
+// TableBatchError is returned by ExecuteBatch when the service rejected an
+// operation of the batch. No operation of the batch was applied.
+type TableBatchError struct {
+	// Index is the position of the failing operation in the batch, or -1
+	// if the service did not report it.
+	Index int
+
+	// Err is the error the failing operation was rejected with.
+	Err error
+}
+
+func (e TableBatchError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("storage: table batch failed: %v", e.Err)
+	}
+	return fmt.Sprintf("storage: table batch operation %d failed: %v", e.Index, e.Err)
+}
+
+// NewBatch returns an empty batch of operations on table. The batch is
+// bound to the context of c.
+func (c *TableServiceClient) NewBatch(table AzureTable) *TableBatch {
+	return &TableBatch{client: *c, table: table}
+}
+
+// InsertEntity adds the insertion of entity to the batch. The batch fails
+// if there is an entity with the same PartitionKey and RowKey in the table.
+func (b *TableBatch) InsertEntity(entity TableEntity) {
+	b.add(tableOperationTypeInsert, entity, "")
+}
+
+// UpdateEntity adds the replacement of the entity with the keys of entity
+// to the batch. The batch fails if there is no such entity in the table.
+func (b *TableBatch) UpdateEntity(entity TableEntity) {
+	b.UpdateEntityIfMatch(entity, "*")
+}
+
+// UpdateEntityIfMatch adds the replacement of the entity with the keys of
+// entity to the batch, provided its ETag matches ifMatch. Otherwise the
+// batch fails with a TablePreconditionFailedError.
+func (b *TableBatch) UpdateEntityIfMatch(entity TableEntity, ifMatch string) {
+	b.add(tableOperationTypeUpdate, entity, ifMatch)
+}
+
+// MergeEntity adds the merge of entity into the entity with the same keys
+// to the batch. The batch fails if there is no such entity in the table.
+func (b *TableBatch) MergeEntity(entity TableEntity) {
+	b.MergeEntityIfMatch(entity, "*")
+}
+
+// MergeEntityIfMatch adds the merge of entity into the entity with the
+// same keys to the batch, provided its ETag matches ifMatch. Otherwise the
+// batch fails with a TablePreconditionFailedError.
+func (b *TableBatch) MergeEntityIfMatch(entity TableEntity, ifMatch string) {
+	b.add(tableOperationTypeMerge, entity, ifMatch)
+}
+
+// InsertOrReplaceEntity adds the insertion of entity, or the replacement of
+// the existing one, to the batch.
+func (b *TableBatch) InsertOrReplaceEntity(entity TableEntity) {
+	b.add(tableOperationTypeInsertOrReplace, entity, "")
+}
+
+// InsertOrMergeEntity adds the insertion of entity, or its merge into the
+// existing one, to the batch.
+func (b *TableBatch) InsertOrMergeEntity(entity TableEntity) {
+	b.add(tableOperationTypeInsertOrMerge, entity, "")
+}
+
+// DeleteEntity adds the deletion of the entity with the keys of entity to
+// the batch, provided its ETag matches ifMatch. Pass "*", or "", to delete
+// it whatever its ETag; the service requires an If-Match header on deletes.
+func (b *TableBatch) DeleteEntity(entity TableEntity, ifMatch string) {
+	if ifMatch == "" {
+		ifMatch = "*"
+	}
+	b.add(tableOperationTypeDelete, entity, ifMatch)
+}
+
+// Len returns the number of operations in the batch.
+func (b *TableBatch) Len() int {
+	return len(b.operations)
+}
+
+func (b *TableBatch) add(operation tableOperation, entity TableEntity, ifMatch string) {
+	b.operations = append(b.operations, tableBatchOperation{operation, entity, ifMatch})
+}
+
+// ExecuteBatch sends the operations of the batch to the service in a single
+// request and returns their responses, in the order they were added. The
+// new ETags of the entities embedding EntityMetadata are set in them. If an
+// operation is rejected the returned error is a TableBatchError and none of
+// the operations is applied.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd894038.aspx
+func (b *TableBatch) ExecuteBatch() ([]TableBatchResponse, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	batchBoundary := "batch_" + newUUID()
+	body, err := b.changeset(batchBoundary)
+	if err != nil {
+		return nil, err
+	}
+
+	c := b.client
+	uri := c.client.getEndpoint(tableServiceName, "$batch", url.Values{})
+	headers := c.getStandardHeaders()
+	headers["Content-Type"] = "multipart/mixed; boundary=" + batchBoundary
+	headers["Content-Length"] = strconv.Itoa(body.Len())
+
+	// A batch that timed out or failed with a server error may have been
+	// applied, and its inserts would conflict if it were sent again.
+	resp, err := c.client.execInternalJSONNonIdempotent(http.MethodPost, uri, headers, bytes.NewReader(body.Bytes()), c.auth)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.body.Close()
+	if err := checkRespCode(resp.statusCode, []int{http.StatusAccepted}); err != nil {
+		return nil, err
+	}
+
+	responses, err := readBatchResponses(resp.headers.Get("Content-Type"), resp.body)
+	if err != nil {
+		return nil, err
+	}
+	return b.results(responses)
+}
+
+// validate checks the batch against the limits of entity group
+// transactions, which the service would otherwise reject as a whole.
+func (b *TableBatch) validate() error {
+	if len(b.operations) == 0 {
+		return errors.New("storage: table batch has no operations")
+	}
+	if len(b.operations) > maxBatchOperations {
+		return fmt.Errorf("storage: table batch has %d operations, more than the maximum of %d", len(b.operations), maxBatchOperations)
+	}
+	partitionKey := b.operations[0].entity.PartitionKey()
+	rowKeys := make(map[string]bool)
+	for i, op := range b.operations {
+		if pk := op.entity.PartitionKey(); pk != partitionKey {
+			return fmt.Errorf("storage: table batch operation %d is on partition %q, not %q", i, pk, partitionKey)
+		}
+		rk := op.entity.RowKey()
+		if rowKeys[rk] {
+			return fmt.Errorf("storage: table batch operation %d repeats row key %q", i, rk)
+		}
+		rowKeys[rk] = true
+	}
+	return nil
+}
+
+// changeset serializes the operations of the batch as the changeset of a
+// multipart/mixed batch request delimited by batchBoundary.
+func (b *TableBatch) changeset(batchBoundary string) (*bytes.Buffer, error) {
+	body := new(bytes.Buffer)
+	batch := multipart.NewWriter(body)
+	if err := batch.SetBoundary(batchBoundary); err != nil {
+		return nil, err
+	}
+
+	changesetBoundary := "changeset_" + newUUID()
+	part, err := batch.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/mixed; boundary=" + changesetBoundary},
+	})
+	if err != nil {
+		return nil, err
+	}
+	changeset := multipart.NewWriter(part)
+	if err := changeset.SetBoundary(changesetBoundary); err != nil {
+		return nil, err
+	}
+
+	for i, op := range b.operations {
+		w, err := changeset.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := b.writeOperation(w, i, op); err != nil {
+			return nil, err
+		}
+	}
+	if err := changeset.Close(); err != nil {
+		return nil, err
+	}
+	if err := batch.Close(); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// writeOperation writes the HTTP request of the operation at index i to w.
+func (b *TableBatch) writeOperation(w io.Writer, i int, op tableBatchOperation) error {
+	c := b.client
+	method, uri := http.MethodPut, c.entityURI(b.table, op.entity)
+	switch op.operation {
+	case tableOperationTypeInsert:
+		method = http.MethodPost
+		uri = c.client.getEndpoint(tableServiceName, pathForTable(b.table), url.Values{})
+	case tableOperationTypeMerge, tableOperationTypeInsertOrMerge:
+		method = "MERGE"
+	case tableOperationTypeDelete:
+		method = http.MethodDelete
+	}
+
+	var entity bytes.Buffer
+	if op.operation != tableOperationTypeDelete {
+		if err := injectPartitionAndRowKeys(op.entity, &entity); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", method, uri)
+	fmt.Fprintf(w, "Content-ID: %d\r\n", i)
+	fmt.Fprintf(w, "Accept: application/json;odata=nometadata\r\n")
+	fmt.Fprintf(w, "DataServiceVersion: 3.0\r\n")
+	if op.ifMatch != "" {
+		fmt.Fprintf(w, "If-Match: %s\r\n", op.ifMatch)
+	}
+	if entity.Len() > 0 {
+		fmt.Fprintf(w, "Content-Type: application/json\r\n")
+		fmt.Fprintf(w, "Content-Length: %d\r\n", entity.Len())
+	}
+	if op.operation == tableOperationTypeInsert {
+		fmt.Fprintf(w, "Prefer: return-no-content\r\n")
+	}
+	fmt.Fprintf(w, "\r\n")
+	_, err := entity.WriteTo(w)
+	return err
+}
+
+// batchResponse is the response to one operation of a batch.
+type batchResponse struct {
+	*http.Response
+	body []byte
+}
+
+// readBatchResponses reads the responses of a multipart/mixed batch
+// response body, flattening the changesets it contains.
+func readBatchResponses(contentType string, body io.Reader) ([]batchResponse, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("storage: malformed table batch response: %v", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("storage: unexpected table batch response of type %q", mediaType)
+	}
+
+	var responses []batchResponse
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("storage: malformed table batch response: %v", err)
+		}
+
+		partType := part.Header.Get("Content-Type")
+		if strings.HasPrefix(partType, "multipart/") {
+			changeset, err := readBatchResponses(partType, part)
+			if err != nil {
+				return nil, err
+			}
+			responses = append(responses, changeset...)
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("storage: malformed table batch response: %v", err)
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, batchResponse{resp, respBody})
+	}
+}
+
+// results matches the responses of the service with the operations of the
+// batch. A failed batch has a single response, for the failing operation.
+func (b *TableBatch) results(responses []batchResponse) ([]TableBatchResponse, error) {
+	for _, resp := range responses {
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, b.batchError(resp)
+		}
+	}
+	if len(responses) != len(b.operations) {
+		return nil, fmt.Errorf("storage: table batch returned %d responses for %d operations", len(responses), len(b.operations))
+	}
+
+	results := make([]TableBatchResponse, len(responses))
+	for i, resp := range responses {
+		results[i] = TableBatchResponse{StatusCode: resp.StatusCode, ETag: resp.Header.Get("ETag")}
+		setEntityETag(b.operations[i].entity, results[i].ETag)
+	}
+	return results, nil
+}
+
+// batchError builds the error of a failed batch from the response to its
+// failing operation. The service reports the index of the operation in the
+// Content-ID header if the request had one, and as a prefix of the message.
+func (b *TableBatch) batchError(resp batchResponse) error {
+	err := serviceErrFromODataResponse(resp.Response, resp.body)
+	index := -1
+	if i, convErr := strconv.Atoi(resp.Header.Get("Content-ID")); convErr == nil {
+		index = i
+	}
+	if serr, ok := err.(AzureStorageServiceError); ok {
+		if colon := strings.Index(serr.Message, ":"); colon > 0 {
+			if i, convErr := strconv.Atoi(serr.Message[:colon]); convErr == nil {
+				serr.Message = serr.Message[colon+1:]
+				if index < 0 {
+					index = i
+				}
+			}
+		}
+		err = serr
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed && index >= 0 && index < len(b.operations) {
+		op := b.operations[index]
+		err = TablePreconditionFailedError{
+			PartitionKey: op.entity.PartitionKey(),
+			RowKey:       op.entity.RowKey(),
+			ETag:         op.ifMatch,
+			Err:          err,
+		}
+	}
+	return TableBatchError{Index: index, Err: err}
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	chk "gopkg.in/check.v1"
+)
+
+type TableBatchSuite struct{}
+
+var _ = chk.Suite(&TableBatchSuite{})
+
+// batchOperation is an operation received by fakeBatchServer.
+type batchOperation struct {
+	method, uri, ifMatch, contentID, body string
+}
+
+// fakeBatchServer records the operations of the batch requests it receives
+// and answers each one with the parts in responses.
+type fakeBatchServer struct {
+	operations []batchOperation
+	responses  []string
+}
+
+func (f *fakeBatchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/$batch" || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := f.readParts(r.Header.Get("Content-Type"), r.Body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary=batchresponse_1")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, "--batchresponse_1\r\nContent-Type: multipart/mixed; boundary=changesetresponse_1\r\n\r\n")
+	for _, part := range f.responses {
+		fmt.Fprintf(w, "--changesetresponse_1\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\n\r\n%s\r\n", part)
+	}
+	fmt.Fprint(w, "--changesetresponse_1--\r\n--batchresponse_1--\r\n")
+}
+
+func (f *fakeBatchServer) readParts(contentType string, body io.Reader) error {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil
+		}
+		if t := part.Header.Get("Content-Type"); strings.HasPrefix(t, "multipart/mixed") {
+			if err := f.readParts(t, part); err != nil {
+				return err
+			}
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return err
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		f.operations = append(f.operations, batchOperation{
+			method:    req.Method,
+			uri:       req.RequestURI,
+			ifMatch:   req.Header.Get("If-Match"),
+			contentID: req.Header.Get("Content-ID"),
+			body:      string(b),
+		})
+	}
+}
+
+func (s *TableBatchSuite) TestExecuteBatch(c *chk.C) {
+	f := &fakeBatchServer{responses: []string{
+		"HTTP/1.1 204 No Content\r\nContent-ID: 0\r\nETag: W/\"1\"\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\nContent-ID: 1\r\nETag: W/\"2\"\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\nContent-ID: 2\r\n\r\n",
+	}}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	tables := cli.GetTableService()
+	batch := tables.NewBatch("audit")
+	batch.InsertEntity(&CustomEntity{PKey: "p", RKey: "a", Name: "first"})
+	batch.MergeEntity(&CustomEntity{PKey: "p", RKey: "b'c", Number: 2})
+	batch.DeleteEntity(&CustomEntity{PKey: "p", RKey: "d"}, "W/\"0\"")
+	c.Assert(batch.Len(), chk.Equals, 3)
+
+	results, err := batch.ExecuteBatch()
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.DeepEquals, []TableBatchResponse{
+		{StatusCode: http.StatusNoContent, ETag: "W/\"1\""},
+		{StatusCode: http.StatusNoContent, ETag: "W/\"2\""},
+		{StatusCode: http.StatusNoContent},
+	})
+
+	c.Assert(f.operations, chk.HasLen, 3)
+	c.Assert(f.operations[0].method, chk.Equals, http.MethodPost)
+	c.Assert(f.operations[0].uri, chk.Equals, "https://foo.table.core.windows.net/audit")
+	c.Assert(f.operations[0].body, chk.Equals, `{"Number":"0","Number@odata.type":"Edm.Int64","PartitionKey":"p","RowKey":"a","name":"first","surname":""}`+"\n")
+	c.Assert(f.operations[1].method, chk.Equals, "MERGE")
+	c.Assert(f.operations[1].uri, chk.Equals, "https://foo.table.core.windows.net/audit(PartitionKey='p',RowKey='b%27c')")
+	c.Assert(f.operations[1].ifMatch, chk.Equals, "*")
+	c.Assert(f.operations[2].method, chk.Equals, http.MethodDelete)
+	c.Assert(f.operations[2].ifMatch, chk.Equals, "W/\"0\"")
+	c.Assert(f.operations[2].contentID, chk.Equals, "2")
+	c.Assert(f.operations[2].body, chk.Equals, "")
+}
+
+func (s *TableBatchSuite) TestDeleteWithoutETag(c *chk.C) {
+	f := &fakeBatchServer{responses: []string{
+		"HTTP/1.1 204 No Content\r\nContent-ID: 0\r\n\r\n",
+	}}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	tables := cli.GetTableService()
+	batch := tables.NewBatch("audit")
+	batch.DeleteEntity(&CustomEntity{PKey: "p", RKey: "a"}, "")
+	_, err := batch.ExecuteBatch()
+	c.Assert(err, chk.IsNil)
+	c.Assert(f.operations, chk.HasLen, 1)
+	c.Assert(f.operations[0].ifMatch, chk.Equals, "*")
+}
+
+func (s *TableBatchSuite) TestExecuteBatchFailure(c *chk.C) {
+	f := &fakeBatchServer{responses: []string{
+		"HTTP/1.1 409 Conflict\r\nContent-Type: application/json;odata=nometadata\r\n\r\n" +
+			`{"odata.error":{"code":"EntityAlreadyExists","message":{"lang":"en-US","value":"1:The specified entity already exists."}}}`,
+	}}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	tables := cli.GetTableService()
+	batch := tables.NewBatch("audit")
+	batch.InsertOrReplaceEntity(&CustomEntity{PKey: "p", RKey: "a"})
+	batch.InsertEntity(&CustomEntity{PKey: "p", RKey: "b"})
+
+	_, err := batch.ExecuteBatch()
+	berr, ok := err.(TableBatchError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	c.Assert(berr.Index, chk.Equals, 1)
+	serr, ok := berr.Err.(AzureStorageServiceError)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(serr.StatusCode, chk.Equals, http.StatusConflict)
+	c.Assert(serr.Code, chk.Equals, "EntityAlreadyExists")
+	c.Assert(serr.Message, chk.Equals, "The specified entity already exists.")
+}
+
+func (s *TableBatchSuite) TestValidate(c *chk.C) {
+	cli, err := NewBasicClient("foo", "YmFy")
+	c.Assert(err, chk.IsNil)
+	tables := cli.GetTableService()
+
+	empty := tables.NewBatch("audit")
+	mixed := tables.NewBatch("audit")
+	mixed.InsertEntity(&CustomEntity{PKey: "p", RKey: "a"})
+	mixed.InsertEntity(&CustomEntity{PKey: "q", RKey: "b"})
+	repeated := tables.NewBatch("audit")
+	repeated.InsertEntity(&CustomEntity{PKey: "p", RKey: "a"})
+	repeated.DeleteEntity(&CustomEntity{PKey: "p", RKey: "a"}, "*")
+	large := tables.NewBatch("audit")
+	for i := 0; i <= maxBatchOperations; i++ {
+		large.InsertEntity(&CustomEntity{PKey: "p", RKey: fmt.Sprint(i)})
+	}
+
+	for _, batch := range []*TableBatch{empty, mixed, repeated, large} {
+		_, err := batch.ExecuteBatch()
+		c.Assert(err, chk.ErrorMatches, "storage: table batch .*")
+	}
+}
@@ -0,0 +1,619 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EDM types of entity properties. Properties of other types than string,
+// Edm.Int32 and Edm.Boolean carry their type in an odata.type annotation.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd179338.aspx
+const (
+	EdmBinary   = "Edm.Binary"
+	EdmBoolean  = "Edm.Boolean"
+	EdmDateTime = "Edm.DateTime"
+	EdmDouble   = "Edm.Double"
+	EdmGUID     = "Edm.Guid"
+	EdmInt32    = "Edm.Int32"
+	EdmInt64    = "Edm.Int64"
+	EdmString   = "Edm.String"
+
+	odataTypeSuffix   = "@odata.type"
+	odataETag         = "odata.etag"
+	timestampNode     = "Timestamp"
+	edmDateTimeFormat = "2006-01-02T15:04:05.0000000Z"
+)
+
+// edmTypeTags are the EDM types that can be set in the table tag of an
+// entity field, as in `table:"Count,int64"`.
+var edmTypeTags = map[string]string{
+	"int64":    EdmInt64,
+	"double":   EdmDouble,
+	"datetime": EdmDateTime,
+	"guid":     EdmGUID,
+	"binary":   EdmBinary,
+}
+
+// GUID is the value of an Edm.Guid property, in its
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form.
+type GUID string
+
+// EntityMetadata holds the system properties of an entity read from a
+// table. Embed it in an entity type to receive them; it is not stored as
+// properties of the entity.
+type EntityMetadata struct {
+	Timestamp time.Time `json:"-"`
+	ETag      string    `json:"-"`
+}
+
+func (m *EntityMetadata) entityMetadata() *EntityMetadata {
+	return m
+}
+
+// metadataEntity is implemented by the entity types embedding
+// EntityMetadata.
+type metadataEntity interface {
+	entityMetadata() *EntityMetadata
+}
+
+// DynamicEntity is an entity without schema, whose properties are kept in a
+// map. Property values are strings, int32s, int64s, float64s, bools,
+// time.Times, []bytes or GUIDs, each stored as the matching EDM type; ints
+// are stored as Edm.Int32, and NaN and infinite float64s as the strings
+// "NaN", "INF" and "-INF" of Edm.Double. Entities read from a table have their
+// properties typed the same way.
+type DynamicEntity struct {
+	EntityMetadata
+	Properties map[string]interface{}
+
+	partitionKey string
+	rowKey       string
+}
+
+// NewDynamicEntity returns an entity without properties with the given
+// keys.
+func NewDynamicEntity(partitionKey, rowKey string) *DynamicEntity {
+	return &DynamicEntity{
+		Properties:   make(map[string]interface{}),
+		partitionKey: partitionKey,
+		rowKey:       rowKey,
+	}
+}
+
+// PartitionKey returns the partition key of e.
+func (e *DynamicEntity) PartitionKey() string { return e.partitionKey }
+
+// RowKey returns the row key of e.
+func (e *DynamicEntity) RowKey() string { return e.rowKey }
+
+// SetPartitionKey sets the partition key of e.
+func (e *DynamicEntity) SetPartitionKey(partitionKey string) error {
+	e.partitionKey = partitionKey
+	return nil
+}
+
+// SetRowKey sets the row key of e.
+func (e *DynamicEntity) SetRowKey(rowKey string) error {
+	e.rowKey = rowKey
+	return nil
+}
+
+// entityField is a field of an entity struct stored as a property.
+type entityField struct {
+	jsonName string // key of the field in the JSON encoding of the struct
+	name     string // name of the property
+	edmType  string // annotated EDM type, or "" for inferred ones
+	ignore   bool   // the field is tagged `table:"-"`
+	numeric  bool
+	index    []int // index sequence of the field, as for reflect.Value.FieldByIndex
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	guidType = reflect.TypeOf(GUID(""))
+)
+
+// entityFields returns the fields of the entity struct t, including the
+// fields of embedded structs, named as encoding/json names them.
+func entityFields(t reflect.Type) ([]entityField, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	var fields []entityField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		jsonName, jsonOpts := splitTag(f.Tag.Get("json"))
+		if jsonName == "-" && jsonOpts == "" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && jsonName == "" && ft.Kind() == reflect.Struct {
+			embedded, err := entityFields(ft)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range embedded {
+				e.index = append([]int{i}, e.index...)
+				fields = append(fields, e)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if jsonName == "" {
+			jsonName = f.Name
+		}
+
+		field := entityField{jsonName: jsonName, name: jsonName, edmType: edmTypeOf(ft), index: []int{i}}
+		switch ft.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			field.numeric = true
+		}
+		name, edmTag := splitTag(f.Tag.Get(tag))
+		if name == tagIgnore && edmTag == "" {
+			field.ignore = true
+		} else if name != "" {
+			field.name = name
+		}
+		if edmTag != "" {
+			edmType, ok := edmTypeTags[edmTag]
+			if !ok {
+				return nil, fmt.Errorf("storage: unknown EDM type %q in the table tag of field %s", edmTag, f.Name)
+			}
+			field.edmType = edmType
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// edmTypeOf returns the annotated EDM type fields of type t are stored as.
+// Integers of up to 32 bits are stored as Edm.Int32, like the service
+// infers for JSON numbers; ints, int64s and unsigned integers are stored as
+// Edm.Int64, and values out of its range are rejected.
+func edmTypeOf(t reflect.Type) string {
+	switch {
+	case t == timeType:
+		return EdmDateTime
+	case t == guidType:
+		return EdmGUID
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return EdmBinary
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return EdmInt64
+	case reflect.Float32, reflect.Float64:
+		return EdmDouble
+	}
+	return ""
+}
+
+func splitTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// entityProperties returns the properties of entity, with the odata.type
+// annotations of their EDM types.
+func entityProperties(entity TableEntity) (map[string]interface{}, error) {
+	if d, ok := entity.(*DynamicEntity); ok {
+		return d.properties()
+	}
+
+	fields, err := entityFields(reflect.TypeOf(entity))
+	if err != nil {
+		return nil, err
+	}
+	// JSON has no numbers for NaN and the infinities, so the Edm.Double
+	// fields holding them are marshalled as zeros and replaced by the
+	// strings of doubleValue.
+	var marshalled interface{} = entity
+	nonFinite := make(map[string]interface{})
+	if v := reflect.ValueOf(entity); v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+		copied := v.Elem()
+		for _, f := range fields {
+			if x, ok := nonFiniteFloat(copied, f.index); ok && f.edmType == EdmDouble && !f.ignore {
+				nonFinite[f.jsonName] = doubleValue(x)
+				copied = zeroField(copied, f.index)
+			}
+		}
+		if len(nonFinite) > 0 {
+			p := reflect.New(copied.Type())
+			p.Elem().Set(copied)
+			marshalled = p.Interface()
+		}
+	}
+
+	b, err := json.Marshal(marshalled)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	encoded := make(map[string]interface{})
+	if err := dec.Decode(&encoded); err != nil {
+		return nil, err
+	}
+
+	props := make(map[string]interface{}, len(encoded))
+	for k, v := range encoded {
+		props[k] = v
+	}
+	for _, f := range fields {
+		v, ok := encoded[f.jsonName]
+		if x, isNonFinite := nonFinite[f.jsonName]; isNonFinite {
+			v, ok = x, true
+		}
+		if !ok {
+			continue
+		}
+		delete(props, f.jsonName)
+		if f.ignore {
+			continue
+		}
+		if err := setProperty(props, f.name, f.edmType, v); err != nil {
+			return nil, err
+		}
+	}
+	props[partitionKeyNode] = entity.PartitionKey()
+	props[rowKeyNode] = entity.RowKey()
+	return props, nil
+}
+
+// nonFiniteFloat returns the value of the float field of the struct v at
+// index if it is NaN or infinite.
+func nonFiniteFloat(v reflect.Value, index []int) (float64, bool) {
+	for _, i := range index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return 0, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return 0, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+		return 0, false
+	}
+	f := v.Float()
+	return f, math.IsNaN(f) || math.IsInf(f, 0)
+}
+
+// zeroField returns a copy of the struct v with the field at index set to
+// its zero value. The embedded structs on the way are copied too, so v and
+// the structs it points to are left untouched. Fields that cannot be set,
+// like those of unexported embedded structs, are left as they are.
+func zeroField(v reflect.Value, index []int) reflect.Value {
+	copied := reflect.New(v.Type()).Elem()
+	copied.Set(v)
+	f := copied.Field(index[0])
+	switch {
+	case !f.CanSet():
+	case len(index) == 1:
+		f.Set(reflect.Zero(f.Type()))
+	case f.Kind() == reflect.Ptr && !f.IsNil():
+		p := reflect.New(f.Type().Elem())
+		p.Elem().Set(zeroField(f.Elem(), index[1:]))
+		f.Set(p)
+	case f.Kind() == reflect.Struct:
+		f.Set(zeroField(f, index[1:]))
+	}
+	return copied
+}
+
+// setFloatField sets the float field of the struct v at index to x,
+// allocating the nil pointers on the way.
+func setFloatField(v reflect.Value, index []int, x float64) error {
+	for n, i := range index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return fmt.Errorf("storage: cannot set field %v of %s", index, v.Type())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+		if !v.CanSet() {
+			return fmt.Errorf("storage: cannot set field %v", index[:n+1])
+		}
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+		return fmt.Errorf("storage: cannot store Edm.Double in a field of type %s", v.Type())
+	}
+	v.SetFloat(x)
+	return nil
+}
+
+// setProperty sets the property name of props to the JSON value v, stored
+// as edmType.
+func setProperty(props map[string]interface{}, name, edmType string, v interface{}) error {
+	if v == nil {
+		// The service does not store null properties.
+		return nil
+	}
+	switch edmType {
+	case EdmInt64:
+		switch n := v.(type) {
+		case json.Number:
+			if _, err := strconv.ParseInt(n.String(), 10, 64); err != nil {
+				return fmt.Errorf("storage: property %s overflows Edm.Int64: %s", name, n)
+			}
+			v = n.String()
+		case string:
+			if _, err := strconv.ParseInt(n, 10, 64); err != nil {
+				return fmt.Errorf("storage: property %s is not an Edm.Int64: %q", name, n)
+			}
+		default:
+			return fmt.Errorf("storage: property %s of type %T cannot be stored as Edm.Int64", name, v)
+		}
+	case EdmDateTime:
+		s, ok := v.(string)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if !ok || err != nil {
+			return fmt.Errorf("storage: property %s cannot be stored as Edm.DateTime", name)
+		}
+		if t.IsZero() {
+			// The zero time is out of the range of the service, so it is
+			// left out and read back as the zero value.
+			return nil
+		}
+		v = t.UTC().Format(edmDateTimeFormat)
+	case EdmDouble:
+		if s, ok := v.(string); ok && isNonFiniteDouble(s) {
+			break
+		}
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("storage: property %s of type %T cannot be stored as Edm.Double", name, v)
+		}
+	case EdmGUID, EdmBinary:
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("storage: property %s of type %T cannot be stored as %s", name, v, edmType)
+		}
+	}
+	props[name] = v
+	if edmType != "" {
+		props[name+odataTypeSuffix] = edmType
+	}
+	return nil
+}
+
+// doubleValue returns the JSON form of the Edm.Double f. JSON has no
+// numbers for NaN and the infinities, so they are sent as the strings OData
+// uses for them.
+func doubleValue(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "INF"
+	case math.IsInf(f, -1):
+		return "-INF"
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+func isNonFiniteDouble(s string) bool {
+	switch s {
+	case "NaN", "INF", "-INF":
+		return true
+	}
+	return false
+}
+
+// properties returns the properties of e in their JSON form, annotated with
+// their EDM types.
+func (e *DynamicEntity) properties() (map[string]interface{}, error) {
+	props := make(map[string]interface{}, 2*len(e.Properties)+2)
+	for name, v := range e.Properties {
+		var err error
+		switch x := v.(type) {
+		case nil:
+		case string, bool, int32:
+			props[name] = x
+		case int:
+			if x < math.MinInt32 || x > math.MaxInt32 {
+				return nil, fmt.Errorf("storage: property %s overflows Edm.Int32, use an int64", name)
+			}
+			props[name] = x
+		case int64:
+			err = setProperty(props, name, EdmInt64, json.Number(strconv.FormatInt(x, 10)))
+		case float64:
+			err = setProperty(props, name, EdmDouble, doubleValue(x))
+		case time.Time:
+			err = setProperty(props, name, EdmDateTime, x.Format(time.RFC3339Nano))
+		case []byte:
+			err = setProperty(props, name, EdmBinary, base64.StdEncoding.EncodeToString(x))
+		case GUID:
+			err = setProperty(props, name, EdmGUID, string(x))
+		default:
+			err = fmt.Errorf("storage: property %s of type %T is not supported", name, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	props[partitionKeyNode] = e.partitionKey
+	props[rowKeyNode] = e.rowKey
+	return props, nil
+}
+
+// decodeEntity returns an entity of type retType holding props, the
+// properties of an entity read from the service with minimal metadata.
+func decodeEntity(retType reflect.Type, props map[string]interface{}) (TableEntity, error) {
+	pk, _ := props[partitionKeyNode].(string)
+	rk, _ := props[rowKeyNode].(string)
+	etag, _ := props[odataETag].(string)
+	var timestamp time.Time
+	if s, ok := props[timestampNode].(string); ok {
+		timestamp, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	delete(props, partitionKeyNode)
+	delete(props, rowKeyNode)
+
+	types := make(map[string]string)
+	for k, v := range props {
+		switch {
+		case strings.HasSuffix(k, odataTypeSuffix):
+			types[strings.TrimSuffix(k, odataTypeSuffix)], _ = v.(string)
+			delete(props, k)
+		case strings.HasPrefix(k, "odata."):
+			delete(props, k)
+		}
+	}
+
+	entity := reflect.New(retType.Elem()).Interface().(TableEntity)
+	if d, ok := entity.(*DynamicEntity); ok {
+		delete(props, timestampNode)
+		var err error
+		if d.Properties, err = dynamicProperties(props, types); err != nil {
+			return nil, err
+		}
+	} else if err := decodeStruct(entity, props, types); err != nil {
+		return nil, err
+	}
+
+	if err := entity.SetPartitionKey(pk); err != nil {
+		return nil, err
+	}
+	if err := entity.SetRowKey(rk); err != nil {
+		return nil, err
+	}
+	if m, ok := entity.(metadataEntity); ok {
+		*m.entityMetadata() = EntityMetadata{Timestamp: timestamp, ETag: etag}
+	}
+	return entity, nil
+}
+
+// decodeStruct unmarshals props into the entity struct, renaming them back
+// to the JSON names of its fields.
+func decodeStruct(entity TableEntity, props map[string]interface{}, types map[string]string) error {
+	fields, err := entityFields(reflect.TypeOf(entity))
+	if err != nil {
+		return err
+	}
+	encoded := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		encoded[k] = v
+	}
+	var nonFinite []entityField
+	for _, f := range fields {
+		v, ok := props[f.name]
+		if f.ignore || !ok {
+			continue
+		}
+		delete(encoded, f.name)
+		if s, ok := v.(string); ok && f.numeric {
+			switch {
+			case types[f.name] == EdmInt64:
+				// Edm.Int64 values are sent as strings.
+				encoded[f.jsonName] = json.Number(s)
+			case types[f.name] == EdmDouble && isNonFiniteDouble(s):
+				// Set once the rest of the entity is unmarshalled.
+				nonFinite = append(nonFinite, f)
+			default:
+				encoded[f.jsonName] = v
+			}
+			continue
+		}
+		encoded[f.jsonName] = v
+	}
+
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, entity); err != nil {
+		return err
+	}
+	for _, f := range nonFinite {
+		x, _ := dynamicValue(props[f.name], EdmDouble)
+		if err := setFloatField(reflect.ValueOf(entity), f.index, x.(float64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dynamicProperties returns the values of props as the Go types of their
+// EDM types.
+func dynamicProperties(props map[string]interface{}, types map[string]string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(props))
+	for name, v := range props {
+		value, err := dynamicValue(v, types[name])
+		if err != nil {
+			return nil, fmt.Errorf("storage: property %s: %v", name, err)
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+func dynamicValue(v interface{}, edmType string) (interface{}, error) {
+	s, isString := v.(string)
+	n, isNumber := v.(json.Number)
+	switch {
+	case edmType == EdmInt64 && isString:
+		return strconv.ParseInt(s, 10, 64)
+	case edmType == EdmDateTime && isString:
+		return time.Parse(time.RFC3339Nano, s)
+	case edmType == EdmGUID && isString:
+		return GUID(s), nil
+	case edmType == EdmBinary && isString:
+		return base64.StdEncoding.DecodeString(s)
+	case edmType == EdmDouble && isString:
+		switch s {
+		case "NaN":
+			return math.NaN(), nil
+		case "INF", "Infinity":
+			return math.Inf(1), nil
+		case "-INF", "-Infinity":
+			return math.Inf(-1), nil
+		}
+	case edmType == EdmDouble && isNumber:
+		return n.Float64()
+	case isNumber && (edmType == EdmInt32 || !strings.ContainsAny(n.String(), ".eE")):
+		i, err := strconv.ParseInt(n.String(), 10, 32)
+		return int32(i), err
+	case isNumber:
+		return n.Float64()
+	case edmType == "" || edmType == EdmString || edmType == EdmBoolean:
+		return v, nil
+	}
+	return nil, fmt.Errorf("unexpected %T value of type %s", v, edmType)
+}
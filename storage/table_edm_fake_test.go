@@ -0,0 +1,75 @@
+package storage_test
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type TableEDMServerSuite struct {
+	tableServerSuite
+}
+
+var _ = chk.Suite(&TableEDMServerSuite{})
+
+type typedEntity struct {
+	storage.EntityMetadata
+	pk, rk string
+	Size   int64
+	Seen   time.Time
+	Hash   []byte
+	ID     storage.GUID
+	Ratio  float64
+}
+
+func (e *typedEntity) PartitionKey() string            { return e.pk }
+func (e *typedEntity) RowKey() string                  { return e.rk }
+func (e *typedEntity) SetPartitionKey(pk string) error { e.pk = pk; return nil }
+func (e *typedEntity) SetRowKey(rk string) error       { e.rk = rk; return nil }
+
+func (s *TableEDMServerSuite) TestEDMTypes(c *chk.C) {
+	in := &typedEntity{
+		pk:    "p",
+		rk:    "r",
+		Size:  math.MaxInt64 - 1,
+		Seen:  time.Date(2017, 1, 2, 3, 4, 5, 123456700, time.UTC),
+		Hash:  []byte{0xde, 0xad},
+		ID:    "c9da6455-213d-42c9-9a79-3e9149a57833",
+		Ratio: 3,
+	}
+	c.Assert(s.cli.InsertEntity("table", in), chk.IsNil)
+
+	query := storage.TableQuery{Filter: storage.FilterAnd(
+		storage.FilterInt64("Size", storage.OpGreaterThan, math.MaxInt64-2),
+		storage.FilterTime("Seen", storage.OpEqual, in.Seen),
+	)}
+	entities, _, err := s.cli.QueryEntities("table", query, reflect.TypeOf(&typedEntity{}), nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(entities, chk.HasLen, 1)
+	out := entities[0].(*typedEntity)
+	c.Assert(out.ETag, chk.Equals, in.ETag)
+	c.Assert(out.Timestamp.IsZero(), chk.Equals, false)
+	out.EntityMetadata = in.EntityMetadata
+	c.Assert(out, chk.DeepEquals, in)
+
+	dynamic := storage.NewDynamicEntity("p", "d")
+	dynamic.Properties["Size"] = int64(1) << 62
+	dynamic.Properties["Count"] = 7
+	dynamic.Properties["Ratio"] = 2.0
+	dynamic.Properties["Hash"] = []byte("a")
+	c.Assert(s.cli.InsertEntity("table", dynamic), chk.IsNil)
+
+	query = storage.TableQuery{Filter: storage.FilterString("RowKey", storage.OpEqual, "d")}
+	entities, _, err = s.cli.QueryEntities("table", query, reflect.TypeOf(&storage.DynamicEntity{}), nil)
+	c.Assert(err, chk.IsNil)
+	c.Assert(entities, chk.HasLen, 1)
+	c.Assert(entities[0].(*storage.DynamicEntity).Properties, chk.DeepEquals, map[string]interface{}{
+		"Size":  int64(1) << 62,
+		"Count": int32(7),
+		"Ratio": 2.0,
+		"Hash":  []byte("a"),
+	})
+}
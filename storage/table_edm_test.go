@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type TableEDMSuite struct{}
+
+var _ = chk.Suite(&TableEDMSuite{})
+
+type edmEntity struct {
+	EntityMetadata
+	PKey    string    `table:"-"`
+	RKey    string    `table:"-"`
+	Size    int64     `json:"size"`
+	Count   int       `table:"Total,int64"`
+	Ratio   float64   `json:"ratio"`
+	Seen    time.Time `json:"seen"`
+	Created time.Time
+	Hash    []byte `json:"hash"`
+	ID      GUID   `json:"id"`
+	Label   string `json:"label" table:"Name"`
+	Note    *string
+	Hidden  string `json:"-"`
+}
+
+func (e *edmEntity) PartitionKey() string             { return e.PKey }
+func (e *edmEntity) RowKey() string                   { return e.RKey }
+func (e *edmEntity) SetPartitionKey(key string) error { e.PKey = key; return nil }
+func (e *edmEntity) SetRowKey(key string) error       { e.RKey = key; return nil }
+
+func encodeProperties(c *chk.C, entity TableEntity) map[string]interface{} {
+	var buf bytes.Buffer
+	c.Assert(injectPartitionAndRowKeys(entity, &buf), chk.IsNil)
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	var props map[string]interface{}
+	c.Assert(dec.Decode(&props), chk.IsNil)
+	return props
+}
+
+func (s *TableEDMSuite) TestEncode(c *chk.C) {
+	entity := &edmEntity{
+		PKey:   "p",
+		RKey:   "r",
+		Size:   math.MaxInt64,
+		Count:  3,
+		Ratio:  2,
+		Seen:   time.Date(2017, 1, 2, 3, 4, 5, 6000, time.FixedZone("X", 3600)),
+		Hash:   []byte{0xde, 0xad},
+		ID:     "c9da6455-213d-42c9-9a79-3e9149a57833",
+		Label:  "label",
+		Hidden: "hidden",
+	}
+	c.Assert(encodeProperties(c, entity), chk.DeepEquals, map[string]interface{}{
+		"PartitionKey":     "p",
+		"RowKey":           "r",
+		"size":             "9223372036854775807",
+		"size@odata.type":  EdmInt64,
+		"Total":            "3",
+		"Total@odata.type": EdmInt64,
+		"ratio":            json.Number("2"),
+		"ratio@odata.type": EdmDouble,
+		"seen":             "2017-01-02T02:04:05.0000060Z",
+		"seen@odata.type":  EdmDateTime,
+		"hash":             "3q0=",
+		"hash@odata.type":  EdmBinary,
+		"id":               "c9da6455-213d-42c9-9a79-3e9149a57833",
+		"id@odata.type":    EdmGUID,
+		"Name":             "label",
+	})
+}
+
+func (s *TableEDMSuite) TestEncodeDynamic(c *chk.C) {
+	entity := NewDynamicEntity("p", "r")
+	entity.Properties["Name"] = "name"
+	entity.Properties["Age"] = 42
+	entity.Properties["Small"] = int32(-1)
+	entity.Properties["Size"] = int64(1) << 60
+	entity.Properties["Score"] = 1.5
+	entity.Properties["Active"] = true
+	entity.Properties["Seen"] = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	entity.Properties["Hash"] = []byte("a")
+	entity.Properties["ID"] = GUID("c9da6455-213d-42c9-9a79-3e9149a57833")
+	entity.Properties["Missing"] = nil
+	c.Assert(encodeProperties(c, entity), chk.DeepEquals, map[string]interface{}{
+		"PartitionKey":     "p",
+		"RowKey":           "r",
+		"Name":             "name",
+		"Age":              json.Number("42"),
+		"Small":            json.Number("-1"),
+		"Size":             "1152921504606846976",
+		"Size@odata.type":  EdmInt64,
+		"Score":            json.Number("1.5"),
+		"Score@odata.type": EdmDouble,
+		"Active":           true,
+		"Seen":             "2017-01-02T03:04:05.0000000Z",
+		"Seen@odata.type":  EdmDateTime,
+		"Hash":             "YQ==",
+		"Hash@odata.type":  EdmBinary,
+		"ID":               "c9da6455-213d-42c9-9a79-3e9149a57833",
+		"ID@odata.type":    EdmGUID,
+	})
+
+	for _, v := range []interface{}{1 << 40, uint8(1), struct{}{}} {
+		entity := NewDynamicEntity("p", "r")
+		entity.Properties["Bad"] = v
+		err := injectPartitionAndRowKeys(entity, &bytes.Buffer{})
+		c.Assert(err, chk.ErrorMatches, "storage: property Bad .*")
+	}
+}
+
+func (s *TableEDMSuite) TestEncodeIntegers(c *chk.C) {
+	type intEntity struct {
+		*CustomEntity
+		Int   int
+		Small int32
+		Byte  uint8
+		Uint  uint64
+	}
+	entity := intEntity{CustomEntity: &CustomEntity{}, Int: math.MaxInt64, Small: 1, Byte: 2, Uint: 3}
+	props := encodeProperties(c, entity)
+	c.Assert(props["Int"], chk.Equals, "9223372036854775807")
+	c.Assert(props["Int@odata.type"], chk.Equals, EdmInt64)
+	c.Assert(props["Small"], chk.Equals, json.Number("1"))
+	c.Assert(props["Small@odata.type"], chk.IsNil)
+	c.Assert(props["Byte"], chk.Equals, "2")
+	c.Assert(props["Byte@odata.type"], chk.Equals, EdmInt64)
+	c.Assert(props["Uint"], chk.Equals, "3")
+	c.Assert(props["Uint@odata.type"], chk.Equals, EdmInt64)
+
+	entity.Uint = math.MaxUint64
+	err := injectPartitionAndRowKeys(entity, &bytes.Buffer{})
+	c.Assert(err, chk.ErrorMatches, "storage: property Uint overflows Edm.Int64: 18446744073709551615")
+}
+
+func (s *TableEDMSuite) TestNonFiniteDoubles(c *chk.C) {
+	entity := NewDynamicEntity("p", "r")
+	entity.Properties["NaN"] = math.NaN()
+	entity.Properties["Inf"] = math.Inf(1)
+	entity.Properties["NegInf"] = math.Inf(-1)
+	props := encodeProperties(c, entity)
+	c.Assert(props, chk.DeepEquals, map[string]interface{}{
+		"PartitionKey":      "p",
+		"RowKey":            "r",
+		"NaN":               "NaN",
+		"NaN@odata.type":    EdmDouble,
+		"Inf":               "INF",
+		"Inf@odata.type":    EdmDouble,
+		"NegInf":            "-INF",
+		"NegInf@odata.type": EdmDouble,
+	})
+
+	decoded, err := decodeEntity(reflect.TypeOf(&DynamicEntity{}), props)
+	c.Assert(err, chk.IsNil)
+	values := decoded.(*DynamicEntity).Properties
+	c.Assert(math.IsNaN(values["NaN"].(float64)), chk.Equals, true)
+	c.Assert(values["Inf"], chk.Equals, math.Inf(1))
+	c.Assert(values["NegInf"], chk.Equals, math.Inf(-1))
+}
+
+// EDMScores is embedded in doubleEntity.
+type EDMScores struct {
+	Low float64
+}
+
+type doubleEntity struct {
+	*EDMScores
+	PKey  string   `table:"-"`
+	RKey  string   `table:"-"`
+	Ratio float64  `json:"ratio"`
+	Max   *float64 `json:",omitempty"`
+}
+
+func (e *doubleEntity) PartitionKey() string             { return e.PKey }
+func (e *doubleEntity) RowKey() string                   { return e.RKey }
+func (e *doubleEntity) SetPartitionKey(key string) error { e.PKey = key; return nil }
+func (e *doubleEntity) SetRowKey(key string) error       { e.RKey = key; return nil }
+
+func (s *TableEDMSuite) TestNonFiniteStructDoubles(c *chk.C) {
+	max := math.Inf(1)
+	entity := &doubleEntity{EDMScores: &EDMScores{Low: math.Inf(-1)}, PKey: "p", RKey: "r", Ratio: math.NaN(), Max: &max}
+	props := encodeProperties(c, entity)
+	c.Assert(props, chk.DeepEquals, map[string]interface{}{
+		"PartitionKey":     "p",
+		"RowKey":           "r",
+		"Low":              "-INF",
+		"Low@odata.type":   EdmDouble,
+		"ratio":            "NaN",
+		"ratio@odata.type": EdmDouble,
+		"Max":              "INF",
+		"Max@odata.type":   EdmDouble,
+	})
+	// The entity itself is left untouched.
+	c.Assert(entity.Low, chk.Equals, math.Inf(-1))
+	c.Assert(*entity.Max, chk.Equals, math.Inf(1))
+
+	decoded, err := decodeEntity(reflect.TypeOf(&doubleEntity{}), props)
+	c.Assert(err, chk.IsNil)
+	d := decoded.(*doubleEntity)
+	c.Assert(d.PKey, chk.Equals, "p")
+	c.Assert(math.IsNaN(d.Ratio), chk.Equals, true)
+	c.Assert(d.Low, chk.Equals, math.Inf(-1))
+	c.Assert(*d.Max, chk.Equals, math.Inf(1))
+}
+
+func (s *TableEDMSuite) TestInvalidTag(c *chk.C) {
+	type badEntity struct {
+		*CustomEntity
+		Size int64 `table:"Size,int128"`
+	}
+	err := injectPartitionAndRowKeys(badEntity{CustomEntity: &CustomEntity{}}, &bytes.Buffer{})
+	c.Assert(err, chk.ErrorMatches, `storage: unknown EDM type "int128" .*`)
+}
+
+const edmResponse = `{"odata.metadata":"https://foo.table.core.windows.net/$metadata#t","value":[{
+	"odata.etag":"W/\"datetime'2017-03-04T05%3A06%3A07.1234567Z'\"",
+	"PartitionKey":"p","RowKey":"r",
+	"Timestamp":"2017-03-04T05:06:07.1234567Z","Timestamp@odata.type":"Edm.DateTime",
+	"size":"9223372036854775807","size@odata.type":"Edm.Int64",
+	"Total":"3","Total@odata.type":"Edm.Int64",
+	"ratio":2,"ratio@odata.type":"Edm.Double",
+	"seen":"2017-01-02T02:04:05.000006Z","seen@odata.type":"Edm.DateTime",
+	"hash":"3q0=","hash@odata.type":"Edm.Binary",
+	"id":"c9da6455-213d-42c9-9a79-3e9149a57833","id@odata.type":"Edm.Guid",
+	"Name":"label","Age":42,"Score":0.5,"Active":true
+}]}`
+
+func (s *TableEDMSuite) TestDecode(c *chk.C) {
+	entities, err := deserializeEntity(reflect.TypeOf(&edmEntity{}), strings.NewReader(edmResponse))
+	c.Assert(err, chk.IsNil)
+	c.Assert(entities, chk.HasLen, 1)
+	c.Assert(entities[0], chk.DeepEquals, &edmEntity{
+		EntityMetadata: EntityMetadata{
+			Timestamp: time.Date(2017, 3, 4, 5, 6, 7, 123456700, time.UTC),
+			ETag:      `W/"datetime'2017-03-04T05%3A06%3A07.1234567Z'"`,
+		},
+		PKey:  "p",
+		RKey:  "r",
+		Size:  math.MaxInt64,
+		Count: 3,
+		Ratio: 2,
+		Seen:  time.Date(2017, 1, 2, 2, 4, 5, 6000, time.UTC),
+		Hash:  []byte{0xde, 0xad},
+		ID:    "c9da6455-213d-42c9-9a79-3e9149a57833",
+		Label: "label",
+	})
+}
+
+func (s *TableEDMSuite) TestDecodeDynamic(c *chk.C) {
+	entities, err := deserializeEntity(reflect.TypeOf(&DynamicEntity{}), strings.NewReader(edmResponse))
+	c.Assert(err, chk.IsNil)
+	c.Assert(entities, chk.HasLen, 1)
+	entity := entities[0].(*DynamicEntity)
+	c.Assert(entity.PartitionKey(), chk.Equals, "p")
+	c.Assert(entity.RowKey(), chk.Equals, "r")
+	c.Assert(entity.Timestamp.Equal(time.Date(2017, 3, 4, 5, 6, 7, 123456700, time.UTC)), chk.Equals, true)
+	c.Assert(entity.ETag, chk.Equals, `W/"datetime'2017-03-04T05%3A06%3A07.1234567Z'"`)
+	c.Assert(entity.Properties, chk.DeepEquals, map[string]interface{}{
+		"size":   int64(math.MaxInt64),
+		"Total":  int64(3),
+		"ratio":  float64(2),
+		"seen":   time.Date(2017, 1, 2, 2, 4, 5, 6000, time.UTC),
+		"hash":   []byte{0xde, 0xad},
+		"id":     GUID("c9da6455-213d-42c9-9a79-3e9149a57833"),
+		"Name":   "label",
+		"Age":    int32(42),
+		"Score":  0.5,
+		"Active": true,
+	})
+}
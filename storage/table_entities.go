@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 )
 
 // Annotating as secure for gas scanning
@@ -34,6 +35,7 @@ const (
 	tableOperationTypeMerge           = iota
 	tableOperationTypeInsertOrReplace = iota
 	tableOperationTypeInsertOrMerge   = iota
+	tableOperationTypeDelete          = iota
 )
 
 type tableOperation int
@@ -44,6 +46,15 @@ type tableOperation int
 // Azure Tables. The struct must only contain
 // simple types because Azure Tables do not
 // support hierarchy.
+//
+// Fields are stored as properties named like
+// encoding/json names them, or as set in a
+// `table:"Name,type"` tag, where type is one of
+// int64, double, datetime, guid or binary. The
+// EDM type is otherwise inferred from the Go type
+// of the field. Fields tagged `table:"-"` are not
+// stored. Embed EntityMetadata to read the
+// Timestamp and ETag of entities.
 type TableEntity interface {
 	PartitionKey() string
 	RowKey() string
@@ -75,7 +86,8 @@ type getTableEntriesResponse struct {
 // is the odata query. To retrieve all the entries pass the empty string.
 // The function returns a pointer to a TableEntity slice, the *ContinuationToken
 // if there are more entries to be returned and an error in case something went
-// wrong.
+// wrong. QueryEntities and NewQueryIterator build the query from typed
+// filters instead.
 //
 // Example:
 // 		entities, cToken, err = tSvc.QueryTableEntities("table", cToken, reflect.TypeOf(entity), 20, "")
@@ -84,47 +96,20 @@ func (c *TableServiceClient) QueryTableEntities(tableName AzureTable, previousCo
 		return nil, nil, fmt.Errorf("top accepts at maximum %d elements. Requested %d instead", maxTopParameter, top)
 	}
 
-	uri := c.client.getEndpoint(tableServiceName, pathForTable(tableName), url.Values{})
-	uri += fmt.Sprintf("?$top=%d", top)
+	params := url.Values{"$top": {strconv.Itoa(top)}}
 	if query != "" {
-		uri += fmt.Sprintf("&$filter=%s", url.QueryEscape(query))
-	}
-
-	if previousContToken != nil {
-		uri += fmt.Sprintf("&NextPartitionKey=%s&NextRowKey=%s", previousContToken.NextPartitionKey, previousContToken.NextRowKey)
-	}
-
-	headers := c.getStandardHeaders()
-
-	headers["Content-Length"] = "0"
-
-	resp, err := c.client.execInternalJSON(http.MethodGet, uri, headers, nil, c.auth)
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	contToken := extractContinuationTokenFromHeaders(resp.headers)
-
-	defer resp.body.Close()
-
-	if err = checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
-		return nil, contToken, err
-	}
-
-	retEntries, err := deserializeEntity(retType, resp.body)
-	if err != nil {
-		return nil, contToken, err
+		params.Set("$filter", query)
 	}
-
-	return retEntries, contToken, nil
+	return c.queryEntities(tableName, params, retType, previousContToken)
 }
 
 // InsertEntity inserts an entity in the specified table.
 // The function fails if there is an entity with the same
-// PartitionKey and RowKey in the table.
+// PartitionKey and RowKey in the table. The ETag of the
+// inserted entity is set in entity if it embeds
+// EntityMetadata.
 func (c *TableServiceClient) InsertEntity(table AzureTable, entity TableEntity) error {
-	sc, err := c.execTable(table, entity, false, http.MethodPost)
+	sc, err := c.execTable(table, entity, false, http.MethodPost, "")
 	if err != nil {
 		return err
 	}
@@ -132,13 +117,16 @@ func (c *TableServiceClient) InsertEntity(table AzureTable, entity TableEntity)
 	return checkRespCode(sc, []int{http.StatusCreated})
 }
 
-func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, specifyKeysInURL bool, method string) (int, error) {
+func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, specifyKeysInURL bool, method, ifMatch string) (int, error) {
 	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
 	if specifyKeysInURL {
-		uri += fmt.Sprintf("(PartitionKey='%s',RowKey='%s')", url.QueryEscape(entity.PartitionKey()), url.QueryEscape(entity.RowKey()))
+		uri = c.entityURI(table, entity)
 	}
 
 	headers := c.getStandardHeaders()
+	if ifMatch != "" {
+		headers["If-Match"] = ifMatch
+	}
 
 	var buf bytes.Buffer
 
@@ -149,6 +137,9 @@ func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, spe
 	headers["Content-Length"] = fmt.Sprintf("%d", buf.Len())
 
 	resp, err := c.client.execInternalJSON(method, uri, headers, &buf, c.auth)
+	if resp != nil && resp.statusCode == http.StatusPreconditionFailed {
+		return 0, preconditionFailed(entity, ifMatch, resp, err)
+	}
 
 	if err != nil {
 		return 0, err
@@ -156,6 +147,10 @@ func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, spe
 
 	defer resp.body.Close()
 
+	if resp.statusCode < http.StatusMultipleChoices {
+		setEntityETag(entity, resp.headers.Get("ETag"))
+	}
+
 	return resp.statusCode, nil
 }
 
@@ -163,7 +158,17 @@ func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, spe
 // one passed as parameter. The function fails if there is no entity
 // with the same PartitionKey and RowKey in the table.
 func (c *TableServiceClient) UpdateEntity(table AzureTable, entity TableEntity) error {
-	sc, err := c.execTable(table, entity, true, http.MethodPut)
+	return c.UpdateEntityIfMatch(table, entity, "*")
+}
+
+// UpdateEntityIfMatch updates the contents of an entity with
+// the one passed as parameter, provided its ETag matches
+// ifMatch. Otherwise it fails with a
+// TablePreconditionFailedError. Pass "*" to update it
+// whatever its ETag. The new ETag of the entity is set in
+// entity if it embeds EntityMetadata.
+func (c *TableServiceClient) UpdateEntityIfMatch(table AzureTable, entity TableEntity, ifMatch string) error {
+	sc, err := c.execTable(table, entity, true, http.MethodPut, ifMatch)
 	if err != nil {
 		return err
 	}
@@ -176,7 +181,17 @@ func (c *TableServiceClient) UpdateEntity(table AzureTable, entity TableEntity)
 // The function fails if there is no entity
 // with the same PartitionKey and RowKey in the table.
 func (c *TableServiceClient) MergeEntity(table AzureTable, entity TableEntity) error {
-	sc, err := c.execTable(table, entity, true, "MERGE")
+	return c.MergeEntityIfMatch(table, entity, "*")
+}
+
+// MergeEntityIfMatch merges the contents of an entity with
+// the one passed as parameter, provided its ETag matches
+// ifMatch. Otherwise it fails with a
+// TablePreconditionFailedError. Pass "*" to merge it
+// whatever its ETag. The new ETag of the entity is set in
+// entity if it embeds EntityMetadata.
+func (c *TableServiceClient) MergeEntityIfMatch(table AzureTable, entity TableEntity, ifMatch string) error {
+	sc, err := c.execTable(table, entity, true, "MERGE", ifMatch)
 	if err != nil {
 		return err
 	}
@@ -197,10 +212,10 @@ func (c *TableServiceClient) DeleteEntityWithoutCheck(table AzureTable, entity T
 // PartitionKey, RowKey and ifMatch field.
 // The function fails if there is no entity
 // with the same PartitionKey and RowKey in the table or
-// the ifMatch is different.
+// the ifMatch is different, in which case the error is a
+// TablePreconditionFailedError.
 func (c *TableServiceClient) DeleteEntity(table AzureTable, entity TableEntity, ifMatch string) error {
-	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
-	uri += fmt.Sprintf("(PartitionKey='%s',RowKey='%s')", url.QueryEscape(entity.PartitionKey()), url.QueryEscape(entity.RowKey()))
+	uri := c.entityURI(table, entity)
 
 	headers := c.getStandardHeaders()
 
@@ -208,6 +223,9 @@ func (c *TableServiceClient) DeleteEntity(table AzureTable, entity TableEntity,
 	headers["If-Match"] = ifMatch
 
 	resp, err := c.client.execInternalJSON(http.MethodDelete, uri, headers, nil, c.auth)
+	if resp != nil && resp.statusCode == http.StatusPreconditionFailed {
+		return preconditionFailed(entity, ifMatch, resp, err)
+	}
 
 	if err != nil {
 		return err
@@ -224,7 +242,7 @@ func (c *TableServiceClient) DeleteEntity(table AzureTable, entity TableEntity,
 // InsertOrReplaceEntity inserts an entity in the specified table
 // or replaced the existing one.
 func (c *TableServiceClient) InsertOrReplaceEntity(table AzureTable, entity TableEntity) error {
-	sc, err := c.execTable(table, entity, true, http.MethodPut)
+	sc, err := c.execTable(table, entity, true, http.MethodPut, "")
 	if err != nil {
 		return err
 	}
@@ -235,7 +253,7 @@ func (c *TableServiceClient) InsertOrReplaceEntity(table AzureTable, entity Tabl
 // InsertOrMergeEntity inserts an entity in the specified table
 // or merges the existing one.
 func (c *TableServiceClient) InsertOrMergeEntity(table AzureTable, entity TableEntity) error {
-	sc, err := c.execTable(table, entity, true, "MERGE")
+	sc, err := c.execTable(table, entity, true, "MERGE", "")
 	if err != nil {
 		return err
 	}
@@ -243,104 +261,84 @@ func (c *TableServiceClient) InsertOrMergeEntity(table AzureTable, entity TableE
 	return checkRespCode(sc, []int{http.StatusNoContent})
 }
 
-func injectPartitionAndRowKeys(entity TableEntity, buf *bytes.Buffer) error {
-	if err := json.NewEncoder(buf).Encode(entity); err != nil {
-		return err
-	}
+// TablePreconditionFailedError is returned by the conditional
+// writes of an entity when the entity in the table no longer
+// has the ETag the write was conditioned on, because another
+// client changed it since it was read.
+type TablePreconditionFailedError struct {
+	PartitionKey string
+	RowKey       string
 
-	dec := make(map[string]interface{})
-	if err := json.NewDecoder(buf).Decode(&dec); err != nil {
-		return err
-	}
+	// ETag is the ETag the write was conditioned on.
+	ETag string
 
-	// Inject PartitionKey and RowKey
-	dec[partitionKeyNode] = entity.PartitionKey()
-	dec[rowKeyNode] = entity.RowKey()
-
-	// Remove tagged fields
-	// The tag is defined in the const section
-	// This is useful to avoid storing the PartitionKey and RowKey twice.
-	numFields := reflect.ValueOf(entity).Elem().NumField()
-	for i := 0; i < numFields; i++ {
-		f := reflect.ValueOf(entity).Elem().Type().Field(i)
-
-		if f.Tag.Get(tag) == tagIgnore {
-			// we must look for its JSON name in the dictionary
-			// as the user can rename it using a tag
-			jsonName := f.Name
-			if f.Tag.Get("json") != "" {
-				jsonName = f.Tag.Get("json")
-			}
-			delete(dec, jsonName)
+	// Err is the error returned by the service.
+	Err error
+}
+
+func (e TablePreconditionFailedError) Error() string {
+	return fmt.Sprintf("storage: entity (%q, %q) does not match ETag %s: %v", e.PartitionKey, e.RowKey, e.ETag, e.Err)
+}
+
+// preconditionFailed returns the error of a write of entity
+// conditioned on ifMatch that the service rejected with resp.
+// err is the error the response was decoded into, if any.
+func preconditionFailed(entity TableEntity, ifMatch string, resp *odataResponse, err error) error {
+	if err == nil {
+		err = AzureStorageServiceError{
+			Code:       resp.odata.Err.Code,
+			Message:    resp.odata.Err.Message.Value,
+			StatusCode: resp.statusCode,
+			RequestID:  resp.headers.Get("x-ms-request-id"),
 		}
 	}
+	return TablePreconditionFailedError{
+		PartitionKey: entity.PartitionKey(),
+		RowKey:       entity.RowKey(),
+		ETag:         ifMatch,
+		Err:          err,
+	}
+}
 
-	buf.Reset()
+// setEntityETag sets etag in entity if it embeds
+// EntityMetadata.
+func setEntityETag(entity TableEntity, etag string) {
+	if m, ok := entity.(metadataEntity); ok && etag != "" {
+		m.entityMetadata().ETag = etag
+	}
+}
+
+// entityURI returns the address of the entity of table with the keys of
+// entity.
+func (c *TableServiceClient) entityURI(table AzureTable, entity TableEntity) string {
+	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
+	return uri + fmt.Sprintf("(PartitionKey='%s',RowKey='%s')", url.QueryEscape(entity.PartitionKey()), url.QueryEscape(entity.RowKey()))
+}
 
-	if err := json.NewEncoder(buf).Encode(&dec); err != nil {
+func injectPartitionAndRowKeys(entity TableEntity, buf *bytes.Buffer) error {
+	props, err := entityProperties(entity)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return json.NewEncoder(buf).Encode(props)
 }
 
 func deserializeEntity(retType reflect.Type, reader io.Reader) ([]TableEntity, error) {
-	buf := new(bytes.Buffer)
-
 	var ret getTableEntriesResponse
-	if err := json.NewDecoder(reader).Decode(&ret); err != nil {
+	dec := json.NewDecoder(reader)
+	dec.UseNumber()
+	if err := dec.Decode(&ret); err != nil {
 		return nil, err
 	}
 
 	tEntries := make([]TableEntity, len(ret.Elements))
-
-	for i, entry := range ret.Elements {
-
-		buf.Reset()
-		if err := json.NewEncoder(buf).Encode(entry); err != nil {
-			return nil, err
-		}
-
-		dec := make(map[string]interface{})
-		if err := json.NewDecoder(buf).Decode(&dec); err != nil {
-			return nil, err
-		}
-
-		var pKey, rKey string
-		// strip pk and rk
-		for key, val := range dec {
-			switch key {
-			case partitionKeyNode:
-				pKey = val.(string)
-			case rowKeyNode:
-				rKey = val.(string)
-			}
-		}
-
-		delete(dec, partitionKeyNode)
-		delete(dec, rowKeyNode)
-
-		buf.Reset()
-		if err := json.NewEncoder(buf).Encode(dec); err != nil {
-			return nil, err
-		}
-
-		// Create a empty retType instance
-		tEntries[i] = reflect.New(retType.Elem()).Interface().(TableEntity)
-		// Popolate it with the values
-		if err := json.NewDecoder(buf).Decode(&tEntries[i]); err != nil {
-			return nil, err
-		}
-
-		// Reset PartitionKey and RowKey
-		if err := tEntries[i].SetPartitionKey(pKey); err != nil {
-			return nil, err
-		}
-		if err := tEntries[i].SetRowKey(rKey); err != nil {
+	for i, props := range ret.Elements {
+		entity, err := decodeEntity(retType, props)
+		if err != nil {
 			return nil, err
 		}
+		tEntries[i] = entity
 	}
-
 	return tEntries, nil
 }
 
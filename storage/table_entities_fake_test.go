@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"reflect"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	chk "gopkg.in/check.v1"
+)
+
+type TableConcurrencySuite struct {
+	tableServerSuite
+}
+
+var _ = chk.Suite(&TableConcurrencySuite{})
+
+type versionedEntity struct {
+	storage.EntityMetadata
+	testEntity
+}
+
+func (s *TableConcurrencySuite) TestConcurrency(c *chk.C) {
+	e := &versionedEntity{testEntity: testEntity{pk: "p", rk: "r", Name: "first"}}
+	c.Assert(s.cli.InsertEntity("table", e), chk.IsNil)
+	c.Assert(e.ETag, chk.Not(chk.Equals), "")
+
+	// Two workers read the entity, the first one to write it wins.
+	read := func() *versionedEntity {
+		entities, _, err := s.cli.QueryEntities("table", storage.TableQuery{}, reflect.TypeOf(&versionedEntity{}), nil)
+		c.Assert(err, chk.IsNil)
+		c.Assert(entities, chk.HasLen, 1)
+		return entities[0].(*versionedEntity)
+	}
+	a, b := read(), read()
+	c.Assert(a.ETag, chk.Equals, e.ETag)
+
+	a.Count = 1
+	c.Assert(s.cli.UpdateEntityIfMatch("table", a, a.ETag), chk.IsNil)
+	c.Assert(a.ETag, chk.Not(chk.Equals), b.ETag)
+
+	b.Count = 2
+	err := s.cli.MergeEntityIfMatch("table", b, b.ETag)
+	perr, ok := err.(storage.TablePreconditionFailedError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	c.Assert(perr.ETag, chk.Equals, b.ETag)
+	c.Assert(perr.RowKey, chk.Equals, "r")
+
+	batch := s.cli.NewBatch("table")
+	batch.UpdateEntityIfMatch(b, b.ETag)
+	_, err = batch.ExecuteBatch()
+	berr, ok := err.(storage.TableBatchError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", err, err))
+	_, ok = berr.Err.(storage.TablePreconditionFailedError)
+	c.Assert(ok, chk.Equals, true, chk.Commentf("%T: %v", berr.Err, berr.Err))
+
+	// The worker retries from the current state of the entity.
+	b = read()
+	c.Assert(b.Count, chk.Equals, 1)
+	b.Count = 2
+	batch = s.cli.NewBatch("table")
+	batch.MergeEntityIfMatch(b, b.ETag)
+	results, err := batch.ExecuteBatch()
+	c.Assert(err, chk.IsNil)
+	c.Assert(b.ETag, chk.Equals, results[0].ETag)
+	c.Assert(s.cli.DeleteEntity("table", b, b.ETag), chk.IsNil)
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TableFilterOp is the comparison operator of a table query filter.
+type TableFilterOp string
+
+// Comparison operators of table query filters.
+const (
+	OpEqual              TableFilterOp = "eq"
+	OpNotEqual           TableFilterOp = "ne"
+	OpGreaterThan        TableFilterOp = "gt"
+	OpGreaterThanOrEqual TableFilterOp = "ge"
+	OpLessThan           TableFilterOp = "lt"
+	OpLessThanOrEqual    TableFilterOp = "le"
+)
+
+// filterTimeFormat is the layout of datetime literals in filters.
+const filterTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// TableFilter is a condition on the entities returned by a table query.
+// Filters are built with the Filter functions, which quote their values,
+// so values taken from user input cannot alter the rest of the query. The
+// zero value matches every entity.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dd894031.aspx
+type TableFilter struct {
+	expr string
+	err  error
+}
+
+// String returns the $filter expression of f.
+func (f TableFilter) String() string {
+	return f.expr
+}
+
+// FilterString compares a string property with value.
+func FilterString(property string, op TableFilterOp, value string) TableFilter {
+	return comparison(property, op, "'"+strings.Replace(value, "'", "''", -1)+"'")
+}
+
+// FilterInt32 compares a 32-bit integer property with value. Integers
+// stored by this package are 32-bit unless they do not fit.
+func FilterInt32(property string, op TableFilterOp, value int32) TableFilter {
+	return comparison(property, op, strconv.FormatInt(int64(value), 10))
+}
+
+// FilterInt64 compares a 64-bit integer property with value.
+func FilterInt64(property string, op TableFilterOp, value int64) TableFilter {
+	return comparison(property, op, strconv.FormatInt(value, 10)+"L")
+}
+
+// FilterFloat64 compares a double property with value.
+func FilterFloat64(property string, op TableFilterOp, value float64) TableFilter {
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return comparison(property, op, literal)
+}
+
+// FilterBool compares a boolean property with value.
+func FilterBool(property string, op TableFilterOp, value bool) TableFilter {
+	return comparison(property, op, strconv.FormatBool(value))
+}
+
+// FilterTime compares a datetime property with value.
+func FilterTime(property string, op TableFilterOp, value time.Time) TableFilter {
+	return comparison(property, op, "datetime'"+value.UTC().Format(filterTimeFormat)+"'")
+}
+
+// FilterGUID compares a GUID property with value, given in its
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form.
+func FilterGUID(property string, op TableFilterOp, value string) TableFilter {
+	if !isGUID(value) {
+		return TableFilter{err: fmt.Errorf("storage: invalid GUID %q in table filter", value)}
+	}
+	return comparison(property, op, "guid'"+value+"'")
+}
+
+// FilterBinary compares a binary property with value.
+func FilterBinary(property string, op TableFilterOp, value []byte) TableFilter {
+	return comparison(property, op, "X'"+hex.EncodeToString(value)+"'")
+}
+
+// FilterAnd matches the entities matched by all of filters.
+func FilterAnd(filters ...TableFilter) TableFilter {
+	return combine("and", filters)
+}
+
+// FilterOr matches the entities matched by any of filters.
+func FilterOr(filters ...TableFilter) TableFilter {
+	return combine("or", filters)
+}
+
+// FilterNot matches the entities f does not match.
+func FilterNot(f TableFilter) TableFilter {
+	if f.err != nil {
+		return f
+	}
+	if f.expr == "" {
+		return TableFilter{err: errors.New("storage: cannot negate an empty table filter")}
+	}
+	return TableFilter{expr: "not (" + f.expr + ")"}
+}
+
+func comparison(property string, op TableFilterOp, literal string) TableFilter {
+	if !isPropertyName(property) {
+		return TableFilter{err: fmt.Errorf("storage: invalid property name %q in table filter", property)}
+	}
+	switch op {
+	case OpEqual, OpNotEqual, OpGreaterThan, OpGreaterThanOrEqual, OpLessThan, OpLessThanOrEqual:
+	default:
+		return TableFilter{err: fmt.Errorf("storage: invalid table filter operator %q", op)}
+	}
+	return TableFilter{expr: property + " " + string(op) + " " + literal}
+}
+
+func combine(op string, filters []TableFilter) TableFilter {
+	var exprs []string
+	for _, f := range filters {
+		if f.err != nil {
+			return f
+		}
+		if f.expr != "" {
+			exprs = append(exprs, "("+f.expr+")")
+		}
+	}
+	if len(exprs) == 1 {
+		// Drop the parentheses of a lone operand.
+		return TableFilter{expr: exprs[0][1 : len(exprs[0])-1]}
+	}
+	return TableFilter{expr: strings.Join(exprs, " "+op+" ")}
+}
+
+// isPropertyName reports whether name is a valid entity property name.
+func isPropertyName(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isGUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TableQuery selects and projects the entities returned by
+// QueryEntities and NewQueryIterator.
+type TableQuery struct {
+	// Filter restricts the entities returned. The zero value returns all
+	// the entities of the table.
+	Filter TableFilter
+
+	// Select lists the properties to return. If it is empty every
+	// property is returned.
+	Select []string
+
+	// Top is the largest number of entities returned at once, at most
+	// 1000. Zero lets the service decide.
+	Top int
+}
+
+func (q TableQuery) params() (url.Values, error) {
+	if q.Filter.err != nil {
+		return nil, q.Filter.err
+	}
+	if q.Top < 0 || q.Top > maxTopParameter {
+		return nil, fmt.Errorf("storage: table query top must be between 0 and %d, got %d", maxTopParameter, q.Top)
+	}
+	params := url.Values{}
+	if q.Filter.expr != "" {
+		params.Set("$filter", q.Filter.expr)
+	}
+	if q.Top > 0 {
+		params.Set("$top", strconv.Itoa(q.Top))
+	}
+	if len(q.Select) > 0 {
+		for _, name := range q.Select {
+			if !isPropertyName(name) {
+				return nil, fmt.Errorf("storage: invalid property name %q in table query select", name)
+			}
+		}
+		params.Set("$select", strings.Join(q.Select, ","))
+	}
+	return params, nil
+}
+
+// QueryEntities returns the first page of entities of table matching query,
+// unmarshaled into values of type retType. If there are more entities the
+// returned *ContinuationToken is non nil; pass it as token to get the
+// next page. NewQueryIterator follows the tokens itself.
+func (c *TableServiceClient) QueryEntities(table AzureTable, query TableQuery, retType reflect.Type, token *ContinuationToken) ([]TableEntity, *ContinuationToken, error) {
+	params, err := query.params()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.queryEntities(table, params, retType, token)
+}
+
+func (c *TableServiceClient) queryEntities(table AzureTable, params url.Values, retType reflect.Type, token *ContinuationToken) ([]TableEntity, *ContinuationToken, error) {
+	if token != nil {
+		params.Set("NextPartitionKey", token.NextPartitionKey)
+		params.Set("NextRowKey", token.NextRowKey)
+	}
+	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
+	uri += "?" + encodeTableQuery(params)
+
+	headers := c.getStandardHeaders()
+	headers["Content-Length"] = "0"
+	// The odata.type annotations and system properties of the entities
+	// are only returned with minimal metadata.
+	headers["Accept"] = "application/json;odata=minimalmetadata"
+
+	resp, err := c.client.execInternalJSON(http.MethodGet, uri, headers, nil, c.auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.body.Close()
+
+	contToken := extractContinuationTokenFromHeaders(resp.headers)
+	if err = checkRespCode(resp.statusCode, []int{http.StatusOK}); err != nil {
+		return nil, contToken, err
+	}
+
+	retEntries, err := deserializeEntity(retType, resp.body)
+	if err != nil {
+		return nil, contToken, err
+	}
+	return retEntries, contToken, nil
+}
+
+// encodeTableQuery encodes params like url.Values.Encode, but leaves the $
+// of the OData system query options unescaped.
+func encodeTableQuery(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		name := strings.Replace(url.QueryEscape(k), "%24", "$", 1)
+		for _, v := range params[k] {
+			parts = append(parts, name+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// TableQueryIterator walks the entities matching a table query, fetching
+// further pages as needed. It stops at the first error, including the
+// cancellation of the context of the client that created it.
+//
+//	it := tables.WithContext(ctx).NewQueryIterator("table", query, reflect.TypeOf(&MyEntity{}))
+//	for it.Next() {
+//		entity := it.Entity().(*MyEntity)
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type TableQueryIterator struct {
+	client  TableServiceClient
+	table   AzureTable
+	query   TableQuery
+	retType reflect.Type
+
+	page   []TableEntity
+	token  *ContinuationToken
+	entity TableEntity
+	done   bool
+	err    error
+}
+
+// NewQueryIterator returns an iterator over the entities of table matching
+// query, unmarshaled into values of type retType.
+func (c *TableServiceClient) NewQueryIterator(table AzureTable, query TableQuery, retType reflect.Type) *TableQueryIterator {
+	return &TableQueryIterator{client: *c, table: table, query: query, retType: retType}
+}
+
+// Next advances the iterator to the next entity, which is then available
+// through Entity. It returns false when there are no more entities or an
+// error occurred.
+func (it *TableQueryIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			it.entity = nil
+			return false
+		}
+		if err := it.client.client.requestContext().Err(); err != nil {
+			it.err = err
+			continue
+		}
+		it.page, it.token, it.err = it.client.QueryEntities(it.table, it.query, it.retType, it.token)
+		it.done = it.token == nil
+	}
+	it.entity, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Entity returns the current entity.
+func (it *TableQueryIterator) Entity() TableEntity {
+	return it.entity
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *TableQueryIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,78 @@
+package storage_test
+
+import (
+	"reflect"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/storage/storagetest"
+	chk "gopkg.in/check.v1"
+)
+
+// tableServerSuite runs each test against a fake server holding an empty
+// table.
+type tableServerSuite struct {
+	srv *storagetest.Server
+	cli storage.TableServiceClient
+}
+
+func (s *tableServerSuite) SetUpTest(c *chk.C) {
+	s.srv = storagetest.NewServer()
+	s.cli = s.srv.Client().GetTableService()
+	c.Assert(s.cli.CreateTable("table"), chk.IsNil)
+}
+
+func (s *tableServerSuite) TearDownTest(c *chk.C) {
+	s.srv.Close()
+}
+
+type testEntity struct {
+	pk, rk string
+	Name   string
+	Count  int
+}
+
+func (e *testEntity) PartitionKey() string { return e.pk }
+func (e *testEntity) RowKey() string       { return e.rk }
+
+func (e *testEntity) SetPartitionKey(pk string) error {
+	e.pk = pk
+	return nil
+}
+
+func (e *testEntity) SetRowKey(rk string) error {
+	e.rk = rk
+	return nil
+}
+
+type TableQueryIteratorSuite struct {
+	tableServerSuite
+}
+
+var _ = chk.Suite(&TableQueryIteratorSuite{})
+
+func (s *TableQueryIteratorSuite) TestQueryIterator(c *chk.C) {
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		c.Assert(s.cli.InsertEntity("table", &testEntity{pk: "p", rk: name, Name: name, Count: i}), chk.IsNil)
+	}
+
+	query := storage.TableQuery{
+		Filter: storage.FilterAnd(
+			storage.FilterInt32("Count", storage.OpGreaterThanOrEqual, 1),
+			storage.FilterNot(storage.FilterString("Name", storage.OpEqual, "e' or Name eq 'a")),
+		),
+		Select: []string{"RowKey", "Count"},
+		Top:    2,
+	}
+	it := s.cli.NewQueryIterator("table", query, reflect.TypeOf(&testEntity{}))
+	var got []*testEntity
+	for it.Next() {
+		got = append(got, it.Entity().(*testEntity))
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	c.Assert(got, chk.DeepEquals, []*testEntity{
+		{rk: "b", Count: 1},
+		{rk: "c", Count: 2},
+		{rk: "d", Count: 3},
+		{rk: "e", Count: 4},
+	})
+}
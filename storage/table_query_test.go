@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type TableQuerySuite struct{}
+
+var _ = chk.Suite(&TableQuerySuite{})
+
+func (s *TableQuerySuite) TestFilters(c *chk.C) {
+	for _, t := range []struct {
+		filter TableFilter
+		want   string
+	}{
+		{FilterString("Name", OpEqual, "it's"), "Name eq 'it''s'"},
+		{FilterString("Id", OpEqual, "x' or 'a' eq 'a"), "Id eq 'x'' or ''a'' eq ''a'"},
+		{FilterInt32("Age", OpGreaterThan, -3), "Age gt -3"},
+		{FilterInt64("Size", OpLessThanOrEqual, 1<<40), "Size le 1099511627776L"},
+		{FilterFloat64("Score", OpGreaterThanOrEqual, 2), "Score ge 2.0"},
+		{FilterBool("Active", OpNotEqual, true), "Active ne true"},
+		{FilterTime("Seen", OpLessThan, time.Date(2017, 1, 2, 3, 4, 5, 6000, time.FixedZone("X", 3600))), "Seen lt datetime'2017-01-02T02:04:05.0000060Z'"},
+		{FilterGUID("Key", OpEqual, "c9da6455-213d-42c9-9a79-3e9149a57833"), "Key eq guid'c9da6455-213d-42c9-9a79-3e9149a57833'"},
+		{FilterBinary("Hash", OpEqual, []byte{0xde, 0xad}), "Hash eq X'dead'"},
+		{FilterAnd(FilterInt32("A", OpEqual, 1), FilterOr(FilterInt32("B", OpEqual, 2), FilterInt32("C", OpEqual, 3))), "(A eq 1) and ((B eq 2) or (C eq 3))"},
+		{FilterAnd(TableFilter{}, FilterInt32("A", OpEqual, 1)), "A eq 1"},
+		{FilterNot(FilterBool("Active", OpEqual, true)), "not (Active eq true)"},
+	} {
+		c.Assert(t.filter.err, chk.IsNil)
+		c.Assert(t.filter.String(), chk.Equals, t.want)
+	}
+}
+
+func (s *TableQuerySuite) TestInvalidFilters(c *chk.C) {
+	for _, f := range []TableFilter{
+		FilterString("Name eq 'a' or Name", OpEqual, "b"),
+		FilterString("1Name", OpEqual, "b"),
+		FilterString("Name", TableFilterOp("eq 'a' or Name eq"), "b"),
+		FilterGUID("Key", OpEqual, "c9da6455' or 1 eq 1 or Key eq '00"),
+		FilterNot(TableFilter{}),
+		FilterOr(FilterInt32("A", OpEqual, 1), FilterString("", OpEqual, "b")),
+	} {
+		_, err := TableQuery{Filter: f}.params()
+		c.Assert(err, chk.ErrorMatches, "storage: .*")
+	}
+	_, err := TableQuery{Select: []string{"Name", "Age,Size"}}.params()
+	c.Assert(err, chk.ErrorMatches, "storage: .*")
+	_, err = TableQuery{Top: 1001}.params()
+	c.Assert(err, chk.ErrorMatches, "storage: .*")
+}
+
+func (s *TableQuerySuite) TestEncodeQuery(c *chk.C) {
+	params, err := TableQuery{
+		Filter: FilterString("Name", OpEqual, "a&b"),
+		Select: []string{"Name", "Age"},
+		Top:    5,
+	}.params()
+	c.Assert(err, chk.IsNil)
+	params.Set("NextRowKey", "1!a+b")
+	c.Assert(encodeTableQuery(params), chk.Equals, "$filter=Name+eq+%27a%26b%27&$select=Name%2CAge&$top=5&NextRowKey=1%21a%2Bb")
+}
+
+// pagingTableServer serves the entities of pages one page at a time,
+// handing out the page index as continuation token.
+type pagingTableServer struct {
+	pages   [][]string
+	queries []string
+}
+
+func (f *pagingTableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.queries = append(f.queries, r.URL.RawQuery)
+	page := 0
+	if v := r.URL.Query().Get("NextPartitionKey"); v != "" {
+		fmt.Sscanf(v, "page&%d", &page)
+	}
+	if page+1 < len(f.pages) {
+		w.Header().Set(continuationTokenPartitionKeyHeader, fmt.Sprintf("page&%d", page+1))
+		w.Header().Set(continuationTokenRowHeader, "row")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"value":[`)
+	for i, rk := range f.pages[page] {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"PartitionKey":"p","RowKey":%q}`, rk)
+	}
+	fmt.Fprint(w, `]}`)
+}
+
+func (s *TableQuerySuite) TestIterator(c *chk.C) {
+	f := &pagingTableServer{pages: [][]string{{"a", "b"}, {}, {"c"}}}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	tables := cli.GetTableService()
+	it := tables.NewQueryIterator("table", TableQuery{Filter: FilterString("PartitionKey", OpEqual, "p"), Top: 2}, reflect.TypeOf(&CustomEntity{}))
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Entity().RowKey())
+	}
+	c.Assert(it.Err(), chk.IsNil)
+	c.Assert(keys, chk.DeepEquals, []string{"a", "b", "c"})
+	c.Assert(f.queries, chk.DeepEquals, []string{
+		"$filter=PartitionKey+eq+%27p%27&$top=2",
+		"$filter=PartitionKey+eq+%27p%27&$top=2&NextPartitionKey=page%261&NextRowKey=row",
+		"$filter=PartitionKey+eq+%27p%27&$top=2&NextPartitionKey=page%262&NextRowKey=row",
+	})
+}
+
+func (s *TableQuerySuite) TestIteratorCancel(c *chk.C) {
+	f := &pagingTableServer{pages: [][]string{{"a"}, {"b"}}}
+	cli, srv := getTestServerClient(c, f)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tables := cli.GetTableService()
+	it := tables.WithContext(ctx).NewQueryIterator("table", TableQuery{}, reflect.TypeOf(&CustomEntity{}))
+	c.Assert(it.Next(), chk.Equals, true)
+	cancel()
+	c.Assert(it.Next(), chk.Equals, false)
+	c.Assert(it.Err(), chk.Equals, context.Canceled)
+	c.Assert(f.queries, chk.HasLen, 1)
+}
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/xml"
@@ -87,3 +89,34 @@ func headersFromStruct(v interface{}) map[string]string {
 	}
 	return headers
 }
+
+// retryWithBackoff calls fn until it succeeds, fails with an error for which
+// permanent returns true, the retries are exhausted or ctx is done. The
+// delay between attempts starts at delay and doubles after every attempt.
+// permanent may be nil, in which case every error is retried.
+func retryWithBackoff(ctx context.Context, retries int, delay time.Duration, permanent func(error) bool, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || (permanent != nil && permanent(err)) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}